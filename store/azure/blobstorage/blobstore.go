@@ -0,0 +1,1421 @@
+package blobstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+const (
+	storageAccountName   = "storageAccountName"
+	storageAccountKey    = "storageAccountKey"
+	containerName        = "containerName"
+	defaultContainerName = "eventstore"
+
+	// the log of all entities, the blobs of the entities are prefixed with streamPrefix
+	logBlobName     = "log"
+	streamPrefix    = "streams/"
+	snapshotPrefix  = "snapshots/"
+	tombstonePrefix = "tombstones/"
+	eventIDPrefix   = "eventids/"
+	indexSuffix     = ".index"
+
+	// an append blob takes at most 50,000 blocks and every block that a write appends to a segment of the log
+	// or of a stream and to their indexes holds at least one record. A segment takes writes until its index holds
+	// segmentSize entries, the difference to the limit leaves room for the blocks of failed writes, that are never indexed.
+	defaultSegmentSize = 45000
+
+	// an index entry holds the start and end offset of a record as big-endian integers
+	indexEntrySize = 16
+
+	// the blob service takes blocks of at most 4 MiB with the API version of the storage client. The records of a write
+	// are appended in several blocks if needed, but the index of the log is appended in one block, which commits the write.
+	maxBlockSize       = 4 * 1024 * 1024
+	maxEntitiesOfWrite = maxBlockSize / indexEntrySize
+
+	// a write holds the lease of the log blob, it expires after this number of seconds if it isn't released
+	leaseDuration = 15
+
+	// error codes of the blob service
+	blobAlreadyExists                = "BlobAlreadyExists"
+	conditionNotMet                  = "ConditionNotMet"
+	appendPositionConditionNotMet    = "AppendPositionConditionNotMet"
+	leaseAlreadyPresent              = "LeaseAlreadyPresent"
+	leaseIDMismatchWithBlobOperation = "LeaseIdMismatchWithBlobOperation"
+	leaseLost                        = "LeaseLost"
+)
+
+type (
+	blobstore struct {
+		client        storage.Client
+		containerName string
+		retryPolicy   store.RetryPolicy
+		subscriber    *store.PollingSubscriber
+		segmentSize   int64
+
+		// httpClient replaces the http.Client of the storage client, if it is set
+		httpClient *http.Client
+	}
+
+	// segment is an append blob of the log or of a stream with its index blob, it holds count records
+	// from the position or version first on. The first segment has the name of the log or the stream,
+	// the following segments are named after their first record.
+	segment struct {
+		first int64
+		count int64
+		blob  *storage.Blob
+		index *storage.Blob
+	}
+
+	// extent is the location of a record in a blob
+	extent struct {
+		start int64
+		end   int64
+	}
+
+	// logRecord is a record of the log of all entities, it refers to the record of the entity in the segment
+	// of its stream, that starts at Segment, or in the first segment if it is 0. Records that were written before hard deletes removed entities from the log hold a
+	// copy of the entity instead of its id and version, the copy is never returned.
+	logRecord struct {
+		ID       string        `json:"id,omitempty"`
+		Version  int64         `json:"version,omitempty"`
+		Segment  int64         `json:"segment,omitempty"`
+		Entity   *store.Entity `json:"entity,omitempty"`
+		Start    int64         `json:"start"`
+		End      int64         `json:"end"`
+		Position int64         `json:"-"`
+	}
+)
+
+// BackendName is the name the Azure Blob Storage store is registered with, see store.Open
+const BackendName = "blobstorage"
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new Azure Blob Storage based event store
+func NewStore() store.EventStore {
+	return &blobstore{}
+}
+
+func (s *blobstore) Init(metadata store.Metadata) error {
+	policy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return fmt.Errorf("azure blobstorage: %v", err)
+	}
+
+	s.retryPolicy = policy
+
+	subscriber, err := store.NewPollingSubscriber(s, metadata)
+	if err != nil {
+		return fmt.Errorf("azure blobstorage: %v", err)
+	}
+
+	s.subscriber = subscriber
+
+	sa, ok := metadata.Properties[storageAccountName]
+	if !ok || sa == "" {
+		return errors.New("azure blobstorage: storage account name is missing")
+	}
+
+	sk, ok := metadata.Properties[storageAccountKey]
+	if !ok || sk == "" {
+		return errors.New("azure blobstorage: storage account key is missing")
+	}
+
+	s.containerName = defaultContainerName
+	if name, ok := metadata.Properties[containerName]; ok && name != "" {
+		s.containerName = name
+	}
+
+	client, err := storage.NewBasicClient(sa, sk)
+	if err != nil {
+		return err
+	}
+
+	if s.httpClient != nil {
+		client.HTTPClient = s.httpClient
+	}
+
+	s.client = client
+
+	if s.segmentSize == 0 {
+		s.segmentSize = defaultSegmentSize
+	}
+
+	container := s.getContainer(context.Background())
+
+	if _, err := container.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+
+	logBlob, logIndex := segmentBlobs(container, logBlobName, 1)
+
+	for _, blob := range []*storage.Blob{logBlob, logIndex} {
+		if err := createAppendBlob(blob); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *blobstore) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *blobstore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, entity.ID, []*store.Entity{entity}, func(version int64) error {
+			if version != 0 {
+				return store.EventStoreError{
+					Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+					ErrorType:  store.AlreadyExists,
+					InnerError: nil,
+				}
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *blobstore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *blobstore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	expectedVersion := entity.Version
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, entity.ID, []*store.Entity{entity}, func(version int64) error {
+			if version == 0 {
+				return notFound(entity.ID)
+			}
+
+			if concurrency == store.Optimistic && version != expectedVersion {
+				return stale(entity.ID)
+			}
+
+			return nil
+		})
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *blobstore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *blobstore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, id, entities, func(version int64) error {
+			if version == 0 {
+				return notFound(id)
+			}
+
+			if version != expectedVersion {
+				return stale(id)
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *blobstore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *blobstore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) == 0 {
+		if err := store.CheckExpectedVersion(ctx, s, id, expected); err != nil {
+			return nil, err
+		}
+
+		return entities, nil
+	}
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, id, entities, func(version int64) error {
+			return expected.Check(id, version)
+		})
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *blobstore) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *blobstore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	_, version, err := s.stream(s.getContainer(ctx), id)
+	return version, err
+}
+
+func (s *blobstore) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *blobstore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	entities, err := s.GetByVersionRangeContext(ctx, id, version, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return &entities[0], nil
+}
+
+func (s *blobstore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+// GetByVersionRangeContext looks up the offsets of the versions in the index blobs of the entity
+// and reads them from every segment of the entity with one request.
+func (s *blobstore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	segments, latest, err := s.stream(s.getContainer(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	if endVersion > latest {
+		endVersion = latest
+	}
+
+	result := []store.Entity{}
+
+	if startVersion > endVersion {
+		return result, nil
+	}
+
+	err = readSegments(segments, startVersion, endVersion, func(record []byte) error {
+		var entity store.Entity
+		if err := json.Unmarshal(record, &entity); err != nil {
+			return err
+		}
+
+		result = append(result, entity)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *blobstore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+func (s *blobstore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	return store.GetAsOf(ctx, s, id, at)
+}
+
+func (s *blobstore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *blobstore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return store.GetByTimeRange(ctx, s, id, from, to)
+}
+
+func (s *blobstore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+// ReadAllContext looks up the offsets of the positions in the indexes of the log and reads them from
+// every segment of the log with one request, the entities are read from the blobs of their streams.
+func (s *blobstore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	container := s.getContainer(ctx)
+
+	segments, err := s.segments(container, logBlobName)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := lastOf(segments)
+
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	toPosition := fromPosition + int64(maxCount) - 1
+	if toPosition > latest {
+		toPosition = latest
+	}
+
+	result := []store.Entity{}
+
+	if fromPosition > toPosition {
+		return result, nil
+	}
+
+	records, err := readLog(segments, fromPosition, toPosition)
+	if err != nil {
+		return nil, err
+	}
+
+	return readEntities(container, records)
+}
+
+func (s *blobstore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext holds the lease of the log like a write. A soft delete creates the tombstone blob of the entity,
+// a hard delete removes the blobs of the entity, the marker blobs of its event IDs, its snapshot and its tombstone. The records in the log only refer
+// to the blob of the entity, so ReadAll no longer returns its entities.
+func (s *blobstore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	return s.retryPolicy.Retry(ctx, func() error {
+		container := s.getContainer(ctx)
+		logBlob := container.GetBlobReference(logBlobName)
+
+		leaseID, err := logBlob.AcquireLease(leaseDuration, "", nil)
+		if err != nil {
+			return internalError("failed to acquire the lease of the log", err)
+		}
+
+		defer logBlob.ReleaseLease(leaseID, nil)
+
+		if err := s.complete(container); err != nil {
+			return err
+		}
+
+		segments, err := s.segments(container, streamName(id))
+		if err != nil {
+			return err
+		}
+
+		version := lastOf(segments)
+		tombstone := tombstoneBlob(container, id)
+
+		deleted, err := exists(tombstone)
+		if err != nil {
+			return err
+		}
+
+		if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+			return err
+		}
+
+		if !hard {
+			if err := tombstone.CreateBlockBlobFromReader(bytes.NewReader([]byte(fmt.Sprint(version))), nil); err != nil {
+				return internalError("failed to delete entity", err)
+			}
+
+			return nil
+		}
+
+		snapshot := container.GetBlobReference(snapshotPrefix + encodeID(id))
+
+		// the segments are removed from the last one on, index first, a delete that fails afterwards leaves no
+		// versions behind, that can be read, and no segments, that would be taken for segments of a new stream
+		blobs := []*storage.Blob{}
+		for i := len(segments) - 1; i >= 0; i-- {
+			blobs = append(blobs, segments[i].index, segments[i].blob)
+		}
+
+		markers, err := eventIDBlobs(container, id)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, markers...)
+
+		for _, blob := range append(blobs, snapshot, tombstone) {
+			if _, err := blob.DeleteIfExists(nil); err != nil {
+				return internalError("failed to delete entity", err)
+			}
+		}
+
+		return nil
+	}, store.Retryable(expected.Concurrency(), isTransient))
+}
+
+func (s *blobstore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+// SaveSnapshotContext stores the snapshot in a block blob, that is only replaced by a snapshot of a newer version.
+// Concurrent writers are detected by the ETag of the blob.
+func (s *blobstore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	latest, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	blob := s.getContainer(ctx).GetBlobReference(snapshotPrefix + encodeID(id))
+
+	return s.retryPolicy.Retry(ctx, func() error {
+		options := &storage.PutBlobOptions{IfNoneMatch: "*"}
+
+		current, etag, err := getSnapshot(blob)
+		if err != nil && !isNotFound(err) {
+			return store.EventStoreError{
+				Text:       "failed to load snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		} else if err == nil {
+			if current.Version >= version {
+				return nil
+			}
+
+			options = &storage.PutBlobOptions{IfMatch: etag}
+		}
+
+		err = blob.CreateBlockBlobFromReader(bytes.NewReader(data), options)
+		if isConflict(err) {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("snapshot of entity %s was saved concurrently", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: err,
+			}
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to save snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	}, store.Retryable(store.None, isTransient))
+}
+
+func (s *blobstore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *blobstore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	snapshot, _, err := getSnapshot(s.getContainer(ctx).GetBlobReference(snapshotPrefix + encodeID(id)))
+
+	if isNotFound(err) {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe polls the log of all entities for new entities, see store.Subscriber.
+// The interval is configured with the metadata property pollInterval.
+func (s *blobstore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	return s.subscriber.Subscribe(ctx, fromPosition, handler)
+}
+
+// write appends entities to the blob of the entity with the given id and to the log of all entities,
+// after check accepted the latest version of the entity. If the entities are already stored with their
+// event IDs, they get the stored versions and positions instead, see store.Deduplicate. Writes are serialized by the lease of the log blob,
+// so the versions and positions are assigned in the same order.
+//
+// The marker blobs of the event IDs are written first. The entities are appended to the last segment of the entity, to the
+// last segment of the log and to its index, which makes them visible in ReadAll, and finally to the index of the segment
+// of the entity. Every append is conditional on the expected length of the blob. A write that failed before the index of the log was appended leaves records
+// behind that are never referenced by an index, a write that failed after it is completed by the next write.
+func (s *blobstore) write(ctx context.Context, id string, entities []*store.Entity, check func(version int64) error) error {
+	if len(entities) > maxEntitiesOfWrite {
+		return internalError(fmt.Sprintf("a write takes at most %d entities", maxEntitiesOfWrite), nil)
+	}
+
+	container := s.getContainer(ctx)
+	logBlob := container.GetBlobReference(logBlobName)
+
+	leaseID, err := logBlob.AcquireLease(leaseDuration, "", nil)
+	if err != nil {
+		return internalError("failed to acquire the lease of the log", err)
+	}
+
+	defer logBlob.ReleaseLease(leaseID, nil)
+
+	if err := s.complete(container); err != nil {
+		return err
+	}
+
+	streamSegments, err := s.segments(container, streamName(id))
+	if err != nil {
+		return err
+	}
+
+	version := lastOf(streamSegments)
+
+	if version > 0 {
+		deleted, err := exists(tombstoneBlob(container, id))
+		if err != nil {
+			return err
+		}
+
+		if deleted {
+			return store.StreamDeletedError(id)
+		}
+	}
+
+	if duplicate, err := deduplicate(container, streamSegments, id, version, entities); err != nil || duplicate {
+		return err
+	}
+
+	if err := check(version); err != nil {
+		return err
+	}
+
+	stream := streamSegments[len(streamSegments)-1]
+
+	if version == 0 {
+		for _, blob := range []*storage.Blob{stream.blob, stream.index} {
+			if err := createAppendBlob(blob); err != nil {
+				return internalError("failed to create blob of entity", err)
+			}
+		}
+	} else if stream, err = s.next(container, streamName(id), stream); err != nil {
+		return internalError("failed to create segment of entity", err)
+	}
+
+	logSegments, err := s.segments(container, logBlobName)
+	if err != nil {
+		return err
+	}
+
+	position := lastOf(logSegments)
+
+	log, err := s.next(container, logBlobName, logSegments[len(logSegments)-1])
+	if err != nil {
+		return internalError("failed to create segment of the log", err)
+	}
+
+	// only the first segment of the log is leased
+	logLeaseID := ""
+	if log.first == 1 {
+		logLeaseID = leaseID
+	}
+
+	streamSize, err := size(stream.blob)
+	if err != nil {
+		return err
+	}
+
+	logSize, err := size(log.blob)
+	if err != nil {
+		return err
+	}
+
+	var streamData, logData [][]byte
+	streamEnd, logEnd := streamSize, logSize
+	streamExtents := make([]extent, 0, len(entities))
+	logExtents := make([]extent, 0, len(entities))
+
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = version + int64(i) + 1
+		entity.Position = position + int64(i) + 1
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+
+		record, err := json.Marshal(entity)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		record = append(record, '\n')
+		if len(record) > maxBlockSize {
+			return internalError(fmt.Sprintf("entity with version %d takes %d bytes, a block of a blob at most %d", entity.Version, len(record), maxBlockSize), nil)
+		}
+
+		streamExtent := extent{start: streamEnd, end: streamEnd + int64(len(record))}
+		streamData = append(streamData, record)
+		streamEnd = streamExtent.end
+		streamExtents = append(streamExtents, streamExtent)
+
+		record, err = json.Marshal(&logRecord{
+			ID:      id,
+			Version: entity.Version,
+			Segment: segmentOf(stream),
+			Start:   streamExtent.start,
+			End:     streamExtent.end,
+		})
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		record = append(record, '\n')
+		logExtent := extent{start: logEnd, end: logEnd + int64(len(record))}
+		logData = append(logData, record)
+		logEnd = logExtent.end
+		logExtents = append(logExtents, logExtent)
+	}
+
+	for _, entity := range entities {
+		if entity.EventID == "" {
+			continue
+		}
+
+		marker := []byte(strconv.FormatInt(entity.Version, 10))
+		if err := eventIDBlob(container, id, entity.EventID).CreateBlockBlobFromReader(bytes.NewReader(marker), nil); err != nil {
+			return internalError("failed to write event ID", err)
+		}
+	}
+
+	if err := appendBlocks(stream.blob, streamData, streamSize, ""); err != nil {
+		return internalError("failed to append entities", err)
+	}
+
+	if err := appendBlocks(log.blob, logData, logSize, logLeaseID); err != nil {
+		return internalError("failed to append entities to the log", err)
+	}
+
+	if err := appendBlock(log.index, bytes.Join(encodeIndex(logExtents), nil), log.count*indexEntrySize, ""); err != nil {
+		return internalError("failed to append entities to the index of the log", err)
+	}
+
+	// the entities are stored, if the index of the entity can't be appended, the next write completes it
+	appendBlocks(stream.index, encodeIndex(streamExtents), stream.count*indexEntrySize, "")
+	return nil
+}
+
+// deduplicate looks up the event IDs of entities in the entity with the given id, that has the given version,
+// see store.Deduplicate. Every event ID has a marker blob, that holds the version it was written with. The marker
+// is written before the entity, so the entity with that version is read to check that it was stored with the event ID.
+// The marker of a failed write is overwritten, when the event ID is written again.
+func deduplicate(container *storage.Container, segments []segment, id string, version int64, entities []*store.Entity) (bool, error) {
+	if !store.HasEventIDs(entities) || version == 0 {
+		return false, store.ValidateEventIDs(entities)
+	}
+
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		body, err := eventIDBlob(container, id, eventID).Get(nil)
+		if isNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, internalError("failed to read event ID", err)
+		}
+
+		marker, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, internalError("failed to read event ID", err)
+		}
+
+		stored, err := strconv.ParseInt(string(marker), 10, 64)
+		if err != nil || stored < 1 || stored > version {
+			return nil, nil
+		}
+
+		var entity *store.Entity
+
+		err = readSegments(segments, stored, stored, func(record []byte) error {
+			entity = &store.Entity{}
+			return json.Unmarshal(record, entity)
+		})
+
+		if err != nil || entity == nil || entity.EventID != eventID {
+			return nil, err
+		}
+
+		return entity, nil
+	})
+}
+
+// complete appends the entities of the last write to the index of their entity, if the write
+// failed after it appended them to the index of the log. It must be called with the lease of the log.
+func (s *blobstore) complete(container *storage.Container) error {
+	logSegments, err := s.segments(container, logBlobName)
+	if err != nil {
+		return err
+	}
+
+	position := lastOf(logSegments)
+	if position == 0 {
+		return nil
+	}
+
+	lastRecord, err := readLog(logSegments, position, position)
+	if err != nil {
+		return err
+	}
+
+	streamSegments, err := s.segments(container, streamName(lastRecord[0].ID))
+	if err != nil {
+		return err
+	}
+
+	version := lastOf(streamSegments)
+
+	missing := lastRecord[0].Version - version
+	if missing <= 0 {
+		return nil
+	}
+
+	// the entities of a write are appended to one segment, which is the last one
+	stream := streamSegments[len(streamSegments)-1]
+	if segmentOf(stream) != lastRecord[0].Segment {
+		return nil
+	}
+
+	// the stream was hard deleted after the write, its records are gone
+	streamSize, err := size(stream.blob)
+	if err != nil || lastRecord[0].End > streamSize {
+		return err
+	}
+
+	// the entities of a write have consecutive positions
+	records, err := readLog(logSegments, position-missing+1, position)
+	if err != nil {
+		return err
+	}
+
+	extents := make([]extent, 0, len(records))
+	for _, record := range records {
+		extents = append(extents, extent{start: record.Start, end: record.End})
+	}
+
+	if err := appendBlocks(stream.index, encodeIndex(extents), stream.count*indexEntrySize, ""); err != nil {
+		return internalError("failed to complete the index of entity", err)
+	}
+
+	return nil
+}
+
+// readLog reads the records of the log from fromPosition to toPosition and sets their positions
+func readLog(segments []segment, fromPosition, toPosition int64) ([]logRecord, error) {
+	records := []logRecord{}
+
+	err := readSegments(segments, fromPosition, toPosition, func(data []byte) error {
+		var record logRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+
+		if record.Entity != nil {
+			record.ID = record.Entity.ID
+			record.Version = record.Entity.Version
+			record.Entity = nil
+		}
+
+		if record.ID == "" {
+			return errors.New("record of the log refers to no entity")
+		}
+
+		record.Position = fromPosition + int64(len(records))
+		records = append(records, record)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// readEntities reads the entities that records of the log refer to from the segments of their streams, with one
+// request per segment. Entities whose stream was hard deleted are skipped.
+func readEntities(container *storage.Container, records []logRecord) ([]store.Entity, error) {
+	type key struct {
+		id      string
+		segment int64
+	}
+
+	keys := []key{}
+	extents := map[key][]extent{}
+
+	for _, record := range records {
+		k := key{id: record.ID, segment: record.Segment}
+		if _, ok := extents[k]; !ok {
+			keys = append(keys, k)
+		}
+
+		extents[k] = append(extents[k], extent{start: record.Start, end: record.End})
+	}
+
+	entities := map[int64]store.Entity{}
+
+	for _, k := range keys {
+		stream, _ := segmentBlobs(container, streamName(k.id), max(k.segment, 1))
+
+		streamSize, err := size(stream)
+		if err != nil {
+			return nil, err
+		}
+
+		// a stream that was hard deleted and added again may be shorter than the records refer to
+		stored := []extent{}
+		for _, e := range extents[k] {
+			if e.end <= streamSize {
+				stored = append(stored, e)
+			}
+		}
+
+		err = readRecords(stream, stored, func(record []byte) error {
+			// the offsets of a stream that was added again may point into other records
+			var entity store.Entity
+			if err := json.Unmarshal(record, &entity); err == nil {
+				entities[entity.Position] = entity
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := []store.Entity{}
+
+	for _, record := range records {
+		if entity, ok := entities[record.Position]; ok && entity.ID == record.ID {
+			result = append(result, entity)
+		}
+	}
+
+	return result, nil
+}
+
+// segments returns the segments of the log or of a stream with the given name. A segment is only followed
+// by other segments if it is full, so the segments after the first one are only listed if the first one is full.
+// All segments but the last one hold the records up to the first record of the next one.
+func (s *blobstore) segments(container *storage.Container, name string) ([]segment, error) {
+	blob, index := segmentBlobs(container, name, 1)
+
+	n, err := count(index)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []segment{{first: 1, count: n, blob: blob, index: index}}
+
+	if n < s.segmentSize {
+		return segments, nil
+	}
+
+	prefix := name + "."
+	params := storage.ListBlobsParameters{Prefix: prefix}
+
+	for {
+		response, err := container.ListBlobs(params)
+		if err != nil {
+			return nil, internalError("failed to list segments", err)
+		}
+
+		// the names of the segments are ordered by their first record, the index blobs are skipped
+		for _, b := range response.Blobs {
+			first, err := strconv.ParseInt(b.Name[len(prefix):], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			segments[len(segments)-1].count = first - segments[len(segments)-1].first
+
+			blob, index := segmentBlobs(container, name, first)
+			segments = append(segments, segment{first: first, blob: blob, index: index})
+		}
+
+		if response.NextMarker == "" {
+			break
+		}
+
+		params.Marker = response.NextMarker
+	}
+
+	if len(segments) > 1 {
+		current := &segments[len(segments)-1]
+		if current.count, err = count(current.index); err != nil {
+			return nil, err
+		}
+	}
+
+	return segments, nil
+}
+
+// next returns the segment, that takes the next write after the given segment. A full segment is followed by a new
+// one, the blobs of a new segment are created, if they don't exist.
+func (s *blobstore) next(container *storage.Container, name string, current segment) (segment, error) {
+	if current.count >= s.segmentSize {
+		first := current.first + current.count
+		blob, index := segmentBlobs(container, name, first)
+		current = segment{first: first, blob: blob, index: index}
+	}
+
+	if current.first == 1 || current.count > 0 {
+		return current, nil
+	}
+
+	// the blob is created before its index, a segment without an index has no records
+	for _, blob := range []*storage.Blob{current.blob, current.index} {
+		if err := createAppendBlob(blob); err != nil {
+			return current, err
+		}
+	}
+
+	return current, nil
+}
+
+// readSegments reads the records first to last of the segments and calls fn for every record,
+// with one request for every segment and its index
+func readSegments(segments []segment, first, last int64, fn func(record []byte) error) error {
+	for _, segment := range segments {
+		from, to := max(first, segment.first), min(last, segment.first+segment.count-1)
+		if from > to {
+			continue
+		}
+
+		extents, err := readIndex(segment.index, from-segment.first+1, to-segment.first+1)
+		if err != nil {
+			return err
+		}
+
+		if err := readRecords(segment.blob, extents, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lastOf returns the last position or version of the segments
+func lastOf(segments []segment) int64 {
+	current := segments[len(segments)-1]
+	return current.first + current.count - 1
+}
+
+// segmentOf returns the first version of a segment of a stream as it is stored in the log, 0 for the first segment
+func segmentOf(stream segment) int64 {
+	if stream.first == 1 {
+		return 0
+	}
+
+	return stream.first
+}
+
+// readIndex reads the entries first to last of an index blob, the first entry is 1
+func readIndex(index *storage.Blob, first, last int64) ([]extent, error) {
+	data, err := readRange(index, (first-1)*indexEntrySize, last*indexEntrySize)
+	if err != nil {
+		return nil, internalError("failed to read index", err)
+	}
+
+	extents := make([]extent, 0, len(data)/indexEntrySize)
+
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		extents = append(extents, extent{
+			start: int64(binary.BigEndian.Uint64(data[i:])),
+			end:   int64(binary.BigEndian.Uint64(data[i+8:])),
+		})
+	}
+
+	return extents, nil
+}
+
+// readRecords reads the range of a blob that contains all extents and calls fn for every record
+func readRecords(blob *storage.Blob, extents []extent, fn func(record []byte) error) error {
+	if len(extents) == 0 {
+		return nil
+	}
+
+	offset := extents[0].start
+
+	data, err := readRange(blob, offset, extents[len(extents)-1].end)
+	if err != nil {
+		return internalError("failed to read records", err)
+	}
+
+	for _, e := range extents {
+		if e.start < offset || e.end-offset > int64(len(data)) {
+			return internalError("index refers to missing records", nil)
+		}
+
+		if err := fn(data[e.start-offset : e.end-offset]); err != nil {
+			return store.EventStoreError{
+				Text:       "failed to deserialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+	}
+
+	return nil
+}
+
+// readRange reads the bytes from start to end, exclusive, of a blob
+func readRange(blob *storage.Blob, start, end int64) ([]byte, error) {
+	if end <= start {
+		return []byte{}, nil
+	}
+
+	body, err := blob.GetRange(&storage.GetBlobRangeOptions{
+		Range: &storage.BlobRange{Start: uint64(start), End: uint64(end - 1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > end-start {
+		data = data[:end-start]
+	}
+
+	return data, nil
+}
+
+// encodeIndex returns the index entries of extents
+func encodeIndex(extents []extent) [][]byte {
+	entries := make([][]byte, 0, len(extents))
+
+	for _, e := range extents {
+		entry := make([]byte, 0, indexEntrySize)
+		entry = binary.BigEndian.AppendUint64(entry, uint64(e.start))
+		entry = binary.BigEndian.AppendUint64(entry, uint64(e.end))
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// appendBlock appends data to an append blob, if the blob has the expected size
+func appendBlock(blob *storage.Blob, data []byte, expectedSize int64, leaseID string) error {
+	position := uint(expectedSize)
+
+	return blob.AppendBlock(data, &storage.AppendBlockOptions{
+		AppendPosition: &position,
+		LeaseID:        leaseID,
+	})
+}
+
+// appendBlocks appends records to an append blob, if the blob has the expected size. The records are appended
+// in as few blocks as possible, a block takes at most maxBlockSize bytes and a record is never split.
+func appendBlocks(blob *storage.Blob, records [][]byte, expectedSize int64, leaseID string) error {
+	block := []byte{}
+
+	for _, record := range records {
+		if len(block) > 0 && len(block)+len(record) > maxBlockSize {
+			if err := appendBlock(blob, block, expectedSize, leaseID); err != nil {
+				return err
+			}
+
+			expectedSize += int64(len(block))
+			block = []byte{}
+		}
+
+		block = append(block, record...)
+	}
+
+	if len(block) == 0 {
+		return nil
+	}
+
+	return appendBlock(blob, block, expectedSize, leaseID)
+}
+
+// createAppendBlob creates an empty append blob, if it doesn't exist
+func createAppendBlob(blob *storage.Blob) error {
+	err := blob.PutAppendBlob(&storage.PutBlobOptions{IfNoneMatch: "*"})
+	if isConflict(err) {
+		return nil
+	}
+
+	return err
+}
+
+// size returns the size of a blob, a blob that doesn't exist is empty
+func size(blob *storage.Blob) (int64, error) {
+	err := blob.GetProperties(nil)
+	if isNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, internalError("failed to load properties of blob", err)
+	}
+
+	return blob.Properties.ContentLength, nil
+}
+
+// exists checks if a blob exists
+func exists(blob *storage.Blob) (bool, error) {
+	err := blob.GetProperties(nil)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, internalError("failed to load properties of blob", err)
+	}
+
+	return true, nil
+}
+
+// count returns the number of entries of an index blob
+func count(index *storage.Blob) (int64, error) {
+	size, err := size(index)
+	return size / indexEntrySize, err
+}
+
+// getSnapshot reads a snapshot and returns it with the ETag of its blob
+func getSnapshot(blob *storage.Blob) (*store.Snapshot, string, error) {
+	body, err := blob.Get(nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer body.Close()
+
+	snapshot := &store.Snapshot{}
+	if err := json.NewDecoder(body).Decode(snapshot); err != nil {
+		return nil, "", store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, blob.Properties.Etag, nil
+}
+
+// streamName returns the name of the blob of the entity with the given id.
+// The id is encoded, so that any id is a valid blob name.
+func streamName(id string) string {
+	return streamPrefix + encodeID(id)
+}
+
+// segmentBlobs returns the blob and the index blob of the segment of the log or of a stream with the given name,
+// that starts at first
+func segmentBlobs(container *storage.Container, name string, first int64) (*storage.Blob, *storage.Blob) {
+	if first > 1 {
+		name = fmt.Sprintf("%s.%019d", name, first)
+	}
+
+	return container.GetBlobReference(name), container.GetBlobReference(name + indexSuffix)
+}
+
+// stream returns the segments of the entity with the given id and its latest version
+func (s *blobstore) stream(container *storage.Container, id string) ([]segment, int64, error) {
+	segments, err := s.segments(container, streamName(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version := lastOf(segments)
+	if version == 0 {
+		return nil, 0, notFound(id)
+	}
+
+	deleted, err := exists(tombstoneBlob(container, id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if deleted {
+		return nil, 0, store.StreamDeletedError(id)
+	}
+
+	return segments, version, nil
+}
+
+// eventIDBlob returns the marker blob of an event ID of the entity with the given id
+func eventIDBlob(container *storage.Container, id, eventID string) *storage.Blob {
+	return container.GetBlobReference(eventIDPrefix + encodeID(id) + "/" + encodeID(eventID))
+}
+
+// eventIDBlobs returns the marker blobs of all event IDs of the entity with the given id
+func eventIDBlobs(container *storage.Container, id string) ([]*storage.Blob, error) {
+	blobs := []*storage.Blob{}
+	params := storage.ListBlobsParameters{Prefix: eventIDPrefix + encodeID(id) + "/"}
+
+	for {
+		response, err := container.ListBlobs(params)
+		if err != nil {
+			return nil, internalError("failed to list event IDs", err)
+		}
+
+		for _, b := range response.Blobs {
+			blobs = append(blobs, container.GetBlobReference(b.Name))
+		}
+
+		if response.NextMarker == "" {
+			return blobs, nil
+		}
+
+		params.Marker = response.NextMarker
+	}
+}
+
+// tombstoneBlob returns the blob, that marks the stream of the entity with the given id as soft deleted
+func tombstoneBlob(container *storage.Container, id string) *storage.Blob {
+	return container.GetBlobReference(tombstonePrefix + encodeID(id))
+}
+
+func encodeID(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func notFound(id string) error {
+	return store.EventStoreError{
+		Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+		ErrorType:  store.EntityNotFound,
+		InnerError: nil,
+	}
+}
+
+func stale(id string) error {
+	return store.EventStoreError{
+		Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+		ErrorType:  store.VersionConflict,
+		InnerError: nil,
+	}
+}
+
+func internalError(text string, err error) error {
+	return store.EventStoreError{
+		Text:       text,
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+func (s *blobstore) getContainer(ctx context.Context) *storage.Container {
+	client := s.client
+	client.Sender = &contextSender{ctx: ctx, sender: s.client.Sender}
+
+	svc := client.GetBlobService()
+	return svc.GetContainerReference(s.containerName)
+}
+
+// contextSender binds all requests sent by a storage client to a context
+type contextSender struct {
+	ctx    context.Context
+	sender storage.Sender
+}
+
+func (c *contextSender) Send(client *storage.Client, req *http.Request) (*http.Response, error) {
+	return c.sender.Send(client, req.WithContext(c.ctx))
+}
+
+// isConflict checks if a conditional request failed, because the blob was changed or already exists
+func isConflict(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.Code == blobAlreadyExists || serr.Code == conditionNotMet ||
+			(serr.StatusCode == http.StatusPreconditionFailed && serr.Code != appendPositionConditionNotMet)
+	}
+
+	return false
+}
+
+func isNotFound(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
+
+// isTransient checks if a request failed because of a condition, that is likely to go away when the request is repeated.
+// The lease of the log is held by another writer or was lost, or a blob was appended by another writer, before
+// the write was visible, so it can be repeated.
+func isTransient(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		switch serr.Code {
+		case leaseAlreadyPresent, leaseIDMismatchWithBlobOperation, leaseLost, appendPositionConditionNotMet:
+			return true
+		}
+
+		switch serr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+			return true
+		}
+	}
+
+	return false
+}
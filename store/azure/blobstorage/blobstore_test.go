@@ -0,0 +1,383 @@
+package blobstorage
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	storageAccountFlag    *string
+	storageAccountKeyFlag *string
+)
+
+func init() {
+	storageAccountFlag = flag.String("storageaccount", "", "name of storage account to use")
+	storageAccountKeyFlag = flag.String("storageaccountkey", "", "key of storage account to use")
+}
+
+// newFakeStore returns a store connected to a new fake
+func newFakeStore(t *testing.T) (*fakeBlobStorage, store.EventStore) {
+	fake, metadata := newFakeBlobStorage(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+
+	s := fake.newStore()
+	require.Nil(t, s.Init(metadata))
+
+	return fake, s
+}
+
+func TestInit(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+
+	s = NewStore()
+	err = s.Init(store.Metadata{Properties: map[string]string{storageAccountName: "account"}})
+	assert.NotNil(t, err)
+}
+
+func TestConformance(t *testing.T) {
+	if *storageAccountFlag == "" {
+		t.Skip("no storage account configured")
+	}
+
+	storetest.RunConformance(t, func() store.EventStore {
+		s := NewStore()
+		err := s.Init(store.Metadata{
+			Properties: map[string]string{
+				storageAccountName: *storageAccountFlag,
+				storageAccountKey:  *storageAccountKeyFlag,
+			},
+		})
+		assert.Nil(t, err)
+		return s
+	})
+}
+
+func TestConformanceFake(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		_, s := newFakeStore(t)
+		return s
+	})
+}
+
+func TestFailedWriteIsInvisible(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the entity is appended to the blob of the entity and the log, but not to the index of the log
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isAppendBlock(r, logBlobName+indexSuffix) {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "lost"}, store.None)
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	fake.setFailRequest(nil)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+
+	// the records of the failed write are skipped
+	e, err := s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+	assert.Equal(t, int64(2), e.Position)
+
+	e, err = s.GetByVersion("1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World", e.Data)
+
+	res, err = s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, "Hello World", res[1].Data)
+}
+
+func TestNextWriteCompletesIndex(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the entities are stored, but the index of the entity isn't appended
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isAppendBlock(r, streamPrefix+encodeID("1")+indexSuffix) {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	_, err = s.AppendBatch("1", 1, []*store.Entity{{Data: "Hello"}, {Data: "World"}})
+	assert.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+
+	// a write of another entity completes the index
+	_, err = s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+
+	res, err = s.GetByVersionRange("1", 1, 3)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "World", res[2].Data)
+	assert.Equal(t, int64(3), res[2].Position)
+}
+
+func TestSegments(t *testing.T) {
+	fake, metadata := newFakeBlobStorage(t)
+	fake.maxBlocks = 4
+
+	s := fake.newStore()
+	s.segmentSize = 3
+	require.Nil(t, s.Init(metadata))
+
+	eventID := uuid.New().String()
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "1", EventID: eventID})
+	require.Nil(t, err)
+
+	_, err = s.Add(&store.Entity{ID: "2", Data: "1"})
+	require.Nil(t, err)
+
+	for i := 2; i <= 10; i++ {
+		_, err = s.Append(&store.Entity{ID: "1", Data: fmt.Sprint(i)}, store.None)
+		require.Nil(t, err)
+
+		_, err = s.AppendBatch("2", int64(2*i-3), []*store.Entity{{Data: fmt.Sprint(2*i - 2)}, {Data: fmt.Sprint(2*i - 1)}})
+		require.Nil(t, err)
+	}
+
+	// the log, the stream and the indexes are continued in new blobs, before they run out of blocks
+	assert.NotNil(t, fake.blob(defaultContainerName, fmt.Sprintf("%s.%019d", logBlobName, 4)))
+	assert.NotNil(t, fake.blob(defaultContainerName, fmt.Sprintf("%s.%019d%s", streamName("1"), 10, indexSuffix)))
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), version)
+
+	res, err := s.GetByVersionRange("1", 2, 10)
+	assert.Nil(t, err)
+	require.Equal(t, 9, len(res))
+	for i, e := range res {
+		assert.Equal(t, int64(i+2), e.Version)
+		assert.Equal(t, fmt.Sprint(i+2), e.Data)
+	}
+
+	res, err = s.GetByVersionRange("2", 1, 19)
+	assert.Nil(t, err)
+	require.Equal(t, 19, len(res))
+	assert.Equal(t, "19", res[18].Data)
+
+	res, err = s.ReadAll(1, 100)
+	assert.Nil(t, err)
+	require.Equal(t, 29, len(res))
+	for i, e := range res {
+		assert.Equal(t, int64(i+1), e.Position)
+	}
+
+	// event IDs are found in every segment
+	e, err := s.Append(&store.Entity{ID: "1", Data: "1", EventID: eventID}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+
+	// the index of a new segment is completed by the next write
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isAppendBlock(r, fmt.Sprintf("%s.%019d%s", streamName("1"), 13, indexSuffix)) {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	_, err = s.AppendBatch("1", 10, []*store.Entity{{Data: "11"}, {Data: "12"}})
+	require.Nil(t, err)
+
+	_, err = s.AppendBatch("1", 12, []*store.Entity{{Data: "13"}, {Data: "14"}})
+	require.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	_, err = s.Append(&store.Entity{ID: "2", Data: "20"}, store.None)
+	require.Nil(t, err)
+
+	res, err = s.GetByVersionRange("1", 11, 14)
+	assert.Nil(t, err)
+	require.Equal(t, 4, len(res))
+	assert.Equal(t, "14", res[3].Data)
+
+	// a hard delete removes all segments of the stream
+	require.Nil(t, s.Delete("1", store.Any, true))
+	assert.Nil(t, fake.blob(defaultContainerName, fmt.Sprintf("%s.%019d", streamName("1"), 4)))
+	assert.Nil(t, fake.blob(defaultContainerName, fmt.Sprintf("%s.%019d%s", streamName("1"), 13, indexSuffix)))
+
+	res, err = s.ReadAll(1, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(res))
+}
+
+func TestLargeWriteIsAppendedInBlocks(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	// the records of the entities take two blocks
+	entities := []*store.Entity{}
+	for i := 0; i < 4; i++ {
+		entities = append(entities, &store.Entity{Data: strings.Repeat(fmt.Sprint(i), maxBlockSize/3)})
+	}
+
+	_, err := s.AppendToStream("1", store.NoStream, entities)
+	require.Nil(t, err)
+
+	blocks := func() int {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		return fake.containers[defaultContainerName][streamName("1")].blocks
+	}
+	assert.Equal(t, 2, blocks())
+
+	res, err := s.GetByVersionRange("1", 1, 4)
+	assert.Nil(t, err)
+	require.Equal(t, 4, len(res))
+	for i, e := range res {
+		assert.Equal(t, entities[i].Data, e.Data)
+	}
+
+	// an entity that fits into a block takes a block of its own
+	_, err = s.Append(&store.Entity{ID: "1", Data: strings.Repeat("x", maxBlockSize-1024)}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, 3, blocks())
+
+	// an entity that doesn't fit into a block is rejected before it is appended
+	_, err = s.Append(&store.Entity{ID: "1", Data: strings.Repeat("x", maxBlockSize)}, store.None)
+	storetest.AssertErrorType(t, err, store.InternalError)
+	assert.Equal(t, 3, blocks())
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), version)
+}
+
+func TestEventIDsAreLookedUp(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	eventIDs := []string{}
+	for i := 1; i <= 20; i++ {
+		eventIDs = append(eventIDs, uuid.New().String())
+
+		_, err := s.AppendToStream("1", store.Any, []*store.Entity{{Data: "Hello World", EventID: eventIDs[i-1]}})
+		require.Nil(t, err)
+	}
+
+	// a repeated write reads the entity of its event ID, not the whole stream
+	read := 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/"+streamName("1")) {
+			if m := rangeExpr.FindStringSubmatch(r.Header.Get("Range")); m != nil {
+				start, _ := strconv.Atoi(m[1])
+				end, _ := strconv.Atoi(m[2])
+				read += end - start + 1
+			}
+		}
+		return nil
+	})
+
+	e, err := s.Append(&store.Entity{ID: "1", Data: "Hello World", EventID: eventIDs[9]}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(10), e.Version)
+
+	fake.setFailRequest(nil)
+
+	records := bytes.Count(fake.blob(defaultContainerName, streamName("1")), []byte("\n"))
+	assert.Equal(t, 20, records)
+	assert.Less(t, read, 2*len(fake.blob(defaultContainerName, streamName("1")))/records)
+
+	// the marker of a failed write doesn't make its event ID a duplicate
+	lost := uuid.New().String()
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isAppendBlock(r, streamName("1")) {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "lost", EventID: lost}, store.None)
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	fake.setFailRequest(nil)
+
+	e, err = s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(21), e.Version)
+
+	e, err = s.Append(&store.Entity{ID: "1", Data: "Hello World", EventID: lost}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(22), e.Version)
+
+	e, err = s.Append(&store.Entity{ID: "1", Data: "Hello World", EventID: lost}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(22), e.Version)
+
+	// a hard delete removes the markers
+	require.Nil(t, s.Delete("1", store.Any, true))
+	assert.Nil(t, fake.blob(defaultContainerName, eventIDPrefix+encodeID("1")+"/"+encodeID(lost)))
+}
+
+func TestLeaseIsReleased(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	storetest.AssertErrorType(t, err, store.AlreadyExists)
+
+	fake.mutex.Lock()
+	lease := fake.containers[defaultContainerName][logBlobName].leaseID
+	fake.mutex.Unlock()
+
+	assert.Empty(t, lease)
+}
+
+func TestContainerName(t *testing.T) {
+	fake, metadata := newFakeBlobStorage(t)
+	metadata.Properties[containerName] = "orders"
+
+	s := fake.newStore()
+	require.Nil(t, s.Init(metadata))
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	assert.True(t, bytes.Contains(fake.blob("orders", streamPrefix+encodeID("1")), []byte("Hello World")))
+	assert.NotEmpty(t, fake.blob("orders", logBlobName))
+}
+
+func TestOpen(t *testing.T) {
+	_, err := store.Open(BackendName, store.Metadata{Properties: map[string]string{}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "azure blobstorage")
+}
@@ -0,0 +1,510 @@
+package blobstorage
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+)
+
+// fakeBlobStorage is an in-process stand-in for the parts of the Blob Storage REST API that are used by
+// the event store: containers, block and append blobs, conditional appends, ranged reads, leases and listing
+// blobs by prefix. Requests are not authenticated.
+type fakeBlobStorage struct {
+	server     *httptest.Server
+	mutex      sync.Mutex
+	containers map[string]map[string]*fakeBlob
+	counter    int64
+
+	// maxBlocks is the number of blocks an append blob takes, like the limit of the blob service
+	maxBlocks int
+	// maxBlockSize is the size of the largest block an append blob takes, like the limit of the blob service
+	maxBlockSize int
+
+	// failRequest fails every request it returns an error for
+	failRequest func(r *http.Request) *fakeError
+}
+
+type fakeBlob struct {
+	blobType     string
+	data         []byte
+	blocks       int
+	etag         string
+	leaseID      string
+	leaseExpires time.Time
+}
+
+type fakeError struct {
+	status int
+	code   string
+}
+
+func (e *fakeError) Error() string {
+	return e.code
+}
+
+var (
+	errFakeNotFound             = &fakeError{http.StatusNotFound, "BlobNotFound"}
+	errFakeContainerNotFound    = &fakeError{http.StatusNotFound, "ContainerNotFound"}
+	errFakeContainerExists      = &fakeError{http.StatusConflict, "ContainerAlreadyExists"}
+	errFakeBlobExists           = &fakeError{http.StatusConflict, blobAlreadyExists}
+	errFakeConditionNotMet      = &fakeError{http.StatusPreconditionFailed, conditionNotMet}
+	errFakeAppendPosition       = &fakeError{http.StatusPreconditionFailed, appendPositionConditionNotMet}
+	errFakeLeasePresent         = &fakeError{http.StatusConflict, leaseAlreadyPresent}
+	errFakeLeaseMismatch        = &fakeError{http.StatusPreconditionFailed, leaseIDMismatchWithBlobOperation}
+	errFakeLeaseMissing         = &fakeError{http.StatusPreconditionFailed, "LeaseIdMissing"}
+	errFakeLeaseOperation       = &fakeError{http.StatusConflict, "LeaseIdMismatchWithLeaseOperation"}
+	errFakeInvalidBlobType      = &fakeError{http.StatusConflict, "InvalidBlobType"}
+	errFakeBlockCount           = &fakeError{http.StatusConflict, "BlockCountExceedsLimit"}
+	errFakeBodyTooLarge         = &fakeError{http.StatusRequestEntityTooLarge, "RequestBodyTooLarge"}
+	errFakeInvalidRange         = &fakeError{http.StatusRequestedRangeNotSatisfiable, "InvalidRange"}
+	errFakeBadRequest           = &fakeError{http.StatusBadRequest, "InvalidInput"}
+	errFakeUnsupportedOperation = &fakeError{http.StatusBadRequest, "UnsupportedHttpVerb"}
+)
+
+var rangeExpr = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// newFakeBlobStorage starts a new fake and returns the metadata to connect to it
+func newFakeBlobStorage(t *testing.T) (*fakeBlobStorage, store.Metadata) {
+	f := &fakeBlobStorage{
+		containers:   map[string]map[string]*fakeBlob{},
+		maxBlocks:    50000,
+		maxBlockSize: 4 * 1024 * 1024,
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	metadata := store.Metadata{
+		Properties: map[string]string{
+			storageAccountName: "fakeaccount",
+			storageAccountKey:  base64.StdEncoding.EncodeToString([]byte("fake")),
+		},
+	}
+
+	return f, metadata
+}
+
+// newStore creates a store, whose requests are sent to the fake
+func (f *fakeBlobStorage) newStore() *blobstore {
+	return &blobstore{httpClient: f.client()}
+}
+
+// client returns an http.Client, that sends all requests to the fake. The storage client
+// builds the host name from the account name, so the host is replaced.
+func (f *fakeBlobStorage) client() *http.Client {
+	target, _ := url.Parse(f.server.URL)
+
+	return &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.Host = target.Host
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+}
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func (f *fakeBlobStorage) setFailRequest(failRequest func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failRequest = failRequest
+}
+
+// blob returns a copy of the content of a blob, or nil if it doesn't exist
+func (f *fakeBlobStorage) blob(container, name string) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if b, ok := f.containers[container][name]; ok {
+		return append([]byte{}, b.data...)
+	}
+
+	return nil
+}
+
+// isAppendBlock checks if r appends a block to the blob with the given name
+func isAppendBlock(r *http.Request, name string) bool {
+	return r.Method == http.MethodPut && r.URL.Query().Get("comp") == "appendblock" && strings.HasSuffix(r.URL.Path, "/"+name)
+}
+
+func (f *fakeBlobStorage) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failRequest != nil {
+		if err := f.failRequest(r); err != nil {
+			f.writeError(w, r, err)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, r, errFakeBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	query := r.URL.Query()
+
+	if len(parts) == 1 {
+		if r.Method == http.MethodPut && query.Get("restype") == "container" {
+			f.createContainer(w, r, parts[0])
+			return
+		}
+
+		if r.Method == http.MethodGet && query.Get("restype") == "container" && query.Get("comp") == "list" {
+			f.listBlobs(w, r, parts[0], query.Get("prefix"))
+			return
+		}
+
+		f.writeError(w, r, errFakeUnsupportedOperation)
+		return
+	}
+
+	blobs, ok := f.containers[parts[0]]
+	if !ok {
+		f.writeError(w, r, errFakeContainerNotFound)
+		return
+	}
+
+	name := parts[1]
+	blob := blobs[name]
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "lease":
+		f.lease(w, r, blob)
+	case r.Method == http.MethodPut && query.Get("comp") == "appendblock":
+		f.appendBlock(w, r, blob, body)
+	case r.Method == http.MethodPut && query.Get("comp") == "":
+		f.putBlob(w, r, blobs, name, body)
+	case r.Method == http.MethodHead:
+		f.getBlob(w, r, blob, true)
+	case r.Method == http.MethodGet:
+		f.getBlob(w, r, blob, false)
+	case r.Method == http.MethodDelete:
+		f.deleteBlob(w, r, blobs, name)
+	default:
+		f.writeError(w, r, errFakeUnsupportedOperation)
+	}
+}
+
+func (f *fakeBlobStorage) createContainer(w http.ResponseWriter, r *http.Request, name string) {
+	if _, ok := f.containers[name]; ok {
+		f.writeError(w, r, errFakeContainerExists)
+		return
+	}
+
+	f.containers[name] = map[string]*fakeBlob{}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// listBlobs lists the names of the blobs with the given prefix in one page
+func (f *fakeBlobStorage) listBlobs(w http.ResponseWriter, r *http.Request, container, prefix string) {
+	blobs, ok := f.containers[container]
+	if !ok {
+		f.writeError(w, r, errFakeContainerNotFound)
+		return
+	}
+
+	type entry struct {
+		Name string `xml:"Name"`
+	}
+
+	names := []entry{}
+	for name := range blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, entry{Name: name})
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"EnumerationResults"`
+		Prefix  string   `xml:"Prefix"`
+		Blobs   []entry  `xml:"Blobs>Blob"`
+	}{Prefix: prefix, Blobs: names})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (f *fakeBlobStorage) putBlob(w http.ResponseWriter, r *http.Request, blobs map[string]*fakeBlob, name string, body []byte) {
+	blob := blobs[name]
+
+	if err := f.checkConditions(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	if err := f.checkLease(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	blobType := r.Header.Get("x-ms-blob-type")
+	if blobType == "AppendBlob" {
+		body = nil
+	}
+
+	if blob == nil {
+		blob = &fakeBlob{}
+		blobs[name] = blob
+	}
+
+	blob.blobType = blobType
+	blob.data = body
+	blob.blocks = 0
+	f.touch(w, blob)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobStorage) appendBlock(w http.ResponseWriter, r *http.Request, blob *fakeBlob, body []byte) {
+	if blob == nil {
+		f.writeError(w, r, errFakeNotFound)
+		return
+	}
+
+	if blob.blobType != "AppendBlob" {
+		f.writeError(w, r, errFakeInvalidBlobType)
+		return
+	}
+
+	if err := f.checkConditions(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	if err := f.checkLease(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	if len(body) == 0 {
+		f.writeError(w, r, errFakeBadRequest)
+		return
+	}
+
+	if len(body) > f.maxBlockSize {
+		f.writeError(w, r, errFakeBodyTooLarge)
+		return
+	}
+
+	if blob.blocks >= f.maxBlocks {
+		f.writeError(w, r, errFakeBlockCount)
+		return
+	}
+
+	if position := r.Header.Get("x-ms-blob-condition-appendpos"); position != "" {
+		if p, err := strconv.Atoi(position); err != nil || p != len(blob.data) {
+			f.writeError(w, r, errFakeAppendPosition)
+			return
+		}
+	}
+
+	w.Header().Set("x-ms-blob-append-offset", strconv.Itoa(len(blob.data)))
+	blob.data = append(blob.data, body...)
+	blob.blocks++
+	f.touch(w, blob)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobStorage) getBlob(w http.ResponseWriter, r *http.Request, blob *fakeBlob, head bool) {
+	if blob == nil {
+		f.writeError(w, r, errFakeNotFound)
+		return
+	}
+
+	if err := f.checkConditions(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	data := blob.data
+	status := http.StatusOK
+
+	if rng := r.Header.Get("Range"); rng != "" && !head {
+		m := rangeExpr.FindStringSubmatch(rng)
+		if m == nil {
+			f.writeError(w, r, errFakeBadRequest)
+			return
+		}
+
+		start, _ := strconv.Atoi(m[1])
+		end := len(data) - 1
+		if m[2] != "" {
+			end, _ = strconv.Atoi(m[2])
+		}
+
+		if start >= len(data) {
+			f.writeError(w, r, errFakeInvalidRange)
+			return
+		}
+
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("ETag", blob.etag)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(time.RFC1123))
+	w.Header().Set("x-ms-blob-type", blob.blobType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	if !head {
+		w.Write(data)
+	}
+}
+
+func (f *fakeBlobStorage) deleteBlob(w http.ResponseWriter, r *http.Request, blobs map[string]*fakeBlob, name string) {
+	blob := blobs[name]
+	if blob == nil {
+		f.writeError(w, r, errFakeNotFound)
+		return
+	}
+
+	if err := f.checkConditions(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	if err := f.checkLease(r, blob); err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	delete(blobs, name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeBlobStorage) lease(w http.ResponseWriter, r *http.Request, blob *fakeBlob) {
+	if blob == nil {
+		f.writeError(w, r, errFakeNotFound)
+		return
+	}
+
+	leased := blob.leaseID != "" && time.Now().Before(blob.leaseExpires)
+
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		if leased {
+			f.writeError(w, r, errFakeLeasePresent)
+			return
+		}
+
+		duration, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || duration < 15 || duration > 60 {
+			f.writeError(w, r, errFakeBadRequest)
+			return
+		}
+
+		f.counter++
+		blob.leaseID = fmt.Sprintf("lease-%d", f.counter)
+		blob.leaseExpires = time.Now().Add(time.Duration(duration) * time.Second)
+
+		w.Header().Set("x-ms-lease-id", blob.leaseID)
+		w.WriteHeader(http.StatusCreated)
+	case "release":
+		if r.Header.Get("x-ms-lease-id") != blob.leaseID {
+			f.writeError(w, r, errFakeLeaseOperation)
+			return
+		}
+
+		blob.leaseID = ""
+		w.WriteHeader(http.StatusOK)
+	default:
+		f.writeError(w, r, errFakeBadRequest)
+	}
+}
+
+// checkConditions checks the If-Match and If-None-Match headers of a request
+func (f *fakeBlobStorage) checkConditions(r *http.Request, blob *fakeBlob) *fakeError {
+	if match := r.Header.Get("If-Match"); match != "" && (blob == nil || (match != "*" && match != blob.etag)) {
+		return errFakeConditionNotMet
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && blob != nil && (match == "*" || match == blob.etag) {
+		if r.Method == http.MethodPut {
+			return errFakeBlobExists
+		}
+
+		return errFakeConditionNotMet
+	}
+
+	return nil
+}
+
+// checkLease checks that a write to a leased blob has the id of its lease
+func (f *fakeBlobStorage) checkLease(r *http.Request, blob *fakeBlob) *fakeError {
+	id := r.Header.Get("x-ms-lease-id")
+
+	if blob == nil || blob.leaseID == "" || time.Now().After(blob.leaseExpires) {
+		if id != "" {
+			return errFakeLeaseMismatch
+		}
+
+		return nil
+	}
+
+	if id == "" {
+		return errFakeLeaseMissing
+	}
+
+	if id != blob.leaseID {
+		return errFakeLeaseMismatch
+	}
+
+	return nil
+}
+
+// touch assigns a new ETag to a blob after it was written
+func (f *fakeBlobStorage) touch(w http.ResponseWriter, blob *fakeBlob) {
+	f.counter++
+	blob.etag = fmt.Sprintf("\"0x%X\"", f.counter)
+	w.Header().Set("ETag", blob.etag)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(time.RFC1123))
+}
+
+func (f *fakeBlobStorage) writeError(w http.ResponseWriter, r *http.Request, err *fakeError) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(err.status)
+		return
+	}
+
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: err.code, Message: err.code})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.status)
+	w.Write(data)
+}
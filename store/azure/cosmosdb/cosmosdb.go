@@ -1,13 +1,47 @@
 package cosmosdb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/AndreasM009/eventstore-impl/store"
 	"github.com/a8m/documentdb"
 )
 
+const (
+	// preconditionFailed is the code of a request error that is returned when an ETag does not match
+	preconditionFailed = "PreconditionFailed"
+	// conflict is the code of a request error that is returned when a document already exists
+	conflict = "Conflict"
+	// notFound is the code of a request error that is returned when a resource does not exist
+	notFound = "NotFound"
+
+	// codes of request errors that are worth another attempt
+	tooManyRequests     = "TooManyRequests"
+	requestTimeout      = "RequestTimeout"
+	serviceUnavailable  = "ServiceUnavailable"
+	internalServerError = "InternalServerError"
+
+	// logID is the partition of the log of all entities
+	logID = "$all"
+
+	// defaultPendingTimeout is the time after which a reader of the log aborts a write, whose log entries are
+	// still pending, unless its entities were stored
+	defaultPendingTimeout = 10 * time.Second
+)
+
+var (
+	// errAborted is the inner error of a write that was aborted by a reader of the log of all entities
+	errAborted = errors.New("the write was aborted by a reader of the log of all entities")
+	// errLogChanged is the inner error of a write whose positions were taken by a concurrent write
+	errLogChanged = errors.New("the log of all entities has changed concurrently")
+)
+
 type cosmosconnectioninfo struct {
 	URL       string `json:"url"`
 	MasterKey string `json:"masterKey"`
@@ -16,20 +50,33 @@ type cosmosconnectioninfo struct {
 }
 
 type cosmosdb struct {
-	connectionInfo cosmosconnectioninfo
-	database       *documentdb.Database
-	container      *documentdb.Collection
-	client         *documentdb.DocumentDB
+	connectionInfo      cosmosconnectioninfo
+	database            *documentdb.Database
+	container           *documentdb.Collection
+	client              *documentdb.DocumentDB
+	appendEntitiesSproc string
+	appendLogSproc      string
+	completeLogSproc    string
+	pendingTimeout      time.Duration
+	retryPolicy         store.RetryPolicy
+	subscriber          *store.PollingSubscriber
 }
 
 type cosmosentity struct {
 	documentdb.Document
-	ID       string        `json:"id"`
-	EntityID string        `json:"entityId"`
-	Version  int64         `json:"version"`
-	Metadata string        `json:"metadata"`
-	Type     string        `json:"type"`
-	Data     *store.Entity `json:"data"`
+	ID       string `json:"id"`
+	EntityID string `json:"entityId"`
+	Version  int64  `json:"version"`
+	Metadata string `json:"metadata"`
+	Type     string `json:"type"`
+	// CreatedAt is the time the entity was created at in microseconds since the epoch, a number is
+	// covered by the range index of the container, so it serves the queries by time
+	CreatedAt int64 `json:"createdAt,omitempty"`
+	// Pending marks a log entry, whose entity may not be stored yet, and First refers to the first
+	// position of the write of a log entry, see cosmosdb.write
+	Pending bool          `json:"pending,omitempty"`
+	First   int64         `json:"first,omitempty"`
+	Data    *store.Entity `json:"data"`
 }
 
 type cosmosdbentityversion struct {
@@ -38,6 +85,36 @@ type cosmosdbentityversion struct {
 	EntityID string `json:"entityId"`
 	Version  int64  `json:"version"`
 	Type     string `json:"type"`
+	// Deleted marks the stream of the entity as soft deleted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// cosmosposition records that the entities of a write were stored with the positions starting at First,
+// or that the write was aborted before
+type cosmosposition struct {
+	documentdb.Document
+	ID       string `json:"id"`
+	EntityID string `json:"entityId"`
+	Type     string `json:"type"`
+	First    int64  `json:"first"`
+	Count    int64  `json:"count"`
+	Aborted  bool   `json:"aborted"`
+}
+
+type cosmossnapshot struct {
+	documentdb.Document
+	ID       string          `json:"id"`
+	EntityID string          `json:"entityId"`
+	Version  int64           `json:"version"`
+	Type     string          `json:"type"`
+	Data     *store.Snapshot `json:"data"`
+}
+
+// BackendName is the name the CosmosDB store is registered with, see store.Open
+const BackendName = "cosmosdb"
+
+func init() {
+	store.Register(BackendName, NewStore)
 }
 
 // NewStore create a new comsosdb store
@@ -46,6 +123,20 @@ func NewStore() store.EventStore {
 }
 
 func (c *cosmosdb) Init(metadata store.Metadata) error {
+	retryPolicy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return err
+	}
+
+	c.retryPolicy = retryPolicy
+
+	subscriber, err := store.NewPollingSubscriber(c, metadata)
+	if err != nil {
+		return err
+	}
+
+	c.subscriber = subscriber
+
 	s, err := json.Marshal(metadata.Properties)
 	if err != nil {
 		return err
@@ -92,49 +183,78 @@ func (c *cosmosdb) Init(metadata store.Metadata) error {
 	}
 
 	c.container = &cntrs[0]
+
+	sproc, err := ensureStoredProcedure(client, c.container, appendEntitiesSprocID, appendEntitiesSproc)
+	if err != nil {
+		return err
+	}
+
+	c.appendEntitiesSproc = sproc
+
+	sproc, err = ensureStoredProcedure(client, c.container, appendLogSprocID, appendLogSproc)
+	if err != nil {
+		return err
+	}
+
+	c.appendLogSproc = sproc
+
+	sproc, err = ensureStoredProcedure(client, c.container, completeLogSprocID, completeLogSproc)
+	if err != nil {
+		return err
+	}
+
+	c.completeLogSproc = sproc
+	c.pendingTimeout = defaultPendingTimeout
 	c.client = client
 	return nil
 }
 
 func (c *cosmosdb) Add(entity *store.Entity) (*store.Entity, error) {
-	entity.Version = 1
+	return c.AddContext(context.Background(), entity)
+}
 
-	cosmosVersion := cosmosdbentityversion{
-		ID:       entity.ID,
-		EntityID: entity.ID,
-		Version:  1,
-		Type:     "version",
+func (c *cosmosdb) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if err := checkID(entity.ID); err != nil {
+		return nil, err
 	}
 
-	cosmosentity := cosmosentity{
-		ID:       makeEntityVersion(entity.ID, 1),
-		EntityID: entity.ID,
-		Version:  1,
-		Metadata: entity.Metadata,
-		Data:     entity,
-		Type:     "entity",
+	if duplicate, err := c.deduplicate(ctx, entity.ID, []*store.Entity{entity}); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entity, nil
 	}
 
-	rqoptions := []documentdb.CallOption{
-		documentdb.PartitionKey(entity.ID),
-	}
+	var result *sprocresult
 
-	_, err := c.client.CreateDocument(c.container.Self, cosmosVersion, rqoptions...)
+	// the version and the entity document are created in one transaction,
+	// so a failure can't leave a version without an entity behind
+	err := c.retryPolicy.Retry(ctx, func() error {
+		var err error
+		result, err = c.write(ctx, entity.ID, 0, true, []*store.Entity{entity})
 
-	if err != nil {
-		return nil, store.EventStoreError{
-			Text:       "insert version entity failed",
-			ErrorType:  store.InternalError,
-			InnerError: err,
+		var evterr store.EventStoreError
+		if err != nil && !errors.As(err, &evterr) {
+			return store.EventStoreError{
+				Text:       "insert entity failed",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
 		}
-	}
 
-	_, err = c.client.CreateDocument(c.container.Self, cosmosentity, rqoptions...)
+		return err
+	}, store.Retryable(store.Optimistic, isTransient))
+
 	if err != nil {
+		return nil, err
+	}
+
+	if result.Status == sprocStatusDeleted {
+		return nil, store.StreamDeletedError(entity.ID)
+	} else if result.Status != sprocStatusOk {
 		return nil, store.EventStoreError{
-			Text:       "insert entity failed",
-			ErrorType:  store.InternalError,
-			InnerError: err,
+			Text:       fmt.Sprintf("CosmosDB eventstore: entity %s already exists", entity.ID),
+			ErrorType:  store.AlreadyExists,
+			InnerError: nil,
 		}
 	}
 
@@ -142,70 +262,189 @@ func (c *cosmosdb) Add(entity *store.Entity) (*store.Entity, error) {
 }
 
 func (c *cosmosdb) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
-	version, err := c.getNextVersionNumber(entity, concurrency)
+	return c.AppendContext(context.Background(), entity, concurrency)
+}
 
-	if err != nil {
+func (c *cosmosdb) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	if err := checkID(entity.ID); err != nil {
 		return nil, err
 	}
 
-	entity.Version = version
+	// entity.Version is overwritten by appendBatch, keep the version the caller expects
+	expectedVersion := entity.Version
+	duplicate := false
 
-	cosmosentity := cosmosentity{
-		ID:       makeEntityVersion(entity.ID, version),
-		EntityID: entity.ID,
-		Version:  version,
-		Metadata: entity.Metadata,
-		Data:     entity,
-		Type:     "entity",
+	err := c.retryPolicy.Retry(ctx, func() error {
+		var err error
+		if duplicate, err = c.deduplicate(ctx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		version := expectedVersion
+
+		// without concurrency control the entity is appended to whatever version is the latest
+		if concurrency == store.None {
+			latest, err := c.GetLatestVersionNumberContext(ctx, entity.ID)
+			if err != nil {
+				return err
+			}
+
+			version = latest
+		}
+
+		_, err = c.appendBatch(ctx, entity.ID, version, false, []*store.Entity{entity})
+		return err
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
 	}
 
-	options := []documentdb.CallOption{
-		documentdb.PartitionKey(entity.ID),
+	return entity, nil
+}
+
+func (c *cosmosdb) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return c.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (c *cosmosdb) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
 	}
 
-	_, err = c.client.CreateDocument(c.container.Self, cosmosentity, options...)
+	var result []*store.Entity
+	duplicate := false
+
+	err := c.retryPolicy.Retry(ctx, func() error {
+		var err error
+		if duplicate, err = c.deduplicate(ctx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		result, err = c.appendBatch(ctx, id, expectedVersion, false, entities)
+		return err
+	}, store.Retryable(store.Optimistic, isTransient))
 
 	if err != nil {
+		return nil, err
+	}
+
+	if duplicate {
+		return entities, nil
+	}
+
+	return result, nil
+}
+
+func (c *cosmosdb) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return c.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (c *cosmosdb) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		if err := store.CheckExpectedVersion(ctx, c, id, expected); err != nil {
+			return nil, err
+		}
+
+		return entities, nil
+	}
+
+	var result []*store.Entity
+	duplicate := false
+
+	// the stored procedure expects an exact version, so the latest version is checked first and passed on,
+	// the entity is only created if it doesn't exist. If it changes in between, the stored procedure reports a conflict.
+	err := c.retryPolicy.Retry(ctx, func() error {
+		var err error
+		if duplicate, err = c.deduplicate(ctx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		version, err := c.GetLatestVersionNumberContext(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			version = 0
+		} else if err != nil {
+			return err
+		}
+
+		if err := expected.Check(id, version); err != nil {
+			return err
+		}
+
+		result, err = c.appendBatch(ctx, id, version, version == 0, entities)
+		return err
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	var evterr store.EventStoreError
+	if expected == store.NoStream && errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		// a concurrent writer created the entity first
 		return nil, store.EventStoreError{
-			Text:       "failed to append new entity version",
-			ErrorType:  store.InternalError,
-			InnerError: err,
+			Text:       fmt.Sprintf("CosmosDB eventstore: entity %s already exists", id),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
 		}
+	} else if err != nil {
+		return nil, err
 	}
 
-	return entity, nil
+	if duplicate {
+		return entities, nil
+	}
+
+	return result, nil
 }
 
 func (c *cosmosdb) GetLatestVersionNumber(id string) (int64, error) {
-	options := []documentdb.CallOption{
-		documentdb.PartitionKey(id),
-	}
+	return c.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (c *cosmosdb) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	options := requestOptions(ctx, id)
 
 	cosmosVersions := []cosmosdbentityversion{}
 	_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
-		Query: "SELECT r.version FROM ROOT r WHERE r.id=@id and r.type=@type",
+		Query: "SELECT r.version, r.deleted FROM ROOT r WHERE r.id=@id and r.type=@type",
 		Parameters: []documentdb.Parameter{
 			{Name: "@id", Value: id},
 			{Name: "@type", Value: "version"},
 		},
 	}, &cosmosVersions, options...)
 
-	if err != nil || len(cosmosVersions) == 0 {
+	if err != nil {
+		return int64(0), loadError("failed to load version of entity", err)
+	}
+
+	if len(cosmosVersions) == 0 {
 		return int64(0), store.EventStoreError{
-			Text:       "failed to load version of entity",
+			Text:       fmt.Sprintf("CosmosDB eventstore: entity %s does not exist", id),
 			ErrorType:  store.EntityNotFound,
-			InnerError: err,
+			InnerError: nil,
 		}
 	}
 
+	if cosmosVersions[0].Deleted {
+		return int64(0), store.StreamDeletedError(id)
+	}
+
 	return cosmosVersions[0].Version, nil
 }
 
 func (c *cosmosdb) GetByVersion(id string, version int64) (*store.Entity, error) {
-	options := []documentdb.CallOption{
-		documentdb.PartitionKey(id),
+	return c.GetByVersionContext(context.Background(), id, version)
+}
+
+func (c *cosmosdb) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	// the entity documents of a deleted stream are kept until a hard delete, the version document tells
+	if _, err := c.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
 	}
 
+	options := requestOptions(ctx, id)
+
 	cosmosEntities := []cosmosentity{}
 	_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
 		Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
@@ -215,11 +454,15 @@ func (c *cosmosdb) GetByVersion(id string, version int64) (*store.Entity, error)
 		},
 	}, &cosmosEntities, options...)
 
-	if err != nil || len(cosmosEntities) == 0 {
+	if err != nil {
+		return nil, loadError("failed to load entity", err)
+	}
+
+	if len(cosmosEntities) == 0 {
 		return nil, store.EventStoreError{
-			Text:       "failed to load entity",
+			Text:       fmt.Sprintf("CosmosDB eventstore: version %v of entity %s does not exist", version, id),
 			ErrorType:  store.EntityNotFound,
-			InnerError: err,
+			InnerError: nil,
 		}
 	}
 
@@ -227,25 +470,29 @@ func (c *cosmosdb) GetByVersion(id string, version int64) (*store.Entity, error)
 }
 
 func (c *cosmosdb) GetByVersionRange(id string, startVersion int64, endVersion int64) ([]store.Entity, error) {
-	options := []documentdb.CallOption{
-		documentdb.PartitionKey(id),
+	return c.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (c *cosmosdb) GetByVersionRangeContext(ctx context.Context, id string, startVersion int64, endVersion int64) ([]store.Entity, error) {
+	// distinguish between an empty result and a missing or deleted entity
+	if _, err := c.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
 	}
 
-	cosmosEntities := []cosmosentity{}
-	_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
-		Query: fmt.Sprintf("SELECT * FROM ROOT r WHERE r.entityId=@entityId and r.type=@type and r.version >= %d and r.version <= %d", startVersion, endVersion),
+	cosmosEntities, err := c.queryEntities(ctx, id, &documentdb.Query{
+		Query: fmt.Sprintf("SELECT * FROM ROOT r WHERE r.entityId=@entityId and r.type=@type and r.version >= %d and r.version <= %d ORDER BY r.version", startVersion, endVersion),
 		Parameters: []documentdb.Parameter{
 			{Name: "@entityId", Value: id},
 			{Name: "@type", Value: "entity"},
 		},
-	}, &cosmosEntities, options...)
+	})
 
-	if err != nil || len(cosmosEntities) == 0 {
-		return nil, store.EventStoreError{
-			Text:       "failed to load entity versions",
-			ErrorType:  store.EntityNotFound,
-			InnerError: err,
-		}
+	if err != nil {
+		return nil, loadError("failed to load entity versions", err)
+	}
+
+	if len(cosmosEntities) == 0 {
+		return []store.Entity{}, nil
 	}
 
 	result := make([]store.Entity, len(cosmosEntities))
@@ -256,71 +503,980 @@ func (c *cosmosdb) GetByVersionRange(id string, startVersion int64, endVersion i
 	return result, nil
 }
 
-func (c *cosmosdb) getNextVersionNumber(entity *store.Entity, concurrency store.ConcurrencyControl) (int64, error) {
-	rqoptions := []documentdb.CallOption{
-		documentdb.PartitionKey(entity.ID),
+func (c *cosmosdb) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return c.GetAsOfContext(context.Background(), id, at)
+}
+
+// GetAsOfContext queries the latest version that was created at or before at by the createdAt field.
+// Entities that were stored before the field was added are never found.
+func (c *cosmosdb) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	// distinguish between an empty result and a missing or deleted entity
+	if _, err := c.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
+	}
+
+	cosmosEntities, err := c.queryEntities(ctx, id, &documentdb.Query{
+		Query: fmt.Sprintf("SELECT TOP 1 * FROM ROOT r WHERE r.entityId=@entityId and r.type=@type and r.createdAt <= %d ORDER BY r.version DESC", at.UnixMicro()),
+		Parameters: []documentdb.Parameter{
+			{Name: "@entityId", Value: id},
+			{Name: "@type", Value: "entity"},
+		},
+	})
+
+	if err != nil {
+		return nil, loadError("failed to load entity", err)
+	}
+
+	if len(cosmosEntities) == 0 {
+		return nil, store.NoVersionAsOf(id, at)
+	}
+
+	return cosmosEntities[0].Data, nil
+}
+
+func (c *cosmosdb) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return c.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (c *cosmosdb) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	// distinguish between an empty result and a missing or deleted entity
+	if _, err := c.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
 	}
 
-	for {
-		cosmosVersions := []cosmosdbentityversion{}
+	cosmosEntities, err := c.queryEntities(ctx, id, &documentdb.Query{
+		Query: fmt.Sprintf("SELECT * FROM ROOT r WHERE r.entityId=@entityId and r.type=@type and r.createdAt >= %d and r.createdAt <= %d ORDER BY r.version", from.UnixMicro(), to.UnixMicro()),
+		Parameters: []documentdb.Parameter{
+			{Name: "@entityId", Value: id},
+			{Name: "@type", Value: "entity"},
+		},
+	})
 
-		_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
-			Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
+	if err != nil {
+		return nil, loadError("failed to load entity versions", err)
+	}
+
+	if len(cosmosEntities) == 0 {
+		return []store.Entity{}, nil
+	}
+
+	result := make([]store.Entity, len(cosmosEntities))
+
+	for i, e := range cosmosEntities {
+		result[i] = *e.Data
+	}
+	return result, nil
+}
+
+func (c *cosmosdb) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return c.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (c *cosmosdb) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	result, _, err := c.readLog(ctx, fromPosition, maxCount)
+	return result, err
+}
+
+// readLog reads the log of all entities like ReadAllContext, and also returns the time of CosmosDB,
+// when it answered the first query of the log
+func (c *cosmosdb) readLog(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, time.Time, error) {
+	if maxCount < 1 {
+		return nil, time.Time{}, store.EventStoreError{
+			Text:       fmt.Sprintf("CosmosDB eventstore: maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	result := []store.Entity{}
+	resolved := map[int64]bool{}
+	var readAt time.Time
+
+	for len(result) < maxCount {
+		count := maxCount - len(result)
+
+		// in the log partition the version of a document is its position
+		entries, now, err := c.queryEntitiesAt(ctx, logID, &documentdb.Query{
+			Query: fmt.Sprintf("SELECT TOP %d * FROM ROOT r WHERE r.type=@type and r.version >= %d ORDER BY r.version", count, fromPosition),
 			Parameters: []documentdb.Parameter{
-				{Name: "@id", Value: entity.ID},
-				{Name: "@type", Value: "version"},
+				{Name: "@type", Value: "log"},
 			},
-		}, &cosmosVersions, rqoptions...)
+		})
+
+		if readAt.IsZero() {
+			readAt = now
+		}
 
 		if err != nil {
-			return 0, store.EventStoreError{
-				Text:       fmt.Sprintf("CosmosDB eventstore: Version for %s not found", entity.ID),
-				ErrorType:  store.EntityNotFound,
-				InnerError: err,
-			}
-		} else if len(cosmosVersions) == 0 {
-			return 0, store.EventStoreError{
-				Text:       fmt.Sprintf("CosmosDB eventstore: Version for %s not found", entity.ID),
-				ErrorType:  store.EntityNotFound,
+			return nil, time.Time{}, store.EventStoreError{
+				Text:       "failed to load log entries",
+				ErrorType:  store.InternalError,
 				InnerError: err,
 			}
 		}
 
-		cosmosVersion := &cosmosVersions[0]
+		for _, e := range entries {
+			if e.Pending {
+				committed, ok := resolved[e.First]
 
-		// check current version
-		if concurrency == store.Optimistic && entity.Version != cosmosVersion.Version {
-			return 0, store.EventStoreError{
-				Text:       "entity has gone stale, a newer version already exists",
-				ErrorType:  store.VersionConflict,
-				InnerError: nil,
+				if !ok {
+					// a write that reserved its positions recently is probably still storing its entities,
+					// the log is read up to it, so that entities are returned in the order of their positions.
+					// The age of the entry is measured with the clock of CosmosDB, that set its timestamp,
+					// a skewed local clock would abort writes that are still running.
+					if now.Sub(time.Unix(int64(e.Ts), 0)) < c.pendingTimeout {
+						return result, readAt, nil
+					}
+
+					if committed, err = c.resolve(ctx, e.Data.ID, e.First); err != nil {
+						return nil, time.Time{}, err
+					}
+
+					resolved[e.First] = committed
+				}
+
+				if !committed {
+					continue
+				}
 			}
+
+			result = append(result, *e.Data)
+		}
+
+		if len(entries) < count {
+			break
 		}
 
-		cosmosVersion.Version++
+		fromPosition = entries[len(entries)-1].Version + 1
+	}
+
+	return result, readAt, nil
+}
+
+func (c *cosmosdb) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return c.DeleteContext(context.Background(), id, expected, hard)
+}
 
-		options := append(rqoptions, documentdb.IfMatch(cosmosVersion.Etag))
+// DeleteContext marks the version document of the entity as deleted, guarded by its ETag, so the stored procedure
+// rejects further appends. A hard delete removes the documents of the entity in the log of all entities and all
+// documents of the partition of the entity afterwards, the version document last.
+func (c *cosmosdb) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
 
-		_, err = c.client.UpsertDocument(c.container.Self, cosmosVersion, options...)
+	if err := checkID(id); err != nil {
+		return err
+	}
 
+	err := c.retryPolicy.Retry(ctx, func() error {
+		version, err := c.getVersion(ctx, id)
 		if err != nil {
-			rqerror := err.(documentdb.RequestError)
-
-			if rqerror.Code == "412" {
-				if concurrency == store.Optimistic {
-					return 0, store.EventStoreError{
-						Text:       "entity has gone stale, a newer version already exists",
-						ErrorType:  store.VersionConflict,
-						InnerError: nil,
-					}
-				}
+			return loadError("failed to load version of entity", err)
+		}
+
+		if version == nil {
+			return store.CheckDelete(id, 0, false, hard, expected)
+		}
+
+		if err := store.CheckDelete(id, version.Version, version.Deleted, hard, expected); err != nil {
+			return err
+		}
+
+		if version.Deleted {
+			return nil
+		}
+
+		version.Deleted = true
+
+		_, err = c.client.UpsertDocument(c.container.Self, version, append(requestOptions(ctx, id), documentdb.IfMatch(version.Etag))...)
+		if isRequestError(err, preconditionFailed) {
+			return store.EventStoreError{
+				Text:       "entity has gone stale, a newer version already exists",
+				ErrorType:  store.VersionConflict,
+				InnerError: err,
 			}
-		} else {
-			return cosmosVersion.Version, nil
+		} else if err != nil {
+			return deleteError(err)
 		}
+
+		return nil
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	if err != nil || !hard {
+		return err
 	}
+
+	return c.retryPolicy.Retry(ctx, func() error {
+		return c.deletePartition(ctx, id)
+	}, store.Retryable(store.None, isTransient))
 }
 
-func makeEntityVersion(id string, version int64) string {
+// getVersion returns the version document of an entity, or nil if there is none
+func (c *cosmosdb) getVersion(ctx context.Context, id string) (*cosmosdbentityversion, error) {
+	versions := []cosmosdbentityversion{}
+	_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
+		Parameters: []documentdb.Parameter{
+			{Name: "@id", Value: id},
+			{Name: "@type", Value: "version"},
+		},
+	}, &versions, requestOptions(ctx, id)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, nil
+	}
+
+	return &versions[0], nil
+}
+
+// deletePartition removes the log documents and the documents of the partition of an entity, the version document
+// is removed last, so that a delete that fails leaves the entity deleted
+func (c *cosmosdb) deletePartition(ctx context.Context, id string) error {
+	entries, err := c.queryEntities(ctx, logID, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.type=@type and r.data.id=@id",
+		Parameters: []documentdb.Parameter{
+			{Name: "@type", Value: "log"},
+			{Name: "@id", Value: id},
+		},
+	})
+
+	if err != nil {
+		return deleteError(err)
+	}
+
+	for _, entry := range entries {
+		if _, err := c.client.DeleteDocument(entry.Self, requestOptions(ctx, logID)...); err != nil && !isRequestError(err, notFound) {
+			return deleteError(err)
+		}
+	}
+
+	docs, err := c.queryEntities(ctx, id, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.type!=@type",
+		Parameters: []documentdb.Parameter{
+			{Name: "@type", Value: "version"},
+		},
+	})
+
+	if err != nil {
+		return deleteError(err)
+	}
+
+	for _, doc := range docs {
+		if _, err := c.client.DeleteDocument(doc.Self, requestOptions(ctx, id)...); err != nil && !isRequestError(err, notFound) {
+			return deleteError(err)
+		}
+	}
+
+	version, err := c.getVersion(ctx, id)
+	if err != nil {
+		return deleteError(err)
+	}
+
+	if version != nil {
+		if _, err := c.client.DeleteDocument(version.Self, requestOptions(ctx, id)...); err != nil && !isRequestError(err, notFound) {
+			return deleteError(err)
+		}
+	}
+
+	return nil
+}
+
+func (c *cosmosdb) SaveSnapshot(id string, version int64, state interface{}) error {
+	return c.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (c *cosmosdb) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	latest, err := c.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("CosmosDB eventstore: version %v of entity %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	snapshot := cosmossnapshot{
+		ID:       makeSnapshotID(id),
+		EntityID: id,
+		Version:  version,
+		Type:     "snapshot",
+		Data:     &store.Snapshot{ID: id, Version: version, State: state},
+	}
+
+	// the snapshot document is only replaced by a snapshot of a newer version, guarded by its ETag
+	return c.retryPolicy.Retry(ctx, func() error {
+		existing, err := c.getSnapshot(ctx, id)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to load snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		if existing != nil && existing.Version >= version {
+			return nil
+		}
+
+		options := requestOptions(ctx, id)
+
+		if existing != nil {
+			_, err = c.client.UpsertDocument(c.container.Self, &snapshot, append(options, documentdb.IfMatch(existing.Etag))...)
+		} else {
+			_, err = c.client.CreateDocument(c.container.Self, &snapshot, options...)
+		}
+
+		if isRequestError(err, conflict) || isRequestError(err, preconditionFailed) {
+			return store.EventStoreError{
+				Text:       "snapshot has changed concurrently",
+				ErrorType:  store.VersionConflict,
+				InnerError: err,
+			}
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to save snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	}, store.Retryable(store.None, isTransient))
+}
+
+func (c *cosmosdb) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return c.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (c *cosmosdb) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	snapshot, err := c.getSnapshot(ctx, id)
+
+	if err != nil {
+		return nil, loadError("failed to load snapshot of entity", err)
+	}
+
+	if snapshot == nil {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("CosmosDB eventstore: there is no snapshot of entity %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return snapshot.Data, nil
+}
+
+// getSnapshot returns the snapshot document of an entity, or nil if there is none
+func (c *cosmosdb) getSnapshot(ctx context.Context, id string) (*cosmossnapshot, error) {
+	snapshots := []cosmossnapshot{}
+	_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
+		Parameters: []documentdb.Parameter{
+			{Name: "@id", Value: makeSnapshotID(id)},
+			{Name: "@type", Value: "snapshot"},
+		},
+	}, &snapshots, requestOptions(ctx, id)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, nil
+	}
+
+	return &snapshots[0], nil
+}
+
+// Subscribe delivers the entities of the log of all entities starting at fromPosition to handler, see store.Subscriber.
+// It catches up with the log by position and then follows the change feed of the log partition, which
+// delivers the log entries as they are completed, in any order. The log is only queried again, if the
+// change feed leaves a gap for longer than pollInterval: a write that is still pending, or log entries
+// that were removed, as the change feed doesn't contain deletes. The position of the last handled entity
+// is all that is needed to resume a subscription, the change feed starts at the time of the catch up.
+// The change feed is read every pollInterval when it has no changes, up to pollBatchSize entries at once.
+func (c *cosmosdb) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	var feed *logFeed
+	// completed log entries from the change feed by position, that wait for the entries in front of them
+	completed := map[int64]store.Entity{}
+
+	for {
+		// catch up with the log
+		for {
+			entities, readAt, err := c.readLog(ctx, position, c.subscriber.BatchSize())
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+
+			// the timestamps only have a resolution of seconds
+			if feed == nil {
+				feed = &logFeed{since: readAt.Add(-time.Second)}
+			}
+
+			for _, entity := range entities {
+				if err := handler(ctx, entity); err != nil {
+					return err
+				}
+
+				position = entity.Position + 1
+			}
+
+			// less than a full batch means the subscription has caught up with the log
+			if len(entities) < c.subscriber.BatchSize() {
+				break
+			}
+		}
+
+		for p := range completed {
+			if p < position {
+				delete(completed, p)
+			}
+		}
+
+		// follow the change feed, until it leaves a gap
+		progressed := time.Now()
+
+		for {
+			entries, err := c.readLogFeed(ctx, feed, c.subscriber.BatchSize())
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+
+			for _, e := range entries {
+				if e.Type == "log" && !e.Pending && e.Version >= position {
+					completed[e.Version] = *e.Data
+				}
+			}
+
+			for {
+				entity, ok := completed[position]
+				if !ok {
+					break
+				}
+
+				if err := handler(ctx, entity); err != nil {
+					return err
+				}
+
+				delete(completed, position)
+				position = entity.Position + 1
+				progressed = time.Now()
+			}
+
+			if len(completed) == 0 {
+				progressed = time.Now()
+			} else if time.Since(progressed) >= c.subscriber.Interval() {
+				break
+			}
+
+			// a full batch means there are probably more changes
+			if len(entries) == c.subscriber.BatchSize() {
+				continue
+			}
+
+			timer := time.NewTimer(c.subscriber.Interval())
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// logFeed is the state of a subscription in the change feed of the log partition. The change feed is read
+// from the time since, until its first changes are read, then from the ETag of the last changes.
+type logFeed struct {
+	since time.Time
+	etag  string
+}
+
+// readLogFeed reads the next changes of the log partition from its change feed, up to maxCount documents.
+// A document is contained once with its latest state, even if it was changed several times.
+func (c *cosmosdb) readLogFeed(ctx context.Context, feed *logFeed, maxCount int) ([]cosmosentity, error) {
+	options := append(requestOptions(ctx, logID), documentdb.ChangeFeed(), documentdb.Limit(maxCount))
+
+	if feed.etag != "" {
+		options = append(options, documentdb.IfNoneMatch(feed.etag))
+	} else {
+		options = append(options, documentdb.IfModifiedSince(feed.since.UTC().Format(http.TimeFormat)))
+	}
+
+	entries := []cosmosentity{}
+	resp, err := c.client.ReadDocuments(c.container.Self, &entries, options...)
+
+	if isNotModified(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to read change feed of log",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		feed.etag = etag
+	}
+
+	return entries, nil
+}
+
+// deduplicate looks up the event ID documents of entities and the entities they refer to, see store.Deduplicate
+func (c *cosmosdb) deduplicate(ctx context.Context, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		eventIDs := []cosmosdbentityversion{}
+		_, err := c.client.QueryDocuments(c.container.Self, &documentdb.Query{
+			Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
+			Parameters: []documentdb.Parameter{
+				{Name: "@id", Value: makeEventID(id, eventID)},
+				{Name: "@type", Value: "eventid"},
+			},
+		}, &eventIDs, requestOptions(ctx, id)...)
+
+		if err != nil {
+			return nil, loadError("failed to load event id", err)
+		}
+
+		if len(eventIDs) == 0 {
+			return nil, nil
+		}
+
+		entity, err := c.GetByVersionContext(ctx, id, eventIDs[0].Version)
+		if err != nil {
+			return nil, err
+		}
+
+		// entities that were stored before their positions were reserved don't carry them
+		if entity.Position == 0 {
+			entity.Position, err = c.logPosition(ctx, id, eventIDs[0].Version)
+		}
+
+		return entity, err
+	})
+}
+
+// logPosition returns the position of a version of an entity in the log of all entities,
+// or 0 if it is missing in the log. The log may keep the documents of entities, that were hard deleted
+// before hard deletes removed them, so the latest position is the one of the current entity.
+func (c *cosmosdb) logPosition(ctx context.Context, id string, version int64) (int64, error) {
+	entries, err := c.queryEntities(ctx, logID, &documentdb.Query{
+		Query: fmt.Sprintf("SELECT TOP 1 * FROM ROOT r WHERE r.type=@type and r.data.id=@id and r.data.version=%d ORDER BY r.version DESC", version),
+		Parameters: []documentdb.Parameter{
+			{Name: "@type", Value: "log"},
+			{Name: "@id", Value: id},
+		},
+	})
+
+	if err != nil {
+		return 0, loadError("failed to load position of entity", err)
+	}
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	// in the log partition the version of a document is its position
+	return entries[0].Version, nil
+}
+
+// queryEntities runs a query within the partition of an entity and reads all result pages
+func (c *cosmosdb) queryEntities(ctx context.Context, id string, query *documentdb.Query) ([]cosmosentity, error) {
+	result, _, err := c.queryEntitiesAt(ctx, id, query)
+	return result, err
+}
+
+// queryEntitiesAt runs a query like queryEntities, and also returns the time of CosmosDB, when it answered
+// the first page
+func (c *cosmosdb) queryEntitiesAt(ctx context.Context, id string, query *documentdb.Query) ([]cosmosentity, time.Time, error) {
+	result := []cosmosentity{}
+	continuation := ""
+	var now time.Time
+
+	for {
+		page := []cosmosentity{}
+
+		options := append(requestOptions(ctx, id), documentdb.Continuation(continuation))
+
+		resp, err := c.client.QueryDocuments(c.container.Self, query, &page, options...)
+
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		if now.IsZero() {
+			now = serverTime(resp)
+		}
+
+		result = append(result, page...)
+
+		if resp == nil || resp.Continuation() == "" {
+			return result, now, nil
+		}
+
+		continuation = resp.Continuation()
+	}
+}
+
+// appendBatch appends entities with consecutive versions in one transaction, the entity is only created if create is set
+func (c *cosmosdb) appendBatch(ctx context.Context, id string, expectedVersion int64, create bool, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) == 0 {
+		version, err := c.GetLatestVersionNumberContext(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if version != expectedVersion {
+			return nil, store.EventStoreError{
+				Text:       "entity has gone stale, a newer version already exists",
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		return entities, nil
+	}
+
+	result, err := c.write(ctx, id, expectedVersion, create, entities)
+
+	var evterr store.EventStoreError
+	if errors.As(err, &evterr) {
+		return nil, err
+	} else if isRequestError(err, conflict) || isRequestError(err, preconditionFailed) {
+		// a concurrent writer created the same versions, the stored procedure was rolled back
+		return nil, store.EventStoreError{
+			Text:       "entity has gone stale, a newer version already exists",
+			ErrorType:  store.VersionConflict,
+			InnerError: err,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to append entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	switch result.Status {
+	case sprocStatusOk:
+		return entities, nil
+	case sprocStatusDeleted:
+		return nil, store.StreamDeletedError(id)
+	case sprocStatusNotFound:
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("CosmosDB eventstore: Version for %s not found", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	default:
+		return nil, store.EventStoreError{
+			Text:       "entity has gone stale, a newer version already exists",
+			ErrorType:  store.VersionConflict,
+			InnerError: nil,
+		}
+	}
+}
+
+// write stores entities with consecutive versions after expectedVersion with the stored procedure, create creates
+// the entity, which must not exist yet. Otherwise the entity must exist. The positions of the entities are reserved in the log of all entities first,
+// the log entries are pending until the entities are stored. If they can't be completed afterwards, the next
+// reader of the log completes them, see resolve. The errors of the stored procedure are returned as they are.
+func (c *cosmosdb) write(ctx context.Context, id string, expectedVersion int64, create bool, entities []*store.Entity) (*sprocresult, error) {
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = expectedVersion + int64(i) + 1
+		entity.Position = 0
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+	}
+
+	first, err := c.reserve(ctx, entities)
+	if err != nil {
+		return nil, err
+	}
+
+	cosmosEntities := make([]cosmosentity, len(entities))
+
+	for i, entity := range entities {
+		cosmosEntities[i] = cosmosentity{
+			ID:        makeEntityVersion(id, entity.Version),
+			EntityID:  id,
+			Version:   entity.Version,
+			Metadata:  entity.Metadata,
+			CreatedAt: entity.System.CreatedAt.UnixMicro(),
+			Data:      entity,
+			Type:      "entity",
+		}
+	}
+
+	result, err := c.appendEntities(ctx, id, expectedVersion, create, cosmosEntities)
+	if err != nil {
+		// the stored procedure may have gone through, even if its response got lost
+		position, aborted, aerr := c.abort(ctx, id, first)
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		if !position.Aborted {
+			_ = c.completeLog(ctx, first, true)
+			return &sprocresult{Status: sprocStatusOk, Version: expectedVersion + int64(len(entities))}, nil
+		}
+
+		_ = c.completeLog(ctx, first, false)
+
+		if !aborted {
+			return nil, store.EventStoreError{
+				Text:       "the write was aborted by a reader of the log of all entities",
+				ErrorType:  store.InternalError,
+				InnerError: errAborted,
+			}
+		}
+
+		return nil, err
+	}
+
+	// log entries that can't be completed here are completed by the next reader of the log
+	_ = c.completeLog(ctx, first, result.Status == sprocStatusOk)
+	return result, nil
+}
+
+// reserve reserves positions in the log of all entities for entities, that are about to be stored,
+// and sets their positions. It returns the position of the first entity.
+func (c *cosmosdb) reserve(ctx context.Context, entities []*store.Entity) (int64, error) {
+	result, err := c.appendLog(ctx, entities)
+
+	if isRequestError(err, conflict) || isRequestError(err, preconditionFailed) {
+		// a concurrent writer took the same positions, the stored procedure was rolled back
+		return 0, store.EventStoreError{
+			Text:       "log has changed concurrently",
+			ErrorType:  store.InternalError,
+			InnerError: fmt.Errorf("%w: %v", errLogChanged, err),
+		}
+	} else if err != nil {
+		return 0, store.EventStoreError{
+			Text:       "failed to append log entries",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	// the stored procedure returns the position of the last entity
+	first := result.Version - int64(len(entities)) + 1
+
+	for i, entity := range entities {
+		entity.Position = first + int64(i)
+	}
+
+	return first, nil
+}
+
+// abort aborts the write of the entity with the given id, whose log entries start at first, unless its entities
+// were stored. It creates an aborted position document for the write, that conflicts with the position document
+// the stored procedure creates with the entities. It returns the position document of the write and if the write
+// was aborted by this call.
+func (c *cosmosdb) abort(ctx context.Context, id string, first int64) (*cosmosposition, bool, error) {
+	position := &cosmosposition{
+		ID:       makePositionID(id, first),
+		EntityID: id,
+		Type:     "position",
+		First:    first,
+		Aborted:  true,
+	}
+
+	_, err := c.client.CreateDocument(c.container.Self, position, requestOptions(ctx, id)...)
+	if err == nil {
+		return position, true, nil
+	} else if !isRequestError(err, conflict) {
+		return nil, false, store.EventStoreError{
+			Text:       "failed to abort write",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	positions := []cosmosposition{}
+	_, err = c.client.QueryDocuments(c.container.Self, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type",
+		Parameters: []documentdb.Parameter{
+			{Name: "@id", Value: makePositionID(id, first)},
+			{Name: "@type", Value: "position"},
+		},
+	}, &positions, requestOptions(ctx, id)...)
+
+	if err != nil {
+		return nil, false, loadError("failed to load position of write", err)
+	}
+
+	// the entity was hard deleted in between
+	if len(positions) == 0 {
+		return position, false, nil
+	}
+
+	return &positions[0], false, nil
+}
+
+// resolve completes the pending log entries of a write of the entity with the given id, that reserved the
+// positions starting at first. It aborts the write, unless its entities were stored, and returns if they were.
+func (c *cosmosdb) resolve(ctx context.Context, id string, first int64) (bool, error) {
+	position, _, err := c.abort(ctx, id, first)
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.completeLog(ctx, first, !position.Aborted); err != nil {
+		return false, store.EventStoreError{
+			Text:       "failed to complete log entries",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return !position.Aborted, nil
+}
+
+// serverTime returns the time of CosmosDB from the date of a response, or the local time if it has none
+func serverTime(resp *documentdb.Response) time.Time {
+	if resp != nil {
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			return date
+		}
+	}
+
+	return time.Now()
+}
+
+// loadError returns the error for a failed read, only a missing resource means that the entity was not found
+func loadError(text string, err error) store.EventStoreError {
+	if isRequestError(err, notFound) {
+		return store.EventStoreError{
+			Text:       text,
+			ErrorType:  store.EntityNotFound,
+			InnerError: err,
+		}
+	}
+
+	return store.EventStoreError{
+		Text:       text,
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// checkID checks that id is not the id of the partition of the log of all entities
+func checkID(id string) error {
+	if id == logID {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("CosmosDB eventstore: the id %s is reserved for the log of all entities", logID),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	return nil
+}
+
+// deleteError returns the error for a failed delete
+func deleteError(err error) store.EventStoreError {
+	return store.EventStoreError{
+		Text:       "failed to delete entity",
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// isTransient checks if a request failed because of throttling, a timeout or an unavailable service
+func isTransient(err error) bool {
+	var rqerror *documentdb.RequestError
+	if errors.As(err, &rqerror) {
+		switch rqerror.Code {
+		case tooManyRequests, requestTimeout, serviceUnavailable, internalServerError:
+			return true
+		}
+
+		return false
+	}
+
+	// the request didn't reach CosmosDB or the response got lost
+	var urlerror *url.Error
+	if errors.As(err, &urlerror) {
+		return true
+	}
+
+	// the write can be repeated with new positions
+	return errors.Is(err, errAborted) || errors.Is(err, errLogChanged)
+}
+
+// isRequestError checks if err is a CosmosDB request error with the given code
+func isRequestError(err error, code string) bool {
+	var rqerror *documentdb.RequestError
+	if errors.As(err, &rqerror) {
+		return rqerror.Code == code
+	}
+
+	return false
+}
+
+// isNotModified checks if a read of the change feed failed, as there are no changes. The response has
+// the status 304 without a body, so the request error has no code.
+func isNotModified(err error) bool {
+	var rqerror *documentdb.RequestError
+	if errors.As(err, &rqerror) {
+		return rqerror.Code == ""
+	}
+
+	return false
+}
+
+// requestOptions returns the options for a request within the partition of an entity
+func requestOptions(ctx context.Context, id string) []documentdb.CallOption {
+	return []documentdb.CallOption{
+		documentdb.PartitionKey(id),
+		withContext(ctx),
+	}
+}
+
+// withContext passes ctx to the HTTP request that is sent to CosmosDB
+func withContext(ctx context.Context) documentdb.CallOption {
+	return func(r *documentdb.Request) error {
+		r.Request = r.Request.WithContext(ctx)
+		return nil
+	}
+}
+
+func makeEntityVersion(id string, version int64) string {
 	return fmt.Sprintf("%s--%d", id, version)
 }
+
+func makeEventID(id, eventID string) string {
+	return fmt.Sprintf("%s--eventid--%s", id, eventID)
+}
+
+func makePositionID(id string, first int64) string {
+	return fmt.Sprintf("%s--position--%d", id, first)
+}
+
+func makeSnapshotID(id string) string {
+	return fmt.Sprintf("%s--snapshot", id)
+}
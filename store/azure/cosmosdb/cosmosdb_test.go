@@ -1,10 +1,17 @@
 package cosmosdb
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/a8m/documentdb"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -23,6 +30,13 @@ func init() {
 	containerFlag = flag.String("container", "", "CosmosDb container name")
 }
 
+// skipWithoutAccount skips a test, that needs a CosmosDB account, if none is configured
+func skipWithoutAccount(t *testing.T) {
+	if *urlFlag == "" {
+		t.Skip("no CosmosDB account configured")
+	}
+}
+
 func initMetadata() store.Metadata {
 	metadata := store.Metadata{
 		Properties: map[string]string{
@@ -35,7 +49,17 @@ func initMetadata() store.Metadata {
 	return metadata
 }
 
+// deleteAfterTest hard deletes an entity when the test has finished, so that test runs against
+// an account don't leave documents behind
+func deleteAfterTest(t *testing.T, s store.EventStore, id string) {
+	t.Cleanup(func() {
+		assert.Nil(t, s.Delete(id, store.Any, true))
+	})
+}
+
 func TestInit(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -44,6 +68,8 @@ func TestInit(t *testing.T) {
 }
 
 func TestAdd(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -58,6 +84,9 @@ func TestAdd(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -65,6 +94,8 @@ func TestAdd(t *testing.T) {
 }
 
 func TestAppend(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -79,6 +110,9 @@ func TestAppend(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -94,6 +128,8 @@ func TestAppend(t *testing.T) {
 }
 
 func TestAppendOptimisticConcurrencyControl(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -108,6 +144,9 @@ func TestAppendOptimisticConcurrencyControl(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -129,6 +168,8 @@ func TestAppendOptimisticConcurrencyControl(t *testing.T) {
 }
 
 func TestGetLastestVersionNumber(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -143,6 +184,9 @@ func TestGetLastestVersionNumber(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -154,6 +198,8 @@ func TestGetLastestVersionNumber(t *testing.T) {
 }
 
 func TestGetByVersion(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -168,6 +214,9 @@ func TestGetByVersion(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -194,6 +243,8 @@ func TestGetByVersion(t *testing.T) {
 }
 
 func TestGetByVersionRange(t *testing.T) {
+	skipWithoutAccount(t)
+
 	metadata := initMetadata()
 	cosmos := NewStore()
 
@@ -208,6 +259,9 @@ func TestGetByVersionRange(t *testing.T) {
 	}
 
 	e, err := cosmos.Add(&entity)
+	if err == nil {
+		deleteAfterTest(t, cosmos, entity.ID)
+	}
 
 	assert.Nil(t, err)
 	assert.NotNil(t, entity)
@@ -239,3 +293,576 @@ func TestGetByVersionRange(t *testing.T) {
 	assert.NotNil(t, result)
 	assert.Equal(t, 3, len(result))
 }
+
+func TestConformance(t *testing.T) {
+	skipWithoutAccount(t)
+
+	storetest.RunConformance(t, func() store.EventStore {
+		cosmos := NewStore()
+		err := cosmos.Init(initMetadata())
+		assert.Nil(t, err)
+		return cosmos
+	})
+}
+
+func TestConformanceFake(t *testing.T) {
+	_, metadata := newFakeCosmos(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+
+	storetest.RunConformance(t, func() store.EventStore {
+		cosmos := NewStore()
+		err := cosmos.Init(metadata)
+		assert.Nil(t, err)
+		return cosmos
+	})
+}
+
+// newFakeStore returns a store connected to a new fake, that gives up after three quick attempts
+func newFakeStore(t *testing.T) (*fakeCosmos, store.EventStore) {
+	fake, metadata := newFakeCosmos(t)
+	metadata.Properties[store.RetryMaxAttempts] = "3"
+	metadata.Properties[store.RetryBaseDelay] = "1ms"
+
+	cosmos := NewStore()
+	err := cosmos.Init(metadata)
+	assert.Nil(t, err)
+
+	return fake, cosmos
+}
+
+func TestAddIsAtomic(t *testing.T) {
+	for _, failType := range []string{"entity", "version"} {
+		fake, cosmos := newFakeStore(t)
+
+		fake.setFailCreate(func(doc fakeDocument) bool {
+			return doc["type"] == failType
+		})
+
+		entity := store.Entity{
+			ID:       uuid.New().String(),
+			Version:  0,
+			Metadata: "AddedEvent",
+			Data:     "Hello World",
+		}
+
+		e, err := cosmos.Add(&entity)
+		assert.NotNil(t, err)
+		assert.Nil(t, e)
+
+		// neither the version nor the entity document was stored
+		assert.Equal(t, 0, len(fake.documents(entity.ID, "entity", "version")))
+
+		_, err = cosmos.GetLatestVersionNumber(entity.ID)
+		evterr, ok := err.(store.EventStoreError)
+		assert.True(t, ok)
+		assert.Equal(t, store.EntityNotFound, evterr.ErrorType)
+
+		// the stream can be created once the failure is gone
+		fake.setFailCreate(nil)
+
+		e, err = cosmos.Add(&entity)
+		assert.Nil(t, err)
+		assert.NotNil(t, e)
+		assert.Equal(t, int64(1), e.Version)
+		assert.Equal(t, 2, len(fake.documents(entity.ID, "entity", "version")))
+
+		e, err = cosmos.Append(&entity, store.Optimistic)
+		assert.Nil(t, err)
+		assert.NotNil(t, e)
+		assert.Equal(t, int64(2), e.Version)
+	}
+}
+
+func TestAppendRetriesTransientErrors(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	// the first execution is throttled
+	executions := 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			executions++
+			if executions == 1 {
+				return errFakeTooManyRequests
+			}
+		}
+		return nil
+	})
+
+	e, err := cosmos.Append(&entity, store.Optimistic)
+	assert.Nil(t, err)
+	assert.NotNil(t, e)
+	assert.Equal(t, int64(2), e.Version)
+	assert.Equal(t, 2, executions)
+
+	// every execution is throttled
+	executions = 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			executions++
+			return errFakeTooManyRequests
+		}
+		return nil
+	})
+
+	e, err = cosmos.Append(&entity, store.None)
+	assert.Nil(t, e)
+	assert.Equal(t, 3, executions)
+
+	evterr, ok := err.(store.EventStoreError)
+	assert.True(t, ok)
+	assert.Equal(t, store.RetriesExhausted, evterr.ErrorType)
+
+	// errors that are not transient are not retried
+	executions = 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			executions++
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	e, err = cosmos.Append(&entity, store.None)
+	assert.Nil(t, e)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, executions)
+
+	evterr, ok = err.(store.EventStoreError)
+	assert.True(t, ok)
+	assert.Equal(t, store.InternalError, evterr.ErrorType)
+
+	fake.setFailRequest(nil)
+
+	version, err := cosmos.GetLatestVersionNumber(entity.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+// readAllOf returns the versions of id in the log of all entities
+func readAllOf(t *testing.T, s store.EventStore, id string) []int64 {
+	entities, err := s.ReadAll(1, 1000)
+	assert.Nil(t, err)
+
+	versions := []int64{}
+	for _, e := range entities {
+		if e.ID == id {
+			versions = append(versions, e.Version)
+		}
+	}
+	return versions
+}
+
+func TestLogIsCompletedByReaders(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+	cosmos.(*cosmosdb).pendingTimeout = 0
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	// the log entries stay pending, as the write can't complete them
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, completeLogSprocID) {
+			return errFakeUnavailable
+		}
+		return nil
+	})
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	for _, doc := range fake.documents(logID, "log") {
+		assert.Equal(t, true, doc["pending"])
+	}
+
+	// the reader completes the log entry of the stored entity
+	assert.Equal(t, []int64{1}, readAllOf(t, cosmos, entity.ID))
+
+	for _, doc := range fake.documents(logID, "log") {
+		assert.Equal(t, false, doc["pending"])
+	}
+
+}
+
+func TestSubscribeDeliversPendingWrites(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+	cosmos.(*cosmosdb).pendingTimeout = 0
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	// the log entry of the stored entity stays pending
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, completeLogSprocID) {
+			return errFakeUnavailable
+		}
+		return nil
+	})
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	delivered := 0
+	err = cosmos.(store.Subscriber).Subscribe(ctx, 1, func(ctx context.Context, e store.Entity) error {
+		if e.ID == entity.ID {
+			delivered++
+			cancel()
+		}
+		return nil
+	})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, delivered)
+}
+
+// nextPosition returns the position of the next entity that is delivered by a subscription
+func nextPosition(ctx context.Context, t *testing.T, delivered <-chan int64) int64 {
+	select {
+	case position := <-delivered:
+		return position
+	case <-ctx.Done():
+		t.Fatal("no entity was delivered")
+		return 0
+	}
+}
+
+func TestSubscribeFollowsChangeFeed(t *testing.T) {
+	fake, metadata := newFakeCosmos(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+
+	cosmos := NewStore()
+	err := cosmos.Init(metadata)
+	assert.Nil(t, err)
+
+	var logQueries, feedReads int32
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if key, _ := partitionKey(r); key == logID {
+			if r.Header.Get(documentdb.HeaderIsQuery) == "true" {
+				atomic.AddInt32(&logQueries, 1)
+			} else if r.Header.Get(documentdb.HeaderAIM) != "" {
+				atomic.AddInt32(&feedReads, 1)
+			}
+		}
+		return nil
+	})
+
+	add := func() {
+		_, err := cosmos.Add(&store.Entity{ID: uuid.New().String(), Data: "Hello World"})
+		assert.Nil(t, err)
+	}
+
+	add()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	delivered := make(chan int64, 10)
+	go func() {
+		_ = cosmos.(store.Subscriber).Subscribe(ctx, 1, func(ctx context.Context, e store.Entity) error {
+			delivered <- e.Position
+			return nil
+		})
+	}()
+
+	// the stored entity is read from the log
+	assert.Equal(t, int64(1), nextPosition(ctx, t, delivered))
+
+	// new entities are read from the change feed, the log is not queried anymore
+	atomic.StoreInt32(&logQueries, 0)
+
+	for i := 0; i < 3; i++ {
+		add()
+	}
+
+	for position := int64(2); position <= 4; position++ {
+		assert.Equal(t, position, nextPosition(ctx, t, delivered))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&logQueries))
+	assert.Greater(t, atomic.LoadInt32(&feedReads), int32(1))
+}
+
+func TestSubscribeFillsGapsInChangeFeed(t *testing.T) {
+	fake, metadata := newFakeCosmos(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+
+	cosmos := NewStore()
+	err := cosmos.Init(metadata)
+	assert.Nil(t, err)
+	cosmos.(*cosmosdb).pendingTimeout = 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	delivered := make(chan int64, 10)
+	go func() {
+		_ = cosmos.(store.Subscriber).Subscribe(ctx, 1, func(ctx context.Context, e store.Entity) error {
+			delivered <- e.Position
+			return nil
+		})
+	}()
+
+	// the log entry of the first entity stays pending, so the change feed only contains the second one
+	var feedReads int32
+	failComplete := int32(1)
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if r.Header.Get(documentdb.HeaderAIM) != "" {
+			atomic.AddInt32(&feedReads, 1)
+		} else if isSprocExecution(r, completeLogSprocID) && atomic.LoadInt32(&failComplete) == 1 {
+			return errFakeUnavailable
+		}
+		return nil
+	})
+
+	// the subscription has caught up with the empty log and follows the change feed
+	for atomic.LoadInt32(&feedReads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = cosmos.Add(&store.Entity{ID: uuid.New().String(), Data: "Hello World"})
+	assert.Nil(t, err)
+
+	atomic.StoreInt32(&failComplete, 0)
+
+	_, err = cosmos.Add(&store.Entity{ID: uuid.New().String(), Data: "Hello World"})
+	assert.Nil(t, err)
+
+	// the subscription reads the log to resolve the pending entry
+	assert.Equal(t, int64(1), nextPosition(ctx, t, delivered))
+	assert.Equal(t, int64(2), nextPosition(ctx, t, delivered))
+}
+
+func TestPendingLogEntriesExpireByServerTime(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	// the clock of CosmosDB is an hour behind the local clock
+	fake.setSkew(-time.Hour)
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	// the log entry of the stored entity stays pending
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, completeLogSprocID) {
+			return errFakeUnavailable
+		}
+		return nil
+	})
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	// the entry was written just now by the clock of CosmosDB, so the write is not resolved yet
+	assert.Equal(t, []int64{}, readAllOf(t, cosmos, entity.ID))
+
+	for _, doc := range fake.documents(logID, "log") {
+		assert.Equal(t, true, doc["pending"])
+	}
+}
+
+func TestLogFollowsLostResponses(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+	cosmos.(*cosmosdb).pendingTimeout = 0
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	// the entities are stored, but the response gets lost
+	fake.setFailResponse(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			return errFakeUnavailable
+		}
+		return nil
+	})
+
+	e, err := cosmos.Append(&entity, store.None)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+
+	fake.setFailResponse(nil)
+
+	// the entities are not stored and the failure is not transient
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	_, err = cosmos.Append(&entity, store.None)
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	fake.setFailRequest(nil)
+
+	e, err = cosmos.Append(&entity, store.None)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), e.Version)
+
+	// every stored entity is in the log exactly once, the aborted write is not
+	assert.Equal(t, []int64{1, 2, 3}, readAllOf(t, cosmos, entity.ID))
+
+	version, err := cosmos.GetLatestVersionNumber(entity.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), version)
+}
+
+func TestPendingLogEntriesAreAbortedByReaders(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	// a reader aborts the write, while its positions are reserved
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isSprocExecution(r, appendEntitiesSprocID) {
+			fake.mutex.Unlock()
+			defer fake.mutex.Lock()
+
+			cosmos.(*cosmosdb).pendingTimeout = 0
+			assert.Equal(t, []int64{1}, readAllOf(t, cosmos, entity.ID))
+			cosmos.(*cosmosdb).pendingTimeout = time.Hour
+
+			fake.failRequest = nil
+		}
+		return nil
+	})
+
+	// the aborted write is retried
+	e, err := cosmos.Append(&entity, store.None)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+
+	assert.Equal(t, []int64{1, 2}, readAllOf(t, cosmos, entity.ID))
+}
+
+func TestLargeWriteIsCompleted(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	// the stored procedures read the log entries of the write in several pages
+	entities := make([]*store.Entity, 2*fake.sprocPageSize+1)
+	for i := range entities {
+		entities[i] = &store.Entity{Data: "Hello World"}
+	}
+
+	id := uuid.New().String()
+	_, err := cosmos.AppendToStream(id, store.NoStream, entities)
+	assert.Nil(t, err)
+
+	logEntries := fake.documents(logID, "log")
+	assert.Equal(t, len(entities), len(logEntries))
+
+	for _, doc := range logEntries {
+		assert.Equal(t, false, doc["pending"])
+	}
+}
+
+func TestLogIDIsReserved(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	_, err := cosmos.Add(&store.Entity{ID: uuid.New().String(), Data: "Hello World"})
+	assert.Nil(t, err)
+
+	// no write reaches the partition of the log
+	_, err = cosmos.Append(&store.Entity{ID: logID, Version: 1, Data: "Hello World"}, store.None)
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	_, err = cosmos.AppendBatch(logID, 1, []*store.Entity{{Data: "Hello World"}})
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	_, err = cosmos.AppendToStream(logID, store.Any, []*store.Entity{{Data: "Hello World"}})
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	for _, doc := range fake.documents(logID) {
+		assert.NotEqual(t, "entity", doc["type"])
+	}
+}
+
+func TestReadErrorsAreMapped(t *testing.T) {
+	fake, cosmos := newFakeStore(t)
+
+	entity := store.Entity{
+		ID:   uuid.New().String(),
+		Data: "Hello World",
+	}
+
+	_, err := cosmos.Add(&entity)
+	assert.Nil(t, err)
+
+	// a failed query doesn't mean that the entity does not exist
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		return errFakeBadRequest
+	})
+
+	_, err = cosmos.GetLatestVersionNumber(entity.ID)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	var evterr store.EventStoreError
+	assert.True(t, errors.As(err, &evterr))
+	assert.Equal(t, store.InternalError, evterr.ErrorType)
+
+	_, err = cosmos.GetByVersion(entity.ID, 1)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = cosmos.GetByVersionRange(entity.ID, 1, 1)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		return errFakeNotFound
+	})
+
+	_, err = cosmos.GetByVersion(entity.ID, 1)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	fake.setFailRequest(nil)
+
+	_, err = cosmos.GetByVersion(entity.ID, 2)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = cosmos.Add(&store.Entity{ID: entity.ID})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists))
+}
+
+func TestOpenFake(t *testing.T) {
+	_, metadata := newFakeCosmos(t)
+
+	cosmos, err := store.Open(BackendName, metadata)
+	assert.Nil(t, err)
+
+	e, err := cosmos.Add(&store.Entity{ID: uuid.New().String(), Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+}
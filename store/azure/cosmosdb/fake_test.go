@@ -0,0 +1,950 @@
+package cosmosdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/a8m/documentdb"
+	"github.com/dop251/goja"
+)
+
+// fakeCosmos is an in-process stand-in for the parts of the CosmosDB REST API that are used by
+// the event store. Stored procedures run in a JavaScript interpreter, see fakeSproc, in a transaction
+// that is rolled back on failure, like in CosmosDB.
+type fakeCosmos struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	database  string
+	container string
+	sprocs    map[string]*documentdb.Sproc
+	// documents by partition key and id
+	partitions map[string]map[string]fakeDocument
+	// partition key and id of documents by resource id
+	rids    map[string][2]string
+	counter int64
+	// sprocPageSize is the number of documents a query of a stored procedure returns per page
+	sprocPageSize int
+	// skew is the difference of the clock of the fake to the local clock, it is used for the
+	// timestamps of documents and the dates of responses
+	skew time.Duration
+
+	// failCreate fails the creation of every document it returns true for
+	failCreate func(doc fakeDocument) bool
+	// failRequest fails every request it returns an error for
+	failRequest func(r *http.Request) *fakeError
+	// failResponse handles every request it returns an error for, but responds with the error,
+	// like a request whose response got lost
+	failResponse func(r *http.Request) *fakeError
+}
+
+type fakeDocument map[string]interface{}
+
+type fakeError struct {
+	status int
+	code   string
+}
+
+func (e *fakeError) Error() string {
+	return e.code
+}
+
+var (
+	errFakeConflict           = &fakeError{http.StatusConflict, "Conflict"}
+	errFakeNotFound           = &fakeError{http.StatusNotFound, "NotFound"}
+	errFakePreconditionFailed = &fakeError{http.StatusPreconditionFailed, "PreconditionFailed"}
+	errFakeBadRequest         = &fakeError{http.StatusBadRequest, "BadRequest"}
+	errFakeUnavailable        = &fakeError{http.StatusServiceUnavailable, "ServiceUnavailable"}
+	errFakeTooManyRequests    = &fakeError{http.StatusTooManyRequests, "TooManyRequests"}
+)
+
+var (
+	queryExpr     = regexp.MustCompile(`(?i)^SELECT\s+(?:TOP\s+(\d+)\s+)?(.+?)\s+FROM\s+ROOT\s+r(?:\s+WHERE\s+(.+?))?(?:\s+ORDER\s+BY\s+r\.(\w+)(?:\s+(ASC|DESC))?)?$`)
+	conditionExpr = regexp.MustCompile(`^r\.([\w.]+)\s*(=|!=|<>|>=|<=|>|<)\s*(@\w+|-?\d+|'[^']*'|"[^"]*")$`)
+	andExpr       = regexp.MustCompile(`(?i)\s+and\s+`)
+)
+
+// newFakeCosmos starts a new fake and returns the metadata to connect to it
+func newFakeCosmos(t *testing.T) (*fakeCosmos, store.Metadata) {
+	f := &fakeCosmos{
+		database:   "eventstore",
+		container:  "entities",
+		sprocs:     map[string]*documentdb.Sproc{},
+		partitions: map[string]map[string]fakeDocument{},
+		rids:       map[string][2]string{},
+		// the default of the server-side API
+		sprocPageSize: 100,
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	metadata := store.Metadata{
+		Properties: map[string]string{
+			"Url":       f.server.URL,
+			"MasterKey": base64.StdEncoding.EncodeToString([]byte("fake")),
+			"Database":  f.database,
+			"Container": f.container,
+		},
+	}
+
+	return f, metadata
+}
+
+// isSprocExecution checks if r executes the stored procedure with the given id
+func isSprocExecution(r *http.Request, id string) bool {
+	return r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/sprocs/"+id+"/")
+}
+
+// documents returns a copy of all documents in a partition
+// documents returns the documents of a partition, restricted to the given types, if there are any
+func (f *fakeCosmos) documents(partitionKey string, types ...string) []fakeDocument {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	result := []fakeDocument{}
+	for _, doc := range f.partitions[partitionKey] {
+		if len(types) > 0 && !containsString(types, doc["type"]) {
+			continue
+		}
+		result = append(result, doc)
+	}
+	return result
+}
+
+func containsString(values []string, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeCosmos) setSkew(skew time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.skew = skew
+}
+
+// now returns the time of the clock of the fake
+func (f *fakeCosmos) now() time.Time {
+	return time.Now().Add(f.skew)
+}
+
+func (f *fakeCosmos) setFailCreate(failCreate func(doc fakeDocument) bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failCreate = failCreate
+}
+
+func (f *fakeCosmos) setFailRequest(failRequest func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failRequest = failRequest
+}
+
+func (f *fakeCosmos) setFailResponse(failResponse func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failResponse = failResponse
+}
+
+func (f *fakeCosmos) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failRequest != nil {
+		if err := f.failRequest(r); err != nil {
+			f.writeError(w, err)
+			return
+		}
+	}
+
+	if f.failResponse != nil {
+		if err := f.failResponse(r); err != nil {
+			f.serve(httptest.NewRecorder(), r)
+			f.writeError(w, err)
+			return
+		}
+	}
+
+	f.serve(w, r)
+}
+
+func (f *fakeCosmos) serve(w http.ResponseWriter, r *http.Request) {
+	var body interface{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.writeError(w, errFakeBadRequest)
+			return
+		}
+	}
+
+	dbLink := fmt.Sprintf("dbs/%s/", f.database)
+	collLink := fmt.Sprintf("%scolls/%s/", dbLink, f.container)
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	isQuery := r.Header.Get(documentdb.HeaderIsQuery) == "true"
+
+	switch {
+	case path == "dbs" && isQuery:
+		f.write(w, http.StatusOK, map[string]interface{}{
+			"Databases": f.filter(body, []fakeDocument{{"id": f.database, "_self": dbLink}}),
+		})
+	case path == dbLink+"colls/" && isQuery:
+		f.write(w, http.StatusOK, map[string]interface{}{
+			"DocumentCollections": f.filter(body, []fakeDocument{{"id": f.container, "_self": collLink}}),
+		})
+	case path == collLink+"sprocs/" && isQuery:
+		sprocs := []fakeDocument{}
+		for _, sproc := range f.sprocs {
+			sprocs = append(sprocs, fakeDocument{"id": sproc.Id, "_self": sproc.Self, "body": sproc.Body})
+		}
+		f.write(w, http.StatusOK, map[string]interface{}{"StoredProcedures": f.filter(body, sprocs)})
+	case path == collLink+"sprocs/" && r.Method == http.MethodPost:
+		f.putSproc(w, http.StatusCreated, collLink, body)
+	case strings.HasPrefix(path, collLink+"sprocs/") && r.Method == http.MethodPut:
+		f.putSproc(w, http.StatusOK, collLink, body)
+	case strings.HasPrefix(path, collLink+"sprocs/") && r.Method == http.MethodPost:
+		f.executeSproc(w, r, strings.TrimSuffix(strings.TrimPrefix(path, collLink+"sprocs/"), "/"), body)
+	case path == collLink+"docs/" && r.Method == http.MethodGet && r.Header.Get(documentdb.HeaderAIM) != "":
+		f.readChangeFeed(w, r)
+	case path == collLink+"docs/" && isQuery:
+		f.queryDocuments(w, r, body)
+	case path == collLink+"docs/" && r.Method == http.MethodPost:
+		f.writeDocument(w, r, body)
+	case strings.HasPrefix(path, collLink+"docs/") && r.Method == http.MethodDelete:
+		f.deleteDocument(w, r, strings.TrimSuffix(strings.TrimPrefix(path, collLink+"docs/"), "/"))
+	default:
+		f.writeError(w, errFakeNotFound)
+	}
+}
+
+func (f *fakeCosmos) putSproc(w http.ResponseWriter, status int, collLink string, body interface{}) {
+	doc, _ := body.(map[string]interface{})
+	id, _ := doc["id"].(string)
+	sprocBody, _ := doc["body"].(string)
+
+	if id == "" {
+		f.writeError(w, errFakeBadRequest)
+		return
+	}
+
+	sproc := &documentdb.Sproc{Body: sprocBody}
+	sproc.Id = id
+	sproc.Self = fmt.Sprintf("%ssprocs/%s/", collLink, id)
+	f.sprocs[id] = sproc
+
+	f.write(w, status, sproc)
+}
+
+func (f *fakeCosmos) queryDocuments(w http.ResponseWriter, r *http.Request, body interface{}) {
+	docs := []fakeDocument{}
+
+	if pk, ok := partitionKey(r); ok {
+		for _, doc := range f.partitions[pk] {
+			docs = append(docs, doc)
+		}
+	} else {
+		for _, partition := range f.partitions {
+			for _, doc := range partition {
+				docs = append(docs, doc)
+			}
+		}
+	}
+
+	sortByRID(docs)
+
+	result, err := f.query(body, docs)
+	if err != nil {
+		f.writeError(w, err)
+		return
+	}
+
+	// page the result, the continuation token is the offset of the next page
+	offset, _ := strconv.Atoi(r.Header.Get(documentdb.HeaderContinuation))
+	if offset > len(result) {
+		offset = len(result)
+	}
+	result = result[offset:]
+
+	if limit, err := strconv.Atoi(r.Header.Get(documentdb.HeaderMaxItemCount)); err == nil && limit > 0 && limit < len(result) {
+		result = result[:limit]
+		w.Header().Set(documentdb.HeaderContinuation, strconv.Itoa(offset+limit))
+	}
+
+	f.write(w, http.StatusOK, map[string]interface{}{"Documents": result, "_count": len(result)})
+}
+
+// readChangeFeed returns the documents of a partition in the order of their last changes, that were changed
+// after the ETag in If-None-Match, or since the time in If-Modified-Since. The ETag of the response is
+// the logical sequence number of the last change, if nothing was changed, the status is 304 Not Modified.
+func (f *fakeCosmos) readChangeFeed(w http.ResponseWriter, r *http.Request) {
+	pk, ok := partitionKey(r)
+	if !ok {
+		f.writeError(w, errFakeBadRequest)
+		return
+	}
+
+	var after, since int64
+
+	if etag := r.Header.Get(documentdb.HeaderIfNonMatch); etag != "" {
+		lsn, err := strconv.ParseInt(strings.Trim(etag, "\""), 10, 64)
+		if err != nil {
+			f.writeError(w, errFakeBadRequest)
+			return
+		}
+		after = lsn
+	} else if date := r.Header.Get(documentdb.HeaderIfModifiedSince); date != "" {
+		t, err := http.ParseTime(date)
+		if err != nil {
+			f.writeError(w, errFakeBadRequest)
+			return
+		}
+		since = t.Unix()
+	}
+
+	docs := []fakeDocument{}
+	for _, doc := range f.partitions[pk] {
+		if int64(doc["_lsn"].(float64)) > after && int64(doc["_ts"].(float64)) >= since {
+			docs = append(docs, doc)
+		}
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i]["_lsn"].(float64) < docs[j]["_lsn"].(float64)
+	})
+
+	if limit, err := strconv.Atoi(r.Header.Get(documentdb.HeaderMaxItemCount)); err == nil && limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+
+	if len(docs) == 0 {
+		w.Header().Set("Date", f.now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", int64(docs[len(docs)-1]["_lsn"].(float64))))
+	f.write(w, http.StatusOK, map[string]interface{}{"Documents": docs, "_count": len(docs)})
+}
+
+func (f *fakeCosmos) writeDocument(w http.ResponseWriter, r *http.Request, body interface{}) {
+	pk, ok := partitionKey(r)
+	doc, isDoc := body.(map[string]interface{})
+	if !ok || !isDoc {
+		f.writeError(w, errFakeBadRequest)
+		return
+	}
+
+	tx := f.begin(pk)
+
+	var err *fakeError
+	status := http.StatusCreated
+
+	if r.Header.Get(documentdb.HeaderUpsert) == "true" {
+		status = http.StatusOK
+		doc, err = tx.upsert(doc, r.Header.Get(documentdb.HeaderIfMatch))
+	} else {
+		doc, err = tx.create(doc)
+	}
+
+	if err != nil {
+		f.writeError(w, err)
+		return
+	}
+
+	tx.commit()
+	f.write(w, status, doc)
+}
+
+func (f *fakeCosmos) deleteDocument(w http.ResponseWriter, r *http.Request, rid string) {
+	key, exists := f.rids[rid]
+	pk, ok := partitionKey(r)
+	if !exists || !ok || pk != key[0] {
+		f.writeError(w, errFakeNotFound)
+		return
+	}
+
+	tx := f.begin(pk)
+	if err := tx.delete(key[1], r.Header.Get(documentdb.HeaderIfMatch)); err != nil {
+		f.writeError(w, err)
+		return
+	}
+
+	tx.commit()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeCosmos) executeSproc(w http.ResponseWriter, r *http.Request, id string, body interface{}) {
+	pk, ok := partitionKey(r)
+	params, isParams := body.([]interface{})
+
+	sproc, exists := f.sprocs[id]
+	if !exists {
+		f.writeError(w, errFakeNotFound)
+		return
+	} else if !ok || !isParams {
+		f.writeError(w, errFakeBadRequest)
+		return
+	}
+
+	tx := f.begin(pk)
+
+	result, err := newFakeSproc(tx).run(sproc.Body, params)
+	if err != nil {
+		// the transaction is not committed, everything is rolled back
+		f.writeError(w, err)
+		return
+	}
+
+	tx.commit()
+	f.write(w, http.StatusOK, result)
+}
+
+// fakeSproc runs the JavaScript of a stored procedure against a transaction, with the part of the
+// server-side API that is used by the event store. Like in CosmosDB, the callback of an operation runs
+// after the function that started the operation returned, and a query returns a page of its results.
+// If the procedure throws an error with a number, that is the status of the execution.
+type fakeSproc struct {
+	tx        *fakeTransaction
+	vm        *goja.Runtime
+	callbacks []func() error
+	response  interface{}
+}
+
+func newFakeSproc(tx *fakeTransaction) *fakeSproc {
+	s := &fakeSproc{tx: tx, vm: goja.New()}
+
+	collection := s.vm.NewObject()
+	_ = collection.Set("getSelfLink", func(goja.FunctionCall) goja.Value {
+		return s.vm.ToValue(fmt.Sprintf("dbs/%s/colls/%s/", tx.fake.database, tx.fake.container))
+	})
+	_ = collection.Set("queryDocuments", s.queryDocuments)
+	_ = collection.Set("createDocument", s.createDocument)
+	_ = collection.Set("replaceDocument", s.replaceDocument)
+	_ = collection.Set("deleteDocument", s.deleteDocument)
+
+	response := s.vm.NewObject()
+	_ = response.Set("setBody", func(call goja.FunctionCall) goja.Value {
+		s.response = s.fromJS(call.Argument(0))
+		return goja.Undefined()
+	})
+
+	context := s.vm.NewObject()
+	_ = context.Set("getCollection", func(goja.FunctionCall) goja.Value { return collection })
+	_ = context.Set("getResponse", func(goja.FunctionCall) goja.Value { return response })
+	_ = s.vm.Set("getContext", func(goja.FunctionCall) goja.Value { return context })
+
+	return s
+}
+
+// run calls the function in body with params and then the scheduled callbacks, until there are none left
+func (s *fakeSproc) run(body string, params []interface{}) (interface{}, *fakeError) {
+	procedure, err := s.vm.RunString("(" + body + ")")
+	if err != nil {
+		return nil, errFakeBadRequest
+	}
+
+	call, ok := goja.AssertFunction(procedure)
+	if !ok {
+		return nil, errFakeBadRequest
+	}
+
+	args := make([]goja.Value, len(params))
+	for i, p := range params {
+		args[i] = s.toJS(p)
+	}
+
+	if _, err := call(goja.Undefined(), args...); err != nil {
+		return nil, s.thrown(err)
+	}
+
+	for len(s.callbacks) > 0 {
+		callback := s.callbacks[0]
+		s.callbacks = s.callbacks[1:]
+
+		if err := callback(); err != nil {
+			return nil, s.thrown(err)
+		}
+	}
+
+	return s.response, nil
+}
+
+// thrown returns the error for an exception of the procedure, errors of operations carry their status as number
+func (s *fakeSproc) thrown(err error) *fakeError {
+	var exception *goja.Exception
+	if !errors.As(err, &exception) {
+		return errFakeBadRequest
+	}
+
+	thrown, ok := exception.Value().(*goja.Object)
+	if !ok {
+		return errFakeBadRequest
+	}
+
+	number, code := thrown.Get("number"), thrown.Get("code")
+	if number == nil || code == nil {
+		return errFakeBadRequest
+	}
+
+	return &fakeError{status: int(number.ToInteger()), code: code.String()}
+}
+
+func (s *fakeSproc) queryDocuments(call goja.FunctionCall) goja.Value {
+	callback := call.Argument(len(call.Arguments) - 1)
+
+	query := s.fromJS(call.Argument(1))
+	if text, ok := query.(string); ok {
+		query = map[string]interface{}{"query": text}
+	}
+
+	docs := []fakeDocument{}
+	for _, doc := range s.tx.docs {
+		docs = append(docs, doc)
+	}
+	sortByRID(docs)
+
+	result, err := s.tx.fake.query(query, docs)
+	if err != nil {
+		s.schedule(callback, s.jsError(err))
+		return s.vm.ToValue(true)
+	}
+
+	options, _ := s.fromJS(call.Argument(2)).(map[string]interface{})
+
+	pageSize := s.tx.fake.sprocPageSize
+	if size, ok := options["pageSize"].(float64); ok && size > 0 {
+		pageSize = int(size)
+	}
+
+	// the continuation token is the offset of the next page
+	offset := 0
+	if continuation, ok := options["continuation"].(string); ok {
+		offset, _ = strconv.Atoi(continuation)
+	}
+	result = result[min(offset, len(result)):]
+
+	responseOptions := map[string]interface{}{}
+	if pageSize < len(result) {
+		result = result[:pageSize]
+		responseOptions["continuation"] = strconv.Itoa(offset + pageSize)
+	}
+
+	s.schedule(callback, goja.Undefined(), s.toJS(result), s.toJS(responseOptions))
+	return s.vm.ToValue(true)
+}
+
+func (s *fakeSproc) createDocument(call goja.FunctionCall) goja.Value {
+	doc, _ := s.fromJS(call.Argument(1)).(map[string]interface{})
+
+	created, err := s.tx.create(doc)
+	s.complete(call, created, err)
+
+	return s.vm.ToValue(true)
+}
+
+func (s *fakeSproc) replaceDocument(call goja.FunctionCall) goja.Value {
+	doc, _ := s.fromJS(call.Argument(1)).(map[string]interface{})
+	options, _ := s.fromJS(call.Argument(2)).(map[string]interface{})
+	etag, _ := options["etag"].(string)
+
+	existing := s.document(call.Argument(0).String())
+	if existing == nil || existing["id"] != doc["id"] {
+		s.complete(call, nil, errFakeNotFound)
+		return s.vm.ToValue(true)
+	}
+
+	replaced, err := s.tx.upsert(doc, etag)
+	s.complete(call, replaced, err)
+
+	return s.vm.ToValue(true)
+}
+
+func (s *fakeSproc) deleteDocument(call goja.FunctionCall) goja.Value {
+	options, _ := s.fromJS(call.Argument(1)).(map[string]interface{})
+	etag, _ := options["etag"].(string)
+
+	existing := s.document(call.Argument(0).String())
+	if existing == nil {
+		s.complete(call, nil, errFakeNotFound)
+		return s.vm.ToValue(true)
+	}
+
+	s.complete(call, nil, s.tx.delete(existing["id"].(string), etag))
+	return s.vm.ToValue(true)
+}
+
+// document returns the document of the transaction with the given self link
+func (s *fakeSproc) document(self string) fakeDocument {
+	for _, doc := range s.tx.docs {
+		if doc["_self"] == self {
+			return doc
+		}
+	}
+	return nil
+}
+
+// complete schedules the callback of an operation, that is its last argument
+func (s *fakeSproc) complete(call goja.FunctionCall, doc fakeDocument, err *fakeError) {
+	callback := call.Argument(len(call.Arguments) - 1)
+
+	if err != nil {
+		s.schedule(callback, s.jsError(err))
+		return
+	}
+
+	s.schedule(callback, goja.Undefined(), s.toJS(doc))
+}
+
+// jsError converts an error to the error of a callback, its number is the status
+func (s *fakeSproc) jsError(err *fakeError) goja.Value {
+	return s.toJS(map[string]interface{}{"number": err.status, "code": err.code, "message": err.Error()})
+}
+
+// schedule queues a call of callback, if it is a function
+func (s *fakeSproc) schedule(callback goja.Value, args ...goja.Value) {
+	call, ok := goja.AssertFunction(callback)
+	if !ok {
+		return
+	}
+
+	s.callbacks = append(s.callbacks, func() error {
+		_, err := call(goja.Undefined(), args...)
+		return err
+	})
+}
+
+// toJS converts a JSON value to JavaScript
+func (s *fakeSproc) toJS(value interface{}) goja.Value {
+	raw, _ := json.Marshal(value)
+
+	parse, _ := goja.AssertFunction(s.vm.Get("JSON").ToObject(s.vm).Get("parse"))
+	result, _ := parse(goja.Undefined(), s.vm.ToValue(string(raw)))
+
+	return result
+}
+
+// fromJS converts a JavaScript value to JSON, numbers are float64 as in documents of requests
+func (s *fakeSproc) fromJS(value goja.Value) interface{} {
+	stringify, _ := goja.AssertFunction(s.vm.Get("JSON").ToObject(s.vm).Get("stringify"))
+	raw, err := stringify(goja.Undefined(), value)
+	if err != nil || goja.IsUndefined(raw) {
+		return nil
+	}
+
+	var result interface{}
+	_ = json.Unmarshal([]byte(raw.String()), &result)
+
+	return result
+}
+
+// fakeTransaction collects the changes to a partition, the changes are applied by commit
+type fakeTransaction struct {
+	fake         *fakeCosmos
+	partitionKey string
+	docs         map[string]fakeDocument
+}
+
+func (f *fakeCosmos) begin(partitionKey string) *fakeTransaction {
+	docs := map[string]fakeDocument{}
+	for id, doc := range f.partitions[partitionKey] {
+		docs[id] = doc
+	}
+
+	return &fakeTransaction{fake: f, partitionKey: partitionKey, docs: docs}
+}
+
+func (tx *fakeTransaction) create(doc fakeDocument) (fakeDocument, *fakeError) {
+	id, _ := doc["id"].(string)
+	if id == "" {
+		return nil, errFakeBadRequest
+	}
+
+	if _, exists := tx.docs[id]; exists {
+		return nil, errFakeConflict
+	}
+
+	if tx.fake.failCreate != nil && tx.fake.failCreate(doc) {
+		return nil, errFakeUnavailable
+	}
+
+	return tx.put(doc), nil
+}
+
+func (tx *fakeTransaction) upsert(doc fakeDocument, ifMatch string) (fakeDocument, *fakeError) {
+	id, _ := doc["id"].(string)
+	if id == "" {
+		return nil, errFakeBadRequest
+	}
+
+	existing, exists := tx.docs[id]
+	if ifMatch != "" && (!exists || existing["_etag"] != ifMatch) {
+		return nil, errFakePreconditionFailed
+	}
+
+	return tx.put(doc), nil
+}
+
+func (tx *fakeTransaction) delete(id, ifMatch string) *fakeError {
+	existing, exists := tx.docs[id]
+	if !exists {
+		return errFakeNotFound
+	} else if ifMatch != "" && existing["_etag"] != ifMatch {
+		return errFakePreconditionFailed
+	}
+
+	delete(tx.docs, id)
+	return nil
+}
+
+func (tx *fakeTransaction) put(doc fakeDocument) fakeDocument {
+	tx.fake.counter++
+
+	stored := fakeDocument{}
+	for k, v := range doc {
+		stored[k] = v
+	}
+
+	// a replaced document keeps its resource id
+	rid := fmt.Sprintf("rid%d", tx.fake.counter)
+	if existing, exists := tx.docs[stored["id"].(string)]; exists {
+		rid = existing["_rid"].(string)
+	}
+
+	stored["_rid"] = rid
+	stored["_self"] = fmt.Sprintf("dbs/%s/colls/%s/docs/%s/", tx.fake.database, tx.fake.container, rid)
+	stored["_etag"] = fmt.Sprintf("\"%d\"", tx.fake.counter)
+	stored["_ts"] = float64(tx.fake.now().Unix())
+	// the logical sequence number orders the changes in the change feed
+	stored["_lsn"] = float64(tx.fake.counter)
+
+	tx.docs[stored["id"].(string)] = stored
+	return stored
+}
+
+func (tx *fakeTransaction) commit() {
+	for rid, key := range tx.fake.rids {
+		if key[0] == tx.partitionKey {
+			delete(tx.fake.rids, rid)
+		}
+	}
+
+	for id, doc := range tx.docs {
+		tx.fake.rids[doc["_rid"].(string)] = [2]string{tx.partitionKey, id}
+	}
+
+	tx.fake.partitions[tx.partitionKey] = tx.docs
+}
+
+// sortByRID sorts documents by their resource id, so that the pages of a query don't overlap
+func sortByRID(docs []fakeDocument) {
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i]["_rid"].(string) < docs[j]["_rid"].(string)
+	})
+}
+
+// filter runs a query against a list of resources, errors are ignored
+func (f *fakeCosmos) filter(body interface{}, docs []fakeDocument) []fakeDocument {
+	result, _ := f.query(body, docs)
+	return result
+}
+
+// query runs a CosmosDB SQL query of the form
+// SELECT [TOP n] ... FROM ROOT r [WHERE r.a op x [and r.b.c op y ...]] [ORDER BY r.d [ASC|DESC]]
+// against a list of documents. The projection is ignored, documents are always returned completely.
+func (f *fakeCosmos) query(body interface{}, docs []fakeDocument) ([]fakeDocument, *fakeError) {
+	q, _ := body.(map[string]interface{})
+	text, _ := q["query"].(string)
+
+	match := queryExpr.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return nil, errFakeBadRequest
+	}
+
+	params := map[string]interface{}{}
+	if ps, ok := q["parameters"].([]interface{}); ok {
+		for _, p := range ps {
+			param, _ := p.(map[string]interface{})
+			name, _ := param["name"].(string)
+			params[name] = param["value"]
+		}
+	}
+
+	type condition struct {
+		field string
+		op    string
+		value interface{}
+	}
+
+	conditions := []condition{}
+
+	if match[3] != "" {
+		for _, c := range andExpr.Split(match[3], -1) {
+			cm := conditionExpr.FindStringSubmatch(strings.TrimSpace(c))
+			if cm == nil {
+				return nil, errFakeBadRequest
+			}
+
+			var value interface{}
+			switch {
+			case strings.HasPrefix(cm[3], "@"):
+				v, exists := params[cm[3]]
+				if !exists {
+					return nil, errFakeBadRequest
+				}
+				value = v
+			case strings.HasPrefix(cm[3], "'") || strings.HasPrefix(cm[3], "\""):
+				value = cm[3][1 : len(cm[3])-1]
+			default:
+				n, _ := strconv.ParseFloat(cm[3], 64)
+				value = n
+			}
+
+			conditions = append(conditions, condition{cm[1], cm[2], value})
+		}
+	}
+
+	result := []fakeDocument{}
+
+	for _, doc := range docs {
+		matches := true
+
+		for _, c := range conditions {
+			cmp, ok := compare(field(doc, c.field), c.value)
+			if !ok {
+				matches = c.op == "!=" || c.op == "<>"
+				if !matches {
+					break
+				}
+				continue
+			}
+
+			switch c.op {
+			case "=":
+				matches = cmp == 0
+			case "!=", "<>":
+				matches = cmp != 0
+			case ">=":
+				matches = cmp >= 0
+			case "<=":
+				matches = cmp <= 0
+			case ">":
+				matches = cmp > 0
+			case "<":
+				matches = cmp < 0
+			}
+
+			if !matches {
+				break
+			}
+		}
+
+		if matches {
+			result = append(result, doc)
+		}
+	}
+
+	if orderBy := match[4]; orderBy != "" {
+		desc := strings.EqualFold(match[5], "DESC")
+		sort.SliceStable(result, func(i, j int) bool {
+			cmp, _ := compare(result[i][orderBy], result[j][orderBy])
+			if desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+
+	if match[1] != "" {
+		if top, _ := strconv.Atoi(match[1]); top < len(result) {
+			result = result[:top]
+		}
+	}
+
+	return result, nil
+}
+
+// field returns the value of a field of a document, the names of nested fields are separated by dots
+func field(doc fakeDocument, name string) interface{} {
+	var value interface{} = map[string]interface{}(doc)
+
+	for _, n := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[n]
+	}
+
+	return value
+}
+
+// compare compares two JSON values of the same type
+func compare(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if av < bv {
+			return -1, true
+		} else if av > bv {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+
+	return 0, false
+}
+
+func partitionKey(r *http.Request) (string, bool) {
+	header := r.Header.Get(documentdb.HeaderPartitionKey)
+	if header == "" {
+		return "", false
+	}
+
+	var key []string
+	if err := json.Unmarshal([]byte(header), &key); err != nil || len(key) != 1 {
+		return "", false
+	}
+
+	return key[0], true
+}
+
+func (f *fakeCosmos) write(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Date", f.now().UTC().Format(http.TimeFormat))
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeCosmos) writeError(w http.ResponseWriter, err *fakeError) {
+	f.write(w, err.status, map[string]string{
+		"code":    err.code,
+		"message": fmt.Sprintf("fake CosmosDB: %s", err.code),
+	})
+}
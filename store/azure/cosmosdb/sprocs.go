@@ -0,0 +1,353 @@
+package cosmosdb
+
+import (
+	"context"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/a8m/documentdb"
+)
+
+const (
+	appendEntitiesSprocID = "eventstore-appendEntities"
+	appendLogSprocID      = "eventstore-appendLog"
+	completeLogSprocID    = "eventstore-completeLog"
+
+	sprocStatusOk       = "ok"
+	sprocStatusNotFound = "notfound"
+	sprocStatusConflict = "conflict"
+	sprocStatusExists   = "exists"
+	sprocStatusDeleted  = "deleted"
+)
+
+// queryAllFunction is nested into every stored procedure. queryAll reads all pages of a query, as a
+// query in a stored procedure only returns a page of its results, at most 100 documents by default.
+// The next page is read with the continuation token of the previous one, until there is none.
+const queryAllFunction = `
+	function queryAll(query, done, results, continuation) {
+		results = results || [];
+
+		var accepted = collection.queryDocuments(collection.getSelfLink(), query, { continuation: continuation }, function (err, docs, options) {
+			if (err) throw err;
+
+			results = results.concat(docs);
+
+			if (options.continuation) {
+				queryAll(query, done, results, options.continuation);
+			} else {
+				done(results);
+			}
+		});
+
+		if (!accepted) throw new Error('query was not accepted');
+	}
+`
+
+// appendEntitiesSproc appends entity documents to the partition of an entity and updates
+// the version document. If create is set, the version document is created, so the stream
+// must not exist yet, otherwise the stream must exist with the expected version. A stream whose version document is marked as deleted
+// is never appended to. For every entity with an event ID an event ID document
+// is created, that conflicts with a concurrent write of the same event ID. The entities carry
+// the positions that were reserved for them in the log of all entities, a position document
+// for the first position records that they were stored, see cosmosdb.abort. A stored procedure
+// runs in a transaction scoped to the partition, if it throws, all documents written so far
+// are rolled back.
+const appendEntitiesSproc = `
+function appendEntities(entityId, expectedVersion, create, entities) {
+	var collection = getContext().getCollection();
+	var response = getContext().getResponse();
+
+	var query = {
+		query: 'SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type',
+		parameters: [{ name: '@id', value: entityId }, { name: '@type', value: 'version' }]
+	};
+
+	queryAll(query, function (versions) {
+		if (versions.length > 0 && versions[0].deleted) {
+			response.setBody({ status: 'deleted', version: versions[0].version });
+			return;
+		}
+
+		if (create) {
+			if (versions.length > 0) {
+				response.setBody({ status: 'exists', version: versions[0].version });
+				return;
+			}
+
+			createEntities(0, function () {
+				var version = { id: entityId, entityId: entityId, version: entities.length, type: 'version' };
+
+				var accepted = collection.createDocument(collection.getSelfLink(), version, function (err) {
+					if (err) throw err;
+					response.setBody({ status: 'ok', version: version.version });
+				});
+
+				if (!accepted) throw new Error('create of version document was not accepted');
+			});
+			return;
+		}
+
+		if (versions.length === 0) {
+			response.setBody({ status: 'notfound', version: 0 });
+			return;
+		}
+
+		var version = versions[0];
+
+		if (version.version !== expectedVersion) {
+			response.setBody({ status: 'conflict', version: version.version });
+			return;
+		}
+
+		createEntities(0, function () {
+			version.version += entities.length;
+
+			var accepted = collection.replaceDocument(version._self, version, { etag: version._etag }, function (err) {
+				if (err) throw err;
+				response.setBody({ status: 'ok', version: version.version });
+			});
+
+			if (!accepted) throw new Error('replace of version document was not accepted');
+		});
+	});
+
+	function createEntities(i, done) {
+		if (i >= entities.length) {
+			createPosition(done);
+			return;
+		}
+
+		var accepted = collection.createDocument(collection.getSelfLink(), entities[i], function (err) {
+			if (err) throw err;
+			createEventID(entities[i], function () {
+				createEntities(i + 1, done);
+			});
+		});
+
+		if (!accepted) throw new Error('create of entity document was not accepted');
+	}
+
+	function createEventID(entity, done) {
+		if (!entity.data.eventId) {
+			done();
+			return;
+		}
+
+		var eventID = { id: entityId + '--eventid--' + entity.data.eventId, entityId: entityId, version: entity.version, type: 'eventid' };
+
+		var accepted = collection.createDocument(collection.getSelfLink(), eventID, function (err) {
+			if (err) throw err;
+			done();
+		});
+
+		if (!accepted) throw new Error('create of event id document was not accepted');
+	}
+
+	function createPosition(done) {
+		var first = entities[0].data.position;
+		var position = { id: entityId + '--position--' + first, entityId: entityId, type: 'position', first: first, count: entities.length, aborted: false };
+
+		// conflicts with the position document of a reader, that aborted the write
+		var accepted = collection.createDocument(collection.getSelfLink(), position, function (err) {
+			if (err) throw err;
+			done();
+		});
+
+		if (!accepted) throw new Error('create of position document was not accepted');
+	}
+` + queryAllFunction + `}
+`
+
+// appendLogSproc reserves positions in the log of all entities for entities, before they are stored.
+// It runs in the partition of the log, where the latest position is kept in a position document.
+// The log documents and the position document are written in one transaction, so positions are unique.
+// The log documents are pending until completeLogSproc completes them, every log document refers to
+// the first position of its write. In the log partition the version of a document is its position.
+const appendLogSproc = `
+function appendLog(logId, entities) {
+	var collection = getContext().getCollection();
+	var response = getContext().getResponse();
+
+	var query = {
+		query: 'SELECT * FROM ROOT r WHERE r.id=@id and r.type=@type',
+		parameters: [{ name: '@id', value: logId }, { name: '@type', value: 'position' }]
+	};
+
+	queryAll(query, function (positions) {
+		var position = positions.length > 0 ? positions[0] : { id: logId, entityId: logId, version: 0, type: 'position' };
+		var first = position.version + 1;
+
+		createEntries(0, function () {
+			position.version = first + entities.length - 1;
+
+			var done = function (err) {
+				if (err) throw err;
+				response.setBody({ status: 'ok', version: position.version });
+			};
+
+			var accepted = positions.length > 0
+				? collection.replaceDocument(position._self, position, { etag: position._etag }, done)
+				: collection.createDocument(collection.getSelfLink(), position, done);
+
+			if (!accepted) throw new Error('write of position document was not accepted');
+		});
+
+		function createEntries(i, done) {
+			if (i >= entities.length) {
+				done();
+				return;
+			}
+
+			var entity = entities[i];
+			entity.position = first + i;
+
+			var entry = {
+				id: logId + '--' + entity.position,
+				entityId: logId,
+				version: entity.position,
+				metadata: entity.metadata,
+				type: 'log',
+				pending: true,
+				first: first,
+				data: entity
+			};
+
+			var accepted = collection.createDocument(collection.getSelfLink(), entry, function (err) {
+				if (err) throw err;
+				createEntries(i + 1, done);
+			});
+
+			if (!accepted) throw new Error('create of log document was not accepted');
+		}
+	});
+` + queryAllFunction + `}
+`
+
+// completeLogSproc completes the pending log documents of a write, that reserved the positions
+// starting at first. If the entities of the write were stored, the log documents are no longer
+// pending, otherwise they are deleted.
+const completeLogSproc = `
+function completeLog(logId, first, committed) {
+	var collection = getContext().getCollection();
+	var response = getContext().getResponse();
+
+	var query = {
+		query: 'SELECT * FROM ROOT r WHERE r.type=@type and r.first=@first',
+		parameters: [{ name: '@type', value: 'log' }, { name: '@first', value: first }]
+	};
+
+	queryAll(query, function (entries) {
+		completeEntries(entries, 0);
+	});
+
+	function completeEntries(entries, i) {
+		if (i >= entries.length) {
+			response.setBody({ status: 'ok', version: entries.length });
+			return;
+		}
+
+		var done = function (err) {
+			if (err) throw err;
+			completeEntries(entries, i + 1);
+		};
+
+		var entry = entries[i];
+		var accepted;
+
+		if (committed) {
+			entry.pending = false;
+			accepted = collection.replaceDocument(entry._self, entry, {}, done);
+		} else {
+			accepted = collection.deleteDocument(entry._self, {}, done);
+		}
+
+		if (!accepted) throw new Error('write of log document was not accepted');
+	}
+` + queryAllFunction + `}
+`
+
+type sprocresult struct {
+	Status  string `json:"status"`
+	Version int64  `json:"version"`
+}
+
+// ensureStoredProcedure creates or updates a stored procedure in the container and returns its self link
+func ensureStoredProcedure(client *documentdb.DocumentDB, container *documentdb.Collection, id, body string) (string, error) {
+	sprocs, err := client.QueryStoredProcedures(container.Self, &documentdb.Query{
+		Query: "SELECT * FROM ROOT r WHERE r.id=@id",
+		Parameters: []documentdb.Parameter{
+			{Name: "@id", Value: id},
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(sprocs) == 0 {
+		sproc, err := client.CreateStoredProcedure(container.Self, &documentdb.Sproc{
+			Resource: documentdb.Resource{Id: id},
+			Body:     body,
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		return sproc.Self, nil
+	}
+
+	if sprocs[0].Body == body {
+		return sprocs[0].Self, nil
+	}
+
+	sproc, err := client.ReplaceStoredProcedure(sprocs[0].Self, &documentdb.Sproc{
+		Resource: documentdb.Resource{Id: id},
+		Body:     body,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return sproc.Self, nil
+}
+
+// appendEntities executes the appendEntities stored procedure within the partition of an entity
+func (c *cosmosdb) appendEntities(ctx context.Context, id string, expectedVersion int64, create bool, entities []cosmosentity) (*sprocresult, error) {
+	result := &sprocresult{}
+
+	err := c.client.ExecuteStoredProcedure(c.appendEntitiesSproc,
+		[]interface{}{id, expectedVersion, create, entities},
+		result,
+		requestOptions(ctx, id)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// appendLog executes the appendLog stored procedure within the partition of the log of all entities
+func (c *cosmosdb) appendLog(ctx context.Context, entities []*store.Entity) (*sprocresult, error) {
+	result := &sprocresult{}
+
+	err := c.client.ExecuteStoredProcedure(c.appendLogSproc,
+		[]interface{}{logID, entities},
+		result,
+		requestOptions(ctx, logID)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// completeLog executes the completeLog stored procedure within the partition of the log of all entities
+func (c *cosmosdb) completeLog(ctx context.Context, first int64, committed bool) error {
+	return c.client.ExecuteStoredProcedure(c.completeLogSproc,
+		[]interface{}{logID, first, committed},
+		&sprocresult{},
+		requestOptions(ctx, logID)...)
+}
@@ -0,0 +1,805 @@
+package tablestorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+)
+
+// fakeTableStorage is an in-process stand-in for the parts of the Table Storage REST API that are used by
+// the event store: tables, entities with ETags, queries with filters and continuation, and entity group
+// transactions. Requests are not authenticated. The errors of an entity group transaction are returned in
+// the response of its changeset, like the errors of its operations, so that the storage client reports them.
+type fakeTableStorage struct {
+	server  *httptest.Server
+	mutex   sync.Mutex
+	tables  map[string]map[fakeKey]*fakeEntity
+	counter int64
+
+	// pageSize is the number of entities of a page of a query, the table service returns at most 1000
+	pageSize int
+
+	// failRequest fails every request it returns an error for
+	failRequest func(r *http.Request) *fakeError
+	// failResponse handles every request it returns an error for, but responds with the error,
+	// like a request whose response got lost
+	failResponse func(r *http.Request) *fakeError
+}
+
+type fakeKey struct {
+	partitionKey string
+	rowKey       string
+}
+
+// fakeEntity is a stored entity, its properties are kept as they were sent, with their type annotations
+type fakeEntity struct {
+	properties map[string]interface{}
+	etag       string
+	timestamp  time.Time
+}
+
+type fakeError struct {
+	status int
+	code   string
+}
+
+func (e *fakeError) Error() string {
+	return e.code
+}
+
+var (
+	errFakeNotFound           = &fakeError{http.StatusNotFound, resourceNotFound}
+	errFakeEntityExists       = &fakeError{http.StatusConflict, entityAlreadyExists}
+	errFakeTableExists        = &fakeError{http.StatusConflict, "TableAlreadyExists"}
+	errFakeConditionNotMet    = &fakeError{http.StatusPreconditionFailed, updateConditionNotSatisfied}
+	errFakeBadRequest         = &fakeError{http.StatusBadRequest, "InvalidInput"}
+	errFakeDifferentPartition = &fakeError{http.StatusBadRequest, "CommandsInBatchActOnDifferentPartitions"}
+	errFakeDuplicateRow       = &fakeError{http.StatusBadRequest, "InvalidDuplicateRow"}
+	errFakeTooManyRequests    = &fakeError{http.StatusTooManyRequests, "TooManyRequests"}
+)
+
+var (
+	tableExpr     = regexp.MustCompile(`^/Tables\('([^']+)'\)$`)
+	entityExpr    = regexp.MustCompile(`^/([^/(]+)\(PartitionKey='([^']*)',\s*RowKey='([^']*)'\)$`)
+	conditionExpr = regexp.MustCompile(`^\((\w+) (eq|ne|gt|ge|lt|le) ('[^']*'|-?\d+|true|false)\)$`)
+)
+
+// newFakeTableStorage starts a new fake and returns the metadata to connect to it
+func newFakeTableStorage(t *testing.T) (*fakeTableStorage, store.Metadata) {
+	f := &fakeTableStorage{
+		tables:   map[string]map[fakeKey]*fakeEntity{},
+		pageSize: 1000,
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	metadata := store.Metadata{
+		Properties: map[string]string{
+			storageAccountName: "fakeaccount",
+			storageAccountKey:  base64.StdEncoding.EncodeToString([]byte("fake")),
+		},
+	}
+
+	return f, metadata
+}
+
+// newStore creates a store, whose requests are sent to the fake
+func (f *fakeTableStorage) newStore() *tablestore {
+	return &tablestore{httpClient: f.client()}
+}
+
+// client returns an http.Client, that sends all requests to the fake. The storage client
+// builds the host name from the account name, so the host is replaced.
+func (f *fakeTableStorage) client() *http.Client {
+	target, _ := url.Parse(f.server.URL)
+
+	return &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.Host = target.Host
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+}
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func (f *fakeTableStorage) setFailRequest(failRequest func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failRequest = failRequest
+}
+
+func (f *fakeTableStorage) setFailResponse(failResponse func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failResponse = failResponse
+}
+
+// rows returns the properties of the rows of a partition of the entity table by their row keys,
+// Int64 properties are converted to int64
+func (f *fakeTableStorage) rows(partitionKey string) map[string]map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	result := map[string]map[string]interface{}{}
+
+	for key, e := range f.tables[entityTableName] {
+		if key.partitionKey != partitionKey {
+			continue
+		}
+
+		props := map[string]interface{}{}
+		for name := range e.properties {
+			if !strings.HasSuffix(name, "@odata.type") {
+				props[name], _ = e.value(key, name)
+			}
+		}
+
+		result[key.rowKey] = props
+	}
+
+	return result
+}
+
+// isBatchWith checks if r is an entity group transaction, that contains text, e.g. the row key of an inserted row
+func isBatchWith(r *http.Request, text string) bool {
+	if r.Method != http.MethodPost || r.URL.Path != "/$batch" {
+		return false
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return bytes.Contains(body, []byte(text))
+}
+
+// isGet checks if r reads the row with the given partition and row key
+func isGet(r *http.Request, partitionKey, rowKey string) bool {
+	m := entityExpr.FindStringSubmatch(r.URL.Path)
+	return r.Method == http.MethodGet && m != nil && m[2] == partitionKey && m[3] == rowKey
+}
+
+func (f *fakeTableStorage) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, r, errFakeBadRequest)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if f.failRequest != nil {
+		if err := f.failRequest(r); err != nil {
+			f.writeError(w, r, err)
+			return
+		}
+	}
+
+	if f.failResponse != nil {
+		if err := f.failResponse(r); err != nil {
+			f.serve(httptest.NewRecorder(), r, body)
+			f.writeError(w, r, err)
+			return
+		}
+	}
+
+	f.serve(w, r, body)
+}
+
+func (f *fakeTableStorage) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	path := r.URL.Path
+
+	if m := tableExpr.FindStringSubmatch(path); m != nil && r.Method == http.MethodGet {
+		if _, ok := f.tables[m[1]]; !ok {
+			f.writeError(w, r, errFakeNotFound)
+			return
+		}
+
+		f.write(w, http.StatusOK, map[string]interface{}{"TableName": m[1]})
+		return
+	}
+
+	if path == "/Tables" && r.Method == http.MethodPost {
+		f.createTable(w, r, body)
+		return
+	}
+
+	if path == "/$batch" && r.Method == http.MethodPost {
+		f.batch(w, r, body)
+		return
+	}
+
+	name, key := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "()"), fakeKey{}
+	if m := entityExpr.FindStringSubmatch(path); m != nil {
+		name, key = m[1], fakeKey{partitionKey: m[2], rowKey: m[3]}
+	}
+
+	entities, ok := f.tables[name]
+	if !ok {
+		f.writeError(w, r, errFakeNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == fakeKey{}:
+		f.query(w, r, name, entities)
+	case r.Method == http.MethodGet:
+		e, ok := entities[key]
+		if !ok {
+			f.writeError(w, r, errFakeNotFound)
+			return
+		}
+
+		f.write(w, http.StatusOK, e.marshal(key, r.Header.Get("Accept"), nil))
+	default:
+		key, e, err := f.apply(entities, r.Method, key, r.Header.Get("If-Match"), body)
+		if err != nil {
+			f.writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", e.etag)
+		w.Header().Set("Date", e.timestamp.Format(http.TimeFormat))
+
+		if r.Method == http.MethodPost && r.Header.Get("Prefer") != "return-no-content" {
+			f.write(w, http.StatusCreated, e.marshal(key, r.Header.Get("Accept"), nil))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeTableStorage) createTable(w http.ResponseWriter, r *http.Request, body []byte) {
+	var request struct {
+		TableName string
+	}
+
+	if err := json.Unmarshal(body, &request); err != nil || request.TableName == "" {
+		f.writeError(w, r, errFakeBadRequest)
+		return
+	}
+
+	if _, ok := f.tables[request.TableName]; ok {
+		f.writeError(w, r, errFakeTableExists)
+		return
+	}
+
+	f.tables[request.TableName] = map[fakeKey]*fakeEntity{}
+
+	if r.Header.Get("Prefer") == "return-no-content" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f.write(w, http.StatusCreated, map[string]interface{}{"TableName": request.TableName})
+}
+
+// apply inserts, replaces, merges or deletes an entity of a table, like a request with the given method. An insert
+// takes the key from the body. It returns the key and the entity after the operation.
+func (f *fakeTableStorage) apply(entities map[fakeKey]*fakeEntity, method string, key fakeKey, ifMatch string, body []byte) (fakeKey, *fakeEntity, *fakeError) {
+	properties := map[string]interface{}{}
+	if method != http.MethodDelete {
+		if err := json.Unmarshal(body, &properties); err != nil {
+			return key, nil, errFakeBadRequest
+		}
+	}
+
+	if method == http.MethodPost {
+		key.partitionKey, _ = properties["PartitionKey"].(string)
+		key.rowKey, _ = properties["RowKey"].(string)
+	}
+
+	for _, name := range []string{"PartitionKey", "RowKey", "Timestamp", "Timestamp@odata.type"} {
+		delete(properties, name)
+	}
+
+	current, exists := entities[key]
+
+	switch method {
+	case http.MethodPost:
+		if exists {
+			return key, nil, errFakeEntityExists
+		}
+	case http.MethodPut, "MERGE", http.MethodDelete:
+		// a replace or merge without If-Match inserts the entity, if it doesn't exist
+		if ifMatch == "" && method != http.MethodDelete {
+			break
+		}
+
+		if !exists {
+			return key, nil, errFakeNotFound
+		}
+
+		if ifMatch != "*" && ifMatch != current.etag {
+			return key, nil, errFakeConditionNotMet
+		}
+	default:
+		return key, nil, errFakeBadRequest
+	}
+
+	if method == http.MethodDelete {
+		delete(entities, key)
+		return key, current, nil
+	}
+
+	if method == "MERGE" && exists {
+		merged := map[string]interface{}{}
+		for name, value := range current.properties {
+			merged[name] = value
+		}
+
+		for name, value := range properties {
+			merged[name] = value
+			if _, ok := properties[name+"@odata.type"]; !ok {
+				delete(merged, name+"@odata.type")
+			}
+		}
+
+		properties = merged
+	}
+
+	f.counter++
+	now := time.Now().UTC()
+	e := &fakeEntity{
+		properties: properties,
+		etag:       fmt.Sprintf("W/\"datetime'%d'\"", f.counter),
+		timestamp:  now,
+	}
+
+	entities[key] = e
+	return key, e, nil
+}
+
+// query returns a page of the entities of a table that match the filter of the request, ordered by their keys
+func (f *fakeTableStorage) query(w http.ResponseWriter, r *http.Request, name string, entities map[fakeKey]*fakeEntity) {
+	params := r.URL.Query()
+
+	conditions, err := parseFilter(params.Get("$filter"))
+	if err != nil {
+		f.writeError(w, r, err)
+		return
+	}
+
+	top := f.pageSize
+	if v := params.Get("$top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			f.writeError(w, r, errFakeBadRequest)
+			return
+		}
+
+		top = min(n, f.pageSize)
+	}
+
+	var selected []string
+	if v := params.Get("$select"); v != "" {
+		selected = strings.Split(v, ",")
+	}
+
+	keys := make([]fakeKey, 0, len(entities))
+	for key := range entities {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].partitionKey != keys[j].partitionKey {
+			return keys[i].partitionKey < keys[j].partitionKey
+		}
+		return keys[i].rowKey < keys[j].rowKey
+	})
+
+	next := fakeKey{partitionKey: params.Get("NextPartitionKey"), rowKey: params.Get("NextRowKey")}
+	values := []interface{}{}
+
+	for _, key := range keys {
+		if key.partitionKey < next.partitionKey || (key.partitionKey == next.partitionKey && key.rowKey < next.rowKey) {
+			continue
+		}
+
+		e := entities[key]
+		if !e.matches(key, conditions) {
+			continue
+		}
+
+		if len(values) == top {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", key.partitionKey)
+			w.Header().Set("x-ms-continuation-NextRowKey", key.rowKey)
+			break
+		}
+
+		values = append(values, e.marshal(key, r.Header.Get("Accept"), selected))
+	}
+
+	f.write(w, http.StatusOK, map[string]interface{}{
+		"odata.metadata": fmt.Sprintf("%s/$metadata#%s", f.server.URL, name),
+		"value":          values,
+	})
+}
+
+// batch executes the operations of an entity group transaction. The operations are applied to a copy of the
+// table, that replaces the table if all of them succeed.
+func (f *fakeTableStorage) batch(w http.ResponseWriter, r *http.Request, body []byte) {
+	operations, err := parseBatch(r, body)
+	if err != nil || len(operations) == 0 || len(operations) > 100 {
+		f.writeBatchError(w, 0, errFakeBadRequest)
+		return
+	}
+
+	var table string
+	var entities map[fakeKey]*fakeEntity
+	keys := map[fakeKey]bool{}
+
+	for i, op := range operations {
+		path := op.URL.Path
+		key := fakeKey{}
+
+		if m := entityExpr.FindStringSubmatch(path); m != nil {
+			path, key = "/"+m[1], fakeKey{partitionKey: m[2], rowKey: m[3]}
+		} else {
+			var properties map[string]interface{}
+			if err := json.Unmarshal(op.body, &properties); err != nil {
+				f.writeBatchError(w, i, errFakeBadRequest)
+				return
+			}
+
+			key.partitionKey, _ = properties["PartitionKey"].(string)
+			key.rowKey, _ = properties["RowKey"].(string)
+		}
+
+		if i == 0 {
+			table = strings.TrimPrefix(path, "/")
+			if _, ok := f.tables[table]; !ok {
+				f.writeBatchError(w, i, errFakeNotFound)
+				return
+			}
+
+			entities = map[fakeKey]*fakeEntity{}
+			for k, e := range f.tables[table] {
+				entities[k] = e
+			}
+		} else if path != "/"+table || key.partitionKey != operations[0].key.partitionKey {
+			f.writeBatchError(w, i, errFakeDifferentPartition)
+			return
+		}
+
+		if keys[key] {
+			f.writeBatchError(w, i, errFakeDuplicateRow)
+			return
+		}
+
+		keys[key] = true
+		operations[i].key = key
+
+		if _, _, err := f.apply(entities, op.Method, key, op.Header.Get("If-Match"), op.body); err != nil {
+			f.writeBatchError(w, i, err)
+			return
+		}
+	}
+
+	f.tables[table] = entities
+
+	responses := make([]string, len(operations))
+	for i := range operations {
+		responses[i] = "HTTP/1.1 204 No Content\r\nDataServiceVersion: 1.0;\r\n\r\n"
+	}
+
+	f.writeBatch(w, responses)
+}
+
+// batchOperation is an operation of an entity group transaction
+type batchOperation struct {
+	*http.Request
+	key  fakeKey
+	body []byte
+}
+
+// parseBatch reads the operations of the changeset of an entity group transaction
+func parseBatch(r *http.Request, body []byte) ([]batchOperation, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	batch, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).NextPart()
+	if err != nil {
+		return nil, err
+	}
+
+	_, params, err = mime.ParseMediaType(batch.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	changeset := multipart.NewReader(batch, params["boundary"])
+	operations := []batchOperation{}
+
+	for {
+		part, err := changeset.NextPart()
+		if err == io.EOF {
+			return operations, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// the operations have no Content-Length, their body is the rest of the part
+		reader := bufio.NewReader(part)
+
+		op, err := http.ReadRequest(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		operations = append(operations, batchOperation{Request: op, body: data})
+	}
+}
+
+// writeBatch writes the response of an entity group transaction with the responses of its operations
+func (f *fakeTableStorage) writeBatch(w http.ResponseWriter, responses []string) {
+	changeset := &bytes.Buffer{}
+	changesetWriter := multipart.NewWriter(changeset)
+
+	for _, response := range responses {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-Transfer-Encoding", "binary")
+
+		part, _ := changesetWriter.CreatePart(header)
+		part.Write([]byte(response))
+	}
+
+	changesetWriter.Close()
+
+	body := &bytes.Buffer{}
+	batchWriter := multipart.NewWriter(body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/mixed; boundary="+changesetWriter.Boundary())
+
+	part, _ := batchWriter.CreatePart(header)
+	part.Write(changeset.Bytes())
+	batchWriter.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+batchWriter.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+}
+
+// writeBatchError writes the response of an entity group transaction, whose operation with the given index failed
+func (f *fakeTableStorage) writeBatchError(w http.ResponseWriter, index int, err *fakeError) {
+	data, _ := json.Marshal(odataError(err, fmt.Sprintf("%d:%s", index, err.code)))
+
+	f.writeBatch(w, []string{fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: application/json;odata=minimalmetadata;streaming=true;charset=utf-8\r\n\r\n%s",
+		err.status, http.StatusText(err.status), data)})
+}
+
+func (f *fakeTableStorage) write(w http.ResponseWriter, status int, body interface{}) {
+	data, _ := json.Marshal(body)
+
+	w.Header().Set("Content-Type", "application/json;odata=minimalmetadata;streaming=true;charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (f *fakeTableStorage) writeError(w http.ResponseWriter, r *http.Request, err *fakeError) {
+	if r.URL.Path == "/$batch" {
+		f.writeBatchError(w, 0, err)
+		return
+	}
+
+	f.write(w, err.status, odataError(err, err.code))
+}
+
+func odataError(err *fakeError, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"odata.error": map[string]interface{}{
+			"code":    err.code,
+			"message": map[string]interface{}{"lang": "en-US", "value": message},
+		},
+	}
+}
+
+// marshal returns the representation of an entity in a response with the given Accept header. Without
+// metadata, the type annotations and the ETag are left out, like Int64 properties are returned as strings.
+func (e *fakeEntity) marshal(key fakeKey, accept string, selected []string) map[string]interface{} {
+	result := map[string]interface{}{
+		"PartitionKey": key.partitionKey,
+		"RowKey":       key.rowKey,
+		"Timestamp":    e.timestamp.Format(time.RFC3339Nano),
+	}
+
+	for name, value := range e.properties {
+		result[name] = value
+	}
+
+	if selected != nil {
+		for name := range result {
+			if !containsString(selected, strings.TrimSuffix(name, "@odata.type")) {
+				delete(result, name)
+			}
+		}
+	}
+
+	if strings.Contains(accept, "odata=nometadata") {
+		for name := range result {
+			if strings.HasSuffix(name, "@odata.type") {
+				delete(result, name)
+			}
+		}
+	} else {
+		result["odata.etag"] = e.etag
+	}
+
+	return result
+}
+
+// value returns a property of an entity, Int64 properties are converted to int64
+func (e *fakeEntity) value(key fakeKey, name string) (interface{}, bool) {
+	switch name {
+	case "PartitionKey":
+		return key.partitionKey, true
+	case "RowKey":
+		return key.rowKey, true
+	}
+
+	value, ok := e.properties[name]
+	if !ok {
+		return nil, false
+	}
+
+	if e.properties[name+"@odata.type"] == "Edm.Int64" {
+		s, _ := value.(string)
+		i, err := strconv.ParseInt(s, 10, 64)
+		return i, err == nil
+	}
+
+	if f, ok := value.(float64); ok {
+		return int64(f), true
+	}
+
+	return value, true
+}
+
+// condition is a comparison of a property with a value in a filter
+type condition struct {
+	property string
+	operator string
+	value    interface{}
+}
+
+// parseFilter parses the filters of the event store, comparisons in parentheses joined by and
+func parseFilter(filter string) ([]condition, *fakeError) {
+	conditions := []condition{}
+	if filter == "" {
+		return conditions, nil
+	}
+
+	for _, part := range strings.Split(filter, " and ") {
+		m := conditionExpr.FindStringSubmatch(part)
+		if m == nil {
+			return nil, errFakeBadRequest
+		}
+
+		c := condition{property: m[1], operator: m[2]}
+
+		switch {
+		case strings.HasPrefix(m[3], "'"):
+			c.value = strings.Trim(m[3], "'")
+		case m[3] == "true" || m[3] == "false":
+			c.value = m[3] == "true"
+		default:
+			c.value, _ = strconv.ParseInt(m[3], 10, 64)
+		}
+
+		conditions = append(conditions, c)
+	}
+
+	return conditions, nil
+}
+
+// matches checks if an entity satisfies all conditions. A missing property or a value of another type
+// doesn't satisfy a condition.
+func (e *fakeEntity) matches(key fakeKey, conditions []condition) bool {
+	for _, c := range conditions {
+		value, ok := e.value(key, c.property)
+		if !ok {
+			return false
+		}
+
+		cmp := 0
+
+		switch v := value.(type) {
+		case string:
+			s, ok := c.value.(string)
+			if !ok {
+				return false
+			}
+			cmp = strings.Compare(v, s)
+		case int64:
+			i, ok := c.value.(int64)
+			if !ok {
+				return false
+			}
+			if v < i {
+				cmp = -1
+			} else if v > i {
+				cmp = 1
+			}
+		case bool:
+			b, ok := c.value.(bool)
+			if !ok || (c.operator != "eq" && c.operator != "ne") {
+				return false
+			}
+			if v != b {
+				cmp = 1
+			}
+		default:
+			return false
+		}
+
+		switch c.operator {
+		case "eq":
+			ok = cmp == 0
+		case "ne":
+			ok = cmp != 0
+		case "gt":
+			ok = cmp > 0
+		case "ge":
+			ok = cmp >= 0
+		case "lt":
+			ok = cmp < 0
+		case "le":
+			ok = cmp <= 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
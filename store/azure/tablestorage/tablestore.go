@@ -1,9 +1,14 @@
 package tablestorage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
 
 	"github.com/AndreasM009/eventstore-impl/store"
 	"github.com/Azure/azure-sdk-for-go/storage"
@@ -15,6 +20,40 @@ const (
 	storageAccountKey   = "storageAccountKey"
 	tableNameSuffix     = "tableNameSuffix"
 	latestEntityVersion = "latestVersion"
+	snapshotRowKey      = "snapshot"
+	// the event ID of an entity is stored in its own row, that holds the version in eventVersion
+	eventIDRowPrefix = "eventid-"
+	// an entity group transaction is limited to 100 operations, one of them updates the version,
+	// one records the positions of the entities and every event ID takes one more
+	maxBatchSize = 98
+	// a soft deleted entity is marked with this property of its version row
+	deletedProperty = "deleted"
+	// the positions of the entities of a write are recorded in a row of the entity's partition, see tablestore.write
+	positionRowKeyFormat = "position-%019d"
+
+	// a query returns at most maxPageSize entities per page and must not ask for more
+	maxPageSize = 1000
+
+	// the log of all entities is stored in its own partition, with the latest position in an extra row
+	logPartitionKey   = "$all"
+	latestLogPosition = "latestPosition"
+	logRowKeyFormat   = "%019d"
+
+	// defaultPendingTimeout is the time after which a reader of the log aborts a write, whose log rows are
+	// still pending, unless its entities were stored
+	defaultPendingTimeout = 10 * time.Second
+
+	// error codes of the table service
+	entityAlreadyExists         = "EntityAlreadyExists"
+	updateConditionNotSatisfied = "UpdateConditionNotSatisfied"
+	resourceNotFound            = "ResourceNotFound"
+)
+
+var (
+	// errAborted is the inner error of a write that was aborted by a reader of the log of all entities
+	errAborted = errors.New("the write was aborted by a reader of the log of all entities")
+	// errLogChanged is the inner error of a write whose positions were taken by a concurrent write
+	errLogChanged = errors.New("the log of all entities has changed concurrently")
 )
 
 type (
@@ -24,9 +63,22 @@ type (
 		client            storage.Client
 		entityTableName   string
 		tableNameSuffix   string
+		retryPolicy       store.RetryPolicy
+		pendingTimeout    time.Duration
+		subscriber        *store.PollingSubscriber
+
+		// httpClient replaces the http.Client of the storage client, if it is set
+		httpClient *http.Client
 	}
 )
 
+// BackendName is the name the Azure Table Storage store is registered with, see store.Open
+const BackendName = "tablestorage"
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
 // NewStore creates a new Azure Table Storage based event store
 func NewStore() store.EventStore {
 	return &tablestore{}
@@ -36,6 +88,21 @@ func (s *tablestore) Init(metadata store.Metadata) error {
 	var sa string
 	var sk string
 
+	policy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return fmt.Errorf("azure tablestorage: %v", err)
+	}
+
+	s.retryPolicy = policy
+	s.pendingTimeout = defaultPendingTimeout
+
+	subscriber, err := store.NewPollingSubscriber(s, metadata)
+	if err != nil {
+		return fmt.Errorf("azure tablestorage: %v", err)
+	}
+
+	s.subscriber = subscriber
+
 	sa, ok := metadata.Properties[storageAccountName]
 	if !ok || sa == "" {
 		return errors.New("azure tablestorage: storage account name is missing")
@@ -61,6 +128,10 @@ func (s *tablestore) Init(metadata store.Metadata) error {
 		return err
 	}
 
+	if s.httpClient != nil {
+		client.HTTPClient = s.httpClient
+	}
+
 	s.client = client
 
 	tbls := client.GetTableService()
@@ -77,52 +148,90 @@ func (s *tablestore) Init(metadata store.Metadata) error {
 }
 
 func (s *tablestore) Add(entity *store.Entity) (*store.Entity, error) {
-	entity.Version = 1
+	return s.AddContext(context.Background(), entity)
+}
 
-	etbl := s.getEntityTable()
+func (s *tablestore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if entity.ID == logPartitionKey {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("the id %s is reserved for the log of all entities", logPartitionKey),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
 
-	vety := s.makeVersionTableEntity(etbl, entity)
-	eety, err := s.makeEntityTableEntity(etbl, entity)
+	etbl := s.getEntityTable(ctx)
 
-	if err != nil {
+	if duplicate, err := s.deduplicate(ctx, etbl, entity.ID, []*store.Entity{entity}); err != nil {
 		return nil, err
+	} else if duplicate {
+		return entity, nil
 	}
 
-	batch := etbl.NewBatch()
+	entity.Version = 1
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
 
-	batch.InsertEntity(vety)
-	batch.InsertEntity(eety)
+	err := s.retryPolicy.Retry(ctx, func() error {
+		batch := etbl.NewBatch()
+		batch.InsertEntity(s.makeVersionTableEntity(etbl, entity))
 
-	err = batch.ExecuteBatch()
+		err := s.write(etbl, entity.ID, []*store.Entity{entity}, batch)
 
-	if err != nil {
-		return nil, store.EventStoreError{
-			Text:       "insert entity failed",
-			ErrorType:  store.InternalError,
-			InnerError: err,
+		var evterr store.EventStoreError
+		if errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict && isAlreadyExists(evterr.InnerError) {
+			if _, err := s.GetLatestVersionNumberContext(ctx, entity.ID); errors.Is(err, store.ErrStreamDeleted) {
+				return err
+			}
+
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("entity %s already exists", entity.ID),
+				ErrorType:  store.AlreadyExists,
+				InnerError: evterr.InnerError,
+			}
 		}
+
+		return err
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
 	}
 
 	return entity, nil
 }
 
 func (s *tablestore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
-	etbl := s.getEntityTable()
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *tablestore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	etbl := s.getEntityTable(ctx)
 	vety := etbl.GetEntityReference(entity.ID, latestEntityVersion)
+	// entity.Version is overwritten below, keep the version the caller expects
+	expectedVersion := entity.Version
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
+	duplicate := false
 
-	for {
+	err := s.retryPolicy.Retry(ctx, func() error {
 		// load version of entity and increment version.
 		if err := vety.Get(10, storage.FullMetadata, nil); err != nil {
-			return nil, store.EventStoreError{
-				Text:       "faild to load version entity",
-				ErrorType:  store.EntityNotFound,
-				InnerError: err,
-			}
+			return loadError("faild to load version entity", err)
+		}
+
+		if isDeleted(vety) {
+			return store.StreamDeletedError(entity.ID)
+		}
+
+		var err error
+		if duplicate, err = s.deduplicate(ctx, etbl, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
 		}
 
 		version, ok := vety.Properties["version"].(int64)
 		if !ok {
-			return nil, store.EventStoreError{
+			return store.EventStoreError{
 				Text:       "invalid type assertion for type version",
 				ErrorType:  store.InternalError,
 				InnerError: nil,
@@ -131,10 +240,10 @@ func (s *tablestore) Append(entity *store.Entity, concurrency store.ConcurrencyC
 
 		// Optimistic Concurrency Control enabled?
 		// check if we have the current verion of the entity or not
-		if concurrency == store.Optimistic && entity.Version != version {
+		if concurrency == store.Optimistic && expectedVersion != version {
 			// there is a newer version already stored, as we do OOL (Optimistic Offline Lock)
 			// we return an error here
-			return nil, store.EventStoreError{
+			return store.EventStoreError{
 				Text:       "entity has gone stale, a newer version already exists",
 				ErrorType:  store.VersionConflict,
 				InnerError: nil,
@@ -143,37 +252,190 @@ func (s *tablestore) Append(entity *store.Entity, concurrency store.ConcurrencyC
 
 		version++
 		vety.Properties["version"] = version
-
 		entity.Version = version
-		eety, err := s.makeEntityTableEntity(etbl, entity)
 
-		if err != nil {
-			return nil, err
+		batch := etbl.NewBatch()
+		batch.ReplaceEntity(vety)
+
+		return s.write(etbl, entity.ID, []*store.Entity{entity}, batch)
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *tablestore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *tablestore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.appendToStream(ctx, id, entities, store.Optimistic, func(version int64) error {
+		if version == 0 {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
 		}
 
-		batch := etbl.NewBatch()
+		if expectedVersion != version {
+			return store.EventStoreError{
+				Text:       "entity has gone stale, a newer version already exists",
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
 
-		batch.InsertEntity(eety)
-		batch.ReplaceEntity(vety)
+		return nil
+	})
+}
+
+func (s *tablestore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *tablestore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	result, err := s.appendToStream(ctx, id, entities, expected.Concurrency(), func(version int64) error {
+		return expected.Check(id, version)
+	})
+
+	var evterr store.EventStoreError
+	if expected == store.NoStream && errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		// a concurrent writer created the entity first
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("entity %s already exists", id),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
+		}
+	}
+
+	return result, err
+}
+
+// appendToStream appends entities in one entity group transaction, if check accepts the latest version of the entity
+func (s *tablestore) appendToStream(ctx context.Context, id string, entities []*store.Entity, concurrency store.ConcurrencyControl, check func(version int64) error) ([]*store.Entity, error) {
+	var result []*store.Entity
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		var err error
+		result, _, err = s.appendBatch(ctx, id, entities, check)
+		return err
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// appendBatch stores entities and their event IDs in one entity group transaction, if check accepts the
+// latest version of the entity. It returns true, if the entities are already stored with their event IDs.
+func (s *tablestore) appendBatch(ctx context.Context, id string, entities []*store.Entity, check func(version int64) error) ([]*store.Entity, bool, error) {
+	if id == logPartitionKey {
+		return nil, false, store.EventStoreError{
+			Text:       fmt.Sprintf("the id %s is reserved for the log of all entities", logPartitionKey),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	operations := len(entities)
+	for _, entity := range entities {
+		if entity.EventID != "" {
+			operations++
+		}
+	}
+
+	if operations > maxBatchSize {
+		return nil, false, store.EventStoreError{
+			Text:       fmt.Sprintf("a batch must not contain more than %v entities and event ids", maxBatchSize),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	etbl := s.getEntityTable(ctx)
+	vety := etbl.GetEntityReference(id, latestEntityVersion)
+
+	// the version row of a new entity is inserted, it conflicts with a concurrent insert
+	exists := true
+
+	if err := vety.Get(10, storage.FullMetadata, nil); isNotFound(err) {
+		exists = false
+		vety.Properties = map[string]interface{}{"version": int64(0)}
+	} else if err != nil {
+		return nil, false, loadError("faild to load version entity", err)
+	} else if isDeleted(vety) {
+		return nil, false, store.StreamDeletedError(id)
+	}
+
+	if !exists {
+		if err := store.ValidateEventIDs(entities); err != nil {
+			return nil, false, err
+		}
+	} else if duplicate, err := s.deduplicate(ctx, etbl, id, entities); err != nil || duplicate {
+		return entities, duplicate, err
+	}
 
-		err = batch.ExecuteBatch()
-		if err == nil {
-			return entity, nil
+	version, ok := vety.Properties["version"].(int64)
+	if !ok {
+		return nil, false, store.EventStoreError{
+			Text:       "invalid type assertion for type version",
+			ErrorType:  store.InternalError,
+			InnerError: nil,
 		}
-		// try it again
 	}
+
+	if err := check(version); err != nil {
+		return nil, false, err
+	}
+
+	if len(entities) == 0 {
+		return entities, false, nil
+	}
+
+	for _, entity := range entities {
+		version++
+		entity.ID = id
+		entity.Version = version
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+	}
+
+	vety.Properties["version"] = version
+	batch := etbl.NewBatch()
+
+	if exists {
+		batch.ReplaceEntity(vety)
+	} else {
+		batch.InsertEntity(vety)
+	}
+
+	if err := s.write(etbl, id, entities, batch); err != nil {
+		return nil, false, err
+	}
+
+	return entities, false, nil
 }
 
 func (s *tablestore) GetLatestVersionNumber(id string) (int64, error) {
-	vtbl := s.getEntityTable()
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *tablestore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	vtbl := s.getEntityTable(ctx)
 	vety := vtbl.GetEntityReference(id, latestEntityVersion)
 
 	if err := vety.Get(10, storage.FullMetadata, nil); err != nil {
-		return int64(0), store.EventStoreError{
-			Text:       "failed to load version of entity",
-			ErrorType:  store.EntityNotFound,
-			InnerError: err,
-		}
+		return int64(0), loadError("failed to load version of entity", err)
+	}
+
+	if isDeleted(vety) {
+		return int64(0), store.StreamDeletedError(id)
 	}
 
 	version := vety.Properties["version"].(int64)
@@ -181,15 +443,19 @@ func (s *tablestore) GetLatestVersionNumber(id string) (int64, error) {
 }
 
 func (s *tablestore) GetByVersion(id string, version int64) (*store.Entity, error) {
-	tbl := s.getEntityTable()
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *tablestore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
+	}
+
+	tbl := s.getEntityTable(ctx)
 	ety := tbl.GetEntityReference(id, fmt.Sprintf("%v", version))
 
 	if err := ety.Get(10, storage.FullMetadata, nil); err != nil {
-		return nil, store.EventStoreError{
-			Text:       "failed to load version of entity",
-			ErrorType:  store.EntityNotFound,
-			InnerError: err,
-		}
+		return nil, loadError("failed to load version of entity", err)
 	}
 
 	result := &store.Entity{}
@@ -206,66 +472,984 @@ func (s *tablestore) GetByVersion(id string, version int64) (*store.Entity, erro
 }
 
 func (s *tablestore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
-	tbl := s.getEntityTable()
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (s *tablestore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.queryVersions(ctx, id, fmt.Sprintf("(PartitionKey eq '%s') and (RowKey ne '%s') and (RowKey ne '%s') and (version ge %v) and (version le %v)", id, latestEntityVersion, snapshotRowKey, startVersion, endVersion))
+}
+
+func (s *tablestore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+// GetAsOfContext queries the versions of the entity that were created at or before at by the createdAt
+// property, only the property version is selected. Entities that were stored before the property was
+// added are never found.
+func (s *tablestore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	tbl := s.getEntityTable(ctx)
 	opts := storage.QueryOptions{
-		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (RowKey ne '%s') and (version ge %v) and (version le %v)", id, latestEntityVersion, startVersion, endVersion),
+		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (createdAt le %v)", id, at.UnixMicro()),
+		Select: []string{"version"},
+	}
+
+	// without metadata the service returns Int64 properties as strings
+	result, err := tbl.QueryEntities(10, storage.MinimalMetadata, &opts)
+	version := int64(0)
+
+	for err == nil {
+		for _, e := range result.Entities {
+			if v, ok := e.Properties["version"].(int64); ok && v > version {
+				version = v
+			}
+		}
+
+		if result.NextLink == nil {
+			break
+		}
+
+		result, err = result.NextResults(nil)
 	}
 
-	result, err := tbl.QueryEntities(10, storage.FullMetadata, &opts)
 	if err != nil {
-		return nil, err
+		return nil, store.EventStoreError{
+			Text:       "failed to load entity versions",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
 	}
 
-	if len(result.Entities) == 0 {
-		return []store.Entity{}, nil
+	if version == 0 {
+		// distinguish between a missing version and a missing entity
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.NoVersionAsOf(id, at)
 	}
 
-	resultEntities := make([]store.Entity, len(result.Entities))
+	return s.GetByVersionContext(ctx, id, version)
+}
 
-	for i, e := range result.Entities {
-		if err := json.Unmarshal(e.Properties["data"].([]byte), &resultEntities[i]); err != nil {
-			return nil, store.EventStoreError{
-				Text:       "failed to deserialize entity",
-				ErrorType:  store.SerializationFailed,
-				InnerError: err,
+func (s *tablestore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *tablestore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return s.queryVersions(ctx, id, fmt.Sprintf("(PartitionKey eq '%s') and (createdAt ge %v) and (createdAt le %v)", id, from.UnixMicro(), to.UnixMicro()))
+}
+
+func (s *tablestore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (s *tablestore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	tbl := s.getEntityTable(ctx)
+	resultEntities := []store.Entity{}
+	resolved := map[int64]bool{}
+
+	for len(resultEntities) < maxCount {
+		count := maxCount - len(resultEntities)
+
+		entries, err := queryLog(tbl, fromPosition, count)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if pending, _ := e.Properties["pending"].(bool); pending {
+				first, _ := e.Properties["first"].(int64)
+				committed, ok := resolved[first]
+
+				if !ok {
+					// a write that reserved its positions recently is probably still storing its entities,
+					// the log is read up to it, so that entities are returned in the order of their positions
+					if time.Since(e.TimeStamp) < s.pendingTimeout {
+						return resultEntities, nil
+					}
+
+					id, _ := e.Properties["entityId"].(string)
+					if committed, err = s.resolve(tbl, id, first); err != nil {
+						return nil, err
+					}
+
+					resolved[first] = committed
+				}
+
+				if !committed {
+					continue
+				}
+			}
+
+			var entity store.Entity
+			if err := json.Unmarshal(e.Properties["data"].([]byte), &entity); err != nil {
+				return nil, store.EventStoreError{
+					Text:       "failed to deserialize entity",
+					ErrorType:  store.SerializationFailed,
+					InnerError: err,
+				}
 			}
+
+			resultEntities = append(resultEntities, entity)
 		}
+
+		if len(entries) < count {
+			break
+		}
+
+		fromPosition, _ = entries[len(entries)-1].Properties["position"].(int64)
+		fromPosition++
 	}
 
 	return resultEntities, nil
 }
 
-func (s *tablestore) makeVersionTableEntity(table *storage.Table, entity *store.Entity) *storage.Entity {
-	props := map[string]interface{}{
-		"version": entity.Version,
+// queryLog returns at most maxCount rows of the log of all entities, starting at fromPosition.
+// RowKeys have a fixed length, so the rows are returned in the order of their position.
+func queryLog(table *storage.Table, fromPosition int64, maxCount int) ([]*storage.Entity, error) {
+	opts := storage.QueryOptions{
+		Top:    uint(min(maxCount, maxPageSize)),
+		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (RowKey ge '%s') and (RowKey ne '%s')", logPartitionKey, fmt.Sprintf(logRowKeyFormat, fromPosition), latestLogPosition),
 	}
 
-	e := table.GetEntityReference(entity.ID, latestEntityVersion)
-	e.Properties = props
-	return e
-}
-
-func (s *tablestore) makeEntityTableEntity(table *storage.Table, entity *store.Entity) (*storage.Entity, error) {
-	data, err := json.Marshal(entity)
+	result, err := table.QueryEntities(10, storage.FullMetadata, &opts)
 	if err != nil {
 		return nil, store.EventStoreError{
-			Text:       "faild to serialize entity",
-			ErrorType:  store.SerializationFailed,
+			Text:       "failed to load log entries",
+			ErrorType:  store.InternalError,
 			InnerError: err,
 		}
 	}
-	props := map[string]interface{}{
-		"data":     data,
-		"version":  entity.Version,
-		"metadata": entity.Metadata,
+
+	entities := result.Entities
+
+	// a page may contain less entities than requested, even if there are more
+	for len(entities) < maxCount && result.NextLink != nil {
+		result, err = result.NextResults(nil)
+		if err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to load log entries",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		entities = append(entities, result.Entities...)
 	}
 
-	e := table.GetEntityReference(entity.ID, fmt.Sprintf("%v", entity.Version))
-	e.Properties = props
-	return e, nil
+	if len(entities) > maxCount {
+		entities = entities[:maxCount]
+	}
+
+	return entities, nil
 }
 
-func (s *tablestore) getEntityTable() *storage.Table {
-	svc := s.client.GetTableService()
-	return svc.GetTableReference(s.entityTableName)
+func (s *tablestore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext marks the version row of the entity as deleted, guarded by its ETag like every write. A hard delete
+// removes the rows of the entity in the log of all entities and all rows of the partition of the entity afterwards,
+// the version row last.
+func (s *tablestore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+
+	if id == logPartitionKey {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("the id %s is reserved for the log of all entities", logPartitionKey),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	etbl := s.getEntityTable(ctx)
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		vety := etbl.GetEntityReference(id, latestEntityVersion)
+		version := int64(0)
+		deleted := false
+
+		if err := vety.Get(10, storage.FullMetadata, nil); err == nil {
+			version, _ = vety.Properties["version"].(int64)
+			deleted = isDeleted(vety)
+		} else if !isNotFound(err) {
+			return loadError("faild to load version entity", err)
+		}
+
+		if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+			return err
+		}
+
+		if deleted {
+			return nil
+		}
+
+		vety.Properties[deletedProperty] = true
+
+		batch := etbl.NewBatch()
+		batch.ReplaceEntity(vety)
+		return s.executeBatch(batch)
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	if err != nil || !hard {
+		return err
+	}
+
+	return s.retryPolicy.Retry(ctx, func() error {
+		return s.deletePartition(etbl, id)
+	}, store.Retryable(store.None, isTransient))
+}
+
+// deletePartition removes the log rows and the rows of the partition of an entity in entity group transactions. The
+// version row is removed last, once no other row is left, so that a delete that fails leaves the entity deleted and
+// can be repeated.
+func (s *tablestore) deletePartition(table *storage.Table, id string) error {
+	if err := deleteQuery(table, fmt.Sprintf("(PartitionKey eq '%s') and (entityId eq '%s')", logPartitionKey, id)); err != nil {
+		return err
+	}
+
+	opts := storage.QueryOptions{
+		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (RowKey ne '%s')", id, latestEntityVersion),
+		Select: []string{"PartitionKey", "RowKey"},
+	}
+
+	if err := deleteQuery(table, opts.Filter); err != nil {
+		return err
+	}
+
+	opts.Top = 1
+	if result, err := table.QueryEntities(10, storage.NoMetadata, &opts); err != nil {
+		return deleteError(err)
+	} else if len(result.Entities) > 0 {
+		return deleteError(fmt.Errorf("rows of entity %s remain after the delete", id))
+	}
+
+	if err := table.GetEntityReference(id, latestEntityVersion).Delete(true, nil); err != nil && !isNotFound(err) {
+		return deleteError(err)
+	}
+
+	return nil
+}
+
+// deleteQuery deletes the rows of a partition that match filter in entity group transactions
+func deleteQuery(table *storage.Table, filter string) error {
+	opts := storage.QueryOptions{
+		Filter: filter,
+		Select: []string{"PartitionKey", "RowKey"},
+	}
+
+	result, err := table.QueryEntities(10, storage.NoMetadata, &opts)
+
+	for err == nil {
+		// a page contains at most 1000 rows, an entity group transaction at most 100 operations
+		for i := 0; i < len(result.Entities); i += 100 {
+			if err := deleteRows(table, result.Entities[i:min(i+100, len(result.Entities))]); err != nil {
+				return err
+			}
+		}
+
+		if result.NextLink == nil {
+			return nil
+		}
+
+		result, err = result.NextResults(nil)
+	}
+
+	return deleteError(err)
+}
+
+// deleteRows deletes rows in one entity group transaction. A row that is missing fails the whole transaction,
+// then the rows are deleted one by one.
+func deleteRows(table *storage.Table, rows []*storage.Entity) error {
+	batch := table.NewBatch()
+
+	for _, e := range rows {
+		batch.DeleteEntity(table.GetEntityReference(e.PartitionKey, e.RowKey), true)
+	}
+
+	err := batch.ExecuteBatch()
+	if err == nil {
+		return nil
+	} else if !isNotFound(err) {
+		return deleteError(err)
+	}
+
+	for _, e := range rows {
+		if err := table.GetEntityReference(e.PartitionKey, e.RowKey).Delete(true, nil); err != nil && !isNotFound(err) {
+			return deleteError(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *tablestore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (s *tablestore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	latest, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("version %v of entity %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "faild to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	tbl := s.getEntityTable(ctx)
+
+	// the snapshot row is only replaced by a snapshot of a newer version, guarded by its ETag
+	return s.retryPolicy.Retry(ctx, func() error {
+		sety := tbl.GetEntityReference(id, snapshotRowKey)
+		exists := true
+
+		if err := sety.Get(10, storage.FullMetadata, nil); err != nil {
+			if !isNotFound(err) {
+				return store.EventStoreError{
+					Text:       "failed to load snapshot",
+					ErrorType:  store.InternalError,
+					InnerError: err,
+				}
+			}
+
+			exists = false
+		} else if v, ok := sety.Properties["version"].(int64); ok && v >= version {
+			return nil
+		}
+
+		sety.Properties = map[string]interface{}{
+			"data":    data,
+			"version": version,
+		}
+
+		batch := tbl.NewBatch()
+
+		if exists {
+			batch.ReplaceEntity(sety)
+		} else {
+			batch.InsertEntity(sety)
+		}
+
+		return s.executeBatch(batch)
+	}, store.Retryable(store.None, isTransient))
+}
+
+func (s *tablestore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *tablestore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	tbl := s.getEntityTable(ctx)
+	sety := tbl.GetEntityReference(id, snapshotRowKey)
+
+	if err := sety.Get(10, storage.FullMetadata, nil); err != nil {
+		return nil, loadError("failed to load snapshot of entity", err)
+	}
+
+	result := &store.Snapshot{}
+
+	if err := json.Unmarshal(sety.Properties["data"].([]byte), result); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return result, nil
+}
+
+// Subscribe polls the log of all entities for new entities, see store.Subscriber.
+// The interval is configured with the metadata property pollInterval.
+func (s *tablestore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	return s.subscriber.Subscribe(ctx, fromPosition, handler)
+}
+
+// write stores entities, whose versions are set, in one entity group transaction with the operations of batch,
+// that update the version row. The positions of the entities are reserved in the log of all entities first, the
+// log rows are pending until the entities are stored. If they can't be completed afterwards, the next reader of
+// the log completes them, see resolve.
+func (s *tablestore) write(table *storage.Table, id string, entities []*store.Entity, batch *storage.TableBatch) error {
+	first, err := s.reserve(table, entities)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		eety, err := s.makeEntityTableEntity(table, entity)
+		if err != nil {
+			_ = s.completeLog(table, first, false)
+			return err
+		}
+
+		batch.InsertEntity(eety)
+
+		if entity.EventID != "" {
+			batch.InsertEntity(s.makeEventIDTableEntity(table, entity))
+		}
+	}
+
+	batch.InsertEntity(s.makePositionTableEntity(table, id, first, int64(len(entities)), false))
+
+	err = s.executeBatch(batch)
+	if err == nil {
+		// log rows that can't be completed here are completed by the next reader of the log
+		_ = s.completeLog(table, first, true)
+		return nil
+	}
+
+	// the transaction may have gone through, even if its response got lost
+	committed, aborted, aerr := s.abort(table, id, first)
+	if aerr != nil {
+		return aerr
+	}
+
+	_ = s.completeLog(table, first, committed)
+
+	if committed {
+		return nil
+	} else if !aborted {
+		return store.EventStoreError{
+			Text:       "the write was aborted by a reader of the log of all entities",
+			ErrorType:  store.InternalError,
+			InnerError: errAborted,
+		}
+	}
+
+	return err
+}
+
+// reserve reserves positions in the log of all entities for entities, that are about to be stored, and sets
+// their positions. The log rows and the latest position are written in one batch, guarded by the ETag of the
+// latest position, so positions are unique. It returns the position of the first entity.
+func (s *tablestore) reserve(table *storage.Table, entities []*store.Entity) (int64, error) {
+	pety := table.GetEntityReference(logPartitionKey, latestLogPosition)
+	position := int64(0)
+	exists := true
+
+	if err := pety.Get(10, storage.FullMetadata, nil); err != nil {
+		if !isNotFound(err) {
+			return 0, store.EventStoreError{
+				Text:       "failed to load latest position",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		exists = false
+	} else if p, ok := pety.Properties["position"].(int64); ok {
+		position = p
+	}
+
+	first := position + 1
+	batch := table.NewBatch()
+
+	for _, entity := range entities {
+		position++
+		entity.Position = position
+
+		lety, err := s.makeLogTableEntity(table, entity, first)
+		if err != nil {
+			return 0, err
+		}
+
+		batch.InsertEntity(lety)
+	}
+
+	pety.Properties = map[string]interface{}{
+		"position": position,
+	}
+
+	if exists {
+		batch.ReplaceEntity(pety)
+	} else {
+		batch.InsertEntity(pety)
+	}
+
+	if err := batch.ExecuteBatch(); err != nil {
+		for _, entity := range entities {
+			entity.Position = 0
+		}
+
+		if isConflict(err) {
+			// a concurrent writer took the same positions
+			return 0, store.EventStoreError{
+				Text:       "log has changed concurrently",
+				ErrorType:  store.InternalError,
+				InnerError: fmt.Errorf("%w: %v", errLogChanged, err),
+			}
+		}
+
+		return 0, store.EventStoreError{
+			Text:       "failed to append log entries",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return first, nil
+}
+
+// abort aborts the write of the entity with the given id, whose log rows start at first, unless its entities were
+// stored. It inserts an aborted position row for the write, that conflicts with the position row the write inserts
+// with the entities. It returns if the entities of the write were stored and if the write was aborted by this call.
+func (s *tablestore) abort(table *storage.Table, id string, first int64) (bool, bool, error) {
+	err := s.makePositionTableEntity(table, id, first, 0, true).Insert(storage.EmptyPayload, nil)
+	if err == nil {
+		return false, true, nil
+	} else if !isAlreadyExists(err) {
+		return false, false, store.EventStoreError{
+			Text:       "failed to abort write",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	pety := table.GetEntityReference(id, fmt.Sprintf(positionRowKeyFormat, first))
+
+	if err := pety.Get(10, storage.FullMetadata, nil); isNotFound(err) {
+		// the entity was hard deleted in between
+		return false, false, nil
+	} else if err != nil {
+		return false, false, loadError("failed to load position of write", err)
+	}
+
+	aborted, _ := pety.Properties["aborted"].(bool)
+	return !aborted, false, nil
+}
+
+// resolve completes the pending log rows of a write of the entity with the given id, that reserved the
+// positions starting at first. It aborts the write, unless its entities were stored, and returns if they were.
+func (s *tablestore) resolve(table *storage.Table, id string, first int64) (bool, error) {
+	committed, _, err := s.abort(table, id, first)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.completeLog(table, first, committed); err != nil {
+		return false, store.EventStoreError{
+			Text:       "failed to complete log entries",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return committed, nil
+}
+
+// completeLog completes the pending log rows of a write, that reserved the positions starting at first.
+// If the entities of the write were stored, the rows are no longer pending, otherwise they are deleted.
+func (s *tablestore) completeLog(table *storage.Table, first int64, committed bool) error {
+	// a write reserves at most maxBatchSize positions, its rows fit in one entity group transaction,
+	// but a page of the query may hold less rows than there are
+	opts := storage.QueryOptions{
+		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (RowKey ge '%s') and (RowKey lt '%s') and (first eq %v) and (pending eq true)",
+			logPartitionKey, fmt.Sprintf(logRowKeyFormat, first), fmt.Sprintf(logRowKeyFormat, first+maxBatchSize), first),
+		Select: []string{"PartitionKey", "RowKey"},
+	}
+
+	result, err := table.QueryEntities(10, storage.NoMetadata, &opts)
+	if err != nil {
+		return err
+	}
+
+	rows := result.Entities
+
+	for result.NextLink != nil {
+		if result, err = result.NextResults(nil); err != nil {
+			return err
+		}
+
+		rows = append(rows, result.Entities...)
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if !committed {
+		return deleteRows(table, rows)
+	}
+
+	batch := table.NewBatch()
+
+	for _, e := range rows {
+		batch.MergeEntity(completedRow(table, e))
+	}
+
+	// a row that is missing was hard deleted in between and fails the whole transaction
+	if err := batch.ExecuteBatch(); err == nil || !isNotFound(err) {
+		return err
+	}
+
+	for _, e := range rows {
+		if err := completedRow(table, e).Merge(true, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// completedRow returns the merge of a log row, that is no longer pending
+func completedRow(table *storage.Table, row *storage.Entity) *storage.Entity {
+	e := table.GetEntityReference(row.PartitionKey, row.RowKey)
+	e.Properties = map[string]interface{}{
+		"pending": false,
+	}
+	return e
+}
+
+func (s *tablestore) makeVersionTableEntity(table *storage.Table, entity *store.Entity) *storage.Entity {
+	props := map[string]interface{}{
+		"version": entity.Version,
+	}
+
+	e := table.GetEntityReference(entity.ID, latestEntityVersion)
+	e.Properties = props
+	return e
+}
+
+func (s *tablestore) makeEntityTableEntity(table *storage.Table, entity *store.Entity) (*storage.Entity, error) {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "faild to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+	// the creation time is stored in microseconds since the epoch, the storage library drops the
+	// fractional seconds of DateTime properties when they are read
+	props := map[string]interface{}{
+		"data":      data,
+		"version":   entity.Version,
+		"metadata":  entity.Metadata,
+		"createdAt": entity.System.CreatedAt.UnixMicro(),
+	}
+
+	e := table.GetEntityReference(entity.ID, fmt.Sprintf("%v", entity.Version))
+	e.Properties = props
+	return e, nil
+}
+
+func (s *tablestore) makeEventIDTableEntity(table *storage.Table, entity *store.Entity) *storage.Entity {
+	props := map[string]interface{}{
+		"eventVersion": entity.Version,
+	}
+
+	e := table.GetEntityReference(entity.ID, eventIDRowPrefix+entity.EventID)
+	e.Properties = props
+	return e
+}
+
+// makeLogTableEntity returns the pending log row of an entity, whose write reserved the positions starting at first
+func (s *tablestore) makeLogTableEntity(table *storage.Table, entity *store.Entity, first int64) (*storage.Entity, error) {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "faild to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+	props := map[string]interface{}{
+		"data":     data,
+		"entityId": entity.ID,
+		"version":  entity.Version,
+		"position": entity.Position,
+		"pending":  true,
+		"first":    first,
+	}
+
+	e := table.GetEntityReference(logPartitionKey, fmt.Sprintf(logRowKeyFormat, entity.Position))
+	e.Properties = props
+	return e, nil
+}
+
+// makePositionTableEntity returns the row that records, that the count entities of a write were stored with
+// the positions starting at first, or that the write was aborted
+func (s *tablestore) makePositionTableEntity(table *storage.Table, id string, first, count int64, aborted bool) *storage.Entity {
+	props := map[string]interface{}{
+		"first":   first,
+		"count":   count,
+		"aborted": aborted,
+	}
+
+	e := table.GetEntityReference(id, fmt.Sprintf(positionRowKeyFormat, first))
+	e.Properties = props
+	return e
+}
+
+// queryVersions queries the versions of the entity with the given id that match filter, ordered by version.
+// The version row is read first, to distinguish between an empty result and a missing or deleted entity.
+func (s *tablestore) queryVersions(ctx context.Context, id string, filter string) ([]store.Entity, error) {
+	if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+		return nil, err
+	}
+
+	tbl := s.getEntityTable(ctx)
+	opts := storage.QueryOptions{
+		Filter: filter,
+	}
+
+	result, err := tbl.QueryEntities(10, storage.FullMetadata, &opts)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entity versions",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	entities := result.Entities
+
+	// a query returns at most 1000 entities per page
+	for result.NextLink != nil {
+		result, err = result.NextResults(nil)
+		if err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to load entity versions",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		entities = append(entities, result.Entities...)
+	}
+
+	resultEntities := make([]store.Entity, len(entities))
+
+	for i, e := range entities {
+		if err := json.Unmarshal(e.Properties["data"].([]byte), &resultEntities[i]); err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to deserialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+	}
+
+	// RowKeys are strings, so the versions are not returned in numerical order
+	sort.Slice(resultEntities, func(i, j int) bool {
+		return resultEntities[i].Version < resultEntities[j].Version
+	})
+
+	return resultEntities, nil
+}
+
+// deduplicate looks up the rows of the event IDs of entities and the entities they refer to, see store.Deduplicate
+func (s *tablestore) deduplicate(ctx context.Context, table *storage.Table, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		ety := table.GetEntityReference(id, eventIDRowPrefix+eventID)
+
+		if err := ety.Get(10, storage.FullMetadata, nil); isNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, loadError("failed to load event id", err)
+		}
+
+		version, ok := ety.Properties["eventVersion"].(int64)
+		if !ok {
+			return nil, store.EventStoreError{
+				Text:       "invalid type assertion for type eventVersion",
+				ErrorType:  store.InternalError,
+				InnerError: nil,
+			}
+		}
+
+		entity, err := s.GetByVersionContext(ctx, id, version)
+		if err != nil {
+			return nil, err
+		}
+
+		// entities that were stored before their positions were reserved don't carry them
+		if entity.Position == 0 {
+			entity.Position, err = s.logPosition(table, id, version)
+		}
+
+		return entity, err
+	})
+}
+
+// logPosition returns the position of a version of an entity in the log of all entities,
+// or 0 if it is missing in the log. The log may keep the rows of entities, that were hard deleted
+// before hard deletes removed them, so the latest position is the one of the version that is stored now.
+func (s *tablestore) logPosition(table *storage.Table, id string, version int64) (int64, error) {
+	opts := storage.QueryOptions{
+		Filter: fmt.Sprintf("(PartitionKey eq '%s') and (entityId eq '%s') and (version eq %v)", logPartitionKey, id, version),
+	}
+
+	result, err := table.QueryEntities(10, storage.FullMetadata, &opts)
+	latest := int64(0)
+
+	for err == nil {
+		for _, e := range result.Entities {
+			if position, ok := e.Properties["position"].(int64); ok && position > latest {
+				latest = position
+			}
+		}
+
+		if result.NextLink == nil {
+			return latest, nil
+		}
+
+		result, err = result.NextResults(nil)
+	}
+
+	return 0, store.EventStoreError{
+		Text:       "failed to load position of entity",
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// executeBatch executes an entity group transaction, a conflict means that the entity was changed concurrently
+func (s *tablestore) executeBatch(batch *storage.TableBatch) error {
+	err := batch.ExecuteBatch()
+	if err == nil {
+		return nil
+	}
+
+	if isConflict(err) {
+		return store.EventStoreError{
+			Text:       "entity has gone stale, a newer version already exists",
+			ErrorType:  store.VersionConflict,
+			InnerError: err,
+		}
+	}
+
+	return store.EventStoreError{
+		Text:       "failed to append entities",
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// loadError returns the error for a failed read, only a missing row means that the entity was not found
+func loadError(text string, err error) store.EventStoreError {
+	if isNotFound(err) {
+		return store.EventStoreError{
+			Text:       text,
+			ErrorType:  store.EntityNotFound,
+			InnerError: err,
+		}
+	}
+
+	return store.EventStoreError{
+		Text:       text,
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+func deleteError(err error) store.EventStoreError {
+	return store.EventStoreError{
+		Text:       "failed to delete entity",
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// isDeleted checks if the version row of an entity marks it as soft deleted
+func isDeleted(vety *storage.Entity) bool {
+	deleted, _ := vety.Properties[deletedProperty].(bool)
+	return deleted
+}
+
+// isConflict checks if a request failed, because an entity was changed or inserted concurrently
+func isConflict(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.Code == entityAlreadyExists || serr.Code == updateConditionNotSatisfied ||
+			serr.StatusCode == http.StatusConflict || serr.StatusCode == http.StatusPreconditionFailed
+	}
+
+	return false
+}
+
+// isAlreadyExists checks if a request failed, because an entity that should be inserted exists
+func isAlreadyExists(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.Code == entityAlreadyExists || serr.StatusCode == http.StatusConflict
+	}
+
+	return false
+}
+
+// isNotFound checks if a request failed, because an entity does not exist
+func isNotFound(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.Code == resourceNotFound || serr.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
+
+// isTransient checks if a request failed because of a condition, that is likely to go away when the request is repeated:
+// a timeout, throttling or a failure of the service
+func isTransient(err error) bool {
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		return serr.StatusCode == http.StatusRequestTimeout || serr.StatusCode == http.StatusTooManyRequests ||
+			serr.StatusCode >= http.StatusInternalServerError
+	}
+
+	// other network errors, like an unknown host or an invalid certificate, don't go away
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return nerr.Timeout()
+	}
+
+	// the write can be repeated with new positions
+	return errors.Is(err, errAborted) || errors.Is(err, errLogChanged)
+}
+
+// getEntityTable returns a reference to the entity table whose requests are bound to ctx
+func (s *tablestore) getEntityTable(ctx context.Context) *storage.Table {
+	client := s.client
+	client.Sender = &contextSender{ctx: ctx, sender: s.client.Sender}
+
+	svc := client.GetTableService()
+	return svc.GetTableReference(s.entityTableName)
+}
+
+// contextSender binds all requests sent by a storage client to a context
+type contextSender struct {
+	ctx    context.Context
+	sender storage.Sender
+}
+
+func (c *contextSender) Send(client *storage.Client, req *http.Request) (*http.Response, error) {
+	return c.sender.Send(client, req.WithContext(c.ctx))
 }
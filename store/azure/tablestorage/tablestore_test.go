@@ -1,12 +1,21 @@
 package tablestorage
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/Azure/azure-sdk-for-go/storage"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -22,6 +31,13 @@ func init() {
 	emptyTestMetadata.Properties = map[string]string{}
 }
 
+// skipWithoutAccount skips a test, that needs a storage account, if none is configured
+func skipWithoutAccount(t *testing.T) {
+	if *storageAccountFlag == "" {
+		t.Skip("no storage account configured")
+	}
+}
+
 func initMetadata(suffix string) {
 	testMetadata.Properties = map[string]string{
 		storageAccountName: *storageAccountFlag,
@@ -45,6 +61,8 @@ func TestInit(t *testing.T) {
 	err := s.Init(emptyTestMetadata)
 	assert.NotNil(t, err)
 
+	skipWithoutAccount(t)
+
 	// test init with connectionstrings
 	s = NewStore()
 	err = s.Init(testMetadata)
@@ -53,6 +71,8 @@ func TestInit(t *testing.T) {
 }
 
 func TestAddEntity(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t2")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -78,6 +98,8 @@ func TestAddEntity(t *testing.T) {
 }
 
 func TestAppend(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t3")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -106,6 +128,8 @@ func TestAppend(t *testing.T) {
 }
 
 func TestAppendOldVersion(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t4")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -150,6 +174,8 @@ func TestAppendOldVersion(t *testing.T) {
 }
 
 func TestGetLatestVersionNumber(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t5")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -182,6 +208,8 @@ func TestGetLatestVersionNumber(t *testing.T) {
 }
 
 func TestGetLatestVersionNumberMissingEntity(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t6")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -195,6 +223,8 @@ func TestGetLatestVersionNumberMissingEntity(t *testing.T) {
 }
 
 func TestGetByVersion(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t7")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -233,6 +263,8 @@ func TestGetByVersion(t *testing.T) {
 }
 
 func TestGetByVersionRange(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t8")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -263,6 +295,8 @@ func TestGetByVersionRange(t *testing.T) {
 }
 
 func TestConcurrencyNone(t *testing.T) {
+	skipWithoutAccount(t)
+
 	initMetadata("t9")
 	s := NewStore()
 	err := s.Init(testMetadata)
@@ -296,3 +330,383 @@ func TestConcurrencyNone(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, int64(3), ety.Version)
 }
+
+func TestConformance(t *testing.T) {
+	skipWithoutAccount(t)
+
+	initMetadata("t10")
+	s := NewStore()
+	err := s.Init(testMetadata)
+	assert.Nil(t, err)
+
+	defer destroyTestData(t, s.(*tablestore))
+
+	storetest.RunConformance(t, func() store.EventStore {
+		return s
+	})
+}
+
+// newFakeStore returns a store connected to a new fake, that gives up after three quick attempts
+func newFakeStore(t *testing.T) (*fakeTableStorage, *tablestore) {
+	fake, metadata := newFakeTableStorage(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+	metadata.Properties[store.RetryMaxAttempts] = "3"
+	metadata.Properties[store.RetryBaseDelay] = "1ms"
+
+	s := fake.newStore()
+	require.Nil(t, s.Init(metadata))
+
+	return fake, s
+}
+
+func TestConformanceFake(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		fake, metadata := newFakeTableStorage(t)
+		metadata.Properties[store.PollInterval] = "10ms"
+
+		// small pages make the queries follow their continuation
+		fake.pageSize = 7
+
+		s := fake.newStore()
+		require.Nil(t, s.Init(metadata))
+		return s
+	})
+}
+
+// readAllIDs returns the ids of the entities in the log of all entities
+func readAllIDs(t *testing.T, s store.EventStore) []string {
+	entities, err := s.ReadAll(1, 1000)
+	assert.Nil(t, err)
+
+	ids := []string{}
+	for _, e := range entities {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+// pendingRows returns the number of rows of the log of all entities, that are pending
+func pendingRows(fake *fakeTableStorage) int {
+	pending := 0
+	for _, row := range fake.rows(logPartitionKey) {
+		if row["pending"] == true {
+			pending++
+		}
+	}
+	return pending
+}
+
+func TestCrashAfterReserve(t *testing.T) {
+	fake, s := newFakeStore(t)
+	s.pendingTimeout = time.Hour
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the writer stops after it reserved the position of the entity, none of its later requests arrive
+	reserved := false
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if reserved {
+			return errFakeBadRequest
+		}
+		reserved = isBatchWith(r, latestLogPosition)
+		return nil
+	})
+
+	_, err = s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	assert.NotNil(t, err)
+
+	fake.setFailRequest(nil)
+	assert.Equal(t, 1, pendingRows(fake))
+
+	_, err = s.GetLatestVersionNumber("2")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.Add(&store.Entity{ID: "3", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// readers stop at the pending write, until it is stale and they abort it
+	assert.Equal(t, []string{"1"}, readAllIDs(t, s))
+
+	s.pendingTimeout = 0
+	assert.Equal(t, []string{"1", "3"}, readAllIDs(t, s))
+	assert.Equal(t, 0, pendingRows(fake))
+
+	e, err := s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+	assert.Equal(t, []string{"1", "3", "2"}, readAllIDs(t, s))
+}
+
+func TestCrashAfterEntityBatch(t *testing.T) {
+	fake, s := newFakeStore(t)
+	s.pendingTimeout = time.Hour
+
+	// the writer stops after it stored the entity, it can't complete the log row
+	stored := false
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if stored {
+			return errFakeBadRequest
+		}
+		stored = isBatchWith(r, "position-")
+		return nil
+	})
+
+	e, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+
+	fake.setFailRequest(nil)
+	assert.Equal(t, 1, pendingRows(fake))
+	assert.Equal(t, []string{}, readAllIDs(t, s))
+
+	// a reader completes the log row of the stored entity, it is returned once
+	s.pendingTimeout = 0
+	assert.Equal(t, []string{"1"}, readAllIDs(t, s))
+	assert.Equal(t, 0, pendingRows(fake))
+	assert.Equal(t, []string{"1"}, readAllIDs(t, s))
+
+	e, err = s.Append(&store.Entity{ID: "1", Version: 1, Data: "Hello World"}, store.Optimistic)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+	assert.Equal(t, int64(2), e.Position)
+}
+
+func TestLostResponseOfEntityBatch(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the entity is stored, but the response gets lost
+	fake.setFailResponse(func(r *http.Request) *fakeError {
+		if isBatchWith(r, "position-") {
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	e, err := s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+
+	fake.setFailResponse(nil)
+
+	// the entity is stored and in the log once
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+	assert.Equal(t, []string{"1", "1"}, readAllIDs(t, s))
+	assert.Equal(t, 0, pendingRows(fake))
+}
+
+func TestStaleReservationIsAbortedByReaders(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// a reader aborts the write, while its position is reserved
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isBatchWith(r, "position-") {
+			fake.failRequest = nil
+			fake.mutex.Unlock()
+
+			s.pendingTimeout = 0
+			assert.Equal(t, []string{"1"}, readAllIDs(t, s))
+			s.pendingTimeout = time.Hour
+
+			fake.mutex.Lock()
+		}
+		return nil
+	})
+
+	// the aborted write is retried with the next position
+	e, err := s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), e.Version)
+	assert.Equal(t, int64(3), e.Position)
+
+	assert.Equal(t, []string{"1", "1"}, readAllIDs(t, s))
+	assert.Equal(t, 0, pendingRows(fake))
+
+	rows := fake.rows("1")
+	assert.Equal(t, true, rows[fmt.Sprintf(positionRowKeyFormat, 2)]["aborted"])
+	assert.Equal(t, false, rows[fmt.Sprintf(positionRowKeyFormat, 3)]["aborted"])
+}
+
+func TestAppendRetriesTransientErrors(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	entity := store.Entity{
+		ID:   "1",
+		Data: "Hello World",
+	}
+
+	_, err := s.Add(&entity)
+	require.Nil(t, err)
+
+	// the first transaction is throttled
+	executions := 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isBatchWith(r, "position-") {
+			executions++
+			if executions == 1 {
+				return errFakeTooManyRequests
+			}
+		}
+		return nil
+	})
+
+	e, err := s.Append(&entity, store.Optimistic)
+	assert.Nil(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, int64(2), e.Version)
+	assert.Equal(t, 2, executions)
+
+	// every transaction is throttled
+	executions = 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isBatchWith(r, "position-") {
+			executions++
+			return errFakeTooManyRequests
+		}
+		return nil
+	})
+
+	e, err = s.Append(&entity, store.None)
+	assert.Nil(t, e)
+	assert.Equal(t, 3, executions)
+	assert.True(t, errors.Is(err, store.ErrRetriesExhausted))
+
+	// errors that are not transient are not retried
+	executions = 0
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isBatchWith(r, "position-") {
+			executions++
+			return errFakeBadRequest
+		}
+		return nil
+	})
+
+	e, err = s.Append(&entity, store.None)
+	assert.Nil(t, e)
+	assert.Equal(t, 1, executions)
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	fake.setFailRequest(nil)
+
+	version, err := s.GetLatestVersionNumber(entity.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	// the log holds the stored entities only
+	assert.Equal(t, []string{"1", "1"}, readAllIDs(t, s))
+	assert.Equal(t, 0, pendingRows(fake))
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{storage.AzureStorageServiceError{StatusCode: http.StatusTooManyRequests}, true},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusRequestTimeout}, true},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusInternalServerError}, true},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusBadGateway}, true},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusServiceUnavailable}, true},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusBadRequest}, false},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusForbidden}, false},
+		{storage.AzureStorageServiceError{StatusCode: http.StatusConflict}, false},
+		{&url.Error{Op: "Get", URL: "https://account.table.core.windows.net", Err: os.ErrDeadlineExceeded}, true},
+		{&url.Error{Op: "Get", URL: "https://account.table.core.windows.net", Err: errors.New("no such host")}, false},
+		{fmt.Errorf("%w: %v", errLogChanged, errors.New("conflict")), true},
+		{errAborted, true},
+		{errors.New("failed"), false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.transient, isTransient(test.err), test.err.Error())
+	}
+}
+
+func TestErrorsAreMapped(t *testing.T) {
+	fake, s := newFakeStore(t)
+
+	entity := store.Entity{
+		ID:   "1",
+		Data: "Hello World",
+	}
+
+	_, err := s.Add(&entity)
+	require.Nil(t, err)
+
+	// a failed request doesn't mean that the entity does not exist
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		return errFakeBadRequest
+	})
+
+	_, err = s.GetLatestVersionNumber(entity.ID)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+	storetest.AssertErrorType(t, err, store.InternalError)
+
+	_, err = s.GetByVersion(entity.ID, 1)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.GetByVersionRange(entity.ID, 1, 1)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.GetLatestSnapshot(entity.ID)
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		return errFakeNotFound
+	})
+
+	_, err = s.GetByVersion(entity.ID, 1)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	fake.setFailRequest(nil)
+
+	_, err = s.GetByVersion(entity.ID, 2)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.GetLatestVersionNumber("2")
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.GetLatestSnapshot(entity.ID)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	// a conflicting insert of the version row means that the entity exists
+	_, err = s.Add(&store.Entity{ID: entity.ID})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists))
+
+	_, err = s.AppendToStream(entity.ID, store.NoStream, []*store.Entity{{Data: "Hello World"}})
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists))
+
+	_, err = s.Append(&store.Entity{ID: entity.ID, Version: 0, Data: "Hello World"}, store.Optimistic)
+	assert.True(t, errors.Is(err, store.ErrVersionConflict))
+
+	// the version row changed between the read and the transaction, the ETag doesn't match anymore
+	replaced := false
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if !replaced && isBatchWith(r, "position-") {
+			replaced = true
+			fake.mutex.Unlock()
+			defer fake.mutex.Lock()
+
+			_, err := s.Append(&store.Entity{ID: entity.ID, Version: 1, Data: "Hello World"}, store.Optimistic)
+			assert.Nil(t, err)
+		}
+		return nil
+	})
+
+	_, err = s.AppendBatch(entity.ID, 1, []*store.Entity{{Data: "Hello World"}})
+	assert.True(t, errors.Is(err, store.ErrVersionConflict))
+	assert.True(t, replaced)
+
+	fake.setFailRequest(nil)
+
+	_, err = s.AppendBatch("2", 0, []*store.Entity{{Data: "Hello World"}})
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+}
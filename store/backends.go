@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates a new EventStore, that is not initialized yet
+type Factory func() EventStore
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]Factory)
+)
+
+// Register makes an EventStore backend available by name, like a database/sql driver.
+// Backends call Register in their init function. If Register is called twice with the same name
+// or factory is nil, it panics.
+func Register(name string, factory Factory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	if factory == nil {
+		panic("store: Register factory is nil")
+	}
+
+	if _, exists := backends[name]; exists {
+		panic("store: Register called twice for backend " + name)
+	}
+
+	backends[name] = factory
+}
+
+// Open creates a new EventStore of the backend registered with name and initializes it with metadata.
+// The package of the backend must be imported, e.g. with a blank import, to register it.
+func Open(name string, metadata Metadata) (EventStore, error) {
+	backendsMutex.RLock()
+	factory, exists := backends[name]
+	backendsMutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("store: unknown backend %q (forgotten import?)", name)
+	}
+
+	s := factory()
+
+	if err := s.Init(metadata); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
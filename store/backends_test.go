@@ -0,0 +1,65 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initStore is an EventStore that only supports Init
+type initStore struct {
+	EventStore
+	metadata Metadata
+	err      error
+}
+
+func (s *initStore) Init(metadata Metadata) error {
+	s.metadata = metadata
+	return s.err
+}
+
+func TestOpen(t *testing.T) {
+	Register("test-open", func() EventStore {
+		return &initStore{}
+	})
+
+	metadata := Metadata{Properties: map[string]string{"key": "value"}}
+
+	s, err := Open("test-open", metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, metadata, s.(*initStore).metadata)
+
+	assert.Contains(t, Backends(), "test-open")
+
+	_, err = Open("test-unknown", metadata)
+	assert.NotNil(t, err)
+}
+
+func TestOpenInitFails(t *testing.T) {
+	errInit := errors.New("init failed")
+
+	Register("test-init-fails", func() EventStore {
+		return &initStore{err: errInit}
+	})
+
+	s, err := Open("test-init-fails", Metadata{})
+	assert.Nil(t, s)
+	assert.Equal(t, errInit, err)
+}
+
+func TestRegisterTwice(t *testing.T) {
+	factory := func() EventStore {
+		return &initStore{}
+	}
+
+	Register("test-twice", factory)
+
+	assert.Panics(t, func() {
+		Register("test-twice", factory)
+	})
+
+	assert.Panics(t, func() {
+		Register("test-nil", nil)
+	})
+}
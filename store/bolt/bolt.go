@@ -0,0 +1,772 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	bbolt "go.etcd.io/bbolt"
+)
+
+const (
+	// BackendName is the name the bbolt store is registered with, see store.Open
+	BackendName = "bolt"
+
+	// dataSource is the metadata property for the path of the database file
+	dataSource = "dataSource"
+
+	// subscribeBatchSize is the number of entities a subscription reads at once
+	subscribeBatchSize = 100
+)
+
+var (
+	// streamsBucket contains a bucket for every entity, whose keys are the versions and whose sequence is the latest version
+	streamsBucket = []byte("streams")
+	// logBucket contains the log of all entities, whose keys are the positions and whose values refer to the versions
+	logBucket = []byte("log")
+	// snapshotsBucket contains the latest snapshot of every entity
+	snapshotsBucket = []byte("snapshots")
+	// eventIDsBucket contains a bucket for every entity with event IDs, whose keys are the event IDs and whose values are the versions
+	eventIDsBucket = []byte("eventids")
+	// tombstonesBucket contains the ids of the entities whose streams are soft deleted
+	tombstonesBucket = []byte("tombstones")
+)
+
+type boltstore struct {
+	db *bbolt.DB
+	// notify is closed and replaced whenever entities are stored, to wake up subscriptions
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new bbolt store
+func NewStore() store.EventStore {
+	return &boltstore{}
+}
+
+func (s *boltstore) Init(metadata store.Metadata) error {
+	path, ok := metadata.Properties[dataSource]
+	if !ok || path == "" {
+		return errors.New("bolt: data source is missing")
+	}
+
+	// the file is locked by the process that opened it, don't wait forever for another process
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{streamsBucket, logBucket, snapshotsBucket, eventIDsBucket, tombstonesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	s.notify = make(chan struct{})
+	return nil
+}
+
+// Close closes the database and releases the lock of the file
+func (s *boltstore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltstore) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *boltstore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err := s.update(func(tx *bbolt.Tx) error {
+		if duplicate, err := deduplicate(tx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		b, err := tx.Bucket(streamsBucket).CreateBucket([]byte(entity.ID))
+		if err == bbolt.ErrBucketExists && deleted(tx, entity.ID) {
+			return store.StreamDeletedError(entity.ID)
+		} else if err == bbolt.ErrBucketExists {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+				ErrorType:  store.AlreadyExists,
+				InnerError: nil,
+			}
+		} else if err != nil {
+			return err
+		}
+
+		entity.Version = 1
+		return put(tx, b, entity)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *boltstore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *boltstore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// there is only one write transaction at a time, so the version can't change before it is written
+	err := s.update(func(tx *bbolt.Tx) error {
+		if duplicate, err := deduplicate(tx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		b, err := stream(tx, entity.ID)
+		if err != nil {
+			return err
+		}
+
+		version := int64(b.Sequence())
+
+		if concurrency == store.Optimistic && version != entity.Version {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		entity.Version = version + 1
+		return put(tx, b, entity)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *boltstore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *boltstore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// all entities are written in one transaction, so either all or none are stored
+	err := s.update(func(tx *bbolt.Tx) error {
+		if duplicate, err := deduplicate(tx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		b, err := stream(tx, id)
+		if err != nil {
+			return err
+		}
+
+		version := int64(b.Sequence())
+
+		if version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		for _, entity := range entities {
+			version++
+			entity.ID = id
+			entity.Version = version
+
+			if err := put(tx, b, entity); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *boltstore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *boltstore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err := s.update(func(tx *bbolt.Tx) error {
+		if duplicate, err := deduplicate(tx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		if deleted(tx, id) {
+			return store.StreamDeletedError(id)
+		}
+
+		b := tx.Bucket(streamsBucket).Bucket([]byte(id))
+
+		version := int64(0)
+		if b != nil {
+			version = int64(b.Sequence())
+		}
+
+		if err := expected.Check(id, version); err != nil {
+			return err
+		}
+
+		if len(entities) == 0 {
+			return nil
+		}
+
+		if b == nil {
+			var err error
+			if b, err = tx.Bucket(streamsBucket).CreateBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		for _, entity := range entities {
+			version++
+			entity.ID = id
+			entity.Version = version
+
+			if err := put(tx, b, entity); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *boltstore) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *boltstore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var version int64
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b, err := stream(tx, id)
+		if err != nil {
+			return err
+		}
+
+		version = int64(b.Sequence())
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (s *boltstore) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *boltstore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var entity *store.Entity
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b, err := stream(tx, id)
+		if err != nil {
+			return err
+		}
+
+		v := b.Get(key(version))
+		if v == nil {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		}
+
+		entity, err = decode(v)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *boltstore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (s *boltstore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	result := []store.Entity{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b, err := stream(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// the keys are big-endian, so the cursor walks the versions in ascending order
+		c := b.Cursor()
+		end := key(endVersion)
+
+		for k, v := c.Seek(key(startVersion)); k != nil && endVersion >= startVersion && string(k) <= string(end); k, v = c.Next() {
+			entity, err := decode(v)
+			if err != nil {
+				return err
+			}
+
+			result = append(result, *entity)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *boltstore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+func (s *boltstore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	return store.GetAsOf(ctx, s, id, at)
+}
+
+func (s *boltstore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *boltstore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return store.GetByTimeRange(ctx, s, id, from, to)
+}
+
+func (s *boltstore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (s *boltstore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	result := []store.Entity{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		streams := tx.Bucket(streamsBucket)
+		c := tx.Bucket(logBucket).Cursor()
+
+		for k, v := c.Seek(key(fromPosition)); k != nil && len(result) < maxCount; k, v = c.Next() {
+			// the value of a log entry is the version followed by the id of the entity
+			b := streams.Bucket(v[8:])
+			if b == nil {
+				return store.EventStoreError{
+					Text:       fmt.Sprintf("Entity with ID %s of position %v does not exist", v[8:], binary.BigEndian.Uint64(k)),
+					ErrorType:  store.InternalError,
+					InnerError: nil,
+				}
+			}
+
+			entity, err := decode(b.Get(v[:8]))
+			if err != nil {
+				return err
+			}
+
+			result = append(result, *entity)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *boltstore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext writes a tombstone to soft delete a stream. A hard delete removes the bucket of the
+// entity and its entries in the log of all entities, the positions of the remaining entities don't change.
+func (s *boltstore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(streamsBucket).Bucket([]byte(id))
+
+		version := int64(0)
+		if b != nil {
+			version = int64(b.Sequence())
+		}
+
+		if err := store.CheckDelete(id, version, deleted(tx, id), hard, expected); err != nil {
+			return err
+		}
+
+		if !hard {
+			return tx.Bucket(tombstonesBucket).Put([]byte(id), key(version))
+		}
+
+		log := tx.Bucket(logBucket)
+
+		err := b.ForEach(func(_, v []byte) error {
+			entity, err := decode(v)
+			if err != nil {
+				return err
+			}
+
+			return log.Delete(key(entity.Position))
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(streamsBucket).DeleteBucket([]byte(id)); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(eventIDsBucket).DeleteBucket([]byte(id)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+
+		if err := tx.Bucket(snapshotsBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		return tx.Bucket(tombstonesBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltstore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (s *boltstore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(streamsBucket).Bucket([]byte(id))
+		if b == nil || version < 1 || version > int64(b.Sequence()) {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		}
+
+		snapshots := tx.Bucket(snapshotsBucket)
+
+		// a snapshot only replaces a snapshot of an older version
+		if existing := snapshots.Get([]byte(id)); existing != nil {
+			var snapshot store.Snapshot
+			if err := json.Unmarshal(existing, &snapshot); err == nil && snapshot.Version >= version {
+				return nil
+			}
+		}
+
+		return snapshots.Put([]byte(id), data)
+	})
+}
+
+func (s *boltstore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *boltstore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	snapshot := &store.Snapshot{}
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(snapshotsBucket).Get([]byte(id))
+		if data == nil {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		}
+
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return store.EventStoreError{
+				Text:       "failed to deserialize snapshot",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe delivers the entities of the log of all entities starting at fromPosition to handler.
+// The database file is locked by one process, so new entities are delivered as soon as they are stored, see store.Subscriber.
+func (s *boltstore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		// take the channel before reading, so that entities stored while reading wake up the subscription
+		s.mutex.Lock()
+		notify := s.notify
+		s.mutex.Unlock()
+
+		entities, err := s.ReadAllContext(ctx, position, subscribeBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, entity := range entities {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			position = entity.Position + 1
+		}
+
+		if len(entities) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// update runs fn in a write transaction and wakes up subscriptions, if the transaction is committed
+func (s *boltstore) update(fn func(tx *bbolt.Tx) error) error {
+	if err := s.db.Update(fn); err != nil {
+		var evterr store.EventStoreError
+		if errors.As(err, &evterr) {
+			return err
+		}
+
+		return store.EventStoreError{
+			Text:       "failed to write entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	s.mutex.Lock()
+	close(s.notify)
+	s.notify = make(chan struct{})
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// stream returns the bucket of the entity with the given id, or an EventStoreError of type
+// StreamDeleted if its stream is soft deleted
+func stream(tx *bbolt.Tx, id string) (*bbolt.Bucket, error) {
+	b := tx.Bucket(streamsBucket).Bucket([]byte(id))
+	if b == nil {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if deleted(tx, id) {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	return b, nil
+}
+
+// deleted checks if the stream of the entity with the given id is soft deleted
+func deleted(tx *bbolt.Tx, id string) bool {
+	return tx.Bucket(tombstonesBucket).Get([]byte(id)) != nil
+}
+
+// put assigns the next position and the type to entity, stores it in the bucket of its stream
+// and adds it to the log. The sequence of the bucket is set to the version of entity.
+func put(tx *bbolt.Tx, b *bbolt.Bucket, entity *store.Entity) error {
+	log := tx.Bucket(logBucket)
+
+	position, err := log.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	entity.Position = int64(position)
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
+
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	version := key(entity.Version)
+
+	if err := b.Put(version, data); err != nil {
+		return err
+	}
+
+	if err := b.SetSequence(uint64(entity.Version)); err != nil {
+		return err
+	}
+
+	if entity.EventID != "" {
+		ids, err := tx.Bucket(eventIDsBucket).CreateBucketIfNotExists([]byte(entity.ID))
+		if err != nil {
+			return err
+		}
+
+		if err := ids.Put([]byte(entity.EventID), version); err != nil {
+			return err
+		}
+	}
+
+	return log.Put(key(entity.Position), append(version, entity.ID...))
+}
+
+// key encodes a version or position as big-endian, so that the keys are sorted by their number
+func key(n int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(n))
+	return k
+}
+
+// deduplicate checks if entities were already stored in the stream of the entity with the given id, see store.Deduplicate
+func deduplicate(tx *bbolt.Tx, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		ids := tx.Bucket(eventIDsBucket).Bucket([]byte(id))
+		if ids == nil {
+			return nil, nil
+		}
+
+		version := ids.Get([]byte(eventID))
+		if version == nil {
+			return nil, nil
+		}
+
+		return decode(tx.Bucket(streamsBucket).Bucket([]byte(id)).Get(version))
+	})
+}
+
+// decode deserializes an entity and decodes its data with store.Types
+func decode(data []byte) (*store.Entity, error) {
+	entity := &store.Entity{}
+
+	if err := json.Unmarshal(data, entity); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return entity, nil
+}
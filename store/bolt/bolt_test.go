@@ -0,0 +1,105 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetadata(t *testing.T) store.Metadata {
+	return store.Metadata{
+		Properties: map[string]string{
+			dataSource: filepath.Join(t.TempDir(), "eventstore.bolt"),
+		},
+	}
+}
+
+func newStore(t *testing.T, metadata store.Metadata) store.EventStore {
+	s := NewStore()
+	require.Nil(t, s.Init(metadata))
+
+	t.Cleanup(func() {
+		s.(*boltstore).Close()
+	})
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		return newStore(t, newMetadata(t))
+	})
+}
+
+func TestInitMissingDataSource(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestPersistence(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "Hello World!"}, store.None)
+	require.Nil(t, err)
+
+	require.Nil(t, s.(*boltstore).Close())
+
+	// the entities are still there when the file is opened again
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	res, err := s.GetByVersion("1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World!", res.Data)
+	assert.Equal(t, int64(2), res.Position)
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	storetest.AssertErrorType(t, err, store.AlreadyExists)
+}
+
+func TestGetByVersionRangeOrder(t *testing.T) {
+	s := newStore(t, newMetadata(t))
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: 1})
+	require.Nil(t, err)
+
+	entities := []*store.Entity{}
+	for i := 2; i <= 300; i++ {
+		entities = append(entities, &store.Entity{Data: i})
+	}
+
+	_, err = s.AppendBatch("1", 1, entities)
+	require.Nil(t, err)
+
+	// the versions span more than one byte of the keys
+	res, err := s.GetByVersionRange("1", 250, 260)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, int64(250+i), e.Version)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	s, err := store.Open(BackendName, newMetadata(t))
+	require.Nil(t, err)
+	defer s.(*boltstore).Close()
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
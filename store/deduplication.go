@@ -0,0 +1,116 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// errPartialDuplicate is the inner error of the VersionConflict returned by Deduplicate. Retrying the
+// write doesn't resolve the conflict, see Retryable.
+var errPartialDuplicate = errors.New("write is partially stored")
+
+// HasEventIDs checks if any of the entities carries an event ID
+func HasEventIDs(entities []*Entity) bool {
+	for _, entity := range entities {
+		if entity.EventID != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateEventIDs returns an EventStoreError of type InternalError if an event ID of the entities
+// is no UUID or occurs more than once
+func ValidateEventIDs(entities []*Entity) error {
+	seen := map[string]bool{}
+
+	for _, entity := range entities {
+		if entity.EventID == "" {
+			continue
+		}
+
+		if _, err := uuid.Parse(entity.EventID); err != nil {
+			return EventStoreError{
+				Text:       fmt.Sprintf("event id %s is no UUID", entity.EventID),
+				ErrorType:  InternalError,
+				InnerError: err,
+			}
+		}
+
+		if seen[entity.EventID] {
+			return EventStoreError{
+				Text:       fmt.Sprintf("event id %s occurs more than once", entity.EventID),
+				ErrorType:  InternalError,
+				InnerError: nil,
+			}
+		}
+
+		seen[entity.EventID] = true
+	}
+
+	return nil
+}
+
+// Deduplicate detects a write that is repeated, e.g. by a client that retries after a timeout, by the
+// event IDs of its entities. stored returns the entity that is stored in the stream of the entity with
+// the given id with an event ID, or nil if there is none. Backends call it before the expected version
+// is checked, because the version has changed when the repeated write was stored.
+//
+// If none of the entities is stored, Deduplicate returns false and the entities have to be written.
+// If all of them are stored with consecutive versions, the write is a duplicate: the entities get the
+// versions, positions and system metadata they are stored with and Deduplicate returns true. If only some
+// of them are stored, an EventStoreError of type VersionConflict is returned.
+func Deduplicate(id string, entities []*Entity, stored func(eventID string) (*Entity, error)) (bool, error) {
+	if err := ValidateEventIDs(entities); err != nil {
+		return false, err
+	}
+
+	if !HasEventIDs(entities) {
+		return false, nil
+	}
+
+	found := make([]*Entity, len(entities))
+	count := 0
+
+	for i, entity := range entities {
+		if entity.EventID == "" {
+			continue
+		}
+
+		e, err := stored(entity.EventID)
+		if err != nil {
+			return false, err
+		}
+
+		if e != nil {
+			found[i] = e
+			count++
+		}
+	}
+
+	if count == 0 {
+		return false, nil
+	}
+
+	for i := range entities {
+		if found[i] == nil || found[i].Version != found[0].Version+int64(i) {
+			return false, EventStoreError{
+				Text:       fmt.Sprintf("some of the events were already stored in entity %s, others not", id),
+				ErrorType:  VersionConflict,
+				InnerError: errPartialDuplicate,
+			}
+		}
+	}
+
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = found[i].Version
+		entity.Position = found[i].Position
+		entity.System = found[i].System
+	}
+
+	return true, nil
+}
@@ -0,0 +1,37 @@
+package store
+
+import "fmt"
+
+// StreamDeletedError returns an EventStoreError of type StreamDeleted for the entity with the given id,
+// whose stream was soft deleted
+func StreamDeletedError(id string) error {
+	return EventStoreError{
+		Text:       fmt.Sprintf("Stream of entity with ID %s was deleted", id),
+		ErrorType:  StreamDeleted,
+		InnerError: nil,
+	}
+}
+
+// CheckDelete checks if the entity with the given id can be deleted with expected, see EventStore.Delete.
+// version is the latest version of the entity or 0 if it doesn't exist, deleted reports if its stream is
+// soft deleted. It returns an EventStoreError of type EntityNotFound if the entity doesn't exist, of type
+// StreamDeleted if a deleted stream is soft deleted again, or the error of expected.Check.
+func CheckDelete(id string, version int64, deleted, hard bool, expected ExpectedVersion) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if deleted && !hard {
+		return StreamDeletedError(id)
+	}
+
+	return expected.Check(id, version)
+}
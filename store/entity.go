@@ -1,9 +1,59 @@
 package store
 
+import "encoding/json"
+
 // Entity represents a record in the EventStore
+//
+// Position is the position of the entity in the log of all entities, that is read with ReadAll.
+// Positions start with 1 and increase in the order the entities are stored, they are not
+// necessarily consecutive. The position is set on the entities returned by the write operations
+// and by ReadAll, entities that are read by version don't necessarily carry their position.
+//
+// Type is the name the type of Data is registered with in Types. It is set by the EventStore when
+// an entity is stored, and used to decode Data into the registered Go type when an entity is read.
+//
+// EventID is an optional UUID that is chosen by the client, e.g. with uuid.NewString(). A write of
+// entities whose event IDs are already stored in the stream is not stored again, see Deduplicate.
+//
+// System is the system metadata of the entity, see SystemMetadata. It is set when the entity is stored
+// and returned by all reads, entities that were stored before it was introduced have none.
 type Entity struct {
-	ID       string      `json:"id"`
-	Version  int64       `json:"version"`
-	Metadata string      `json:"metadata"`
-	Data     interface{} `json:"data"`
+	ID       string          `json:"id"`
+	Version  int64           `json:"version"`
+	Position int64           `json:"position,omitempty"`
+	EventID  string          `json:"eventId,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Metadata string          `json:"metadata"`
+	System   *SystemMetadata `json:"system,omitempty"`
+	Data     interface{}     `json:"data"`
+}
+
+// UnmarshalJSON decodes Data into the Go type that is registered for Type
+func (e *Entity) UnmarshalJSON(b []byte) error {
+	type entity Entity
+
+	aux := struct {
+		*entity
+		Data json.RawMessage `json:"data"`
+	}{
+		entity: (*entity)(e),
+	}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	e.Data = nil
+
+	if len(aux.Data) == 0 {
+		return nil
+	}
+
+	data, err := Types.Decode(e.Type, aux.Data)
+	if err != nil {
+		return err
+	}
+
+	e.Data = data
+	return nil
 }
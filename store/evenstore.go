@@ -1,5 +1,10 @@
 package store
 
+import (
+	"context"
+	"time"
+)
+
 // ConcurrencyControl controls concurrency handlen when new entities are append to the event store
 type ConcurrencyControl int
 
@@ -11,12 +16,50 @@ const (
 )
 
 // EventStore is the interface for an event store
+//
+// Every operation has a variant that takes a context.Context. The context is passed down
+// to the storage backend and cancels pending requests and retries. The variants without
+// a context use context.Background().
 type EventStore interface {
 	Init(metadata Metadata) error
 	Add(entity *Entity) (*Entity, error)
 	Append(entity *Entity, concurrency ConcurrencyControl) (*Entity, error)
+	// AppendBatch appends entities with consecutive versions to the entity with the given id.
+	// Either all entities are appended or none. expectedVersion must be the latest version of the entity.
+	AppendBatch(id string, expectedVersion int64, entities []*Entity) ([]*Entity, error)
+	// AppendToStream appends entities with consecutive versions to the entity with the given id, if its
+	// latest version satisfies expected, see ExpectedVersion. The entity is created if expected allows it.
+	// Either all entities are appended or none, without entities only expected is checked.
+	AppendToStream(id string, expected ExpectedVersion, entities []*Entity) ([]*Entity, error)
 
 	GetLatestVersionNumber(id string) (int64, error)
 	GetByVersion(id string, version int64) (*Entity, error)
 	GetByVersionRange(id string, startVersion int64, endVersion int64) ([]Entity, error)
+	// GetAsOf returns the latest version of the entity with the given id, that was created at or before at,
+	// see SystemMetadata. It returns an EventStoreError of type EntityNotFound if there is none.
+	GetAsOf(id string, at time.Time) (*Entity, error)
+	// GetByTimeRange returns the versions of the entity with the given id, that were created between from
+	// and to, both inclusive. Versions that were stored without system metadata are never returned.
+	GetByTimeRange(id string, from time.Time, to time.Time) ([]Entity, error)
+	// ReadAll reads at most maxCount entities of all entities in the order they were stored, starting
+	// with the entity at fromPosition. To continue reading, pass the position of the last entity plus 1.
+	ReadAll(fromPosition int64, maxCount int) ([]Entity, error)
+	// Delete deletes the stream of the entity with the given id, if its latest version satisfies expected.
+	// A soft delete writes a tombstone: reads and writes of the entity return an EventStoreError of type
+	// StreamDeleted. A hard delete removes the versions, event IDs and snapshots of the entity, afterwards
+	// the entity doesn't exist and its id can be used again. A soft deleted stream can be hard deleted.
+	Delete(id string, expected ExpectedVersion, hard bool) error
+
+	AddContext(ctx context.Context, entity *Entity) (*Entity, error)
+	AppendContext(ctx context.Context, entity *Entity, concurrency ConcurrencyControl) (*Entity, error)
+	AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*Entity) ([]*Entity, error)
+	AppendToStreamContext(ctx context.Context, id string, expected ExpectedVersion, entities []*Entity) ([]*Entity, error)
+
+	GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error)
+	GetByVersionContext(ctx context.Context, id string, version int64) (*Entity, error)
+	GetByVersionRangeContext(ctx context.Context, id string, startVersion int64, endVersion int64) ([]Entity, error)
+	GetAsOfContext(ctx context.Context, id string, at time.Time) (*Entity, error)
+	GetByTimeRangeContext(ctx context.Context, id string, from time.Time, to time.Time) ([]Entity, error)
+	ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]Entity, error)
+	DeleteContext(ctx context.Context, id string, expected ExpectedVersion, hard bool) error
 }
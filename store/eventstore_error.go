@@ -1,6 +1,9 @@
 package store
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // ErrorType is the base type of error that are returned
 type ErrorType int
@@ -14,9 +17,33 @@ const (
 	VersionConflict
 	// InternalError is returned i9n all other casses
 	InternalError
+	// RetriesExhausted is returned when an operation still fails after the configured number of retries
+	RetriesExhausted
+	// AlreadyExists is returned when an entity should be added that already exists
+	AlreadyExists
+	// StreamDeleted is returned when an entity is read or written, whose stream was deleted
+	StreamDeleted
+)
+
+var (
+	// ErrNotFound matches an EventStoreError of type EntityNotFound with errors.Is
+	ErrNotFound = errors.New("entity not found")
+	// ErrVersionConflict matches an EventStoreError of type VersionConflict with errors.Is
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrAlreadyExists matches an EventStoreError of type AlreadyExists with errors.Is
+	ErrAlreadyExists = errors.New("entity already exists")
+	// ErrSerializationFailed matches an EventStoreError of type SerializationFailed with errors.Is
+	ErrSerializationFailed = errors.New("serialization failed")
+	// ErrRetriesExhausted matches an EventStoreError of type RetriesExhausted with errors.Is
+	ErrRetriesExhausted = errors.New("retries exhausted")
+	// ErrStreamDeleted matches an EventStoreError of type StreamDeleted with errors.Is
+	ErrStreamDeleted = errors.New("stream deleted")
 )
 
 // EventStoreError that is returned in case of an error
+//
+// errors.Is matches an EventStoreError with the sentinel error of its ErrorType, e.g. ErrNotFound,
+// and with the errors of its InnerError chain.
 type EventStoreError struct {
 	Text       string
 	ErrorType  ErrorType
@@ -24,5 +51,34 @@ type EventStoreError struct {
 }
 
 func (e EventStoreError) Error() string {
+	if e.InnerError == nil {
+		return e.Text
+	}
+
 	return fmt.Sprintf("%s -- Inner error: %s", e.Text, e.InnerError)
 }
+
+// Is reports whether target is the sentinel error of the type of e
+func (e EventStoreError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.ErrorType == EntityNotFound
+	case ErrVersionConflict:
+		return e.ErrorType == VersionConflict
+	case ErrAlreadyExists:
+		return e.ErrorType == AlreadyExists
+	case ErrSerializationFailed:
+		return e.ErrorType == SerializationFailed
+	case ErrRetriesExhausted:
+		return e.ErrorType == RetriesExhausted
+	case ErrStreamDeleted:
+		return e.ErrorType == StreamDeleted
+	}
+
+	return false
+}
+
+// Unwrap returns the inner error
+func (e EventStoreError) Unwrap() error {
+	return e.InnerError
+}
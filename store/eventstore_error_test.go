@@ -0,0 +1,50 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventStoreErrorIs(t *testing.T) {
+	sentinels := map[ErrorType]error{
+		EntityNotFound:      ErrNotFound,
+		VersionConflict:     ErrVersionConflict,
+		AlreadyExists:       ErrAlreadyExists,
+		SerializationFailed: ErrSerializationFailed,
+		RetriesExhausted:    ErrRetriesExhausted,
+		StreamDeleted:       ErrStreamDeleted,
+	}
+
+	for errorType, sentinel := range sentinels {
+		err := EventStoreError{Text: "failed", ErrorType: errorType}
+		assert.True(t, errors.Is(err, sentinel))
+
+		// wrapped errors match as well
+		assert.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), sentinel))
+
+		for other, s := range sentinels {
+			if other != errorType {
+				assert.False(t, errors.Is(err, s))
+			}
+		}
+	}
+
+	assert.False(t, errors.Is(EventStoreError{ErrorType: InternalError}, ErrNotFound))
+}
+
+func TestEventStoreErrorUnwrap(t *testing.T) {
+	inner := errors.New("inner")
+	err := EventStoreError{Text: "failed", ErrorType: InternalError, InnerError: inner}
+
+	assert.True(t, errors.Is(err, inner))
+	assert.Equal(t, "failed -- Inner error: inner", err.Error())
+
+	var evterr EventStoreError
+	assert.True(t, errors.As(fmt.Errorf("wrapped: %w", err), &evterr))
+	assert.Equal(t, InternalError, evterr.ErrorType)
+
+	assert.Equal(t, "failed", EventStoreError{Text: "failed"}.Error())
+}
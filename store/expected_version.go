@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ExpectedVersion is the latest version an entity must have, so that AppendToStream appends to it.
+// Besides an exact version, created with ExactVersion, it is one of Any, NoStream or StreamExists.
+type ExpectedVersion int64
+
+const (
+	// Any appends regardless of the latest version, the entity is created if it doesn't exist
+	Any ExpectedVersion = -1
+	// NoStream creates the entity, it must not exist yet. It is the same as ExactVersion(0).
+	NoStream ExpectedVersion = 0
+	// StreamExists appends to the latest version, the entity must exist
+	StreamExists ExpectedVersion = -2
+)
+
+// ExactVersion expects the entity to exist with the given latest version
+func ExactVersion(version int64) ExpectedVersion {
+	return ExpectedVersion(version)
+}
+
+func (e ExpectedVersion) String() string {
+	switch e {
+	case Any:
+		return "Any"
+	case NoStream:
+		return "NoStream"
+	case StreamExists:
+		return "StreamExists"
+	}
+
+	return fmt.Sprintf("%d", int64(e))
+}
+
+// Validate returns an EventStoreError of type InternalError if e is neither a version nor one of
+// Any, NoStream or StreamExists
+func (e ExpectedVersion) Validate() error {
+	if e < StreamExists {
+		return EventStoreError{
+			Text:       fmt.Sprintf("invalid expected version %v", int64(e)),
+			ErrorType:  InternalError,
+			InnerError: nil,
+		}
+	}
+
+	return nil
+}
+
+// Check checks if the latest version of the entity with the given id satisfies e, version is 0 if the
+// entity doesn't exist. It returns an EventStoreError of type AlreadyExists, EntityNotFound or
+// VersionConflict if it doesn't.
+func (e ExpectedVersion) Check(id string, version int64) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case e == Any:
+		return nil
+	case e == NoStream && version > 0:
+		return EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", id),
+			ErrorType:  AlreadyExists,
+			InnerError: nil,
+		}
+	case e != NoStream && version == 0:
+		return EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  EntityNotFound,
+			InnerError: nil,
+		}
+	case e != StreamExists && int64(e) != version:
+		return EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+			ErrorType:  VersionConflict,
+			InnerError: nil,
+		}
+	}
+
+	return nil
+}
+
+// Concurrency returns the concurrency control that an append with e is retried with, see Retryable.
+// Appends with Any or StreamExists don't depend on the latest version, so they retry on a version conflict.
+func (e ExpectedVersion) Concurrency() ConcurrencyControl {
+	if e == Any || e == StreamExists {
+		return None
+	}
+
+	return Optimistic
+}
+
+// CheckExpectedVersion checks expected against the latest version of the entity with the given id that
+// s returns. Backends use it for AppendToStream without entities, when there is nothing to write.
+func CheckExpectedVersion(ctx context.Context, s EventStore, id string, expected ExpectedVersion) error {
+	version, err := s.GetLatestVersionNumberContext(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		version = 0
+	} else if err != nil {
+		return err
+	}
+
+	return expected.Check(id, version)
+}
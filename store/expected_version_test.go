@@ -0,0 +1,57 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedVersionCheck(t *testing.T) {
+	tests := []struct {
+		expected  ExpectedVersion
+		version   int64
+		errorType ErrorType
+	}{
+		{Any, 0, 0},
+		{Any, 3, 0},
+		{NoStream, 0, 0},
+		{NoStream, 3, AlreadyExists},
+		{StreamExists, 0, EntityNotFound},
+		{StreamExists, 3, 0},
+		{ExactVersion(0), 0, 0},
+		{ExactVersion(3), 3, 0},
+		{ExactVersion(3), 0, EntityNotFound},
+		{ExactVersion(2), 3, VersionConflict},
+		{ExactVersion(4), 3, VersionConflict},
+		{ExactVersion(-3), 0, InternalError},
+		{ExactVersion(-3), 3, InternalError},
+	}
+
+	for _, tc := range tests {
+		err := tc.expected.Check("id", tc.version)
+
+		if tc.errorType == 0 {
+			assert.Nil(t, err, "%v with version %v", tc.expected, tc.version)
+			continue
+		}
+
+		evterr, ok := err.(EventStoreError)
+		if assert.True(t, ok, "%v with version %v: %v", tc.expected, tc.version, err) {
+			assert.Equal(t, tc.errorType, evterr.ErrorType, "%v with version %v", tc.expected, tc.version)
+		}
+	}
+}
+
+func TestExpectedVersionConcurrency(t *testing.T) {
+	assert.Equal(t, None, Any.Concurrency())
+	assert.Equal(t, None, StreamExists.Concurrency())
+	assert.Equal(t, Optimistic, NoStream.Concurrency())
+	assert.Equal(t, Optimistic, ExactVersion(3).Concurrency())
+}
+
+func TestExpectedVersionString(t *testing.T) {
+	assert.Equal(t, "Any", Any.String())
+	assert.Equal(t, "NoStream", ExactVersion(0).String())
+	assert.Equal(t, "StreamExists", StreamExists.String())
+	assert.Equal(t, "42", ExactVersion(42).String())
+}
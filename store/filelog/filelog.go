@@ -0,0 +1,888 @@
+package filelog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+)
+
+const (
+	// BackendName is the name the file log store is registered with, see store.Open
+	BackendName = "filelog"
+
+	// dataSource is the metadata property for the directory of the segment files
+	dataSource = "dataSource"
+	// segmentSize is the metadata property for the size in bytes, at which a new segment file is started
+	segmentSize = "segmentSize"
+
+	defaultSegmentSize = 64 << 20
+
+	// lockName is the name of the file in the directory, that is locked by the store that opened it
+	lockName = "lock"
+)
+
+// errLocked is returned by lockFile, if the file is locked already
+var errLocked = errors.New("file is locked")
+
+// record is the payload of a record in a segment file. The entities of a write are stored in one record,
+// so that either all or none of them are recovered after a crash.
+type record struct {
+	Entities []*store.Entity `json:"entities,omitempty"`
+	Snapshot *store.Snapshot `json:"snapshot,omitempty"`
+	Deletion *deletion       `json:"deletion,omitempty"`
+}
+
+// deletion is the payload of a record that deletes the stream of an entity, see EventStore.Delete
+type deletion struct {
+	ID   string `json:"id"`
+	Hard bool   `json:"hard"`
+}
+
+// recordKeys is the part of a record that is needed to rebuild the index, without decoding the data
+type recordKeys struct {
+	Entities []struct {
+		ID       string `json:"id"`
+		Version  int64  `json:"version"`
+		Position int64  `json:"position"`
+		EventID  string `json:"eventId"`
+	} `json:"entities"`
+	Snapshot *struct {
+		ID      string `json:"id"`
+		Version int64  `json:"version"`
+	} `json:"snapshot"`
+	Deletion *deletion `json:"deletion"`
+}
+
+// location is the place of an entity or a snapshot in the segment files, the locations of the
+// entities of hard deleted streams are zero
+type location struct {
+	segment *segment
+	offset  int64
+	// index of the entity in the record
+	index int
+}
+
+type snapshotLocation struct {
+	location
+	version int64
+}
+
+type filelog struct {
+	dir         string
+	lock        *os.File
+	segmentSize int64
+	segments    []*segment
+	// the locations of the versions of every entity, the location of a version is at index version-1
+	streams map[string][]location
+	// the locations of all entities in the order they were stored, the position of an entity is its index plus 1
+	all       []location
+	snapshots map[string]snapshotLocation
+	// the versions of the event IDs of every entity
+	eventIDs map[string]map[string]int64
+	// deleted are the tombstones of the entities whose streams are soft deleted
+	deleted map[string]bool
+	// notify is closed and replaced whenever an entity is stored, to wake up subscriptions
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new file log store
+func NewStore() store.EventStore {
+	return &filelog{}
+}
+
+// Init opens the segment files in the configured directory and rebuilds the index by scanning them.
+// A corrupt or incomplete record at the end of the last segment, left behind by a crash, is truncated.
+// The store holds an exclusive lock of the directory until it is closed, so that no other store, in this
+// or another process, appends to the same segment files.
+func (s *filelog) Init(metadata store.Metadata) error {
+	dir, ok := metadata.Properties[dataSource]
+	if !ok || dir == "" {
+		return errors.New("filelog: data source is missing")
+	}
+
+	s.segmentSize = defaultSegmentSize
+
+	if v, ok := metadata.Properties[segmentSize]; ok && v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 1 {
+			return fmt.Errorf("filelog: %s must be a positive number: %s", segmentSize, v)
+		}
+		s.segmentSize = size
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := lockFile(lock); errors.Is(err, errLocked) {
+		lock.Close()
+		return fmt.Errorf("filelog: directory %s is already opened by another store", dir)
+	} else if err != nil {
+		lock.Close()
+		return fmt.Errorf("filelog: directory %s can't be locked: %v", dir, err)
+	}
+
+	s.lock = lock
+
+	ids, err := listSegments(dir)
+	if err != nil {
+		s.Close()
+		return err
+	}
+
+	s.dir = dir
+	s.segments = nil
+	s.streams = make(map[string][]location)
+	s.all = nil
+	s.snapshots = make(map[string]snapshotLocation)
+	s.eventIDs = make(map[string]map[string]int64)
+	s.deleted = make(map[string]bool)
+	s.notify = make(chan struct{})
+
+	for i, id := range ids {
+		seg, err := openSegment(dir, id)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		s.segments = append(s.segments, seg)
+
+		offset, err := seg.scan(func(offset int64, payload []byte) error {
+			return s.index(seg, offset, payload)
+		})
+
+		if err != nil {
+			// only the last record that was written can be torn, corruption before it means data loss
+			if !errors.Is(err, errCorrupt) || i != len(ids)-1 {
+				s.Close()
+				return fmt.Errorf("filelog: segment %s can't be read at offset %d: %v", segmentName(id), offset, err)
+			}
+
+			if err := seg.truncate(offset); err != nil {
+				s.Close()
+				return err
+			}
+		}
+	}
+
+	if len(s.segments) == 0 {
+		seg, err := openSegment(dir, 1)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		s.segments = append(s.segments, seg)
+	}
+
+	return nil
+}
+
+// Close closes the segment files and releases the lock of the directory
+func (s *filelog) Close() error {
+	var result error
+
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	if s.lock != nil {
+		if err := s.lock.Close(); err != nil && result == nil {
+			result = err
+		}
+
+		s.lock = nil
+	}
+
+	return result
+}
+
+func (s *filelog) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *filelog) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[entity.ID] {
+		return nil, store.StreamDeletedError(entity.ID)
+	}
+
+	if duplicate, err := s.deduplicate(entity.ID, []*store.Entity{entity}); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entity, nil
+	}
+
+	if _, exists := s.streams[entity.ID]; exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+			ErrorType:  store.AlreadyExists,
+			InnerError: nil,
+		}
+	}
+
+	entity.Version = 1
+
+	if err := s.write(&record{Entities: []*store.Entity{entity}}); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *filelog) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *filelog) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[entity.ID] {
+		return nil, store.StreamDeletedError(entity.ID)
+	}
+
+	if duplicate, err := s.deduplicate(entity.ID, []*store.Entity{entity}); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entity, nil
+	}
+
+	versions, exists := s.streams[entity.ID]
+
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", entity.ID),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	version := int64(len(versions))
+
+	if concurrency == store.Optimistic && version != entity.Version {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+			ErrorType:  store.VersionConflict,
+			InnerError: nil,
+		}
+	}
+
+	entity.Version = version + 1
+
+	if err := s.write(&record{Entities: []*store.Entity{entity}}); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *filelog) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *filelog) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	if duplicate, err := s.deduplicate(id, entities); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entities, nil
+	}
+
+	versions, exists := s.streams[id]
+
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	version := int64(len(versions))
+
+	if version != expectedVersion {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+			ErrorType:  store.VersionConflict,
+			InnerError: nil,
+		}
+	}
+
+	for _, entity := range entities {
+		version++
+		entity.ID = id
+		entity.Version = version
+	}
+
+	if err := s.write(&record{Entities: entities}); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *filelog) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *filelog) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	if duplicate, err := s.deduplicate(id, entities); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entities, nil
+	}
+
+	version := int64(len(s.streams[id]))
+
+	if err := expected.Check(id, version); err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return entities, nil
+	}
+
+	for _, entity := range entities {
+		version++
+		entity.ID = id
+		entity.Version = version
+	}
+
+	if err := s.write(&record{Entities: entities}); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *filelog) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *filelog) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return 0, store.StreamDeletedError(id)
+	}
+
+	versions, exists := s.streams[id]
+
+	if !exists {
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return int64(len(versions)), nil
+}
+
+func (s *filelog) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *filelog) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	versions, exists := s.streams[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if version < 1 || version > int64(len(versions)) {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return s.read(versions[version-1])
+}
+
+func (s *filelog) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (s *filelog) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	versions, exists := s.streams[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	if latest := int64(len(versions)); endVersion > latest {
+		endVersion = latest
+	}
+
+	result := []store.Entity{}
+
+	for v := startVersion; v <= endVersion; v++ {
+		entity, err := s.read(versions[v-1])
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *entity)
+	}
+
+	return result, nil
+}
+
+func (s *filelog) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+func (s *filelog) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	return store.GetAsOf(ctx, s, id, at)
+}
+
+func (s *filelog) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *filelog) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return store.GetByTimeRange(ctx, s, id, from, to)
+}
+
+func (s *filelog) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (s *filelog) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.readAll(fromPosition, maxCount)
+}
+
+func (s *filelog) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext appends a record that deletes the stream, so the deletion is recovered with the index.
+// A hard delete removes the entities from the index and from the log of all entities, the positions of
+// the remaining entities don't change. The records of the entities remain in the segment files.
+func (s *filelog) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := store.CheckDelete(id, int64(len(s.streams[id])), s.deleted[id], hard, expected); err != nil {
+		return err
+	}
+
+	return s.write(&record{Deletion: &deletion{ID: id, Hard: hard}})
+}
+
+func (s *filelog) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (s *filelog) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	versions, exists := s.streams[id]
+	if !exists || version < 1 || version > int64(len(versions)) {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if snapshot, exists := s.snapshots[id]; exists && snapshot.version >= version {
+		return nil
+	}
+
+	return s.write(&record{Snapshot: &store.Snapshot{ID: id, Version: version, State: state}})
+}
+
+func (s *filelog) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *filelog) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	loc, exists := s.snapshots[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	rec, err := s.readRecord(loc.location)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec.Snapshot, nil
+}
+
+// Subscribe delivers the entities of the log of all entities starting at fromPosition to handler.
+// New entities are delivered as soon as they are stored, see store.Subscriber.
+func (s *filelog) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		entities, err := s.readAll(position, len(s.all))
+		notify := s.notify
+		s.mutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		for _, entity := range entities {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			position = entity.Position + 1
+		}
+
+		if len(entities) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// write assigns positions, types and system metadata to the entities of rec, appends it to the active segment and
+// adds it to the index. A new segment is started when the active one reached the segment size.
+// The caller must hold the mutex.
+func (s *filelog) write(rec *record) error {
+	for i, entity := range rec.Entities {
+		entity.Position = int64(len(s.all) + i + 1)
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+
+	if seg.size > 0 && seg.size+headerSize+int64(len(payload)) > s.segmentSize {
+		seg, err = openSegment(s.dir, seg.id+1)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to create segment",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		s.segments = append(s.segments, seg)
+	}
+
+	offset, err := seg.append(payload)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to write entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if err := s.index(seg, offset, payload); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to index entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if len(rec.Entities) > 0 {
+		close(s.notify)
+		s.notify = make(chan struct{})
+	}
+
+	return nil
+}
+
+// index adds the entities and the snapshot of the record at offset to the index. A record that
+// doesn't continue the versions and positions in the index is corrupt, and is not added.
+func (s *filelog) index(seg *segment, offset int64, payload []byte) error {
+	var keys recordKeys
+
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+
+	versions := make(map[string]int64)
+
+	for i, e := range keys.Entities {
+		if _, ok := versions[e.ID]; !ok {
+			versions[e.ID] = int64(len(s.streams[e.ID]))
+		}
+
+		versions[e.ID]++
+
+		if e.Version != versions[e.ID] || e.Position != int64(len(s.all)+i+1) {
+			return fmt.Errorf("%w: unexpected version %d of entity %s at position %d", errCorrupt, e.Version, e.ID, e.Position)
+		}
+	}
+
+	for i, e := range keys.Entities {
+		loc := location{segment: seg, offset: offset, index: i}
+		s.streams[e.ID] = append(s.streams[e.ID], loc)
+		s.all = append(s.all, loc)
+
+		if e.EventID != "" {
+			if s.eventIDs[e.ID] == nil {
+				s.eventIDs[e.ID] = make(map[string]int64)
+			}
+			s.eventIDs[e.ID][e.EventID] = e.Version
+		}
+	}
+
+	if snapshot := keys.Snapshot; snapshot != nil {
+		if existing, ok := s.snapshots[snapshot.ID]; !ok || existing.version < snapshot.Version {
+			s.snapshots[snapshot.ID] = snapshotLocation{
+				location: location{segment: seg, offset: offset},
+				version:  snapshot.Version,
+			}
+		}
+	}
+
+	if d := keys.Deletion; d != nil {
+		s.delete(d.ID, d.Hard)
+	}
+
+	return nil
+}
+
+// delete removes the stream of the entity with the given id from the index, a soft delete only marks
+// it as deleted. The caller must hold the mutex.
+func (s *filelog) delete(id string, hard bool) {
+	if !hard {
+		s.deleted[id] = true
+		return
+	}
+
+	removed := make(map[location]bool)
+	for _, loc := range s.streams[id] {
+		removed[loc] = true
+	}
+
+	for i, loc := range s.all {
+		if removed[loc] {
+			s.all[i] = location{}
+		}
+	}
+
+	delete(s.streams, id)
+	delete(s.eventIDs, id)
+	delete(s.snapshots, id)
+	delete(s.deleted, id)
+}
+
+// readAll reads up to maxCount entities starting at fromPosition, the caller must hold the mutex
+func (s *filelog) readAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	result := []store.Entity{}
+
+	for p := fromPosition; p <= int64(len(s.all)) && len(result) < maxCount; p++ {
+		if s.all[p-1].segment == nil {
+			continue
+		}
+
+		entity, err := s.read(s.all[p-1])
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *entity)
+	}
+
+	return result, nil
+}
+
+// deduplicate checks if entities were already stored in the stream of the entity with the given id, see
+// store.Deduplicate, the caller must hold the mutex
+func (s *filelog) deduplicate(id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		version, exists := s.eventIDs[id][eventID]
+		if !exists {
+			return nil, nil
+		}
+
+		return s.read(s.streams[id][version-1])
+	})
+}
+
+// read reads the entity at loc and decodes its data with store.Types
+func (s *filelog) read(loc location) (*store.Entity, error) {
+	rec, err := s.readRecord(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec.Entities[loc.index], nil
+}
+
+// readRecord reads and deserializes the record at loc
+func (s *filelog) readRecord(loc location) (*record, error) {
+	payload, _, err := loc.segment.read(loc.offset)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("failed to read record at offset %d of segment %s", loc.offset, segmentName(loc.segment.id)),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	rec := &record{}
+
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize record",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,243 @@
+package filelog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetadata(t *testing.T) store.Metadata {
+	return store.Metadata{
+		Properties: map[string]string{
+			dataSource: t.TempDir(),
+		},
+	}
+}
+
+func newStore(t *testing.T, metadata store.Metadata) store.EventStore {
+	s := NewStore()
+	require.Nil(t, s.Init(metadata))
+
+	t.Cleanup(func() {
+		s.(*filelog).Close()
+	})
+
+	return s
+}
+
+// writeEntities stores the versions 1 to 3 of entity "1" with a write per version
+func writeEntities(t *testing.T, s store.EventStore) {
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+		require.Nil(t, err)
+	}
+}
+
+// lastSegment returns the path of the segment file with the highest id
+func lastSegment(t *testing.T, dir string) string {
+	ids, err := listSegments(dir)
+	require.Nil(t, err)
+	require.NotEmpty(t, ids)
+
+	return filepath.Join(dir, segmentName(ids[len(ids)-1]))
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		return newStore(t, newMetadata(t))
+	})
+}
+
+func TestInitMissingDataSource(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestPersistence(t *testing.T) {
+	metadata := newMetadata(t)
+	metadata.Properties[segmentSize] = "100"
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+
+	_, err := s.AppendBatch("1", 3, []*store.Entity{{Data: "Hello"}, {Data: "World"}})
+	require.Nil(t, err)
+
+	require.Nil(t, s.(*filelog).SaveSnapshot("1", 4, "snapshot"))
+	require.Nil(t, s.(*filelog).Close())
+
+	// the small segment size spreads the records over several files
+	ids, err := listSegments(metadata.Properties[dataSource])
+	require.Nil(t, err)
+	assert.Greater(t, len(ids), 1)
+
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), version)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(res))
+	assert.Equal(t, "World", res[4].Data)
+	assert.Equal(t, int64(5), res[4].Position)
+
+	snapshot, err := s.(*filelog).GetLatestSnapshot("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), snapshot.Version)
+	assert.Equal(t, "snapshot", snapshot.State)
+}
+
+func TestPersistDeletion(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+
+	_, err := s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+
+	require.Nil(t, s.Delete("1", store.Any, true))
+	require.Nil(t, s.Delete("2", store.Any, false))
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World!"})
+	require.Nil(t, err)
+	require.Nil(t, s.(*filelog).Close())
+
+	// the deletions are recovered with the index
+	s = newStore(t, metadata)
+
+	_, err = s.GetLatestVersionNumber("2")
+	storetest.AssertErrorType(t, err, store.StreamDeleted)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "2", res[0].ID)
+	assert.Equal(t, "Hello World!", res[1].Data)
+	assert.Equal(t, int64(5), res[1].Position)
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+	require.Nil(t, s.(*filelog).Close())
+
+	// cut off the last record in the middle, as if the process crashed while writing it
+	path := lastSegment(t, metadata.Properties[dataSource])
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(path, info.Size()-5))
+
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	// the store continues after the last complete record
+	res, err := s.Append(&store.Entity{ID: "1", Version: 2, Data: "Hello World"}, store.Optimistic)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), res.Version)
+
+	res, err = s.GetByVersion("1", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), res.Position)
+}
+
+func TestRecoverCorruptTail(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+	require.Nil(t, s.(*filelog).Close())
+
+	// flip a byte of the last record, so that its checksum doesn't match, and append garbage
+	path := lastSegment(t, metadata.Properties[dataSource])
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	data[len(data)-2] ^= 0xff
+	data = append(data, 0, 0, 0)
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+}
+
+func TestCorruptSegmentBeforeTail(t *testing.T) {
+	metadata := newMetadata(t)
+	metadata.Properties[segmentSize] = "50"
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+	require.Nil(t, s.(*filelog).Close())
+
+	ids, err := listSegments(metadata.Properties[dataSource])
+	require.Nil(t, err)
+	require.Greater(t, len(ids), 1)
+
+	// corruption in a segment that isn't the last one can't be a torn write
+	path := filepath.Join(metadata.Properties[dataSource], segmentName(ids[0]))
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	data[len(data)-2] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	err = NewStore().Init(metadata)
+	assert.NotNil(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := store.Open(BackendName, newMetadata(t))
+	require.Nil(t, err)
+	defer s.(*filelog).Close()
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
+
+func TestInitLocksDirectory(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+	writeEntities(t, s)
+
+	// a second store would interleave its appends with the first one
+	err := NewStore().Init(metadata)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already opened")
+
+	require.Nil(t, s.(*filelog).Close())
+
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), version)
+}
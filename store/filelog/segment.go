@@ -0,0 +1,176 @@
+package filelog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A segment file is a sequence of records. Every record starts with a header of the length
+// and the CRC-32 checksum of its payload, both encoded big-endian.
+const (
+	headerSize    = 8
+	segmentSuffix = ".log"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt is returned when a record is incomplete or its checksum doesn't match
+var errCorrupt = errors.New("corrupt record")
+
+type segment struct {
+	id   int
+	file *os.File
+	size int64
+}
+
+// segmentName returns the name of the file of the segment with the given id, the names sort in the order of the ids
+func segmentName(id int) string {
+	return fmt.Sprintf("%010d%s", id, segmentSuffix)
+}
+
+// listSegments returns the ids of the segments in dir in ascending order
+func listSegments(dir string) ([]int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// openSegment opens the segment with the given id, the file is created if it doesn't exist
+func openSegment(dir string, id int) (*segment, error) {
+	file, err := os.OpenFile(filepath.Join(dir, segmentName(id)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &segment{id: id, file: file, size: info.Size()}, nil
+}
+
+// append writes a record with payload to the end of the segment and syncs it to disk.
+// It returns the offset of the record. If the write fails, the segment is truncated to its previous size.
+func (s *segment) append(payload []byte) (int64, error) {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[headerSize:], payload)
+
+	offset := s.size
+
+	if _, err := s.file.WriteAt(buf, offset); err != nil {
+		s.file.Truncate(offset)
+		return 0, err
+	}
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Truncate(offset)
+		return 0, err
+	}
+
+	s.size += int64(len(buf))
+	return offset, nil
+}
+
+// read reads the payload of the record at offset and returns it with the offset of the next record.
+// It returns errCorrupt if the record is incomplete or its checksum doesn't match.
+func (s *segment) read(offset int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+
+	if offset+headerSize > s.size {
+		return nil, 0, errCorrupt
+	}
+
+	if _, err := s.file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	if offset+headerSize+length > s.size {
+		return nil, 0, errCorrupt
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := s.file.ReadAt(payload, offset+headerSize); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, errCorrupt
+	}
+
+	return payload, offset + headerSize + length, nil
+}
+
+// scan calls fn for every record of the segment in the order they were written.
+// If a record is corrupt, scan stops and returns the offset of the record with the error.
+func (s *segment) scan(fn func(offset int64, payload []byte) error) (int64, error) {
+	offset := int64(0)
+
+	for offset < s.size {
+		payload, next, err := s.read(offset)
+		if err != nil {
+			return offset, err
+		}
+
+		if err := fn(offset, payload); err != nil {
+			return offset, err
+		}
+
+		offset = next
+	}
+
+	return offset, nil
+}
+
+// truncate cuts off the segment at size
+func (s *segment) truncate(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.size = size
+	return nil
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
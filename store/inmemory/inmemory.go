@@ -1,16 +1,34 @@
 package inmemory
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/AndreasM009/eventstore-impl/store"
 )
 
 type inmemory struct {
-	entities map[string]map[int64]*store.Entity
-	versions map[string]int64
-	mutex    sync.Mutex
+	entities  map[string]map[int64]*store.Entity
+	versions  map[string]int64
+	snapshots map[string]*store.Snapshot
+	// eventIDs maps the event IDs of every entity to the versions they are stored with
+	eventIDs map[string]map[string]int64
+	// deleted are the tombstones of the entities whose streams are soft deleted
+	deleted map[string]bool
+	// all entities in the order they were stored, the position of an entity is its index plus 1
+	all []*store.Entity
+	// notify is closed and replaced whenever an entity is stored, to wake up subscriptions
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+// BackendName is the name the in memory store is registered with, see store.Open
+const BackendName = "inmemory"
+
+func init() {
+	store.Register(BackendName, NewStore)
 }
 
 // NewStore creates a new in memory store
@@ -22,86 +40,605 @@ func (s *inmemory) Init(metadata store.Metadata) error {
 
 	s.versions = make(map[string]int64)
 	s.entities = make(map[string]map[int64]*store.Entity)
+	s.snapshots = make(map[string]*store.Snapshot)
+	s.eventIDs = make(map[string]map[string]int64)
+	s.deleted = make(map[string]bool)
+	s.all = nil
+	s.notify = make(chan struct{})
 	return nil
 }
 
 func (s *inmemory) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *inmemory) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.deleted[entity.ID] {
+		return nil, store.StreamDeletedError(entity.ID)
+	}
+
+	if duplicate, err := s.deduplicate(entity.ID, []*store.Entity{entity}); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entity, nil
+	}
+
 	if _, exists := s.versions[entity.ID]; exists {
-		return nil, fmt.Errorf("An entity with id %s already exists", entity.ID)
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+			ErrorType:  store.AlreadyExists,
+			InnerError: nil,
+		}
 	}
 
 	entity.Version = 1
 	s.versions[entity.ID] = int64(1)
 
 	s.entities[entity.ID] = make(map[int64]*store.Entity)
-	s.entities[entity.ID][entity.Version] = s.clone(entity)
+	s.put(entity)
 	return entity, nil
 }
 
 func (s *inmemory) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *inmemory) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.deleted[entity.ID] {
+		return nil, store.StreamDeletedError(entity.ID)
+	}
+
+	if duplicate, err := s.deduplicate(entity.ID, []*store.Entity{entity}); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entity, nil
+	}
+
 	version, exists := s.versions[entity.ID]
 
 	if !exists {
-		return nil, fmt.Errorf("An entity with id %s already exists", entity.ID)
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", entity.ID),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
 	}
 
-	if version != entity.Version {
-		return nil, fmt.Errorf("Entity %s has gone stale, newer version already available (OOL)", entity.ID)
+	if concurrency == store.Optimistic && version != entity.Version {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+			ErrorType:  store.VersionConflict,
+			InnerError: nil,
+		}
 	}
 
 	version++
 	entity.Version = version
 	s.versions[entity.ID] = version
-	s.entities[entity.ID][version] = s.clone(entity)
+	s.put(entity)
 	return entity, nil
 }
 
+func (s *inmemory) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *inmemory) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	if duplicate, err := s.deduplicate(id, entities); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entities, nil
+	}
+
+	version, exists := s.versions[id]
+
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if version != expectedVersion {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+			ErrorType:  store.VersionConflict,
+			InnerError: nil,
+		}
+	}
+
+	for _, entity := range entities {
+		version++
+		entity.ID = id
+		entity.Version = version
+		s.put(entity)
+	}
+
+	s.versions[id] = version
+	return entities, nil
+}
+
+func (s *inmemory) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *inmemory) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	if duplicate, err := s.deduplicate(id, entities); err != nil {
+		return nil, err
+	} else if duplicate {
+		return entities, nil
+	}
+
+	version := s.versions[id]
+
+	if err := expected.Check(id, version); err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return entities, nil
+	}
+
+	if version == 0 {
+		s.entities[id] = make(map[int64]*store.Entity)
+	}
+
+	for _, entity := range entities {
+		version++
+		entity.ID = id
+		entity.Version = version
+		s.put(entity)
+	}
+
+	s.versions[id] = version
+	return entities, nil
+}
+
 func (s *inmemory) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *inmemory) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.deleted[id] {
+		return 0, store.StreamDeletedError(id)
+	}
+
 	version, exists := s.versions[id]
 
 	if !exists {
-		return 0, fmt.Errorf("Entity with ID %s does not exist", id)
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
 	}
 
 	return version, nil
 }
 
 func (s *inmemory) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *inmemory) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
 	ebv, exists := s.entities[id]
 	if !exists {
-		return nil, fmt.Errorf("Enity with ID %s does not exist", id)
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
 	}
 
 	entity, exists := ebv[version]
 
 	if !exists {
-		return nil, fmt.Errorf("Version %v of entity with ID %s does not exist", version, id)
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
 	}
 
 	return s.clone(entity), nil
 }
 
 func (s *inmemory) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
-	return nil, nil
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (s *inmemory) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	ebv, exists := s.entities[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	// versions are dense, so clamp the requested range to the versions
+	// that are stored and walk it in ascending order
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	if latest := s.versions[id]; endVersion > latest {
+		endVersion = latest
+	}
+
+	result := []store.Entity{}
+
+	for v := startVersion; v <= endVersion; v++ {
+		result = append(result, *s.clone(ebv[v]))
+	}
+
+	return result, nil
+}
+
+func (s *inmemory) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+func (s *inmemory) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	ebv, exists := s.entities[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	version, _ := store.SearchAsOf(s.versions[id], at, s.createdAt(ebv))
+	if version == 0 {
+		return nil, store.NoVersionAsOf(id, at)
+	}
+
+	return s.clone(ebv[version]), nil
+}
+
+func (s *inmemory) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *inmemory) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.deleted[id] {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	ebv, exists := s.entities[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	first, last, _ := store.SearchTimeRange(s.versions[id], from, to, s.createdAt(ebv))
+
+	result := []store.Entity{}
+
+	for v := first; v <= last; v++ {
+		result = append(result, *s.clone(ebv[v]))
+	}
+
+	return result, nil
+}
+
+// createdAt returns the creation times of the versions of an entity, for a binary search over them
+func (s *inmemory) createdAt(ebv map[int64]*store.Entity) func(version int64) (time.Time, error) {
+	return func(version int64) (time.Time, error) {
+		return store.CreatedAt(ebv[version]), nil
+	}
+}
+
+func (s *inmemory) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (s *inmemory) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	result := []store.Entity{}
+
+	for p := fromPosition; p <= int64(len(s.all)) && len(result) < maxCount; p++ {
+		if s.all[p-1] != nil {
+			result = append(result, *s.clone(s.all[p-1]))
+		}
+	}
+
+	return result, nil
+}
+
+func (s *inmemory) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext removes the entities of a hard deleted stream from the log of all entities as well,
+// the positions of the remaining entities don't change.
+func (s *inmemory) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := store.CheckDelete(id, s.versions[id], s.deleted[id], hard, expected); err != nil {
+		return err
+	}
+
+	if !hard {
+		s.deleted[id] = true
+		return nil
+	}
+
+	for _, entity := range s.entities[id] {
+		s.all[entity.Position-1] = nil
+	}
+
+	delete(s.versions, id)
+	delete(s.entities, id)
+	delete(s.eventIDs, id)
+	delete(s.snapshots, id)
+	delete(s.deleted, id)
+	return nil
+}
+
+func (s *inmemory) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (s *inmemory) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	latest, exists := s.versions[id]
+	if !exists || version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if snapshot, exists := s.snapshots[id]; exists && snapshot.Version >= version {
+		return nil
+	}
+
+	s.snapshots[id] = &store.Snapshot{
+		ID:      id,
+		Version: version,
+		State:   state,
+	}
+	return nil
+}
+
+func (s *inmemory) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *inmemory) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot, exists := s.snapshots[id]
+	if !exists {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	result := *snapshot
+	return &result, nil
+}
+
+// put assigns the next position, the type and the system metadata to entity and stores a copy of it,
+// the caller must hold the mutex
+func (s *inmemory) put(entity *store.Entity) {
+	entity.Position = int64(len(s.all)) + 1
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
+
+	e := s.clone(entity)
+	s.entities[entity.ID][entity.Version] = e
+	s.all = append(s.all, e)
+
+	if entity.EventID != "" {
+		if s.eventIDs[entity.ID] == nil {
+			s.eventIDs[entity.ID] = make(map[string]int64)
+		}
+		s.eventIDs[entity.ID][entity.EventID] = entity.Version
+	}
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// deduplicate checks if entities were already stored in the stream of the entity with the given id, see
+// store.Deduplicate, the caller must hold the mutex
+func (s *inmemory) deduplicate(id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		version, exists := s.eventIDs[id][eventID]
+		if !exists {
+			return nil, nil
+		}
+
+		return s.clone(s.entities[id][version]), nil
+	})
+}
+
+// Subscribe delivers the entities of the log of all entities starting at fromPosition to handler.
+// New entities are delivered as soon as they are stored, see store.Subscriber.
+func (s *inmemory) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mutex.Lock()
+		entities := []store.Entity{}
+		for p := position; p <= int64(len(s.all)); p++ {
+			if s.all[p-1] != nil {
+				entities = append(entities, *s.clone(s.all[p-1]))
+			}
+		}
+		notify := s.notify
+		s.mutex.Unlock()
+
+		for _, entity := range entities {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			position = entity.Position + 1
+		}
+
+		if len(entities) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
 }
 
 func (s *inmemory) clone(entity *store.Entity) *store.Entity {
-	return &store.Entity{
+	e := &store.Entity{
 		ID:       entity.ID,
 		Version:  entity.Version,
+		Position: entity.Position,
+		EventID:  entity.EventID,
+		Type:     entity.Type,
 		Data:     entity.Data,
 		Metadata: entity.Metadata,
 	}
+
+	if entity.System != nil {
+		system := *entity.System
+		e.System = &system
+	}
+
+	return e
 }
@@ -1,9 +1,11 @@
 package inmemory
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -198,3 +200,140 @@ func TestGetByVersionMissingVersion(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, res)
 }
+
+func TestGetByVersionRange(t *testing.T) {
+	s := NewStore()
+	err := s.Init(testMetadata)
+	assert.Nil(t, err)
+
+	ety := &store.Entity{
+		ID:      "1",
+		Version: 0,
+		Data:    "1",
+	}
+
+	_, err = s.Add(ety)
+	assert.Nil(t, err)
+
+	ety.Data = "2"
+	_, err = s.Append(ety, store.Optimistic)
+	assert.Nil(t, err)
+
+	ety.Data = "3"
+	_, err = s.Append(ety, store.Optimistic)
+	assert.Nil(t, err)
+
+	res, err := s.GetByVersionRange("1", 1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), e.Data.(string))
+	}
+
+	res, err = s.GetByVersionRange("1", 2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, int64(2), res[0].Version)
+
+	res, err = s.GetByVersionRange("1", 2, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = s.GetByVersionRange("1", 4, 10)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestGetByVersionRangeMissingEntity(t *testing.T) {
+	s := NewStore()
+	err := s.Init(testMetadata)
+	assert.Nil(t, err)
+
+	res, err := s.GetByVersionRange("1", 1, 3)
+	assert.NotNil(t, err)
+	assert.Nil(t, res)
+
+	evterr, ok := err.(store.EventStoreError)
+	assert.True(t, ok)
+	assert.Equal(t, store.EntityNotFound, evterr.ErrorType)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		s := NewStore()
+		err := s.Init(testMetadata)
+		assert.Nil(t, err)
+		return s
+	})
+}
+
+func TestReadAll(t *testing.T) {
+	s := NewStore()
+	err := s.Init(testMetadata)
+	assert.Nil(t, err)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	for _, id := range []string{"1", "2"} {
+		_, err = s.Add(&store.Entity{ID: id, Data: id})
+		assert.Nil(t, err)
+	}
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "1"}, store.None)
+	assert.Nil(t, err)
+
+	// positions start with 1 and are consecutive in memory
+	res, err = s.ReadAll(0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, int64(i+1), e.Position)
+	}
+
+	assert.Equal(t, "1", res[2].ID)
+	assert.Equal(t, int64(2), res[2].Version)
+
+	res, err = s.ReadAll(2, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "2", res[0].ID)
+}
+
+func TestDeleteHardReadAll(t *testing.T) {
+	s := NewStore()
+	err := s.Init(testMetadata)
+	assert.Nil(t, err)
+
+	for _, id := range []string{"1", "2", "1"} {
+		_, err = s.AppendToStream(id, store.Any, []*store.Entity{{Data: id}})
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, s.Delete("1", store.Any, true))
+
+	// the entities of a hard deleted stream are removed from the log, the positions don't change
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "2", res[0].ID)
+	assert.Equal(t, int64(2), res[0].Position)
+
+	added, err := s.AppendToStream("1", store.NoStream, []*store.Entity{{Data: "1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), added[0].Position)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := store.Open(BackendName, testMetadata)
+	assert.Nil(t, err)
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
@@ -0,0 +1,1200 @@
+package jetstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// BackendName is the name the NATS JetStream store is registered with, see store.Open
+	BackendName = "jetstream"
+
+	defaultStreamName = "eventstore"
+
+	// versionHeader is the header of a message with the latest version of the entity after the message
+	versionHeader = "Eventstore-Version"
+
+	// deletedHeader is the header of the tombstone of an entity, the message that soft deletes its stream
+	deletedHeader = "Eventstore-Deleted"
+
+	// the key of the stream sequence up to which the event IDs of an entity are in the key-value bucket
+	// of event IDs, it follows the encoded id of the entity like the event IDs do
+	indexedKey = "indexed"
+
+	// positionShift is the number of bits of a position, that hold the index of an entity in its message.
+	// The position of an entity is the stream sequence of its message shifted left, plus the index.
+	positionShift = 16
+	positionMask  = 1<<positionShift - 1
+	maxBatchSize  = 1 << positionShift
+)
+
+type jetstreamconnectioninfo struct {
+	URL        string `json:"natsURL"`
+	StreamName string `json:"streamName"`
+}
+
+// message is the payload of a message, the entities of a write are published in one message,
+// so that either all or none of them are stored
+type message struct {
+	Entities []*store.Entity `json:"entities"`
+}
+
+type jetstreamstore struct {
+	connectionInfo jetstreamconnectioninfo
+	conn           *nats.Conn
+	js             jetstream.JetStream
+	stream         jetstream.Stream
+	snapshots      jetstream.KeyValue
+	eventIDs       jetstream.KeyValue
+	eventIDStream  jetstream.Stream
+	retryPolicy    store.RetryPolicy
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new NATS JetStream store
+func NewStore() store.EventStore {
+	return &jetstreamstore{}
+}
+
+func (j *jetstreamstore) Init(metadata store.Metadata) error {
+	retryPolicy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return err
+	}
+
+	j.retryPolicy = retryPolicy
+
+	s, err := json.Marshal(metadata.Properties)
+	if err != nil {
+		return err
+	}
+
+	var info jetstreamconnectioninfo
+	err = json.Unmarshal(s, &info)
+	if err != nil {
+		return err
+	}
+
+	if info.URL == "" {
+		return errors.New("URL of NATS JetStream eventstore is missing")
+	}
+
+	if info.StreamName == "" {
+		info.StreamName = defaultStreamName
+	}
+
+	j.connectionInfo = info
+
+	conn, err := nats.Connect(info.URL)
+	if err != nil {
+		return err
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	ctx := context.Background()
+
+	// single messages are never removed, so the versions and positions stay valid. Only a hard delete
+	// purges the subject of an entity, which doesn't change the positions of the other entities.
+	config := jetstream.StreamConfig{
+		Name:        info.StreamName,
+		Subjects:    []string{info.StreamName + ".>"},
+		Storage:     jetstream.FileStorage,
+		Retention:   jetstream.LimitsPolicy,
+		DenyDelete:  true,
+		AllowDirect: true,
+	}
+
+	// streams that were created before hard deletes deny purges, which can't be allowed afterwards
+	if existing, err := js.Stream(ctx, info.StreamName); err == nil && existing.CachedInfo().Config.DenyPurge {
+		config.DenyPurge = true
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	snapshots, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  info.StreamName + "_snapshots",
+		Storage: jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// the stream sequences of the messages with event IDs, so that a write doesn't read the whole subject
+	// of its entity, see deduplicate. The keys of an entity are purged with the stream of the bucket.
+	eventIDs, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  info.StreamName + "_eventids",
+		Storage: jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	eventIDStream, err := js.Stream(ctx, "KV_"+info.StreamName+"_eventids")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	j.conn = conn
+	j.js = js
+	j.stream = stream
+	j.snapshots = snapshots
+	j.eventIDs = eventIDs
+	j.eventIDStream = eventIDStream
+	return nil
+}
+
+// Close closes the connection to NATS
+func (j *jetstreamstore) Close() error {
+	j.conn.Close()
+	return nil
+}
+
+func (j *jetstreamstore) Add(entity *store.Entity) (*store.Entity, error) {
+	return j.AddContext(context.Background(), entity)
+}
+
+func (j *jetstreamstore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	err := j.retryPolicy.Retry(ctx, func() error {
+		if store.HasEventIDs([]*store.Entity{entity}) {
+			_, sequence, err := j.latest(ctx, entity.ID)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return err
+			}
+
+			if duplicate, err := j.deduplicate(ctx, entity.ID, sequence, []*store.Entity{entity}); err != nil || duplicate {
+				return err
+			}
+		} else if err := store.ValidateEventIDs([]*store.Entity{entity}); err != nil {
+			return err
+		}
+
+		return j.publish(ctx, entity.ID, 0, 0, []*store.Entity{entity})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	var evterr store.EventStoreError
+	if errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		if _, _, err := j.latest(ctx, entity.ID); errors.Is(err, store.ErrStreamDeleted) {
+			return nil, err
+		}
+
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (j *jetstreamstore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return j.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (j *jetstreamstore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	expectedVersion := entity.Version
+
+	err := j.retryPolicy.Retry(ctx, func() error {
+		version, sequence, err := j.latest(ctx, entity.ID)
+		if err != nil {
+			return err
+		}
+
+		if duplicate, err := j.deduplicate(ctx, entity.ID, sequence, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		if concurrency == store.Optimistic && version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		return j.publish(ctx, entity.ID, version, sequence, []*store.Entity{entity})
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (j *jetstreamstore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return j.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (j *jetstreamstore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) >= maxBatchSize {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("a batch can contain at most %d entities", maxBatchSize-1),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	err := j.retryPolicy.Retry(ctx, func() error {
+		version, sequence, err := j.latest(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if duplicate, err := j.deduplicate(ctx, id, sequence, entities); err != nil || duplicate {
+			return err
+		}
+
+		if version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		return j.publish(ctx, id, version, sequence, entities)
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (j *jetstreamstore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return j.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (j *jetstreamstore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) >= maxBatchSize {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("a batch can contain at most %d entities", maxBatchSize-1),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	err := j.retryPolicy.Retry(ctx, func() error {
+		version, sequence, err := j.latest(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			version, sequence = 0, 0
+		} else if err != nil {
+			return err
+		}
+
+		if duplicate, err := j.deduplicate(ctx, id, sequence, entities); err != nil || duplicate {
+			return err
+		}
+
+		if err := expected.Check(id, version); err != nil {
+			return err
+		}
+
+		if len(entities) == 0 {
+			return nil
+		}
+
+		return j.publish(ctx, id, version, sequence, entities)
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	var evterr store.EventStoreError
+	if expected == store.NoStream && errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		// a concurrent writer created the entity first
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", id),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (j *jetstreamstore) GetLatestVersionNumber(id string) (int64, error) {
+	return j.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (j *jetstreamstore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	version, _, err := j.latest(ctx, id)
+	return version, err
+}
+
+func (j *jetstreamstore) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return j.GetByVersionContext(context.Background(), id, version)
+}
+
+func (j *jetstreamstore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	entities, err := j.GetByVersionRangeContext(ctx, id, version, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 || version < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return &entities[0], nil
+}
+
+func (j *jetstreamstore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return j.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+// GetByVersionRangeContext reads the messages of the subject of the entity with an ordered consumer from
+// the message with startVersion on, until the message with endVersion or the latest message is reached.
+func (j *jetstreamstore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	latest, sequence, err := j.latest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []store.Entity{}
+
+	if startVersion > endVersion || startVersion > latest || endVersion < 1 {
+		return result, nil
+	}
+
+	start, err := j.sequenceOf(ctx, id, startVersion, sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.scan(ctx, j.subject(id), start, sequence, func(_ uint64, entities []*store.Entity) (bool, error) {
+		for _, entity := range entities {
+			if entity.Version >= startVersion && entity.Version <= endVersion {
+				result = append(result, *entity)
+			}
+		}
+
+		return entities[len(entities)-1].Version < endVersion, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (j *jetstreamstore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return j.GetAsOfContext(context.Background(), id, at)
+}
+
+// GetAsOfContext searches the versions of the entity binary, see store.SearchAsOf, and reads every version it
+// looks at with direct gets, see versionAt.
+func (j *jetstreamstore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	latest, sequence, err := j.latest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	read := map[int64]*store.Entity{}
+
+	version, err := store.SearchAsOf(latest, at, func(version int64) (time.Time, error) {
+		entity, err := j.versionAt(ctx, id, version, sequence)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		read[version] = entity
+		return store.CreatedAt(entity), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		return nil, store.NoVersionAsOf(id, at)
+	}
+
+	return read[version], nil
+}
+
+func (j *jetstreamstore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return j.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+// GetByTimeRangeContext searches the first and the last version of the range binary, see store.SearchTimeRange,
+// and reads the versions between them like GetByVersionRangeContext.
+func (j *jetstreamstore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	latest, sequence, err := j.latest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, err := store.SearchTimeRange(latest, from, to, func(version int64) (time.Time, error) {
+		entity, err := j.versionAt(ctx, id, version, sequence)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return store.CreatedAt(entity), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if last < first {
+		return []store.Entity{}, nil
+	}
+
+	return j.GetByVersionRangeContext(ctx, id, first, last)
+}
+
+func (j *jetstreamstore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return j.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (j *jetstreamstore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	result := []store.Entity{}
+
+	// the last message of the stream may have been purged, the scan has to stop at the last stored message
+	last, err := j.stream.GetLastMsgForSubject(ctx, j.connectionInfo.StreamName+".>")
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return result, nil
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load last message",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	sequence := startSequence(fromPosition)
+
+	if sequence > last.Sequence {
+		return result, nil
+	}
+
+	err = j.scan(ctx, "", sequence, last.Sequence, func(_ uint64, entities []*store.Entity) (bool, error) {
+		for _, entity := range entities {
+			if entity.Position >= fromPosition {
+				result = append(result, *entity)
+			}
+
+			if len(result) == maxCount {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (j *jetstreamstore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return j.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext soft deletes the stream of an entity by publishing a tombstone to its subject, that is
+// guarded by the last sequence of the subject like every write. A hard delete purges the subject and
+// the snapshot of the entity, which fails for streams that deny purges.
+func (j *jetstreamstore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	return j.retryPolicy.Retry(ctx, func() error {
+		version, sequence, deleted, err := j.state(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			version, sequence = 0, 0
+		} else if err != nil {
+			return err
+		}
+
+		if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+			return err
+		}
+
+		if hard {
+			return j.purge(ctx, id)
+		}
+
+		msg := nats.NewMsg(j.subject(id))
+		msg.Header.Set(versionHeader, strconv.FormatInt(version, 10))
+		msg.Header.Set(deletedHeader, "true")
+
+		_, err = j.js.PublishMsg(ctx, msg,
+			jetstream.WithExpectStream(j.connectionInfo.StreamName),
+			jetstream.WithExpectLastSequencePerSubject(sequence))
+
+		if isWrongLastSequence(err) {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: err,
+			}
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to delete entity",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	}, store.Retryable(expected.Concurrency(), isTransient))
+}
+
+// purge removes the messages of the subject and the snapshot of the entity with the given id
+func (j *jetstreamstore) purge(ctx context.Context, id string) error {
+	if err := j.stream.Purge(ctx, jetstream.WithPurgeSubject(j.subject(id))); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to delete entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if err := j.snapshots.Purge(ctx, encodeID(id)); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to delete snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	subject := fmt.Sprintf("$KV.%s_eventids.%s.>", j.connectionInfo.StreamName, encodeID(id))
+	if err := j.eventIDStream.Purge(ctx, jetstream.WithPurgeSubject(subject)); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to delete event IDs",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+func (j *jetstreamstore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return j.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+// SaveSnapshotContext stores the snapshot in a key-value bucket. It is only replaced by a snapshot
+// of a newer version, which is guarded by the revision of the key.
+func (j *jetstreamstore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	latest, _, err := j.latest(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	key := encodeID(id)
+
+	return j.retryPolicy.Retry(ctx, func() error {
+		entry, err := j.snapshots.Get(ctx, key)
+
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			_, err = j.snapshots.Create(ctx, key, data)
+		} else if err == nil {
+			var snapshot store.Snapshot
+			if err := json.Unmarshal(entry.Value(), &snapshot); err == nil && snapshot.Version >= version {
+				return nil
+			}
+
+			_, err = j.snapshots.Update(ctx, key, data, entry.Revision())
+		}
+
+		if isWrongLastSequence(err) {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("snapshot of entity %s was saved concurrently", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: err,
+			}
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to save snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	}, store.Retryable(store.None, isTransient))
+}
+
+func (j *jetstreamstore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return j.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (j *jetstreamstore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	entry, err := j.snapshots.Get(ctx, encodeID(id))
+
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	snapshot := &store.Snapshot{}
+
+	if err := json.Unmarshal(entry.Value(), snapshot); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe delivers the entities of the stream starting at fromPosition to handler with an ordered consumer,
+// new entities are pushed by the server as they are stored, see store.Subscriber.
+func (j *jetstreamstore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	err := j.scan(ctx, "", startSequence(fromPosition), math.MaxUint64, func(_ uint64, entities []*store.Entity) (bool, error) {
+		for _, entity := range entities {
+			if entity.Position < fromPosition {
+				continue
+			}
+
+			if err := handler(ctx, *entity); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+
+	if err == nil {
+		// the scan only stops without an error when the subscription is canceled
+		err = ctx.Err()
+	}
+
+	return err
+}
+
+// latest returns the latest version of an entity and the stream sequence of its last message
+func (j *jetstreamstore) latest(ctx context.Context, id string) (int64, uint64, error) {
+	version, sequence, deleted, err := j.state(ctx, id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if deleted {
+		return 0, 0, store.StreamDeletedError(id)
+	}
+
+	return version, sequence, nil
+}
+
+// state returns the latest version of an entity, the stream sequence of its last message
+// and whether its stream was soft deleted
+func (j *jetstreamstore) state(ctx context.Context, id string) (int64, uint64, bool, error) {
+	msg, err := j.stream.GetLastMsgForSubject(ctx, j.subject(id))
+
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return 0, 0, false, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return 0, 0, false, store.EventStoreError{
+			Text:       "failed to load version of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	version, err := strconv.ParseInt(msg.Header.Get(versionHeader), 10, 64)
+	if err != nil {
+		return 0, 0, false, store.EventStoreError{
+			Text:       fmt.Sprintf("invalid version of entity %s", id),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return version, msg.Sequence, msg.Header.Get(deletedHeader) != "", nil
+}
+
+// deduplicate looks up the event IDs of entities in the key-value bucket of event IDs, see store.Deduplicate.
+// The messages of the subject of the entity with the given id up to its last sequence, that aren't in the bucket
+// yet, e.g. because a write failed after it was published, are read and added to the bucket first. Nothing is
+// read if no entity has an event ID.
+func (j *jetstreamstore) deduplicate(ctx context.Context, id string, sequence uint64, entities []*store.Entity) (bool, error) {
+	if !store.HasEventIDs(entities) || sequence == 0 {
+		return false, store.ValidateEventIDs(entities)
+	}
+
+	indexed, err := j.indexed(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	stored := map[string]*store.Entity{}
+
+	if indexed < sequence {
+		err := j.scan(ctx, j.subject(id), indexed+1, sequence, func(_ uint64, entities []*store.Entity) (bool, error) {
+			for _, entity := range entities {
+				if entity.EventID != "" {
+					stored[entity.EventID] = entity
+				}
+			}
+
+			return true, nil
+		})
+
+		if err != nil {
+			return false, err
+		}
+
+		found := make([]*store.Entity, 0, len(stored))
+		for _, entity := range stored {
+			found = append(found, entity)
+		}
+
+		j.index(ctx, id, indexed, sequence, found)
+	}
+
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		if entity, ok := stored[eventID]; ok {
+			return entity, nil
+		}
+
+		return j.lookup(ctx, id, eventID)
+	})
+}
+
+// indexed returns the stream sequence up to which the event IDs of the entity with the given id are
+// in the key-value bucket of event IDs
+func (j *jetstreamstore) indexed(ctx context.Context, id string) (uint64, error) {
+	entry, err := j.eventIDs.Get(ctx, encodeID(id)+"."+indexedKey)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, store.EventStoreError{
+			Text:       "failed to load event IDs",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	sequence, err := strconv.ParseUint(string(entry.Value()), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+
+	return sequence, nil
+}
+
+// index adds the event IDs of entities, that are stored in the subject of the entity with the given id after
+// the stream sequence previous up to sequence, to the key-value bucket of event IDs. The bucket is marked to hold
+// the event IDs up to sequence, if it holds those up to previous. A failure leaves the messages to the next deduplicate.
+func (j *jetstreamstore) index(ctx context.Context, id string, previous, sequence uint64, entities []*store.Entity) {
+	if indexed, err := j.indexed(ctx, id); err != nil || indexed < previous {
+		return
+	}
+
+	for _, entity := range entities {
+		if entity.EventID == "" {
+			continue
+		}
+
+		value := strconv.FormatUint(uint64(entity.Position>>positionShift), 10)
+		if _, err := j.eventIDs.Put(ctx, encodeID(id)+"."+entity.EventID, []byte(value)); err != nil {
+			return
+		}
+	}
+
+	j.eventIDs.Put(ctx, encodeID(id)+"."+indexedKey, []byte(strconv.FormatUint(sequence, 10)))
+}
+
+// lookup returns the entity with the given event ID, that is stored in the subject of the entity with
+// the given id, or nil if the key-value bucket of event IDs doesn't refer to a stored message
+func (j *jetstreamstore) lookup(ctx context.Context, id, eventID string) (*store.Entity, error) {
+	entry, err := j.eventIDs.Get(ctx, encodeID(id)+"."+eventID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load event IDs",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	sequence, err := strconv.ParseUint(string(entry.Value()), 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	// the message was purged by a hard delete, whose event IDs weren't purged
+	msg, err := j.stream.GetMsg(ctx, sequence)
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if msg.Subject != j.subject(id) || msg.Header.Get(deletedHeader) != "" {
+		return nil, nil
+	}
+
+	entities, err := decode(sequence, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range entities {
+		if entity.EventID == eventID {
+			return entity, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// sequenceOf returns a stream sequence to start reading the subject of the entity with the given id at, so that
+// the first message read holds version. The versions of the messages of a subject grow with their sequences,
+// the sequence is found by a binary search up to the last sequence of the subject with one direct get per step.
+func (j *jetstreamstore) sequenceOf(ctx context.Context, id string, version int64, last uint64) (uint64, error) {
+	low, high := uint64(1), last
+
+	for version > 1 && low < high {
+		middle := low + (high-low)/2
+
+		// the first message of the subject at or after middle
+		msg, err := j.stream.GetMsg(ctx, middle, jetstream.WithGetMsgSubject(j.subject(id)))
+		if err != nil {
+			return 0, store.EventStoreError{
+				Text:       "failed to load version of entity",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		latest, err := strconv.ParseInt(msg.Header.Get(versionHeader), 10, 64)
+		if err != nil {
+			return 0, store.EventStoreError{
+				Text:       fmt.Sprintf("invalid version of entity %s", id),
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		if latest >= version {
+			high = middle
+		} else {
+			low = msg.Sequence + 1
+		}
+	}
+
+	return low, nil
+}
+
+// versionAt returns the version of the entity with the given id, whose subject ends at the sequence last. The message
+// that holds the version is found by sequenceOf and read with a direct get.
+func (j *jetstreamstore) versionAt(ctx context.Context, id string, version int64, last uint64) (*store.Entity, error) {
+	sequence, err := j.sequenceOf(ctx, id, version, last)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := j.stream.GetMsg(ctx, sequence, jetstream.WithGetMsgSubject(j.subject(id)))
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load version of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	entities, err := decode(msg.Sequence, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range entities {
+		if entity.Version == version {
+			return entity, nil
+		}
+	}
+
+	return nil, store.EventStoreError{
+		Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+		ErrorType:  store.EntityNotFound,
+		InnerError: nil,
+	}
+}
+
+// publish publishes entities in one message to the subject of the entity with the given id, following
+// version. The server rejects the message, if sequence isn't the last sequence of the subject anymore.
+func (j *jetstreamstore) publish(ctx context.Context, id string, version int64, sequence uint64, entities []*store.Entity) error {
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = version + int64(i) + 1
+		entity.Position = 0
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+	}
+
+	data, err := json.Marshal(&message{Entities: entities})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	msg := nats.NewMsg(j.subject(id))
+	msg.Data = data
+	msg.Header.Set(versionHeader, strconv.FormatInt(version+int64(len(entities)), 10))
+
+	ack, err := j.js.PublishMsg(ctx, msg,
+		jetstream.WithExpectStream(j.connectionInfo.StreamName),
+		jetstream.WithExpectLastSequencePerSubject(sequence))
+
+	if isWrongLastSequence(err) {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+			ErrorType:  store.VersionConflict,
+			InnerError: err,
+		}
+	} else if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to publish entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	for i, entity := range entities {
+		entity.Position = position(ack.Sequence, i)
+	}
+
+	// the bucket holds the event IDs up to sequence, unless deduplicate failed to add them
+	if store.HasEventIDs(entities) {
+		j.index(ctx, id, sequence, ack.Sequence, entities)
+	}
+
+	return nil
+}
+
+// scan reads the messages of the stream starting at sequence with an ordered consumer, and calls fn
+// with the entities of every message until fn returns false or the message with lastSequence was read.
+// If filter isn't empty, only the messages of that subject are read. Tombstones are skipped.
+func (j *jetstreamstore) scan(ctx context.Context, filter string, sequence, lastSequence uint64, fn func(sequence uint64, entities []*store.Entity) (bool, error)) error {
+	config := jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:   sequence,
+	}
+
+	if filter != "" {
+		config.FilterSubjects = []string{filter}
+	}
+
+	consumer, err := j.stream.OrderedConsumer(ctx, config)
+	if err != nil {
+		return scanError(ctx, err)
+	}
+
+	messages, err := consumer.Messages()
+	if err != nil {
+		return scanError(ctx, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Next doesn't take a context, stopping the iterator makes it return
+	go func() {
+		select {
+		case <-ctx.Done():
+			messages.Stop()
+		case <-done:
+		}
+	}()
+
+	defer func() {
+		messages.Stop()
+
+		// ordered consumers are only removed by the server after some minutes of inactivity
+		if info := consumer.CachedInfo(); info != nil {
+			j.stream.DeleteConsumer(context.Background(), info.Name)
+		}
+	}()
+
+	for {
+		msg, err := messages.Next()
+		if err != nil {
+			return scanError(ctx, err)
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return scanError(ctx, err)
+		}
+
+		if msg.Headers().Get(deletedHeader) == "" {
+			entities, err := decode(meta.Sequence.Stream, msg.Data())
+			if err != nil {
+				return err
+			}
+
+			if cont, err := fn(meta.Sequence.Stream, entities); err != nil || !cont {
+				return err
+			}
+		}
+
+		if meta.Sequence.Stream >= lastSequence {
+			return nil
+		}
+	}
+}
+
+// subject returns the subject of the entity with the given id. The id is encoded, so that it is a valid token of a subject.
+func (j *jetstreamstore) subject(id string) string {
+	return j.connectionInfo.StreamName + "." + encodeID(id)
+}
+
+func encodeID(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// decode deserializes the entities of a message, decodes their data with store.Types and sets their positions
+func decode(sequence uint64, data []byte) ([]*store.Entity, error) {
+	var msg message
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize entities",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	if len(msg.Entities) == 0 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("message %d contains no entities", sequence),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	for i, entity := range msg.Entities {
+		entity.Position = position(sequence, i)
+	}
+
+	return msg.Entities, nil
+}
+
+// position returns the position of the entity with the given index in the message with the given stream sequence
+func position(sequence uint64, index int) int64 {
+	return int64(sequence<<positionShift) | int64(index)
+}
+
+// startSequence returns the stream sequence of the message of the entity at position
+func startSequence(position int64) uint64 {
+	if position < 1<<positionShift {
+		return 1
+	}
+
+	return uint64(position) >> positionShift
+}
+
+// scanError returns the error of ctx if it is done, as it stopped the scan
+func scanError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return store.EventStoreError{
+		Text:       "failed to read messages",
+		ErrorType:  store.InternalError,
+		InnerError: err,
+	}
+}
+
+// isWrongLastSequence checks if a message was rejected, because the last sequence of the subject didn't match
+func isWrongLastSequence(err error) bool {
+	var jerr jetstream.JetStreamError
+	if errors.As(err, &jerr) && jerr.APIError() != nil {
+		return jerr.APIError().ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+	}
+
+	return false
+}
+
+// isTransient checks if a request failed because of a condition, that is likely to go away when it is repeated.
+// Only requests that reached no server are retried, as a published message may be stored even though its
+// acknowledgement was lost.
+func isTransient(err error) bool {
+	return errors.Is(err, nats.ErrNoResponders) || errors.Is(err, jetstream.ErrNoStreamResponse)
+}
@@ -0,0 +1,305 @@
+package jetstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var streamCount int64
+
+// runServer starts an in-process NATS server with JetStream enabled and returns its URL
+func runServer(t *testing.T) string {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.Nil(t, err)
+
+	go ns.Start()
+	require.True(t, ns.ReadyForConnections(10*time.Second))
+
+	t.Cleanup(ns.Shutdown)
+
+	return ns.ClientURL()
+}
+
+// newStore creates a store with its own stream on the server with the given URL
+func newStore(t *testing.T, url string) store.EventStore {
+	s := NewStore()
+	err := s.Init(store.Metadata{
+		Properties: map[string]string{
+			"natsURL":    url,
+			"streamName": fmt.Sprintf("eventstore_test_%d", atomic.AddInt64(&streamCount, 1)),
+		},
+	})
+	require.Nil(t, err)
+
+	t.Cleanup(func() {
+		s.(*jetstreamstore).Close()
+	})
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	url := runServer(t)
+
+	storetest.RunConformance(t, func() store.EventStore {
+		return newStore(t, url)
+	})
+}
+
+func TestInitMissingURL(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestBatchPositions(t *testing.T) {
+	s := newStore(t, runServer(t))
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.AppendBatch("1", 1, []*store.Entity{{Data: "Hello"}, {Data: "World"}})
+	require.Nil(t, err)
+
+	res, err := s.ReadAll(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(res))
+
+	// resuming in the middle of a message skips the entities before the position
+	res, err = s.ReadAll(res[2].Position, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "World", res[0].Data)
+	assert.Equal(t, int64(3), res[0].Version)
+}
+
+func TestEventIDsAreIndexed(t *testing.T) {
+	s := newStore(t, runServer(t))
+	js := s.(*jetstreamstore)
+	ctx := context.Background()
+
+	first := &store.Entity{ID: "1", Data: "Hello", EventID: uuid.New().String()}
+	_, err := s.Add(first)
+	require.Nil(t, err)
+
+	_, err = s.AppendBatch("1", 1, []*store.Entity{{Data: "Hello"}, {Data: "World"}})
+	require.Nil(t, err)
+
+	last := &store.Entity{ID: "1", Data: "World", EventID: uuid.New().String()}
+	_, err = s.Append(last, store.None)
+	require.Nil(t, err)
+
+	indexed, err := js.indexed(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(last.Position>>positionShift), indexed)
+
+	e, err := s.Append(&store.Entity{ID: "1", Data: "Hello", EventID: first.EventID}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+
+	// event IDs that are missing in the bucket are read from the subject
+	require.Nil(t, js.eventIDs.Purge(ctx, encodeID("1")+"."+last.EventID))
+	require.Nil(t, js.eventIDs.Purge(ctx, encodeID("1")+"."+indexedKey))
+
+	e, err = s.Append(&store.Entity{ID: "1", Data: "World", EventID: last.EventID}, store.None)
+	require.Nil(t, err)
+	assert.Equal(t, int64(4), e.Version)
+
+	indexed, err = js.indexed(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(last.Position>>positionShift), indexed)
+
+	// a hard delete removes the event IDs of the entity
+	require.Nil(t, s.Delete("1", store.Any, true))
+
+	_, err = js.eventIDs.Get(ctx, encodeID("1")+"."+first.EventID)
+	assert.True(t, errors.Is(err, jetstream.ErrKeyNotFound))
+
+	e, err = s.Add(&store.Entity{ID: "1", Data: "Hello", EventID: first.EventID})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), e.Version)
+	assert.Greater(t, e.Position, last.Position)
+}
+
+func TestGetByVersionInterleaved(t *testing.T) {
+	s := newStore(t, runServer(t))
+
+	for _, id := range []string{"1", "2"} {
+		_, err := s.Add(&store.Entity{ID: id, Data: "1"})
+		require.Nil(t, err)
+	}
+
+	// the versions of entity 1 are spread over messages with one or two entities between those of entity 2
+	for v := 2; v <= 20; v += 3 {
+		_, err := s.AppendBatch("1", int64(v-1), []*store.Entity{{Data: fmt.Sprint(v)}, {Data: fmt.Sprint(v + 1)}})
+		require.Nil(t, err)
+
+		_, err = s.Append(&store.Entity{ID: "2", Data: "Hello"}, store.None)
+		require.Nil(t, err)
+
+		_, err = s.Append(&store.Entity{ID: "1", Data: fmt.Sprint(v + 2)}, store.None)
+		require.Nil(t, err)
+	}
+
+	for v := int64(1); v <= 22; v++ {
+		e, err := s.GetByVersion("1", v)
+		require.Nil(t, err)
+		assert.Equal(t, v, e.Version)
+		assert.Equal(t, fmt.Sprint(v), e.Data)
+	}
+
+	res, err := s.GetByVersionRange("1", 9, 13)
+	assert.Nil(t, err)
+	require.Equal(t, 5, len(res))
+	assert.Equal(t, int64(9), res[0].Version)
+	assert.Equal(t, int64(13), res[4].Version)
+}
+
+func TestGetByTimeInterleaved(t *testing.T) {
+	s := newStore(t, runServer(t))
+
+	for _, id := range []string{"1", "2"} {
+		_, err := s.Add(&store.Entity{ID: id, Data: "1"})
+		require.Nil(t, err)
+	}
+
+	// the versions of entity 1 are spread over messages with one or two entities between those of entity 2
+	for v := 2; v <= 20; v += 3 {
+		_, err := s.AppendBatch("1", int64(v-1), []*store.Entity{{Data: fmt.Sprint(v)}, {Data: fmt.Sprint(v + 1)}})
+		require.Nil(t, err)
+
+		_, err = s.Append(&store.Entity{ID: "2", Data: "Hello"}, store.None)
+		require.Nil(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		_, err = s.Append(&store.Entity{ID: "1", Data: fmt.Sprint(v + 2)}, store.None)
+		require.Nil(t, err)
+	}
+
+	versions, err := s.GetByVersionRange("1", 1, 22)
+	require.Nil(t, err)
+	require.Equal(t, 22, len(versions))
+
+	// the latest version created at or before the creation of a version
+	asOf := func(at time.Time) int64 {
+		latest := int64(0)
+		for _, e := range versions {
+			if !e.System.CreatedAt.After(at) {
+				latest = e.Version
+			}
+		}
+		return latest
+	}
+
+	for _, v := range versions {
+		e, err := s.GetAsOf("1", v.System.CreatedAt)
+		require.Nil(t, err)
+		assert.Equal(t, asOf(v.System.CreatedAt), e.Version)
+	}
+
+	from, to := versions[4].System.CreatedAt, versions[12].System.CreatedAt
+
+	res, err := s.GetByTimeRange("1", from, to)
+	assert.Nil(t, err)
+	require.NotEmpty(t, res)
+	assert.Equal(t, asOf(from.Add(-time.Microsecond))+1, res[0].Version)
+	assert.Equal(t, asOf(to), res[len(res)-1].Version)
+	for _, e := range res {
+		assert.Equal(t, "1", e.ID)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	s, err := store.Open(BackendName, store.Metadata{
+		Properties: map[string]string{"natsURL": runServer(t)},
+	})
+	require.Nil(t, err)
+	defer s.(*jetstreamstore).Close()
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
+
+func TestDeleteHardLastMessage(t *testing.T) {
+	s := newStore(t, runServer(t))
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+
+	res, err := s.ReadAll(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(res))
+
+	require.Nil(t, s.Delete("2", store.Any, true))
+
+	// the scan stops at the last stored message instead of waiting for the purged one
+	all, err := s.ReadAll(0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, "1", all[0].ID)
+
+	all, err = s.ReadAll(res[1].Position, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(all))
+}
+
+func TestInitStreamDenyingPurges(t *testing.T) {
+	url := runServer(t)
+
+	conn, err := nats.Connect(url)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	js, err := jetstream.New(conn)
+	require.Nil(t, err)
+
+	// streams created before hard deletes deny purges
+	_, err = js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:       "eventstore_old",
+		Subjects:   []string{"eventstore_old.>"},
+		Storage:    jetstream.FileStorage,
+		DenyDelete: true,
+		DenyPurge:  true,
+	})
+	require.Nil(t, err)
+
+	s := NewStore()
+	err = s.Init(store.Metadata{
+		Properties: map[string]string{"natsURL": url, "streamName": "eventstore_old"},
+	})
+	require.Nil(t, err)
+	defer s.(*jetstreamstore).Close()
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	assert.Nil(t, s.Delete("1", store.Any, false))
+
+	err = s.Delete("1", store.Any, true)
+	storetest.AssertErrorType(t, err, store.InternalError)
+}
@@ -0,0 +1,892 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// BackendName is the name the PostgreSQL store is registered with, see store.Open
+	BackendName = "postgres"
+
+	// defaultTableName is the name of the events table, if the metadata doesn't configure one
+	defaultTableName = "events"
+
+	// codes of PostgreSQL errors
+	uniqueViolation      = "23505"
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
+type postgresconnectioninfo struct {
+	ConnectionString string `json:"connectionString"`
+	TableName        string `json:"tableName"`
+}
+
+type postgres struct {
+	connectionInfo postgresconnectioninfo
+	pool           *pgxpool.Pool
+	// quoted names of the tables
+	eventsTable     string
+	snapshotsTable  string
+	tombstonesTable string
+	retryPolicy     store.RetryPolicy
+	subscriber      *store.PollingSubscriber
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new PostgreSQL store
+func NewStore() store.EventStore {
+	return &postgres{}
+}
+
+func (p *postgres) Init(metadata store.Metadata) error {
+	retryPolicy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return err
+	}
+
+	p.retryPolicy = retryPolicy
+
+	subscriber, err := store.NewPollingSubscriber(p, metadata)
+	if err != nil {
+		return err
+	}
+
+	p.subscriber = subscriber
+
+	s, err := json.Marshal(metadata.Properties)
+	if err != nil {
+		return err
+	}
+
+	var info postgresconnectioninfo
+	err = json.Unmarshal(s, &info)
+	if err != nil {
+		return err
+	}
+
+	if info.ConnectionString == "" {
+		return errors.New("connection string for PostgreSQL eventstore is missing")
+	}
+
+	if info.TableName == "" {
+		info.TableName = defaultTableName
+	}
+
+	p.connectionInfo = info
+	p.eventsTable = pgx.Identifier{info.TableName}.Sanitize()
+	p.snapshotsTable = pgx.Identifier{info.TableName + "_snapshots"}.Sanitize()
+	p.tombstonesTable = pgx.Identifier{info.TableName + "_tombstones"}.Sanitize()
+
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, info.ConnectionString)
+	if err != nil {
+		return err
+	}
+
+	// the unique index on id and version detects concurrent writes of the same version,
+	// and serves the queries for the versions of an entity. Event IDs are unique within the
+	// stream of an entity, the index on created_at serves the queries by time. The columns that
+	// were added later are added to tables that were created without them. The tombstones table
+	// holds the ids of the entities whose streams are soft deleted.
+	schema := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			position   BIGSERIAL PRIMARY KEY,
+			id         TEXT      NOT NULL,
+			version    BIGINT    NOT NULL,
+			event_id   TEXT,
+			type       TEXT      NOT NULL,
+			metadata   TEXT      NOT NULL,
+			system     JSONB,
+			data       JSONB     NOT NULL,
+			created_at TIMESTAMPTZ
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS %[2]s ON %[1]s (id, version);
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS event_id TEXT;
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS system JSONB;
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+		CREATE UNIQUE INDEX IF NOT EXISTS %[4]s ON %[1]s (id, event_id);
+		CREATE INDEX IF NOT EXISTS %[5]s ON %[1]s (id, created_at, version);
+		CREATE TABLE IF NOT EXISTS %[3]s (
+			id      TEXT   PRIMARY KEY,
+			version BIGINT NOT NULL,
+			state   JSONB  NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS %[6]s (
+			id TEXT PRIMARY KEY
+		);`,
+		p.eventsTable,
+		pgx.Identifier{info.TableName + "_id_version"}.Sanitize(),
+		p.snapshotsTable,
+		pgx.Identifier{info.TableName + "_id_event_id"}.Sanitize(),
+		pgx.Identifier{info.TableName + "_id_created_at"}.Sanitize(),
+		p.tombstonesTable)
+
+	if _, err := pool.Exec(ctx, schema); err != nil {
+		pool.Close()
+		return err
+	}
+
+	p.pool = pool
+	return nil
+}
+
+// Close closes all connections to the database
+func (p *postgres) Close() error {
+	p.pool.Close()
+	return nil
+}
+
+func (p *postgres) Add(entity *store.Entity) (*store.Entity, error) {
+	return p.AddContext(context.Background(), entity)
+}
+
+func (p *postgres) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	entity.Version = 1
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
+
+	err := p.retryPolicy.Retry(ctx, func() error {
+		if duplicate, err := p.deduplicate(ctx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		return p.write(ctx, func(tx pgx.Tx) error {
+			if err := p.checkTombstone(ctx, tx, entity.ID); err != nil {
+				return err
+			}
+
+			return p.insert(ctx, tx, entity)
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	var evterr store.EventStoreError
+	if errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (p *postgres) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return p.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (p *postgres) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	expectedVersion := entity.Version
+	store.RecordType(entity)
+	store.RecordSystemMetadata(entity)
+
+	// the version is read outside of the transaction, a concurrent write of the next version
+	// violates the unique index and is retried without concurrency control
+	err := p.retryPolicy.Retry(ctx, func() error {
+		if duplicate, err := p.deduplicate(ctx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		version, err := p.latestVersion(ctx, entity.ID)
+		if err != nil {
+			return err
+		}
+
+		if concurrency == store.Optimistic && version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		entity.Version = version + 1
+
+		return p.write(ctx, func(tx pgx.Tx) error {
+			if err := p.checkTombstone(ctx, tx, entity.ID); err != nil {
+				return err
+			}
+
+			return p.insert(ctx, tx, entity)
+		})
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		entity.Version = expectedVersion
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (p *postgres) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return p.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (p *postgres) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	err := p.retryPolicy.Retry(ctx, func() error {
+		if duplicate, err := p.deduplicate(ctx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		version, err := p.latestVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		// all entities are inserted in one transaction, so either all or none are stored
+		return p.write(ctx, func(tx pgx.Tx) error {
+			if err := p.checkTombstone(ctx, tx, id); err != nil {
+				return err
+			}
+
+			for i, entity := range entities {
+				entity.ID = id
+				entity.Version = version + int64(i) + 1
+				store.RecordType(entity)
+				store.RecordSystemMetadata(entity)
+
+				if err := p.insert(ctx, tx, entity); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (p *postgres) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return p.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (p *postgres) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	err := p.retryPolicy.Retry(ctx, func() error {
+		if duplicate, err := p.deduplicate(ctx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		version, err := p.latestVersion(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			version = 0
+		} else if err != nil {
+			return err
+		}
+
+		if err := expected.Check(id, version); err != nil {
+			return err
+		}
+
+		if len(entities) == 0 {
+			return nil
+		}
+
+		return p.write(ctx, func(tx pgx.Tx) error {
+			if err := p.checkTombstone(ctx, tx, id); err != nil {
+				return err
+			}
+
+			for i, entity := range entities {
+				entity.ID = id
+				entity.Version = version + int64(i) + 1
+				store.RecordType(entity)
+				store.RecordSystemMetadata(entity)
+
+				if err := p.insert(ctx, tx, entity); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	var evterr store.EventStoreError
+	if expected == store.NoStream && errors.As(err, &evterr) && evterr.ErrorType == store.VersionConflict {
+		// a concurrent writer created the entity first
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("An entity with id %s already exists", id),
+			ErrorType:  store.AlreadyExists,
+			InnerError: evterr.InnerError,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (p *postgres) GetLatestVersionNumber(id string) (int64, error) {
+	return p.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (p *postgres) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	return p.latestVersion(ctx, id)
+}
+
+func (p *postgres) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return p.GetByVersionContext(context.Background(), id, version)
+}
+
+func (p *postgres) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	entities, err := p.query(ctx,
+		fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE id = $1 AND id NOT IN (SELECT id FROM %s) AND version = $2", p.eventsTable, p.tombstonesTable),
+		id, version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between a missing version and a missing or deleted entity
+		if _, err := p.latestVersion(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return &entities[0], nil
+}
+
+func (p *postgres) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return p.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (p *postgres) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	entities, err := p.query(ctx,
+		fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE id = $1 AND id NOT IN (SELECT id FROM %s) AND version BETWEEN $2 AND $3 ORDER BY version", p.eventsTable, p.tombstonesTable),
+		id, startVersion, endVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between an empty range and a missing or deleted entity
+		if _, err := p.latestVersion(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+func (p *postgres) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return p.GetAsOfContext(context.Background(), id, at)
+}
+
+// GetAsOfContext reads the latest version that was created at or before at with the index on created_at.
+// Entities that were stored before the column was added have no creation time and are never found.
+func (p *postgres) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	entities, err := p.query(ctx,
+		fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE id = $1 AND id NOT IN (SELECT id FROM %s) AND created_at <= $2 ORDER BY created_at DESC, version DESC LIMIT 1", p.eventsTable, p.tombstonesTable),
+		id, at)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between a missing version and a missing or deleted entity
+		if _, err := p.latestVersion(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.NoVersionAsOf(id, at)
+	}
+
+	return &entities[0], nil
+}
+
+func (p *postgres) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return p.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (p *postgres) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	entities, err := p.query(ctx,
+		fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE id = $1 AND id NOT IN (SELECT id FROM %s) AND created_at BETWEEN $2 AND $3 ORDER BY version", p.eventsTable, p.tombstonesTable),
+		id, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between an empty range and a missing or deleted entity
+		if _, err := p.latestVersion(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+func (p *postgres) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return p.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (p *postgres) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	return p.query(ctx,
+		fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE position >= $1 ORDER BY position LIMIT $2", p.eventsTable),
+		fromPosition, maxCount)
+}
+
+func (p *postgres) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return p.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext writes a tombstone to soft delete a stream, a hard delete removes the rows of the entity,
+// so its entities are removed from the log of all entities as well.
+func (p *postgres) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	return p.retryPolicy.Retry(ctx, func() error {
+		return p.write(ctx, func(tx pgx.Tx) error {
+			version, deleted, err := p.streamState(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+
+			if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+				return err
+			}
+
+			statements := []string{fmt.Sprintf("INSERT INTO %s (id) VALUES ($1)", p.tombstonesTable)}
+			if hard {
+				statements = []string{
+					fmt.Sprintf("DELETE FROM %s WHERE id = $1", p.eventsTable),
+					fmt.Sprintf("DELETE FROM %s WHERE id = $1", p.snapshotsTable),
+					fmt.Sprintf("DELETE FROM %s WHERE id = $1", p.tombstonesTable),
+				}
+			}
+
+			for _, statement := range statements {
+				if _, err := tx.Exec(ctx, statement, id); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+}
+
+func (p *postgres) SaveSnapshot(id string, version int64, state interface{}) error {
+	return p.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (p *postgres) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	latest, err := p.latestVersion(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	// a snapshot only replaces a snapshot of an older version
+	_, err = p.pool.Exec(ctx,
+		fmt.Sprintf(`INSERT INTO %[1]s (id, version, state) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO UPDATE SET version = excluded.version, state = excluded.state
+			WHERE excluded.version > %[1]s.version`, p.snapshotsTable),
+		id, version, string(data))
+
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to save snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+func (p *postgres) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return p.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (p *postgres) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	var data []byte
+
+	err := p.pool.QueryRow(ctx, fmt.Sprintf("SELECT state FROM %s WHERE id = $1", p.snapshotsTable), id).Scan(&data)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	snapshot := &store.Snapshot{}
+
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe delivers new entities as they are stored, see store.Subscriber.
+// Every write notifies the channel named like the events table, a subscription listens on it
+// and reads the new entities. It reads the table at least every pollInterval, in case a notification is missed.
+func (p *postgres) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+p.eventsTable); err != nil {
+		return err
+	}
+	// the connection goes back to the pool, it must not receive notifications anymore
+	defer conn.Exec(context.Background(), "UNLISTEN "+p.eventsTable)
+
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		entities, err := p.ReadAllContext(ctx, position, p.subscriber.BatchSize())
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		for _, entity := range entities {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			position = entity.Position + 1
+		}
+
+		// a full batch means there are probably more entities to catch up with
+		if len(entities) == p.subscriber.BatchSize() {
+			continue
+		}
+
+		wait, cancel := context.WithTimeout(ctx, p.subscriber.Interval())
+		_, err = conn.Conn().WaitForNotification(wait)
+		cancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil && !pgconn.Timeout(err) {
+			return err
+		}
+	}
+}
+
+// write runs fn in a transaction, that is committed if fn succeeds.
+// Writes are serialized by an advisory lock on the events table, so that the positions of the
+// entities become visible in ascending order, and readers of the log don't skip an entity.
+// A lock per stream isn't enough: a position is drawn from the sequence when the row is inserted,
+// but becomes visible when the transaction commits, so a reader could see the position of a write to
+// one stream before the lower position of a concurrent write to another stream, and skip it. The
+// versions don't need the lock, they are checked by the unique index.
+func (p *postgres) write(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", p.eventsTable); err != nil {
+			return err
+		}
+
+		return fn(tx)
+	})
+
+	var evterr store.EventStoreError
+	if err != nil && !errors.As(err, &evterr) {
+		return store.EventStoreError{
+			Text:       "failed to write entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return err
+}
+
+// deduplicate checks if entities were already stored in the stream of the entity with the given id, see store.Deduplicate
+func (p *postgres) deduplicate(ctx context.Context, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		entities, err := p.query(ctx,
+			fmt.Sprintf("SELECT position, id, version, event_id, type, metadata, system, data FROM %s WHERE id = $1 AND event_id = $2", p.eventsTable),
+			id, eventID)
+
+		if err != nil || len(entities) == 0 {
+			return nil, err
+		}
+
+		return &entities[0], nil
+	})
+}
+
+// latestVersion returns the latest version of an entity, or an EventStoreError of type StreamDeleted
+// if its stream is soft deleted
+func (p *postgres) latestVersion(ctx context.Context, id string) (int64, error) {
+	version, deleted, err := p.streamState(ctx, p.pool, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if version == 0 {
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if deleted {
+		return 0, store.StreamDeletedError(id)
+	}
+
+	return version, nil
+}
+
+// queryer is implemented by pgxpool.Pool and pgx.Tx
+type queryer interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// streamState returns the latest version of an entity, which is 0 if it doesn't exist, and if its
+// stream is soft deleted
+func (p *postgres) streamState(ctx context.Context, q queryer, id string) (int64, bool, error) {
+	var version int64
+	var deleted bool
+
+	err := q.QueryRow(ctx,
+		fmt.Sprintf("SELECT COALESCE(MAX(version), 0), EXISTS (SELECT 1 FROM %s WHERE id = $1) FROM %s WHERE id = $1", p.tombstonesTable, p.eventsTable),
+		id).Scan(&version, &deleted)
+
+	if err != nil {
+		return 0, false, store.EventStoreError{
+			Text:       "failed to load version of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return version, deleted, nil
+}
+
+// checkTombstone returns an EventStoreError of type StreamDeleted if the stream of the entity with the
+// given id is soft deleted. Writes check it within their transaction, so they don't race with a delete.
+func (p *postgres) checkTombstone(ctx context.Context, tx pgx.Tx, id string) error {
+	_, deleted, err := p.streamState(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if deleted {
+		return store.StreamDeletedError(id)
+	}
+
+	return nil
+}
+
+// insert inserts entity, sets its position and notifies subscriptions when the transaction commits
+func (p *postgres) insert(ctx context.Context, tx pgx.Tx, entity *store.Entity) error {
+	data, err := json.Marshal(entity.Data)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	var eventID *string
+	if entity.EventID != "" {
+		eventID = &entity.EventID
+	}
+
+	system, err := json.Marshal(entity.System)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize system metadata",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	err = tx.QueryRow(ctx,
+		fmt.Sprintf("INSERT INTO %s (id, version, event_id, type, metadata, system, data, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING position", p.eventsTable),
+		entity.ID, entity.Version, eventID, entity.Type, entity.Metadata, string(system), string(data), entity.System.CreatedAt).Scan(&entity.Position)
+
+	if isUniqueViolation(err) {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity %s already exists", entity.Version, entity.ID),
+			ErrorType:  store.VersionConflict,
+			InnerError: err,
+		}
+	} else if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to insert entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT pg_notify($1, $2)", p.connectionInfo.TableName, fmt.Sprint(entity.Position)); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to notify subscriptions",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+// query runs a query for entities and decodes their data with store.Types
+func (p *postgres) query(ctx context.Context, sql string, args ...interface{}) ([]store.Entity, error) {
+	rows, err := p.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+	defer rows.Close()
+
+	result := []store.Entity{}
+
+	for rows.Next() {
+		var entity store.Entity
+		var eventID *string
+		var system, data []byte
+
+		if err := rows.Scan(&entity.Position, &entity.ID, &entity.Version, &eventID, &entity.Type, &entity.Metadata, &system, &data); err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to load entity",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		decoded, err := store.Types.Decode(entity.Type, data)
+		if err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to deserialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		// entities that were stored before the system metadata was introduced have none
+		if system != nil {
+			if err := json.Unmarshal(system, &entity.System); err != nil {
+				return nil, store.EventStoreError{
+					Text:       "failed to deserialize system metadata",
+					ErrorType:  store.SerializationFailed,
+					InnerError: err,
+				}
+			}
+		}
+
+		if eventID != nil {
+			entity.EventID = *eventID
+		}
+
+		entity.Data = decoded
+		result = append(result, entity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return result, nil
+}
+
+// isUniqueViolation checks if a statement failed, because a row with the same key exists
+func isUniqueViolation(err error) bool {
+	var perr *pgconn.PgError
+	return errors.As(err, &perr) && perr.Code == uniqueViolation
+}
+
+// isTransient checks if a statement failed because of a condition, that is likely to go away when the statement is repeated
+func isTransient(err error) bool {
+	var perr *pgconn.PgError
+	if errors.As(err, &perr) {
+		return perr.Code == serializationFailure || perr.Code == deadlockDetected
+	}
+
+	return pgconn.SafeToRetry(err)
+}
@@ -0,0 +1,906 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// BackendName is the name the Redis store is registered with, see store.Open
+	BackendName = "redis"
+
+	defaultKeyPrefix = "eventstore"
+
+	// replies of the scripts
+	replyExists    = "EXISTS"
+	replyNotFound  = "NOTFOUND"
+	replyConflict  = "CONFLICT"
+	replyDuplicate = "DUPLICATE"
+	replyDeleted   = "DELETED"
+)
+
+// appendScript appends entities to the stream of an entity and to the log of all entities.
+// The latest version is the length of the stream, it is checked and incremented atomically.
+// The latest position is kept in its own key, as hard deletes remove entries of the log, it is
+// the length of the log as long as the key doesn't exist.
+//
+// KEYS[1] is the stream of the entity, KEYS[2] the log of all entities, KEYS[3] the hash of the event IDs of the entity,
+// KEYS[4] the tombstone of the entity, KEYS[5] the latest position. ARGV[1] is "add" to create the stream, "append" to append to it or "any" to create or append,
+// ARGV[2] the expected version or an empty string, ARGV[3] the id of the entity, followed by type, metadata, data,
+// event ID and system metadata of every entity. The script returns the version and the position of the first entity, or DUPLICATE
+// if an event ID is already stored, or DELETED if the stream of the entity was deleted.
+var appendScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	return redis.error_reply('DELETED')
+end
+
+local version = redis.call('XLEN', KEYS[1])
+local expected = tonumber(ARGV[2])
+
+for i = 7, #ARGV, 5 do
+	if ARGV[i] ~= '' and redis.call('HEXISTS', KEYS[3], ARGV[i]) == 1 then
+		return redis.error_reply('DUPLICATE')
+	end
+end
+
+if ARGV[1] == 'add' then
+	if version > 0 then
+		return redis.error_reply('EXISTS')
+	end
+elseif ARGV[1] == 'append' then
+	if version == 0 then
+		return redis.error_reply('NOTFOUND')
+	end
+	if expected and version ~= expected then
+		return redis.error_reply('CONFLICT')
+	end
+end
+
+local position = tonumber(redis.call('GET', KEYS[5]) or redis.call('XLEN', KEYS[2]))
+local first = {version + 1, position + 1}
+
+for i = 4, #ARGV, 5 do
+	version = version + 1
+	position = position + 1
+	redis.call('XADD', KEYS[1], version .. '-0', 'position', position, 'type', ARGV[i], 'metadata', ARGV[i + 1], 'data', ARGV[i + 2], 'eventid', ARGV[i + 3], 'system', ARGV[i + 4])
+	redis.call('XADD', KEYS[2], position .. '-0', 'id', ARGV[3], 'version', version, 'type', ARGV[i], 'metadata', ARGV[i + 1], 'data', ARGV[i + 2], 'eventid', ARGV[i + 3], 'system', ARGV[i + 4])
+	if ARGV[i + 3] ~= '' then
+		redis.call('HSET', KEYS[3], ARGV[i + 3], version)
+	end
+end
+
+redis.call('SET', KEYS[5], position)
+return first
+`)
+
+// snapshotScript stores a snapshot, unless the stored snapshot has the same or a newer version.
+//
+// KEYS[1] is the stream of the entity, KEYS[2] the snapshot. ARGV[1] is the version, ARGV[2] the snapshot.
+var snapshotScript = redis.NewScript(`
+local version = tonumber(ARGV[1])
+
+if version < 1 or version > redis.call('XLEN', KEYS[1]) then
+	return redis.error_reply('NOTFOUND')
+end
+
+local current = tonumber(redis.call('HGET', KEYS[2], 'version') or '0')
+if current >= version then
+	return 0
+end
+
+redis.call('HSET', KEYS[2], 'version', ARGV[1], 'snapshot', ARGV[2])
+return 1
+`)
+
+// deleteScript deletes the stream of an entity. A soft delete sets the tombstone of the entity,
+// a hard delete removes the entries of the entity from the log of all entities by their positions,
+// and the stream, the event IDs, the snapshot and the tombstone. The latest position is stored
+// before, as it can't be counted by the length of the log afterwards, see appendScript.
+//
+// KEYS[1] is the stream of the entity, KEYS[2] the hash of the event IDs, KEYS[3] the snapshot, KEYS[4] the tombstone,
+// KEYS[5] the log of all entities, KEYS[6] the latest position. ARGV[1] is the expected version, see store.ExpectedVersion, ARGV[2] is "hard" for a hard delete.
+var deleteScript = redis.NewScript(`
+local version = redis.call('XLEN', KEYS[1])
+local expected = tonumber(ARGV[1])
+local deleted = redis.call('EXISTS', KEYS[4]) == 1
+
+if version == 0 then
+	return redis.error_reply('NOTFOUND')
+end
+if deleted and ARGV[2] ~= 'hard' then
+	return redis.error_reply('DELETED')
+end
+if expected == 0 then
+	return redis.error_reply('EXISTS')
+end
+if expected > 0 and version ~= expected then
+	return redis.error_reply('CONFLICT')
+end
+
+if ARGV[2] == 'hard' then
+	if redis.call('EXISTS', KEYS[6]) == 0 then
+		redis.call('SET', KEYS[6], redis.call('XLEN', KEYS[5]))
+	end
+
+	for _, entry in ipairs(redis.call('XRANGE', KEYS[1], '-', '+')) do
+		local fields = entry[2]
+		for i = 1, #fields, 2 do
+			if fields[i] == 'position' then
+				redis.call('XDEL', KEYS[5], fields[i + 1] .. '-0')
+			end
+		end
+	end
+
+	redis.call('DEL', KEYS[1], KEYS[2], KEYS[3], KEYS[4])
+else
+	redis.call('SET', KEYS[4], version)
+end
+
+return version
+`)
+
+type redisconnectioninfo struct {
+	Host      string `json:"redisHost"`
+	Password  string `json:"redisPassword"`
+	KeyPrefix string `json:"keyPrefix"`
+}
+
+type redisstore struct {
+	connectionInfo redisconnectioninfo
+	client         *redis.Client
+	retryPolicy    store.RetryPolicy
+	subscriber     *store.PollingSubscriber
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new Redis store
+func NewStore() store.EventStore {
+	return &redisstore{}
+}
+
+func (r *redisstore) Init(metadata store.Metadata) error {
+	retryPolicy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return err
+	}
+
+	r.retryPolicy = retryPolicy
+
+	subscriber, err := store.NewPollingSubscriber(r, metadata)
+	if err != nil {
+		return err
+	}
+
+	r.subscriber = subscriber
+
+	s, err := json.Marshal(metadata.Properties)
+	if err != nil {
+		return err
+	}
+
+	var info redisconnectioninfo
+	err = json.Unmarshal(s, &info)
+	if err != nil {
+		return err
+	}
+
+	if info.Host == "" {
+		return errors.New("host of Redis eventstore is missing")
+	}
+
+	if info.KeyPrefix == "" {
+		info.KeyPrefix = defaultKeyPrefix
+	}
+
+	r.connectionInfo = info
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     info.Host,
+		Password: info.Password,
+	})
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return err
+	}
+
+	r.client = client
+	return nil
+}
+
+// Close closes the connections to Redis
+func (r *redisstore) Close() error {
+	return r.client.Close()
+}
+
+func (r *redisstore) Add(entity *store.Entity) (*store.Entity, error) {
+	return r.AddContext(context.Background(), entity)
+}
+
+func (r *redisstore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	if err := r.append(ctx, "add", entity.ID, "", []*store.Entity{entity}); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (r *redisstore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return r.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (r *redisstore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	expectedVersion := ""
+	if concurrency == store.Optimistic {
+		expectedVersion = strconv.FormatInt(entity.Version, 10)
+	}
+
+	if err := r.append(ctx, "append", entity.ID, expectedVersion, []*store.Entity{entity}); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (r *redisstore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return r.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (r *redisstore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := r.append(ctx, "append", id, strconv.FormatInt(expectedVersion, 10), entities); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (r *redisstore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return r.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (r *redisstore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if err := expected.Validate(); err != nil {
+		return nil, err
+	}
+
+	mode, expectedVersion := "append", ""
+
+	switch expected {
+	case store.Any:
+		mode = "any"
+	case store.NoStream:
+		mode = "add"
+	case store.StreamExists:
+	default:
+		expectedVersion = strconv.FormatInt(int64(expected), 10)
+	}
+
+	if err := r.append(ctx, mode, id, expectedVersion, entities); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (r *redisstore) GetLatestVersionNumber(id string) (int64, error) {
+	return r.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (r *redisstore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	pipe := r.client.Pipeline()
+	length := pipe.XLen(ctx, r.streamKey(id))
+	tombstone := pipe.Exists(ctx, r.tombstoneKey(id))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, store.EventStoreError{
+			Text:       "failed to load version of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	version := length.Val()
+	if version == 0 {
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if tombstone.Val() == 1 {
+		return 0, store.StreamDeletedError(id)
+	}
+
+	return version, nil
+}
+
+func (r *redisstore) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return r.GetByVersionContext(context.Background(), id, version)
+}
+
+func (r *redisstore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	var entities []store.Entity
+
+	if version >= 1 {
+		var err error
+		entities, err = r.versions(ctx, id, version, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entities) == 0 {
+		if _, err := r.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return &entities[0], nil
+}
+
+func (r *redisstore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return r.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (r *redisstore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	entities := []store.Entity{}
+
+	if endVersion >= startVersion {
+		var err error
+		entities, err = r.versions(ctx, id, startVersion, endVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entities) == 0 {
+		// distinguish between an empty range and a missing entity
+		if _, err := r.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+func (r *redisstore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return r.GetAsOfContext(context.Background(), id, at)
+}
+
+func (r *redisstore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	return store.GetAsOf(ctx, r, id, at)
+}
+
+func (r *redisstore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return r.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (r *redisstore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return store.GetByTimeRange(ctx, r, id, from, to)
+}
+
+func (r *redisstore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return r.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (r *redisstore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	if fromPosition < 1 {
+		fromPosition = 1
+	}
+
+	messages, err := r.client.XRangeN(ctx, r.logKey(), streamID(fromPosition), "+", int64(maxCount)).Result()
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return logEntities(messages)
+}
+
+func (r *redisstore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return r.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext deletes the stream of an entity with deleteScript
+func (r *redisstore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+
+	mode := "soft"
+	if hard {
+		mode = "hard"
+	}
+
+	keys := []string{r.streamKey(id), r.eventIDsKey(id), r.snapshotKey(id), r.tombstoneKey(id), r.logKey(), r.positionKey()}
+
+	return r.retryPolicy.Retry(ctx, func() error {
+		err := deleteScript.Run(ctx, r.client, keys, int64(expected), mode).Err()
+
+		switch {
+		case err == nil:
+			return nil
+		case isReply(err, replyDeleted):
+			return store.StreamDeletedError(id)
+		case isReply(err, replyNotFound):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		case isReply(err, replyExists):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("An entity with id %s already exists", id),
+				ErrorType:  store.AlreadyExists,
+				InnerError: nil,
+			}
+		case isReply(err, replyConflict):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		return store.EventStoreError{
+			Text:       "failed to delete entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}, store.Retryable(store.Optimistic, isTransient))
+}
+
+func (r *redisstore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return r.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (r *redisstore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	err = r.retryPolicy.Retry(ctx, func() error {
+		err := snapshotScript.Run(ctx, r.client, []string{r.streamKey(id), r.snapshotKey(id)}, version, string(data)).Err()
+
+		if isReply(err, replyNotFound) {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to save snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	return err
+}
+
+func (r *redisstore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return r.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (r *redisstore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	data, err := r.client.HGet(ctx, r.snapshotKey(id), "snapshot").Result()
+
+	if err == redis.Nil {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	snapshot := &store.Snapshot{}
+
+	if err := json.Unmarshal([]byte(data), snapshot); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe delivers the entities of the log of all entities starting at fromPosition to handler, see store.Subscriber.
+// It waits for new entities with a blocking XREAD, that is repeated every pollInterval to notice when ctx is done.
+func (r *redisstore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		// XREAD returns the entries after the given id
+		streams, err := r.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{r.logKey(), streamID(position - 1)},
+			Count:   int64(r.subscriber.BatchSize()),
+			Block:   r.subscriber.Interval(),
+		}).Result()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to read entities",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		for _, stream := range streams {
+			entities, err := logEntities(stream.Messages)
+			if err != nil {
+				return err
+			}
+
+			for _, entity := range entities {
+				if err := handler(ctx, entity); err != nil {
+					return err
+				}
+
+				position = entity.Position + 1
+			}
+		}
+	}
+}
+
+// append runs appendScript and sets the versions and positions of entities. If expectedVersion
+// is empty, the entities are appended to the latest version. If the entities are already stored
+// with their event IDs, they get the stored versions and positions, see store.Deduplicate.
+func (r *redisstore) append(ctx context.Context, mode, id, expectedVersion string, entities []*store.Entity) error {
+	if err := store.ValidateEventIDs(entities); err != nil {
+		return err
+	}
+
+	args := []interface{}{mode, expectedVersion, id}
+
+	for _, entity := range entities {
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+
+		data, err := json.Marshal(entity.Data)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		system, err := json.Marshal(entity.System)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize system metadata",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		args = append(args, entity.Type, entity.Metadata, string(data), entity.EventID, string(system))
+	}
+
+	var first []int64
+	duplicate := false
+
+	err := r.retryPolicy.Retry(ctx, func() error {
+		var err error
+		first, err = appendScript.Run(ctx, r.client, []string{r.streamKey(id), r.logKey(), r.eventIDsKey(id), r.tombstoneKey(id), r.positionKey()}, args...).Int64Slice()
+		if err == nil {
+			return nil
+		}
+
+		switch {
+		case isReply(err, replyDuplicate):
+			duplicate, err = r.deduplicate(ctx, id, entities)
+			if err == nil && !duplicate {
+				return store.EventStoreError{
+					Text:       fmt.Sprintf("failed to deduplicate entities of entity %s", id),
+					ErrorType:  store.InternalError,
+					InnerError: nil,
+				}
+			}
+			return err
+		case isReply(err, replyDeleted):
+			return store.StreamDeletedError(id)
+		case isReply(err, replyExists):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("An entity with id %s already exists", id),
+				ErrorType:  store.AlreadyExists,
+				InnerError: nil,
+			}
+		case isReply(err, replyNotFound):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		case isReply(err, replyConflict):
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		return store.EventStoreError{
+			Text:       "failed to append entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil || duplicate {
+		return err
+	}
+
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = first[0] + int64(i)
+		entity.Position = first[1] + int64(i)
+	}
+
+	return nil
+}
+
+// deduplicate looks up the event IDs of entities in the hash of the event IDs of an entity, see store.Deduplicate
+func (r *redisstore) deduplicate(ctx context.Context, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		version, err := r.client.HGet(ctx, r.eventIDsKey(id), eventID).Int64()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to load event id",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		stored, err := r.versions(ctx, id, version, version)
+		if err != nil || len(stored) == 0 {
+			return nil, err
+		}
+
+		return &stored[0], nil
+	})
+}
+
+// versions reads a range of versions from the stream of an entity, unless the stream was soft deleted
+func (r *redisstore) versions(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	pipe := r.client.Pipeline()
+	xrange := pipe.XRange(ctx, r.streamKey(id), streamID(startVersion), streamID(endVersion))
+	tombstone := pipe.Exists(ctx, r.tombstoneKey(id))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if tombstone.Val() == 1 {
+		return nil, store.StreamDeletedError(id)
+	}
+
+	messages := xrange.Val()
+
+	result := []store.Entity{}
+
+	for _, message := range messages {
+		version, err := parseStreamID(message.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		entity, err := decode(message.Values)
+		if err != nil {
+			return nil, err
+		}
+
+		entity.ID = id
+		entity.Version = version
+		result = append(result, *entity)
+	}
+
+	return result, nil
+}
+
+func (r *redisstore) streamKey(id string) string {
+	return r.key("stream:" + id)
+}
+
+func (r *redisstore) logKey() string {
+	return r.key("log")
+}
+
+func (r *redisstore) positionKey() string {
+	return r.key("position")
+}
+
+func (r *redisstore) eventIDsKey(id string) string {
+	return r.key("eventids:" + id)
+}
+
+func (r *redisstore) snapshotKey(id string) string {
+	return r.key("snapshot:" + id)
+}
+
+func (r *redisstore) tombstoneKey(id string) string {
+	return r.key("tombstone:" + id)
+}
+
+// key returns the key with the key prefix. The prefix is a hash tag, so that all keys of
+// the store are in the same slot of a cluster and can be used by one script.
+func (r *redisstore) key(name string) string {
+	return "{" + r.connectionInfo.KeyPrefix + "}:" + name
+}
+
+// logEntities decodes the entries of the log of all entities
+func logEntities(messages []redis.XMessage) ([]store.Entity, error) {
+	result := []store.Entity{}
+
+	for _, message := range messages {
+		entity, err := decode(message.Values)
+		if err != nil {
+			return nil, err
+		}
+
+		position, err := parseStreamID(message.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		id, _ := message.Values["id"].(string)
+		version, err := strconv.ParseInt(fmt.Sprint(message.Values["version"]), 10, 64)
+		if err != nil {
+			return nil, store.EventStoreError{
+				Text:       "invalid version of entity",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		entity.ID = id
+		entity.Version = version
+		entity.Position = position
+		result = append(result, *entity)
+	}
+
+	return result, nil
+}
+
+// decode reads the fields of a stream entry into an entity and decodes its data with store.Types
+func decode(values map[string]interface{}) (*store.Entity, error) {
+	entity := &store.Entity{}
+	entity.Type, _ = values["type"].(string)
+	entity.Metadata, _ = values["metadata"].(string)
+	entity.EventID, _ = values["eventid"].(string)
+
+	if position, ok := values["position"].(string); ok {
+		entity.Position, _ = strconv.ParseInt(position, 10, 64)
+	}
+
+	data, _ := values["data"].(string)
+
+	decoded, err := store.Types.Decode(entity.Type, []byte(data))
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	// entries that were added before the system metadata was introduced have none
+	if system, ok := values["system"].(string); ok {
+		if err := json.Unmarshal([]byte(system), &entity.System); err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to deserialize system metadata",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+	}
+
+	entity.Data = decoded
+	return entity, nil
+}
+
+// streamID returns the id of the stream entry of a version or position
+func streamID(n int64) string {
+	return strconv.FormatInt(n, 10) + "-0"
+}
+
+// parseStreamID returns the version or position of a stream entry
+func parseStreamID(id string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(id, "-0"), 10, 64)
+	if err != nil {
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("invalid id of stream entry: %s", id),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return n, nil
+}
+
+// isReply checks if err is the error reply of a script, some servers prefix it with the generic error code ERR
+func isReply(err error, reply string) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr) && strings.HasPrefix(strings.TrimPrefix(rerr.Error(), "ERR "), reply)
+}
+
+// isTransient checks if a command was rejected because of a condition, that is likely to go away when it is repeated.
+// Network errors are not retried, as the script may have run even though its reply was lost.
+func isTransient(err error) bool {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return false
+	}
+
+	for _, prefix := range []string{"LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN"} {
+		if strings.HasPrefix(rerr.Error(), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
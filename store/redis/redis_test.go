@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStore creates a store that is connected to an in-process Redis server
+func newStore(t *testing.T) store.EventStore {
+	server := miniredis.RunT(t)
+
+	s := NewStore()
+	err := s.Init(store.Metadata{
+		Properties: map[string]string{
+			"redisHost":        server.Addr(),
+			store.PollInterval: "10ms",
+		},
+	})
+	require.Nil(t, err)
+
+	t.Cleanup(func() {
+		s.(*redisstore).Close()
+	})
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		return newStore(t)
+	})
+}
+
+func TestInitMissingHost(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	s := NewStore()
+	err := s.Init(store.Metadata{
+		Properties: map[string]string{
+			"redisHost": server.Addr(),
+			"keyPrefix": "orders",
+		},
+	})
+	require.Nil(t, err)
+	defer s.(*redisstore).Close()
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	assert.True(t, server.Exists("{orders}:stream:1"))
+	assert.True(t, server.Exists("{orders}:log"))
+}
+
+func TestOpen(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	s, err := store.Open(BackendName, store.Metadata{
+		Properties: map[string]string{"redisHost": server.Addr()},
+	})
+	require.Nil(t, err)
+	defer s.(*redisstore).Close()
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
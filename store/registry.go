@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// TypeRegistry maps type names to the Go types of the data of entities
+//
+// The event stores record the type name of the data with every stored entity. When an entity is
+// deserialized, its data is decoded into the registered Go type instead of a map[string]interface{}.
+type TypeRegistry struct {
+	mutex sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// Types is the TypeRegistry that is used by all event stores
+var Types = NewTypeRegistry()
+
+// NewTypeRegistry creates a new, empty TypeRegistry
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+}
+
+// RegisterType registers the type of data under name in Types
+func RegisterType(name string, data interface{}) error {
+	return Types.Register(name, data)
+}
+
+// RecordType sets the type of entity to the name its data is registered with in Types,
+// unless the type is already set
+func RecordType(entity *Entity) {
+	if entity.Type != "" {
+		return
+	}
+
+	if name, ok := Types.TypeName(entity.Data); ok {
+		entity.Type = name
+	}
+}
+
+// Register registers the type of data under name. If data is a pointer, entities are decoded to a
+// pointer as well. A name and a type can only be registered once, registering the same pair again is allowed.
+func (r *TypeRegistry) Register(name string, data interface{}) error {
+	if name == "" || data == nil {
+		return fmt.Errorf("type name and data must not be empty")
+	}
+
+	t := reflect.TypeOf(data)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if existing, ok := r.types[name]; ok && existing != t {
+		return fmt.Errorf("type name %s is already registered for %v", name, existing)
+	}
+
+	if existing, ok := r.names[t]; ok && existing != name {
+		return fmt.Errorf("type %v is already registered as %s", t, existing)
+	}
+
+	r.types[name] = t
+	r.names[t] = name
+	return nil
+}
+
+// TypeName returns the name the type of data is registered with
+func (r *TypeRegistry) TypeName(data interface{}) (string, bool) {
+	if data == nil {
+		return "", false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	name, ok := r.names[reflect.TypeOf(data)]
+	return name, ok
+}
+
+// Decode decodes JSON data into the type registered with name. If no type is registered with name,
+// data is decoded into an interface{}.
+func (r *TypeRegistry) Decode(name string, data []byte) (interface{}, error) {
+	r.mutex.RLock()
+	t, ok := r.types[name]
+	r.mutex.RUnlock()
+
+	if !ok {
+		var result interface{}
+		err := json.Unmarshal(data, &result)
+		return result, err
+	}
+
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+
+	v := reflect.New(t)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
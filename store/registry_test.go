@@ -0,0 +1,90 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type registryTestEvent struct {
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+type registryTestPointerEvent struct {
+	Text string `json:"text"`
+}
+
+func TestTypeRegistryRegister(t *testing.T) {
+	r := NewTypeRegistry()
+
+	assert.Nil(t, r.Register("test", registryTestEvent{}))
+	// registering the same pair again is allowed
+	assert.Nil(t, r.Register("test", registryTestEvent{}))
+
+	assert.NotNil(t, r.Register("test", registryTestPointerEvent{}))
+	assert.NotNil(t, r.Register("other", registryTestEvent{}))
+	assert.NotNil(t, r.Register("", registryTestEvent{}))
+	assert.NotNil(t, r.Register("nil", nil))
+
+	name, ok := r.TypeName(registryTestEvent{Text: "hello"})
+	assert.True(t, ok)
+	assert.Equal(t, "test", name)
+
+	_, ok = r.TypeName(&registryTestEvent{})
+	assert.False(t, ok)
+
+	_, ok = r.TypeName(nil)
+	assert.False(t, ok)
+}
+
+func TestTypeRegistryDecode(t *testing.T) {
+	r := NewTypeRegistry()
+	require.Nil(t, r.Register("value", registryTestEvent{}))
+	require.Nil(t, r.Register("pointer", &registryTestPointerEvent{}))
+
+	data, err := r.Decode("value", []byte(`{"text":"hello","count":2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, registryTestEvent{Text: "hello", Count: 2}, data)
+
+	data, err = r.Decode("pointer", []byte(`{"text":"hello"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &registryTestPointerEvent{Text: "hello"}, data)
+
+	data, err = r.Decode("unknown", []byte(`{"text":"hello"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"text": "hello"}, data)
+
+	_, err = r.Decode("value", []byte(`{"count":"two"}`))
+	assert.NotNil(t, err)
+}
+
+func TestEntityUnmarshalJSON(t *testing.T) {
+	require.Nil(t, RegisterType("store.registryTestEvent", registryTestEvent{}))
+
+	entity := &Entity{
+		ID:      "1",
+		Version: 2,
+		Data:    registryTestEvent{Text: "hello", Count: 2},
+	}
+	RecordType(entity)
+	assert.Equal(t, "store.registryTestEvent", entity.Type)
+
+	b, err := json.Marshal(entity)
+	require.Nil(t, err)
+
+	result := &Entity{}
+	assert.Nil(t, json.Unmarshal(b, result))
+	assert.Equal(t, entity, result)
+
+	// data of an unregistered type stays generic
+	b, err = json.Marshal(&Entity{ID: "1", Data: map[string]int{"count": 2}})
+	require.Nil(t, err)
+
+	result = &Entity{}
+	assert.Nil(t, json.Unmarshal(b, result))
+	assert.Equal(t, "", result.Type)
+	assert.Equal(t, map[string]interface{}{"count": float64(2)}, result.Data)
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// RetryMaxAttempts is the metadata property for the maximum number of attempts of an operation
+	RetryMaxAttempts = "retryMaxAttempts"
+	// RetryBaseDelay is the metadata property for the delay before the first retry, e.g. "20ms"
+	RetryBaseDelay = "retryBaseDelay"
+	// RetryMaxDelay is the metadata property for the upper limit of the delay between two attempts, e.g. "2s"
+	RetryMaxDelay = "retryMaxDelay"
+	// RetryJitter is the metadata property for the random part of a delay, a fraction between 0 and 1
+	RetryJitter = "retryJitter"
+)
+
+// RetryPolicy controls how often and how fast operations are retried, that failed because of a conflict or a transient error.
+// The delay doubles with every attempt, starting with BaseDelay, until it reaches MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+// DefaultRetryPolicy returns the policy that is used when the metadata doesn't configure retries
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 10,
+		BaseDelay:   20 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// NewRetryPolicy reads a RetryPolicy from metadata, missing properties are taken from DefaultRetryPolicy
+func NewRetryPolicy(metadata Metadata) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+
+	if v, ok := metadata.Properties[RetryMaxAttempts]; ok && v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("%s must be a positive number: %s", RetryMaxAttempts, v)
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	if v, ok := metadata.Properties[RetryBaseDelay]; ok && v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay <= 0 {
+			return policy, fmt.Errorf("%s must be a positive duration: %s", RetryBaseDelay, v)
+		}
+		policy.BaseDelay = delay
+	}
+
+	if v, ok := metadata.Properties[RetryMaxDelay]; ok && v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay <= 0 {
+			return policy, fmt.Errorf("%s must be a positive duration: %s", RetryMaxDelay, v)
+		}
+		policy.MaxDelay = delay
+	}
+
+	if v, ok := metadata.Properties[RetryJitter]; ok && v != "" {
+		jitter, err := strconv.ParseFloat(v, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return policy, fmt.Errorf("%s must be a number between 0 and 1: %s", RetryJitter, v)
+		}
+		policy.Jitter = jitter
+	}
+
+	return policy, nil
+}
+
+// Delay returns the time to wait after the given, failed attempt. Attempts start with 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		// spread the delay evenly by +/- jitter
+		delay = time.Duration(float64(delay) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+
+	return delay
+}
+
+// Retry runs operation until it succeeds or fails with an error that retryable rejects.
+// If the policy runs out of attempts, an EventStoreError of type RetriesExhausted is returned.
+// If ctx is done, Retry stops waiting and returns the error of the context.
+func (p RetryPolicy) Retry(ctx context.Context, operation func() error, retryable func(err error) bool) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := operation()
+		if err == nil || !retryable(err) {
+			return err
+		}
+
+		if attempt >= p.MaxAttempts {
+			return EventStoreError{
+				Text:       fmt.Sprintf("giving up after %d attempts", attempt),
+				ErrorType:  RetriesExhausted,
+				InnerError: err,
+			}
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Retryable returns a function for Retry that accepts EventStoreErrors of type VersionConflict when there is
+// no concurrency control, as the write can go to the new latest version, unless the write is partially stored
+// (see Deduplicate), and EventStoreErrors whose inner error is accepted by isTransient.
+func Retryable(concurrency ConcurrencyControl, isTransient func(err error) bool) func(err error) bool {
+	return func(err error) bool {
+		var evterr EventStoreError
+		if !errors.As(err, &evterr) {
+			return false
+		}
+
+		if evterr.ErrorType == VersionConflict {
+			return concurrency == None && !errors.Is(evterr.InnerError, errPartialDuplicate)
+		}
+
+		return evterr.InnerError != nil && isTransient(evterr.InnerError)
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTransient = errors.New("transient")
+
+func isTransient(err error) bool {
+	return err == errTransient
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	policy, err := NewRetryPolicy(Metadata{Properties: map[string]string{}})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultRetryPolicy(), policy)
+
+	policy, err = NewRetryPolicy(Metadata{
+		Properties: map[string]string{
+			RetryMaxAttempts: "3",
+			RetryBaseDelay:   "5ms",
+			RetryMaxDelay:    "1s",
+			RetryJitter:      "0.5",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, RetryPolicy{MaxAttempts: 3, BaseDelay: 5 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.5}, policy)
+
+	for _, property := range []struct{ key, value string }{
+		{RetryMaxAttempts, "0"},
+		{RetryBaseDelay, "soon"},
+		{RetryBaseDelay, "0s"},
+		{RetryMaxDelay, "-1s"},
+		{RetryMaxDelay, "0"},
+		{RetryJitter, "2"},
+	} {
+		_, err = NewRetryPolicy(Metadata{Properties: map[string]string{property.key: property.value}})
+		assert.NotNil(t, err, property.key+"="+property.value)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+
+	assert.Equal(t, 10*time.Millisecond, policy.Delay(1))
+	assert.Equal(t, 20*time.Millisecond, policy.Delay(2))
+	assert.Equal(t, 40*time.Millisecond, policy.Delay(3))
+	assert.Equal(t, 50*time.Millisecond, policy.Delay(4))
+	assert.Equal(t, 50*time.Millisecond, policy.Delay(100))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(1)
+		assert.True(t, delay >= 5*time.Millisecond && delay <= 15*time.Millisecond, delay)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	// succeeds after a transient error
+	attempts := 0
+	err := policy.Retry(context.Background(), func() error {
+		attempts++
+		if attempts < 2 {
+			return errTransient
+		}
+		return nil
+	}, isTransient)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// other errors are not retried
+	attempts = 0
+	permanent := errors.New("permanent")
+	err = policy.Retry(context.Background(), func() error {
+		attempts++
+		return permanent
+	}, isTransient)
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, 1, attempts)
+
+	// gives up after max attempts
+	attempts = 0
+	err = policy.Retry(context.Background(), func() error {
+		attempts++
+		return errTransient
+	}, isTransient)
+	assert.Equal(t, 3, attempts)
+
+	evterr, ok := err.(EventStoreError)
+	assert.True(t, ok)
+	assert.Equal(t, RetriesExhausted, evterr.ErrorType)
+	assert.Equal(t, errTransient, evterr.InnerError)
+}
+
+func TestRetryCanceled(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 100, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := policy.Retry(ctx, func() error {
+		attempts++
+		return errTransient
+	}, isTransient)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryable(t *testing.T) {
+	conflict := EventStoreError{ErrorType: VersionConflict}
+	transient := EventStoreError{ErrorType: InternalError, InnerError: errTransient}
+	permanent := EventStoreError{ErrorType: InternalError, InnerError: errors.New("permanent")}
+	partial := EventStoreError{ErrorType: VersionConflict, InnerError: errPartialDuplicate}
+
+	none := Retryable(None, isTransient)
+	assert.True(t, none(conflict))
+	assert.False(t, none(partial))
+	assert.True(t, none(transient))
+	assert.False(t, none(permanent))
+	assert.False(t, none(errTransient))
+
+	optimistic := Retryable(Optimistic, isTransient)
+	assert.False(t, optimistic(conflict))
+	assert.True(t, optimistic(transient))
+	assert.False(t, optimistic(permanent))
+}
+
+func TestRetriesExhaustedWrapsError(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2}
+
+	err := policy.Retry(context.Background(), func() error {
+		return EventStoreError{ErrorType: VersionConflict}
+	}, Retryable(None, isTransient))
+
+	assert.True(t, errors.Is(err, ErrRetriesExhausted))
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+	assert.False(t, errors.Is(err, ErrNotFound))
+}
@@ -0,0 +1,270 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+)
+
+// fakeS3 is an in-process stand-in for the parts of the S3 REST API that are used by the event store:
+// buckets, objects with conditional puts and listing with ListObjectsV2. Buckets are addressed by the
+// path and requests are not authenticated.
+type fakeS3 struct {
+	server  *httptest.Server
+	mutex   sync.Mutex
+	buckets map[string]map[string][]byte
+
+	// failRequest fails every request it returns an error for
+	failRequest func(r *http.Request) *fakeError
+}
+
+type fakeError struct {
+	status int
+	code   string
+}
+
+func (e *fakeError) Error() string {
+	return e.code
+}
+
+var (
+	errFakeNoSuchBucket       = &fakeError{http.StatusNotFound, "NoSuchBucket"}
+	errFakeNoSuchKey          = &fakeError{http.StatusNotFound, "NoSuchKey"}
+	errFakeBucketExists       = &fakeError{http.StatusConflict, "BucketAlreadyOwnedByYou"}
+	errFakePreconditionFailed = &fakeError{http.StatusPreconditionFailed, "PreconditionFailed"}
+	errFakeInvalidRequest     = &fakeError{http.StatusBadRequest, "InvalidRequest"}
+	errFakeNotImplemented     = &fakeError{http.StatusNotImplemented, "NotImplemented"}
+)
+
+// newFakeS3 starts a new fake and returns the metadata to connect to it
+func newFakeS3(t *testing.T) (*fakeS3, store.Metadata) {
+	f := &fakeS3{
+		buckets: map[string]map[string][]byte{},
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+
+	metadata := store.Metadata{
+		Properties: map[string]string{
+			"endpoint":        f.server.URL,
+			"bucket":          "events",
+			"accessKeyId":     "fake",
+			"secretAccessKey": "fake",
+		},
+	}
+
+	return f, metadata
+}
+
+func (f *fakeS3) setFailRequest(failRequest func(r *http.Request) *fakeError) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failRequest = failRequest
+}
+
+// keys returns the keys of all objects of a bucket in ascending order
+func (f *fakeS3) keys(bucket string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	keys := []string{}
+	for key := range f.buckets[bucket] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// isPutObject checks if r creates an object whose key starts with prefix
+func isPutObject(r *http.Request, bucket, prefix string) bool {
+	return r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/"+bucket+"/"+prefix)
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failRequest != nil {
+		if err := f.failRequest(r); err != nil {
+			f.writeError(w, r, err)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, r, errFakeInvalidRequest)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+
+	if len(parts) == 1 || parts[1] == "" {
+		switch r.Method {
+		case http.MethodPut:
+			f.createBucket(w, r, bucket)
+		case http.MethodHead:
+			if _, ok := f.buckets[bucket]; !ok {
+				f.writeError(w, r, errFakeNoSuchBucket)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			f.listObjects(w, r, bucket)
+		default:
+			f.writeError(w, r, errFakeNotImplemented)
+		}
+		return
+	}
+
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		f.writeError(w, r, errFakeNoSuchBucket)
+		return
+	}
+
+	key := parts[1]
+
+	switch r.Method {
+	case http.MethodPut:
+		if _, exists := objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			f.writeError(w, r, errFakePreconditionFailed)
+			return
+		}
+
+		objects[key] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%x\"", len(body)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, exists := objects[key]
+		if !exists {
+			f.writeError(w, r, errFakeNoSuchKey)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, r, errFakeNotImplemented)
+	}
+}
+
+func (f *fakeS3) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if _, ok := f.buckets[bucket]; ok {
+		f.writeError(w, r, errFakeBucketExists)
+		return
+	}
+
+	f.buckets[bucket] = map[string][]byte{}
+	w.WriteHeader(http.StatusOK)
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	KeyCount              int      `xml:"KeyCount"`
+	MaxKeys               int      `xml:"MaxKeys"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+// listObjects lists the objects of a bucket like ListObjectsV2, the continuation token is the last key of a page
+func (f *fakeS3) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		f.writeError(w, r, errFakeNoSuchBucket)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		f.writeError(w, r, errFakeNotImplemented)
+		return
+	}
+
+	prefix := query.Get("prefix")
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	maxKeys := 1000
+	if s := query.Get("max-keys"); s != "" {
+		maxKeys, _ = strconv.Atoi(s)
+	}
+
+	keys := []string{}
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	result := fakeListResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys}
+
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key  string `xml:"Key"`
+			Size int    `xml:"Size"`
+		}{key, len(objects[key])})
+	}
+
+	result.KeyCount = len(keys)
+
+	data, _ := xml.Marshal(result)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, r *http.Request, err *fakeError) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(err.status)
+		return
+	}
+
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: err.code, Message: err.code})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.status)
+	w.Write(data)
+}
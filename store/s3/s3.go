@@ -0,0 +1,1173 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// BackendName is the name the S3 store is registered with, see store.Open
+	BackendName = "s3"
+
+	defaultRegion = "us-east-1"
+
+	// the log of all entities and the snapshots are stored below their own prefix,
+	// that can't be the prefix of an encoded id
+	logPrefix       = "$all/"
+	snapshotPrefix  = "$snapshots/"
+	eventIDPrefix   = "$eventids/"
+	tombstonePrefix = "$tombstones/"
+	keyFormat       = "%019d"
+
+	// positionShift is the number of bits of a position, that hold the index of an entity in its log object.
+	// The position of an entity is the sequence of its log object shifted left, plus the index.
+	positionShift = 16
+	maxBatchSize  = 1 << positionShift
+)
+
+type s3connectioninfo struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	KeyPrefix       string `json:"keyPrefix"`
+}
+
+// logObject is an object of the log of all entities, it holds the entities of one write or a deletion
+type logObject struct {
+	Entities []*store.Entity `json:"entities"`
+	Deletion *deletion       `json:"deletion,omitempty"`
+}
+
+// deletion deletes the stream of the entity with the given id
+type deletion struct {
+	ID   string `json:"id"`
+	Hard bool   `json:"hard"`
+}
+
+type s3store struct {
+	connectionInfo s3connectioninfo
+	client         *s3.Client
+	retryPolicy    store.RetryPolicy
+	subscriber     *store.PollingSubscriber
+
+	// sequence is the latest sequence of the log known to the store, the log is listed after it
+	mutex    sync.Mutex
+	sequence int64
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new S3 store
+func NewStore() store.EventStore {
+	return &s3store{}
+}
+
+func (s *s3store) Init(metadata store.Metadata) error {
+	retryPolicy, err := store.NewRetryPolicy(metadata)
+	if err != nil {
+		return err
+	}
+
+	s.retryPolicy = retryPolicy
+
+	subscriber, err := store.NewPollingSubscriber(s, metadata)
+	if err != nil {
+		return err
+	}
+
+	s.subscriber = subscriber
+
+	data, err := json.Marshal(metadata.Properties)
+	if err != nil {
+		return err
+	}
+
+	var info s3connectioninfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return err
+	}
+
+	if info.Bucket == "" {
+		return errors.New("bucket of S3 eventstore is missing")
+	}
+
+	if info.Region == "" {
+		info.Region = defaultRegion
+	}
+
+	if info.KeyPrefix != "" && !strings.HasSuffix(info.KeyPrefix, "/") {
+		info.KeyPrefix += "/"
+	}
+
+	s.connectionInfo = info
+
+	options := s3.Options{
+		Region: info.Region,
+	}
+
+	if info.AccessKeyID != "" {
+		options.Credentials = aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: info.AccessKeyID, SecretAccessKey: info.SecretAccessKey}, nil
+		})
+	}
+
+	// S3-compatible storage is addressed by the path, as the bucket is often no DNS name of the endpoint
+	if info.Endpoint != "" {
+		options.BaseEndpoint = aws.String(info.Endpoint)
+		options.UsePathStyle = true
+	}
+
+	s.client = s3.New(options)
+
+	ctx := context.Background()
+
+	_, err = s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(info.Bucket)})
+	if isNotFound(err) {
+		input := &s3.CreateBucketInput{Bucket: aws.String(info.Bucket)}
+
+		if info.Region != defaultRegion {
+			input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+				LocationConstraint: types.BucketLocationConstraint(info.Region),
+			}
+		}
+
+		_, err = s.client.CreateBucket(ctx, input)
+	}
+
+	return err
+}
+
+func (s *s3store) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *s3store) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, entity.ID, []*store.Entity{entity}, func(version int64) error {
+			if version != 0 {
+				return store.EventStoreError{
+					Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+					ErrorType:  store.AlreadyExists,
+					InnerError: nil,
+				}
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *s3store) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *s3store) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	expectedVersion := entity.Version
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, entity.ID, []*store.Entity{entity}, func(version int64) error {
+			if version == 0 {
+				return notFound(entity.ID)
+			}
+
+			if concurrency == store.Optimistic && version != expectedVersion {
+				return stale(entity.ID)
+			}
+
+			return nil
+		})
+	}, store.Retryable(concurrency, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *s3store) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *s3store) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) >= maxBatchSize {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("a batch can contain at most %d entities", maxBatchSize-1),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, id, entities, func(version int64) error {
+			if version == 0 {
+				return notFound(id)
+			}
+
+			if version != expectedVersion {
+				return stale(id)
+			}
+
+			return nil
+		})
+	}, store.Retryable(store.Optimistic, isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *s3store) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *s3store) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	if len(entities) >= maxBatchSize {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("a batch can contain at most %d entities", maxBatchSize-1),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	if len(entities) == 0 {
+		if err := store.CheckExpectedVersion(ctx, s, id, expected); err != nil {
+			return nil, err
+		}
+
+		return entities, nil
+	}
+
+	err := s.retryPolicy.Retry(ctx, func() error {
+		return s.write(ctx, id, entities, func(version int64) error {
+			return expected.Check(id, version)
+		})
+	}, store.Retryable(expected.Concurrency(), isTransient))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *s3store) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *s3store) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	version, err := s.latestVersion(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if version == 0 {
+		return 0, notFound(id)
+	}
+
+	if err := s.checkDeleted(ctx, id); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (s *s3store) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *s3store) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	entities, err := s.GetByVersionRangeContext(ctx, id, version, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	return &entities[0], nil
+}
+
+func (s *s3store) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+// GetByVersionRangeContext lists the objects of the entity starting at startVersion and reads them.
+func (s *s3store) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	if startVersion < 1 {
+		startVersion = 1
+	}
+
+	keys := []string{}
+
+	if startVersion <= endVersion {
+		err := s.list(ctx, s.entityPrefix(id), s.entityKey(id, startVersion-1), func(key string, version int64) bool {
+			if version > endVersion {
+				return false
+			}
+
+			keys = append(keys, key)
+			return true
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(keys) == 0 {
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+	} else if err := s.checkDeleted(ctx, id); err != nil {
+		return nil, err
+	}
+
+	result := make([]store.Entity, 0, len(keys))
+
+	for _, key := range keys {
+		var entity store.Entity
+		if err := s.get(ctx, key, &entity); err != nil {
+			return nil, err
+		}
+
+		result = append(result, entity)
+	}
+
+	return result, nil
+}
+
+func (s *s3store) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+func (s *s3store) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	return store.GetAsOf(ctx, s, id, at)
+}
+
+func (s *s3store) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *s3store) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	return store.GetByTimeRange(ctx, s, id, from, to)
+}
+
+func (s *s3store) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+// ReadAllContext lists the objects of the log starting at the object of fromPosition and reads them,
+// until maxCount entities are read.
+func (s *s3store) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	result := []store.Entity{}
+	var readErr error
+
+	err := s.list(ctx, s.connectionInfo.KeyPrefix+logPrefix, s.logKey(startSequence(fromPosition)-1), func(key string, _ int64) bool {
+		var object logObject
+		if readErr = s.get(ctx, key, &object); readErr != nil {
+			return false
+		}
+
+		for _, entity := range object.Entities {
+			if entity.Position < fromPosition {
+				continue
+			}
+
+			result = append(result, *entity)
+
+			if len(result) == maxCount {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if err == nil {
+		err = readErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *s3store) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext creates an object of the log of all entities with the deletion, so that it is ordered with
+// the writes like an object with entities. Afterwards a soft delete creates the tombstone object of the entity,
+// a hard delete empties the log objects of the entity and removes its objects, its event IDs and snapshots.
+func (s *s3store) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	if err := expected.Validate(); err != nil {
+		return err
+	}
+
+	return s.retryPolicy.Retry(ctx, func() error {
+		sequence, err := s.latestSequence(ctx)
+		if err != nil {
+			return err
+		}
+
+		if sequence > 0 {
+			if err := s.complete(ctx, sequence); err != nil {
+				return err
+			}
+		}
+
+		version, err := s.latestVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := s.exists(ctx, s.tombstoneKey(id))
+		if err != nil {
+			return err
+		}
+
+		if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+			return err
+		}
+
+		d := &deletion{ID: id, Hard: hard}
+
+		data, err := json.Marshal(&logObject{Entities: []*store.Entity{}, Deletion: d})
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize deletion",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		if err := s.put(ctx, s.logKey(sequence+1), data); err != nil {
+			return store.EventStoreError{
+				Text:       "failed to append deletion to the log",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		s.advance(sequence + 1)
+
+		// the deletion is stored, if it can't be applied, the next write completes it
+		s.applyDeletion(ctx, d)
+		return nil
+	}, store.Retryable(expected.Concurrency(), isTransient))
+}
+
+func (s *s3store) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+// SaveSnapshotContext stores the snapshot as an immutable object per version. Older snapshots of
+// the entity are removed afterwards, so usually only the latest snapshot is listed.
+func (s *s3store) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	latest, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if version < 1 || version > latest {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	prefix := s.snapshotPrefix(id)
+	older := []string{}
+	newer := false
+
+	err = s.list(ctx, prefix, "", func(key string, v int64) bool {
+		if v >= version {
+			newer = true
+			return false
+		}
+
+		older = append(older, key)
+		return true
+	})
+
+	if err != nil || newer {
+		return err
+	}
+
+	err = s.retryPolicy.Retry(ctx, func() error {
+		return s.put(ctx, prefix+fmt.Sprintf(keyFormat, version), data)
+	}, store.Retryable(store.None, isTransient))
+
+	// the snapshot of this version was saved concurrently
+	if isPreconditionFailed(err) {
+		return nil
+	} else if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to save snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	for _, key := range older {
+		s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.connectionInfo.Bucket),
+			Key:    aws.String(key),
+		})
+	}
+
+	return nil
+}
+
+func (s *s3store) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *s3store) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	latest := ""
+
+	err := s.list(ctx, s.snapshotPrefix(id), "", func(key string, _ int64) bool {
+		latest = key
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if latest == "" {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	snapshot := &store.Snapshot{}
+	if err := s.get(ctx, latest, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe polls the log of all entities for new entities, see store.Subscriber.
+// The interval is configured with the metadata property pollInterval.
+func (s *s3store) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	return s.subscriber.Subscribe(ctx, fromPosition, handler)
+}
+
+// write stores entities as one object of the log of all entities, after check accepted the latest version
+// of the entity. If the entities are already stored with their event IDs, they get the stored versions and
+// positions instead, see store.Deduplicate. The object is created with the next sequence of the log, if the sequence is taken by a
+// concurrent write, the write is repeated. Afterwards every entity is copied to its own object.
+//
+// The objects of the entities of the previous write are created before, in case it failed after its log
+// object was created, so the latest version of an entity is always known when the log is appended.
+func (s *s3store) write(ctx context.Context, id string, entities []*store.Entity, check func(version int64) error) error {
+	sequence, err := s.latestSequence(ctx)
+	if err != nil {
+		return err
+	}
+
+	if sequence > 0 {
+		if err := s.complete(ctx, sequence); err != nil {
+			return err
+		}
+	}
+
+	version, err := s.latestVersion(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// a tombstone without objects of the entity is left behind by an incomplete hard delete
+	if version > 0 {
+		if err := s.checkDeleted(ctx, id); err != nil {
+			return err
+		}
+	} else if err := s.deleteObject(ctx, s.tombstoneKey(id)); err != nil {
+		return err
+	}
+
+	if duplicate, err := s.deduplicate(ctx, id, entities); err != nil || duplicate {
+		return err
+	}
+
+	if err := check(version); err != nil {
+		return err
+	}
+
+	for i, entity := range entities {
+		entity.ID = id
+		entity.Version = version + int64(i) + 1
+		entity.Position = position(sequence+1, i)
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+	}
+
+	data, err := json.Marshal(&logObject{Entities: entities})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	if err := s.put(ctx, s.logKey(sequence+1), data); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to append entities to the log",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	s.advance(sequence + 1)
+
+	// the entities are stored, if they can't be copied, the next write completes them
+	s.copyEntities(ctx, entities)
+	return nil
+}
+
+// complete copies the entities of the log object with the given sequence to their own objects,
+// if the write of the log object failed before it copied all of them. The deletion of a log object
+// is applied again, as it can't be told if it was applied completely, but only as long as it is the
+// last object of the log, so that a stale sequence doesn't delete a stream that was written since.
+func (s *s3store) complete(ctx context.Context, sequence int64) error {
+	var object logObject
+	if err := s.get(ctx, s.logKey(sequence), &object); err != nil {
+		return err
+	}
+
+	if object.Deletion != nil {
+		newer, err := s.exists(ctx, s.logKey(sequence+1))
+		if err != nil || newer {
+			return err
+		}
+
+		return s.applyDeletion(ctx, object.Deletion)
+	}
+
+	if len(object.Entities) == 0 {
+		return nil
+	}
+
+	// the entities are copied in the order of their versions
+	last := object.Entities[len(object.Entities)-1]
+
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Key:    aws.String(s.entityKey(last.ID, last.Version)),
+	})
+
+	if isNotFound(err) {
+		return s.copyEntities(ctx, object.Entities)
+	} else if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to load entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+// copyEntities creates an object per entity, objects that already exist are kept. The object of the event ID
+// of an entity is created before the object of the entity, so it exists when the write is complete.
+func (s *s3store) copyEntities(ctx context.Context, entities []*store.Entity) error {
+	for _, entity := range entities {
+		if entity.EventID != "" {
+			err := s.put(ctx, s.eventIDKey(entity.ID, entity.EventID), []byte(strconv.FormatInt(entity.Version, 10)))
+			if err != nil && !isPreconditionFailed(err) {
+				return store.EventStoreError{
+					Text:       "failed to store event id",
+					ErrorType:  store.InternalError,
+					InnerError: err,
+				}
+			}
+		}
+
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to serialize entity",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+
+		err = s.put(ctx, s.entityKey(entity.ID, entity.Version), data)
+		if err != nil && !isPreconditionFailed(err) {
+			return store.EventStoreError{
+				Text:       "failed to store entity",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyDeletion creates the tombstone object of an entity. A hard delete empties the log objects of the entity and
+// removes the event IDs, snapshots and objects of the entity afterwards and the tombstone last, so the stream is
+// deleted until it is complete. A tombstone only counts as long as the entity has objects.
+func (s *s3store) applyDeletion(ctx context.Context, d *deletion) error {
+	err := s.put(ctx, s.tombstoneKey(d.ID), []byte("true"))
+	if err != nil && !isPreconditionFailed(err) {
+		return store.EventStoreError{
+			Text:       "failed to store tombstone",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if !d.Hard {
+		return nil
+	}
+
+	if err := s.removeFromLog(ctx, d.ID); err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{s.eventIDPrefix(d.ID), s.snapshotPrefix(d.ID), s.entityPrefix(d.ID)} {
+		if err := s.deletePrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+
+	return s.deleteObject(ctx, s.tombstoneKey(d.ID))
+}
+
+// removeFromLog replaces the log objects that hold entities of the entity with the given id with empty objects.
+// The log objects are found by the positions of the objects of the entity, a log object only holds entities of
+// one entity. The objects are removed afterwards, so a deletion that fails in between can be applied again.
+func (s *s3store) removeFromLog(ctx context.Context, id string) error {
+	sequences := map[int64]bool{}
+	var readErr error
+
+	err := s.list(ctx, s.entityPrefix(id), "", func(key string, _ int64) bool {
+		var entity store.Entity
+		if readErr = s.get(ctx, key, &entity); readErr != nil {
+			return false
+		}
+
+		if entity.Position > 0 {
+			sequences[entity.Position>>positionShift] = true
+		}
+
+		return true
+	})
+
+	if err == nil {
+		err = readErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&logObject{Entities: []*store.Entity{}})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize log object",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	for sequence := range sequences {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.connectionInfo.Bucket),
+			Key:         aws.String(s.logKey(sequence)),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		})
+
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to remove entities from the log",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+	}
+
+	return nil
+}
+
+// deletePrefix removes all objects below prefix
+func (s *s3store) deletePrefix(ctx context.Context, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to list objects",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		for _, object := range page.Contents {
+			if err := s.deleteObject(ctx, aws.ToString(object.Key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *s3store) deleteObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil && !isNotFound(err) {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("failed to delete object %s", key),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+// checkDeleted returns an error of type StreamDeleted, if the tombstone object of the entity exists
+func (s *s3store) checkDeleted(ctx context.Context, id string) error {
+	deleted, err := s.exists(ctx, s.tombstoneKey(id))
+	if err != nil {
+		return err
+	}
+
+	if deleted {
+		return store.StreamDeletedError(id)
+	}
+
+	return nil
+}
+
+// exists checks if an object exists
+func (s *s3store) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Key:    aws.String(key),
+	})
+
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, store.EventStoreError{
+			Text:       fmt.Sprintf("failed to load object %s", key),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return true, nil
+}
+
+// deduplicate reads the objects of the event IDs of entities and the entities they refer to, see store.Deduplicate
+func (s *s3store) deduplicate(ctx context.Context, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		var version int64
+		if err := s.get(ctx, s.eventIDKey(id, eventID), &version); isNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var entity store.Entity
+		if err := s.get(ctx, s.entityKey(id, version), &entity); err != nil {
+			return nil, err
+		}
+
+		return &entity, nil
+	})
+}
+
+// latestVersion returns the version of the last object of an entity, or 0 if it has none
+func (s *s3store) latestVersion(ctx context.Context, id string) (int64, error) {
+	version := int64(0)
+
+	err := s.list(ctx, s.entityPrefix(id), "", func(_ string, v int64) bool {
+		version = v
+		return true
+	})
+
+	return version, err
+}
+
+// latestSequence returns the sequence of the last object of the log, or 0 if the log is empty
+func (s *s3store) latestSequence(ctx context.Context) (int64, error) {
+	s.mutex.Lock()
+	sequence := s.sequence
+	s.mutex.Unlock()
+
+	err := s.list(ctx, s.connectionInfo.KeyPrefix+logPrefix, s.logKey(sequence), func(_ string, v int64) bool {
+		sequence = v
+		return true
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.advance(sequence)
+	return sequence, nil
+}
+
+// advance sets the latest sequence of the log known to the store
+func (s *s3store) advance(sequence int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sequence > s.sequence {
+		s.sequence = sequence
+	}
+}
+
+// list calls fn with the keys below prefix after the key startAfter in ascending order and the number
+// the keys end with, until fn returns false
+func (s *s3store) list(ctx context.Context, prefix, startAfter string, fn func(key string, number int64) bool) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to list objects",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+
+			number, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if !fn(key, number) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// get reads an object and deserializes it into v
+func (s *s3store) get(ctx context.Context, key string, v interface{}) error {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.connectionInfo.Bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("failed to load object %s", key),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("failed to load object %s", key),
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("failed to deserialize object %s", key),
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+// put creates an object, if it doesn't exist yet
+func (s *s3store) put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.connectionInfo.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		IfNoneMatch: aws.String("*"),
+	})
+
+	return err
+}
+
+// entityPrefix returns the prefix of the objects of the entity with the given id.
+// The id is encoded, so that it contains no slashes and every id has its own prefix.
+func (s *s3store) entityPrefix(id string) string {
+	return s.connectionInfo.KeyPrefix + base64.RawURLEncoding.EncodeToString([]byte(id)) + "/"
+}
+
+func (s *s3store) entityKey(id string, version int64) string {
+	return s.entityPrefix(id) + fmt.Sprintf(keyFormat, version)
+}
+
+func (s *s3store) logKey(sequence int64) string {
+	return s.connectionInfo.KeyPrefix + logPrefix + fmt.Sprintf(keyFormat, sequence)
+}
+
+func (s *s3store) eventIDKey(id, eventID string) string {
+	return s.eventIDPrefix(id) + eventID
+}
+
+func (s *s3store) eventIDPrefix(id string) string {
+	return s.connectionInfo.KeyPrefix + eventIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(id)) + "/"
+}
+
+func (s *s3store) tombstoneKey(id string) string {
+	return s.connectionInfo.KeyPrefix + tombstonePrefix + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func (s *s3store) snapshotPrefix(id string) string {
+	return s.connectionInfo.KeyPrefix + snapshotPrefix + base64.RawURLEncoding.EncodeToString([]byte(id)) + "/"
+}
+
+// position returns the position of the entity with the given index in the log object with the given sequence
+func position(sequence int64, index int) int64 {
+	return sequence<<positionShift | int64(index)
+}
+
+// startSequence returns the sequence of the log object of the entity at position
+func startSequence(position int64) int64 {
+	if position < 1<<positionShift {
+		return 1
+	}
+
+	return position >> positionShift
+}
+
+func notFound(id string) error {
+	return store.EventStoreError{
+		Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+		ErrorType:  store.EntityNotFound,
+		InnerError: nil,
+	}
+}
+
+func stale(id string) error {
+	return store.EventStoreError{
+		Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+		ErrorType:  store.VersionConflict,
+		InnerError: nil,
+	}
+}
+
+func statusCode(err error) int {
+	var rerr *smithyhttp.ResponseError
+	if errors.As(err, &rerr) {
+		return rerr.HTTPStatusCode()
+	}
+
+	return 0
+}
+
+func isNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// isPreconditionFailed checks if an object wasn't created, because it already exists
+func isPreconditionFailed(err error) bool {
+	return statusCode(err) == http.StatusPreconditionFailed
+}
+
+// isTransient checks if a request failed because of a condition, that is likely to go away when it is repeated.
+// A log object that already exists was created by a concurrent write, the write is repeated with the next sequence.
+func isTransient(err error) bool {
+	switch statusCode(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict, http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+
+	return false
+}
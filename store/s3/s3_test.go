@@ -0,0 +1,167 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStore returns a store connected to a new fake
+func newStore(t *testing.T) (*fakeS3, store.EventStore) {
+	fake, metadata := newFakeS3(t)
+	metadata.Properties[store.PollInterval] = "10ms"
+
+	s := NewStore()
+	require.Nil(t, s.Init(metadata))
+
+	return fake, s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		_, s := newStore(t)
+		return s
+	})
+}
+
+func TestInitMissingBucket(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestKeys(t *testing.T) {
+	fake, metadata := newFakeS3(t)
+	metadata.Properties["keyPrefix"] = "archive"
+
+	s := NewStore()
+	require.Nil(t, s.Init(metadata))
+
+	_, err := s.Add(&store.Entity{ID: "order/1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	require.Nil(t, s.(*s3store).SaveSnapshot("order/1", 1, "snapshot"))
+
+	assert.Equal(t, []string{
+		"archive/$all/0000000000000000001",
+		"archive/$snapshots/b3JkZXIvMQ/0000000000000000001",
+		"archive/b3JkZXIvMQ/0000000000000000001",
+	}, fake.keys("events"))
+}
+
+func TestNextWriteCompletesEntities(t *testing.T) {
+	fake, s := newStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the entities are appended to the log, but their own objects aren't created
+	prefix := s.(*s3store).entityPrefix("1")
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if isPutObject(r, "events", prefix) {
+			return errFakeInvalidRequest
+		}
+		return nil
+	})
+
+	_, err = s.AppendBatch("1", 1, []*store.Entity{{Data: "Hello"}, {Data: "World"}})
+	assert.Nil(t, err)
+
+	fake.setFailRequest(nil)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+
+	res, err := s.ReadAll(1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+
+	// a write of another entity completes the objects
+	_, err = s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+
+	res, err = s.GetByVersionRange("1", 1, 3)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "World", res[2].Data)
+	assert.Equal(t, int64(3), res[2].Version)
+}
+
+func TestNextWriteCompletesDeletion(t *testing.T) {
+	fake, s := newStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	// the deletion is appended to the log, but the objects of the entity aren't removed
+	fake.setFailRequest(func(r *http.Request) *fakeError {
+		if r.Method == http.MethodDelete {
+			return errFakeInvalidRequest
+		}
+		return nil
+	})
+
+	assert.Nil(t, s.Delete("1", store.Any, true))
+
+	fake.setFailRequest(nil)
+
+	// the tombstone hides the stream until the deletion is complete
+	_, err = s.GetLatestVersionNumber("1")
+	storetest.AssertErrorType(t, err, store.StreamDeleted)
+
+	// a write of another entity completes the deletion
+	_, err = s.Add(&store.Entity{ID: "2", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.GetLatestVersionNumber("1")
+	storetest.AssertErrorType(t, err, store.EntityNotFound)
+
+	for _, key := range fake.keys("events") {
+		assert.False(t, strings.HasPrefix(key, s.(*s3store).entityPrefix("1")), key)
+		assert.False(t, strings.HasPrefix(key, tombstonePrefix), key)
+	}
+}
+
+func TestSnapshotReplacesOlder(t *testing.T) {
+	fake, s := newStore(t)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "Hello World"}, store.None)
+	require.Nil(t, err)
+
+	snapshots := s.(store.SnapshotStore)
+	require.Nil(t, snapshots.SaveSnapshot("1", 1, "first"))
+	require.Nil(t, snapshots.SaveSnapshot("1", 2, "second"))
+
+	snapshot, err := snapshots.GetLatestSnapshot("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", snapshot.State)
+
+	count := 0
+	for _, key := range fake.keys("events") {
+		if strings.HasPrefix(key, snapshotPrefix) {
+			count++
+		}
+	}
+
+	assert.Equal(t, 1, count)
+}
+
+func TestOpen(t *testing.T) {
+	_, metadata := newFakeS3(t)
+
+	s, err := store.Open(BackendName, metadata)
+	require.Nil(t, err)
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// Snapshot is the state of an entity at a version, so that only the versions after it have to be replayed
+type Snapshot struct {
+	ID      string      `json:"id"`
+	Version int64       `json:"version"`
+	State   interface{} `json:"state"`
+}
+
+// SnapshotStore is implemented by event stores that store snapshots of entities
+//
+// SaveSnapshot stores the state of the entity with the given id at version, the version must exist.
+// Only the snapshot with the highest version is kept, a snapshot of an older version is ignored.
+// GetLatestSnapshot returns an EventStoreError of type EntityNotFound if there is no snapshot.
+type SnapshotStore interface {
+	SaveSnapshot(id string, version int64, state interface{}) error
+	GetLatestSnapshot(id string) (*Snapshot, error)
+
+	SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error
+	GetLatestSnapshotContext(ctx context.Context, id string) (*Snapshot, error)
+}
+
+// LoadFromSnapshot loads the latest snapshot of an entity and the versions that were stored after it.
+// If s is no SnapshotStore or there is no snapshot, the snapshot is nil and all versions are returned.
+func LoadFromSnapshot(ctx context.Context, s EventStore, id string) (*Snapshot, []Entity, error) {
+	var snapshot *Snapshot
+	startVersion := int64(1)
+
+	if snapshots, ok := s.(SnapshotStore); ok {
+		latest, err := snapshots.GetLatestSnapshotContext(ctx, id)
+		if err == nil {
+			snapshot = latest
+			startVersion = latest.Version + 1
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, nil, err
+		}
+	}
+
+	endVersion, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entities, err := s.GetByVersionRangeContext(ctx, id, startVersion, endVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return snapshot, entities, nil
+}
@@ -0,0 +1,796 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	// BackendName is the name the SQLite store is registered with, see store.Open
+	BackendName = "sqlite"
+
+	// dataSource is the metadata property for the path of the database file
+	dataSource = "dataSource"
+)
+
+// the position of an event is its rowid, AUTOINCREMENT makes sure positions are never reused
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+	position   INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT    NOT NULL,
+	version    INTEGER NOT NULL,
+	event_id   TEXT,
+	type       TEXT    NOT NULL,
+	metadata   TEXT    NOT NULL,
+	system     TEXT,
+	data       TEXT    NOT NULL,
+	-- the time the entity was created at in microseconds since the epoch, see store.SystemMetadata
+	created_at INTEGER,
+	UNIQUE (id, version)
+);
+
+CREATE TABLE IF NOT EXISTS snapshots (
+	id      TEXT    PRIMARY KEY,
+	version INTEGER NOT NULL,
+	state   TEXT    NOT NULL
+);
+
+-- the tombstones of the entities whose streams are soft deleted
+CREATE TABLE IF NOT EXISTS tombstones (
+	id TEXT PRIMARY KEY
+);
+`
+
+type sqlitestore struct {
+	db         *sql.DB
+	subscriber *store.PollingSubscriber
+}
+
+func init() {
+	store.Register(BackendName, NewStore)
+}
+
+// NewStore creates a new SQLite based event store
+func NewStore() store.EventStore {
+	return &sqlitestore{}
+}
+
+func (s *sqlitestore) Init(metadata store.Metadata) error {
+	path, ok := metadata.Properties[dataSource]
+	if !ok || path == "" {
+		return errors.New("sqlite: data source is missing")
+	}
+
+	subscriber, err := store.NewPollingSubscriber(s, metadata)
+	if err != nil {
+		return fmt.Errorf("sqlite: %v", err)
+	}
+
+	s.subscriber = subscriber
+
+	// transactions take the write lock when they begin, so that the version that is read
+	// within a transaction can't change before it is written, other processes wait for it
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_txlock=immediate&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return err
+	}
+
+	// SQLite has a single writer, one connection avoids waiting for the lock within the process
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+// Close closes the database
+func (s *sqlitestore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlitestore) Add(entity *store.Entity) (*store.Entity, error) {
+	return s.AddContext(context.Background(), entity)
+}
+
+func (s *sqlitestore) AddContext(ctx context.Context, entity *store.Entity) (*store.Entity, error) {
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if duplicate, err := s.deduplicate(ctx, tx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		entity.Version = 1
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+
+		err := s.insert(ctx, tx, entity)
+
+		if isUniqueViolation(err) {
+			if _, deleted, _ := s.streamState(ctx, tx, entity.ID); deleted {
+				return store.StreamDeletedError(entity.ID)
+			}
+
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("An entity with id %s already exists", entity.ID),
+				ErrorType:  store.AlreadyExists,
+				InnerError: err,
+			}
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *sqlitestore) Append(entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	return s.AppendContext(context.Background(), entity, concurrency)
+}
+
+func (s *sqlitestore) AppendContext(ctx context.Context, entity *store.Entity, concurrency store.ConcurrencyControl) (*store.Entity, error) {
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if duplicate, err := s.deduplicate(ctx, tx, entity.ID, []*store.Entity{entity}); err != nil || duplicate {
+			return err
+		}
+
+		version, err := s.latestVersion(ctx, tx, entity.ID)
+		if err != nil {
+			return err
+		}
+
+		if concurrency == store.Optimistic && version != entity.Version {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", entity.ID),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		entity.Version = version + 1
+		store.RecordType(entity)
+		store.RecordSystemMetadata(entity)
+
+		return s.insert(ctx, tx, entity)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *sqlitestore) AppendBatch(id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendBatchContext(context.Background(), id, expectedVersion, entities)
+}
+
+func (s *sqlitestore) AppendBatchContext(ctx context.Context, id string, expectedVersion int64, entities []*store.Entity) ([]*store.Entity, error) {
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if duplicate, err := s.deduplicate(ctx, tx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		version, err := s.latestVersion(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		if version != expectedVersion {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Entity %s has gone stale, newer version already available (OOL)", id),
+				ErrorType:  store.VersionConflict,
+				InnerError: nil,
+			}
+		}
+
+		for _, entity := range entities {
+			version++
+			entity.ID = id
+			entity.Version = version
+			store.RecordType(entity)
+			store.RecordSystemMetadata(entity)
+
+			if err := s.insert(ctx, tx, entity); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *sqlitestore) AppendToStream(id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	return s.AppendToStreamContext(context.Background(), id, expected, entities)
+}
+
+func (s *sqlitestore) AppendToStreamContext(ctx context.Context, id string, expected store.ExpectedVersion, entities []*store.Entity) ([]*store.Entity, error) {
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if duplicate, err := s.deduplicate(ctx, tx, id, entities); err != nil || duplicate {
+			return err
+		}
+
+		version, err := s.latestVersion(ctx, tx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			version = 0
+		} else if err != nil {
+			return err
+		}
+
+		if err := expected.Check(id, version); err != nil {
+			return err
+		}
+
+		for _, entity := range entities {
+			version++
+			entity.ID = id
+			entity.Version = version
+			store.RecordType(entity)
+			store.RecordSystemMetadata(entity)
+
+			if err := s.insert(ctx, tx, entity); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (s *sqlitestore) GetLatestVersionNumber(id string) (int64, error) {
+	return s.GetLatestVersionNumberContext(context.Background(), id)
+}
+
+func (s *sqlitestore) GetLatestVersionNumberContext(ctx context.Context, id string) (int64, error) {
+	return s.latestVersion(ctx, s.db, id)
+}
+
+func (s *sqlitestore) GetByVersion(id string, version int64) (*store.Entity, error) {
+	return s.GetByVersionContext(context.Background(), id, version)
+}
+
+func (s *sqlitestore) GetByVersionContext(ctx context.Context, id string, version int64) (*store.Entity, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE id = ? AND version = ? AND id NOT IN (SELECT id FROM tombstones)",
+		id, version)
+
+	entity, err := scanEntity(row)
+
+	if err == sql.ErrNoRows {
+		// distinguish between a missing version and a missing or deleted entity
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *sqlitestore) GetByVersionRange(id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	return s.GetByVersionRangeContext(context.Background(), id, startVersion, endVersion)
+}
+
+func (s *sqlitestore) GetByVersionRangeContext(ctx context.Context, id string, startVersion, endVersion int64) ([]store.Entity, error) {
+	entities, err := s.query(ctx,
+		"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE id = ? AND id NOT IN (SELECT id FROM tombstones) AND version >= ? AND version <= ? ORDER BY version",
+		id, startVersion, endVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between an empty range and a missing or deleted entity
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+func (s *sqlitestore) GetAsOf(id string, at time.Time) (*store.Entity, error) {
+	return s.GetAsOfContext(context.Background(), id, at)
+}
+
+// GetAsOfContext reads the latest version that was created at or before at with the index on created_at.
+// Entities that were stored before the column was added have no creation time and are never found.
+func (s *sqlitestore) GetAsOfContext(ctx context.Context, id string, at time.Time) (*store.Entity, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE id = ? AND id NOT IN (SELECT id FROM tombstones) AND created_at <= ? ORDER BY created_at DESC, version DESC LIMIT 1",
+		id, at.UnixMicro())
+
+	entity, err := scanEntity(row)
+
+	if err == sql.ErrNoRows {
+		// distinguish between a missing version and a missing or deleted entity
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return nil, store.NoVersionAsOf(id, at)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (s *sqlitestore) GetByTimeRange(id string, from, to time.Time) ([]store.Entity, error) {
+	return s.GetByTimeRangeContext(context.Background(), id, from, to)
+}
+
+func (s *sqlitestore) GetByTimeRangeContext(ctx context.Context, id string, from, to time.Time) ([]store.Entity, error) {
+	entities, err := s.query(ctx,
+		"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE id = ? AND id NOT IN (SELECT id FROM tombstones) AND created_at >= ? AND created_at <= ? ORDER BY version",
+		id, from.UnixMicro(), to.UnixMicro())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		// distinguish between an empty range and a missing or deleted entity
+		if _, err := s.GetLatestVersionNumberContext(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entities, nil
+}
+
+func (s *sqlitestore) ReadAll(fromPosition int64, maxCount int) ([]store.Entity, error) {
+	return s.ReadAllContext(context.Background(), fromPosition, maxCount)
+}
+
+func (s *sqlitestore) ReadAllContext(ctx context.Context, fromPosition int64, maxCount int) ([]store.Entity, error) {
+	if maxCount < 1 {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("maxCount must be positive: %v", maxCount),
+			ErrorType:  store.InternalError,
+			InnerError: nil,
+		}
+	}
+
+	return s.query(ctx,
+		"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE position >= ? ORDER BY position LIMIT ?",
+		fromPosition, maxCount)
+}
+
+func (s *sqlitestore) Delete(id string, expected store.ExpectedVersion, hard bool) error {
+	return s.DeleteContext(context.Background(), id, expected, hard)
+}
+
+// DeleteContext writes a tombstone to soft delete a stream, a hard delete removes the rows of the entity,
+// so its entities are removed from the log of all entities as well.
+func (s *sqlitestore) DeleteContext(ctx context.Context, id string, expected store.ExpectedVersion, hard bool) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		version, deleted, err := s.streamState(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := store.CheckDelete(id, version, deleted, hard, expected); err != nil {
+			return err
+		}
+
+		statements := []string{"INSERT INTO tombstones (id) VALUES (?)"}
+		if hard {
+			statements = []string{
+				"DELETE FROM events WHERE id = ?",
+				"DELETE FROM snapshots WHERE id = ?",
+				"DELETE FROM tombstones WHERE id = ?",
+			}
+		}
+
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement, id); err != nil {
+				return store.EventStoreError{
+					Text:       "failed to delete entity",
+					ErrorType:  store.InternalError,
+					InnerError: err,
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *sqlitestore) SaveSnapshot(id string, version int64, state interface{}) error {
+	return s.SaveSnapshotContext(context.Background(), id, version, state)
+}
+
+func (s *sqlitestore) SaveSnapshotContext(ctx context.Context, id string, version int64, state interface{}) error {
+	data, err := json.Marshal(&store.Snapshot{ID: id, Version: version, State: state})
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		latest, err := s.latestVersion(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		if version < 1 || version > latest {
+			return store.EventStoreError{
+				Text:       fmt.Sprintf("Version %v of entity with ID %s does not exist", version, id),
+				ErrorType:  store.EntityNotFound,
+				InnerError: nil,
+			}
+		}
+
+		// a snapshot only replaces a snapshot of an older version
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO snapshots (id, version, state) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET version = excluded.version, state = excluded.state
+			WHERE excluded.version > snapshots.version`,
+			id, version, string(data))
+
+		if err != nil {
+			return store.EventStoreError{
+				Text:       "failed to save snapshot",
+				ErrorType:  store.InternalError,
+				InnerError: err,
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *sqlitestore) GetLatestSnapshot(id string) (*store.Snapshot, error) {
+	return s.GetLatestSnapshotContext(context.Background(), id)
+}
+
+func (s *sqlitestore) GetLatestSnapshotContext(ctx context.Context, id string) (*store.Snapshot, error) {
+	var data string
+
+	err := s.db.QueryRowContext(ctx, "SELECT state FROM snapshots WHERE id = ?", id).Scan(&data)
+
+	if err == sql.ErrNoRows {
+		return nil, store.EventStoreError{
+			Text:       fmt.Sprintf("There is no snapshot of entity with ID %s", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	} else if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load snapshot",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	snapshot := &store.Snapshot{}
+
+	if err := json.Unmarshal([]byte(data), snapshot); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize snapshot",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Subscribe polls the events table for new entities, see store.Subscriber.
+// The interval is configured with the metadata property pollInterval.
+func (s *sqlitestore) Subscribe(ctx context.Context, fromPosition int64, handler store.Handler) error {
+	return s.subscriber.Subscribe(ctx, fromPosition, handler)
+}
+
+// queryer is implemented by sql.DB and sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// scanner is implemented by sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// inTransaction runs fn in a transaction, that is committed if fn succeeds
+func (s *sqlitestore) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to begin transaction",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return store.EventStoreError{
+			Text:       "failed to commit transaction",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return nil
+}
+
+// migrate adds the columns, that were added to the schema later, to an existing database
+func migrate(db *sql.DB) error {
+	columns := []struct{ name, typ string }{
+		{"event_id", "TEXT"},
+		{"system", "TEXT"},
+		{"created_at", "INTEGER"},
+	}
+
+	for _, column := range columns {
+		var count int
+
+		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('events') WHERE name = ?", column.name).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			if _, err := db.Exec(fmt.Sprintf("ALTER TABLE events ADD COLUMN %s %s", column.name, column.typ)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// event IDs are unique within the stream of an entity, NULLs don't conflict
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS events_event_id ON events (id, event_id)"); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS events_created_at ON events (id, created_at, version)")
+	return err
+}
+
+// deduplicate checks if entities were already stored in the stream of the entity with the given id, see store.Deduplicate
+func (s *sqlitestore) deduplicate(ctx context.Context, tx *sql.Tx, id string, entities []*store.Entity) (bool, error) {
+	return store.Deduplicate(id, entities, func(eventID string) (*store.Entity, error) {
+		row := tx.QueryRowContext(ctx,
+			"SELECT position, id, version, event_id, type, metadata, system, data FROM events WHERE id = ? AND event_id = ?",
+			id, eventID)
+
+		entity, err := scanEntity(row)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return entity, err
+	})
+}
+
+// latestVersion returns the latest version of an entity, or an EventStoreError of type StreamDeleted
+// if its stream is soft deleted
+func (s *sqlitestore) latestVersion(ctx context.Context, q queryer, id string) (int64, error) {
+	version, deleted, err := s.streamState(ctx, q, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if version == 0 {
+		return 0, store.EventStoreError{
+			Text:       fmt.Sprintf("Entity with ID %s does not exist", id),
+			ErrorType:  store.EntityNotFound,
+			InnerError: nil,
+		}
+	}
+
+	if deleted {
+		return 0, store.StreamDeletedError(id)
+	}
+
+	return version, nil
+}
+
+// streamState returns the latest version of an entity, which is 0 if it doesn't exist, and if its
+// stream is soft deleted
+func (s *sqlitestore) streamState(ctx context.Context, q queryer, id string) (int64, bool, error) {
+	var version int64
+	var deleted bool
+
+	err := q.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(version), 0), EXISTS (SELECT 1 FROM tombstones WHERE id = ?) FROM events WHERE id = ?",
+		id, id).Scan(&version, &deleted)
+
+	if err != nil {
+		return 0, false, store.EventStoreError{
+			Text:       "failed to load version of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return version, deleted, nil
+}
+
+// insert inserts entity and sets its position
+func (s *sqlitestore) insert(ctx context.Context, q queryer, entity *store.Entity) error {
+	data, err := json.Marshal(entity.Data)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	eventID := sql.NullString{String: entity.EventID, Valid: entity.EventID != ""}
+
+	system, err := json.Marshal(entity.System)
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to serialize system metadata",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	result, err := q.ExecContext(ctx,
+		"INSERT INTO events (id, version, event_id, type, metadata, system, data, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		entity.ID, entity.Version, eventID, entity.Type, entity.Metadata, string(system), string(data), entity.System.CreatedAt.UnixMicro())
+
+	if isUniqueViolation(err) {
+		return store.EventStoreError{
+			Text:       fmt.Sprintf("Version %v of entity %s already exists", entity.Version, entity.ID),
+			ErrorType:  store.VersionConflict,
+			InnerError: err,
+		}
+	} else if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to insert entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	position, err := result.LastInsertId()
+	if err != nil {
+		return store.EventStoreError{
+			Text:       "failed to read position of entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	entity.Position = position
+	return nil
+}
+
+// query runs a query for entities
+func (s *sqlitestore) query(ctx context.Context, query string, args ...interface{}) ([]store.Entity, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+	defer rows.Close()
+
+	result := []store.Entity{}
+
+	for rows.Next() {
+		entity, err := scanEntity(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *entity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to load entities",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	return result, nil
+}
+
+// scanEntity reads an entity from a row and decodes its data with store.Types
+func scanEntity(row scanner) (*store.Entity, error) {
+	entity := &store.Entity{}
+	var eventID, system sql.NullString
+	var data string
+
+	if err := row.Scan(&entity.Position, &entity.ID, &entity.Version, &eventID, &entity.Type, &entity.Metadata, &system, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+
+		return nil, store.EventStoreError{
+			Text:       "failed to load entity",
+			ErrorType:  store.InternalError,
+			InnerError: err,
+		}
+	}
+
+	decoded, err := store.Types.Decode(entity.Type, []byte(data))
+	if err != nil {
+		return nil, store.EventStoreError{
+			Text:       "failed to deserialize entity",
+			ErrorType:  store.SerializationFailed,
+			InnerError: err,
+		}
+	}
+
+	// entities that were stored before the system metadata was introduced have none
+	if system.Valid {
+		if err := json.Unmarshal([]byte(system.String), &entity.System); err != nil {
+			return nil, store.EventStoreError{
+				Text:       "failed to deserialize system metadata",
+				ErrorType:  store.SerializationFailed,
+				InnerError: err,
+			}
+		}
+	}
+
+	entity.EventID = eventID.String
+	entity.Data = decoded
+	return entity, nil
+}
+
+// isUniqueViolation checks if a statement failed, because a row with the same key exists
+func isUniqueViolation(err error) bool {
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		return serr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || serr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/AndreasM009/eventstore-impl/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetadata(t *testing.T) store.Metadata {
+	return store.Metadata{
+		Properties: map[string]string{
+			dataSource:         filepath.Join(t.TempDir(), "eventstore.db"),
+			store.PollInterval: "10ms",
+		},
+	}
+}
+
+func newStore(t *testing.T, metadata store.Metadata) store.EventStore {
+	s := NewStore()
+	require.Nil(t, s.Init(metadata))
+
+	t.Cleanup(func() {
+		s.(*sqlitestore).Close()
+	})
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.EventStore {
+		return newStore(t, newMetadata(t))
+	})
+}
+
+func TestInitMissingDataSource(t *testing.T) {
+	s := NewStore()
+	err := s.Init(store.Metadata{Properties: map[string]string{}})
+	assert.NotNil(t, err)
+}
+
+func TestPersistence(t *testing.T) {
+	metadata := newMetadata(t)
+
+	s := newStore(t, metadata)
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.Append(&store.Entity{ID: "1", Data: "Hello World!"}, store.None)
+	require.Nil(t, err)
+
+	require.Nil(t, s.(*sqlitestore).Close())
+
+	// the entities are still there when the file is opened again
+	s = newStore(t, metadata)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	res, err := s.GetByVersion("1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World!", res.Data)
+	assert.Equal(t, int64(2), res.Position)
+
+	_, err = s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	storetest.AssertErrorType(t, err, store.AlreadyExists)
+}
+
+func TestSaveSnapshotError(t *testing.T) {
+	s := newStore(t, newMetadata(t))
+
+	_, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	require.Nil(t, err)
+
+	_, err = s.(*sqlitestore).db.Exec("DROP TABLE snapshots")
+	require.Nil(t, err)
+
+	// the error of the driver is wrapped like every other error
+	err = s.(store.SnapshotStore).SaveSnapshot("1", 1, "state")
+	storetest.AssertErrorType(t, err, store.InternalError)
+}
+
+func TestMigrate(t *testing.T) {
+	metadata := newMetadata(t)
+
+	// a database that was created before event IDs, system metadata and creation times were stored
+	db, err := sql.Open("sqlite", metadata.Properties[dataSource])
+	require.Nil(t, err)
+
+	_, err = db.Exec(`
+		CREATE TABLE events (
+			position INTEGER PRIMARY KEY AUTOINCREMENT,
+			id       TEXT    NOT NULL,
+			version  INTEGER NOT NULL,
+			type     TEXT    NOT NULL,
+			metadata TEXT    NOT NULL,
+			data     TEXT    NOT NULL,
+			UNIQUE (id, version)
+		);
+		INSERT INTO events (id, version, type, metadata, data) VALUES ('1', 1, '', '', '"Hello World"');`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	s := newStore(t, metadata)
+
+	res, err := s.GetByVersion("1", 1)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, "", res.EventID)
+	assert.Nil(t, res.System)
+
+	e := &store.Entity{ID: "1", EventID: "0b7f2a4e-5c4d-4f8e-9a61-3c2b1d0e9f87", Data: "Hello World!"}
+	_, err = s.Append(e, store.None)
+	require.Nil(t, err)
+
+	res, err = s.Append(&store.Entity{ID: "1", EventID: e.EventID, Data: "Hello World!"}, store.None)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(2), res.Version)
+
+	res, err = s.GetByVersion("1", 2)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	require.NotNil(t, res.System)
+	assert.Equal(t, "string", res.System.EventType)
+
+	// only the version with a creation time is found by time
+	res, err = s.GetAsOf("1", time.Now())
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(2), res.Version)
+
+	entities, err := s.GetByTimeRange("1", time.Time{}, time.Now())
+	assert.Nil(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, int64(2), entities[0].Version)
+
+	version, err := s.GetLatestVersionNumber("1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+func TestOpen(t *testing.T) {
+	s, err := store.Open(BackendName, newMetadata(t))
+	require.Nil(t, err)
+	defer s.(*sqlitestore).Close()
+
+	res, err := s.Add(&store.Entity{ID: "1", Data: "Hello World"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.Version)
+}
@@ -0,0 +1,1776 @@
+// Package storetest provides a conformance test suite that every
+// store.EventStore implementation is expected to pass.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndreasM009/eventstore-impl/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEvent is the type of data that the conformance tests register in store.Types
+type TestEvent struct {
+	Text  string `json:"text"`
+	Count int    `json:"count"`
+}
+
+// TestEventType is the name TestEvent is registered with
+const TestEventType = "storetest.TestEvent"
+
+// concurrentWriters is the number of goroutines used by the concurrency tests
+const concurrentWriters = 10
+
+// Factory returns a new, initialized EventStore
+type Factory func() store.EventStore
+
+// RunConformance runs the EventStore conformance test suite against the stores returned by factory.
+// Every sub test asks the factory for a store and uses new, random entity IDs, so the factory may
+// return stores that share the same underlying storage.
+func RunConformance(t *testing.T, factory Factory) {
+	require.Nil(t, store.RegisterType(TestEventType, TestEvent{}))
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s store.EventStore)
+	}{
+		{"Add", testAdd},
+		{"AddDuplicate", testAddDuplicate},
+		{"AppendMissingEntity", testAppendMissingEntity},
+		{"AppendOptimistic", testAppendOptimistic},
+		{"AppendOptimisticStale", testAppendOptimisticStale},
+		{"AppendNone", testAppendNone},
+		{"AppendBatch", testAppendBatch},
+		{"AppendBatchStale", testAppendBatchStale},
+		{"AppendBatchMissingEntity", testAppendBatchMissingEntity},
+		{"AppendToStreamAny", testAppendToStreamAny},
+		{"AppendToStreamNoStream", testAppendToStreamNoStream},
+		{"AppendToStreamStreamExists", testAppendToStreamStreamExists},
+		{"AppendToStreamExactVersion", testAppendToStreamExactVersion},
+		{"AppendToStreamEmpty", testAppendToStreamEmpty},
+		{"AppendToStreamInvalid", testAppendToStreamInvalid},
+		{"DeduplicateAdd", testDeduplicateAdd},
+		{"DeduplicateAppend", testDeduplicateAppend},
+		{"DeduplicateBatch", testDeduplicateBatch},
+		{"DeduplicatePartial", testDeduplicatePartial},
+		{"DeduplicateOtherEntity", testDeduplicateOtherEntity},
+		{"DeduplicateInvalidEventID", testDeduplicateInvalidEventID},
+		{"GetLatestVersionNumber", testGetLatestVersionNumber},
+		{"GetLatestVersionNumberMissingEntity", testGetLatestVersionNumberMissingEntity},
+		{"GetByVersion", testGetByVersion},
+		{"GetByVersionMissing", testGetByVersionMissing},
+		{"GetByVersionRange", testGetByVersionRange},
+		{"GetByVersionRangeEmpty", testGetByVersionRangeEmpty},
+		{"GetByVersionRangeMissingEntity", testGetByVersionRangeMissingEntity},
+		{"GetAsOf", testGetAsOf},
+		{"GetAsOfBeforeFirstVersion", testGetAsOfBeforeFirstVersion},
+		{"GetAsOfMissingEntity", testGetAsOfMissingEntity},
+		{"GetByTimeRange", testGetByTimeRange},
+		{"GetByTimeRangeEmpty", testGetByTimeRangeEmpty},
+		{"GetByTimeRangeMissingEntity", testGetByTimeRangeMissingEntity},
+		{"DeleteSoft", testDeleteSoft},
+		{"DeleteHard", testDeleteHard},
+		{"DeleteSoftThenHard", testDeleteSoftThenHard},
+		{"DeleteStale", testDeleteStale},
+		{"DeleteMissingEntity", testDeleteMissingEntity},
+		{"ConcurrentAppendNone", testConcurrentAppendNone},
+		{"ConcurrentAppendOptimistic", testConcurrentAppendOptimistic},
+		{"ConcurrentAppendBatch", testConcurrentAppendBatch},
+		{"ConcurrentAppendToStreamAny", testConcurrentAppendToStreamAny},
+		{"ConcurrentAppendToStreamNoStream", testConcurrentAppendToStreamNoStream},
+		{"ConcurrentDeduplicate", testConcurrentDeduplicate},
+		{"TypedData", testTypedData},
+		{"SystemMetadata", testSystemMetadata},
+		{"ReadAll", testReadAll},
+		{"ReadAllPaged", testReadAllPaged},
+		{"ReadAllEnd", testReadAllEnd},
+		{"ReadAllInvalidMaxCount", testReadAllInvalidMaxCount},
+		{"ConcurrentReadAll", testConcurrentReadAll},
+		{"Subscribe", testSubscribe},
+		{"SubscribeResume", testSubscribeResume},
+		{"Snapshot", testSnapshot},
+		{"SnapshotMissing", testSnapshotMissing},
+		{"SnapshotOlderVersion", testSnapshotOlderVersion},
+		{"LoadFromSnapshot", testLoadFromSnapshot},
+		{"CanceledContext", testCanceledContext},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := factory()
+			require.NotNil(t, s)
+			tc.test(t, s)
+		})
+	}
+}
+
+// AssertErrorType asserts that err is or wraps a store.EventStoreError of the given type
+func AssertErrorType(t *testing.T, err error, errorType store.ErrorType) bool {
+	var evterr store.EventStoreError
+	if !assert.True(t, errors.As(err, &evterr), "expected store.EventStoreError, got %T: %v", err, err) {
+		return false
+	}
+
+	return assert.Equal(t, errorType, evterr.ErrorType, "unexpected error type: %v", err)
+}
+
+func newEntity(data string) *store.Entity {
+	return &store.Entity{
+		ID:       uuid.New().String(),
+		Version:  0,
+		Metadata: "Metadata",
+		Data:     data,
+	}
+}
+
+func newEntityWithID(id string, data string) *store.Entity {
+	e := newEntity(data)
+	e.ID = id
+	return e
+}
+
+// addVersions adds a new entity and appends until the entity has count versions.
+// Version n carries the data "n".
+func addVersions(t *testing.T, s store.EventStore, count int) *store.Entity {
+	ety := newEntity("1")
+
+	_, err := s.Add(ety)
+	require.Nil(t, err)
+
+	for v := 2; v <= count; v++ {
+		ety.Data = fmt.Sprintf("%v", v)
+		_, err = s.Append(ety, store.Optimistic)
+		require.Nil(t, err)
+	}
+
+	return ety
+}
+
+func testAdd(t *testing.T, s store.EventStore) {
+	ety := newEntity("Hello World")
+
+	res, err := s.Add(ety)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(1), res.Version)
+	assert.Equal(t, ety.ID, res.ID)
+}
+
+func testAddDuplicate(t *testing.T, s store.EventStore) {
+	ety := newEntity("Hello World")
+
+	_, err := s.Add(ety)
+	require.Nil(t, err)
+
+	res, err := s.Add(newEntityWithID(ety.ID, "Hello again"))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.AlreadyExists)
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists))
+
+	// the existing stream must be left untouched
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+
+	e, err := s.GetByVersion(ety.ID, 1)
+	assert.Nil(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, "Hello World", e.Data)
+}
+
+func testAppendMissingEntity(t *testing.T, s store.EventStore) {
+	for _, concurrency := range []store.ConcurrencyControl{store.None, store.Optimistic} {
+		// only Add and AppendToStream create entities, not even with the version 0
+		for _, version := range []int64{0, 1} {
+			ety := newEntity("Hello World")
+			ety.Version = version
+
+			res, err := s.Append(ety, concurrency)
+			assert.Nil(t, res)
+			AssertErrorType(t, err, store.EntityNotFound)
+			assert.True(t, errors.Is(err, store.ErrNotFound))
+
+			_, err = s.GetLatestVersionNumber(ety.ID)
+			AssertErrorType(t, err, store.EntityNotFound)
+		}
+	}
+}
+
+func testAppendOptimistic(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	ety.Data = "2"
+	res, err := s.Append(ety, store.Optimistic)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(2), res.Version)
+
+	res.Data = "3"
+	res, err = s.Append(res, store.Optimistic)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(3), res.Version)
+}
+
+func testAppendOptimisticStale(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	stale := newEntityWithID(ety.ID, "stale")
+	stale.Version = 1
+
+	res, err := s.Append(stale, store.Optimistic)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.VersionConflict)
+	assert.True(t, errors.Is(err, store.ErrVersionConflict))
+	assert.False(t, errors.Is(err, store.ErrNotFound))
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+func testAppendNone(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	// the version of the appended entity is ignored without concurrency control
+	for _, v := range []int64{0, 1, 42} {
+		e := newEntityWithID(ety.ID, "none")
+		e.Version = v
+
+		res, err := s.Append(e, store.None)
+		assert.Nil(t, err)
+		require.NotNil(t, res)
+	}
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), version)
+}
+
+func newBatch(from, to int) []*store.Entity {
+	entities := []*store.Entity{}
+	for v := from; v <= to; v++ {
+		entities = append(entities, newEntity(fmt.Sprintf("%v", v)))
+	}
+	return entities
+}
+
+func testAppendBatch(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	res, err := s.AppendBatch(ety.ID, 1, newBatch(2, 4))
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, ety.ID, e.ID)
+		assert.Equal(t, int64(i+2), e.Version)
+	}
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), version)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 4)
+	assert.Nil(t, err)
+	require.Equal(t, 4, len(entities))
+
+	for i, e := range entities {
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), e.Data)
+	}
+
+	// a single append continues after the batch
+	ety.Version = 4
+	res1, err := s.Append(ety, store.Optimistic)
+	assert.Nil(t, err)
+	require.NotNil(t, res1)
+	assert.Equal(t, int64(5), res1.Version)
+}
+
+func testAppendBatchStale(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	for _, expected := range []int64{0, 1, 3} {
+		res, err := s.AppendBatch(ety.ID, expected, newBatch(3, 5))
+		assert.Nil(t, res)
+		AssertErrorType(t, err, store.VersionConflict)
+	}
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entities))
+}
+
+func testAppendBatchMissingEntity(t *testing.T, s store.EventStore) {
+	for _, expectedVersion := range []int64{0, 1} {
+		id := uuid.New().String()
+
+		res, err := s.AppendBatch(id, expectedVersion, newBatch(int(expectedVersion)+1, int(expectedVersion)+2))
+		assert.Nil(t, res)
+		AssertErrorType(t, err, store.EntityNotFound)
+
+		_, err = s.GetLatestVersionNumber(id)
+		AssertErrorType(t, err, store.EntityNotFound)
+	}
+}
+
+// assertVersions asserts that the entity with the given id has the versions 1 to count with the data "1" to "count"
+func assertVersions(t *testing.T, s store.EventStore, id string, count int) {
+	version, err := s.GetLatestVersionNumber(id)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(count), version)
+
+	entities, err := s.GetByVersionRange(id, 1, 100)
+	assert.Nil(t, err)
+	require.Equal(t, count, len(entities))
+
+	for i, e := range entities {
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), e.Data)
+	}
+}
+
+func testAppendToStreamAny(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+
+	// the entity is created
+	res, err := s.AppendToStream(id, store.Any, newBatch(1, 2))
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, id, e.ID)
+		assert.Equal(t, int64(i+1), e.Version)
+	}
+
+	// and appended to
+	res, err = s.AppendToStream(id, store.Any, newBatch(3, 3))
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, int64(3), res[0].Version)
+
+	assertVersions(t, s, id, 3)
+}
+
+func testAppendToStreamNoStream(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+
+	res, err := s.AppendToStream(id, store.NoStream, newBatch(1, 2))
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(2), res[1].Version)
+
+	res, err = s.AppendToStream(id, store.NoStream, newBatch(3, 4))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.AlreadyExists)
+	assert.True(t, errors.Is(err, store.ErrAlreadyExists))
+
+	// ExactVersion(0) is the same as NoStream
+	res, err = s.AppendToStream(id, store.ExactVersion(0), newBatch(3, 4))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.AlreadyExists)
+
+	// an entity created by Add exists as well
+	ety := addVersions(t, s, 1)
+	_, err = s.AppendToStream(ety.ID, store.NoStream, newBatch(2, 2))
+	AssertErrorType(t, err, store.AlreadyExists)
+
+	assertVersions(t, s, id, 2)
+}
+
+func testAppendToStreamStreamExists(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+
+	res, err := s.AppendToStream(id, store.StreamExists, newBatch(1, 2))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.EntityNotFound)
+	assert.True(t, errors.Is(err, store.ErrNotFound))
+
+	_, err = s.GetLatestVersionNumber(id)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	ety := addVersions(t, s, 2)
+
+	res, err = s.AppendToStream(ety.ID, store.StreamExists, newBatch(3, 4))
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(3), res[0].Version)
+	assert.Equal(t, int64(4), res[1].Version)
+
+	assertVersions(t, s, ety.ID, 4)
+}
+
+func testAppendToStreamExactVersion(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	res, err := s.AppendToStream(ety.ID, store.ExactVersion(2), newBatch(3, 4))
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(4), res[1].Version)
+
+	for _, expected := range []int64{1, 2, 5} {
+		res, err = s.AppendToStream(ety.ID, store.ExactVersion(expected), newBatch(5, 6))
+		assert.Nil(t, res)
+		AssertErrorType(t, err, store.VersionConflict)
+		assert.True(t, errors.Is(err, store.ErrVersionConflict))
+	}
+
+	res, err = s.AppendToStream(uuid.New().String(), store.ExactVersion(1), newBatch(1, 1))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	assertVersions(t, s, ety.ID, 4)
+}
+
+func testAppendToStreamEmpty(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+	missing := uuid.New().String()
+
+	// without entities only the expected version is checked
+	for _, expected := range []store.ExpectedVersion{store.Any, store.StreamExists, store.ExactVersion(2)} {
+		_, err := s.AppendToStream(ety.ID, expected, []*store.Entity{})
+		assert.Nil(t, err, "expected %v", expected)
+	}
+
+	_, err := s.AppendToStream(ety.ID, store.ExactVersion(1), []*store.Entity{})
+	AssertErrorType(t, err, store.VersionConflict)
+
+	_, err = s.AppendToStream(ety.ID, store.NoStream, []*store.Entity{})
+	AssertErrorType(t, err, store.AlreadyExists)
+
+	_, err = s.AppendToStream(missing, store.NoStream, []*store.Entity{})
+	assert.Nil(t, err)
+
+	_, err = s.AppendToStream(missing, store.StreamExists, []*store.Entity{})
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	// nothing was created
+	_, err = s.GetLatestVersionNumber(missing)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	assertVersions(t, s, ety.ID, 2)
+}
+
+func testAppendToStreamInvalid(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	res, err := s.AppendToStream(ety.ID, store.ExactVersion(-3), newBatch(2, 2))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.InternalError)
+
+	assertVersions(t, s, ety.ID, 1)
+}
+
+// newBatchWithEventIDs returns a batch like newBatch, whose entities have new event IDs
+func newBatchWithEventIDs(from, to int) []*store.Entity {
+	entities := newBatch(from, to)
+	for _, e := range entities {
+		e.EventID = uuid.New().String()
+	}
+	return entities
+}
+
+// resubmit returns copies of entities as a client would send them again
+func resubmit(entities []*store.Entity) []*store.Entity {
+	result := []*store.Entity{}
+	for _, e := range entities {
+		result = append(result, &store.Entity{EventID: e.EventID, Metadata: e.Metadata, Data: e.Data})
+	}
+	return result
+}
+
+func testDeduplicateAdd(t *testing.T, s store.EventStore) {
+	ety := newEntity("1")
+	ety.EventID = uuid.New().String()
+
+	res, err := s.Add(ety)
+	require.Nil(t, err)
+	position := res.Position
+
+	again := newEntityWithID(ety.ID, "1")
+	again.EventID = ety.EventID
+
+	res, err = s.Add(again)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(1), res.Version)
+	assert.Equal(t, position, res.Position)
+
+	// an entity without the event ID is no duplicate
+	_, err = s.Add(newEntityWithID(ety.ID, "1"))
+	AssertErrorType(t, err, store.AlreadyExists)
+
+	e, err := s.GetByVersion(ety.ID, 1)
+	assert.Nil(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, ety.EventID, e.EventID)
+
+	assertVersions(t, s, ety.ID, 1)
+}
+
+func testDeduplicateAppend(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	e := newEntityWithID(ety.ID, "2")
+	e.Version = 1
+	e.EventID = uuid.New().String()
+
+	res, err := s.Append(e, store.Optimistic)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2), res.Version)
+
+	// the client doesn't know that the append was stored and sends it again, with the same expected version
+	for _, concurrency := range []store.ConcurrencyControl{store.Optimistic, store.None} {
+		again := newEntityWithID(ety.ID, "2")
+		again.Version = 1
+		again.EventID = e.EventID
+
+		res, err = s.Append(again, concurrency)
+		assert.Nil(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, int64(2), res.Version)
+	}
+
+	stored, err := s.GetByVersion(ety.ID, 2)
+	assert.Nil(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, e.EventID, stored.EventID)
+
+	all, err := s.ReadAll(1, 10000)
+	assert.Nil(t, err)
+
+	found := 0
+	for _, entity := range all {
+		if entity.EventID == e.EventID {
+			found++
+			assert.Equal(t, ety.ID, entity.ID)
+			assert.Equal(t, int64(2), entity.Version)
+		}
+	}
+	assert.Equal(t, 1, found)
+
+	assertVersions(t, s, ety.ID, 2)
+}
+
+func testDeduplicateBatch(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+	batch := newBatchWithEventIDs(1, 3)
+
+	res, err := s.AppendToStream(id, store.NoStream, batch)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(res))
+
+	positions := []int64{res[0].Position, res[1].Position, res[2].Position}
+
+	res, err = s.AppendToStream(id, store.NoStream, resubmit(batch))
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, id, e.ID)
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, positions[i], e.Position)
+	}
+
+	// a part of the batch, that is stored with consecutive versions, is a duplicate as well
+	res, err = s.AppendBatch(id, 1, resubmit(batch[1:]))
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(2), res[0].Version)
+	assert.Equal(t, int64(3), res[1].Version)
+
+	assertVersions(t, s, id, 3)
+}
+
+func testDeduplicatePartial(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+	batch := newBatchWithEventIDs(1, 3)
+
+	_, err := s.AppendToStream(id, store.NoStream, batch)
+	require.Nil(t, err)
+
+	partial := append(resubmit(batch[2:]), newBatchWithEventIDs(4, 4)...)
+	res, err := s.AppendToStream(id, store.Any, partial)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.VersionConflict)
+
+	// the versions are not consecutive
+	res, err = s.AppendToStream(id, store.Any, resubmit([]*store.Entity{batch[0], batch[2]}))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.VersionConflict)
+
+	// an entity without event ID can't be matched
+	res, err = s.AppendToStream(id, store.Any, append(resubmit(batch[2:]), newBatch(4, 4)...))
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.VersionConflict)
+
+	assertVersions(t, s, id, 3)
+}
+
+func testDeduplicateOtherEntity(t *testing.T, s store.EventStore) {
+	batch := newBatchWithEventIDs(1, 1)
+
+	_, err := s.AppendToStream(uuid.New().String(), store.NoStream, batch)
+	require.Nil(t, err)
+
+	// event IDs are unique within the stream of an entity
+	id := uuid.New().String()
+	res, err := s.AppendToStream(id, store.NoStream, resubmit(batch))
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, id, res[0].ID)
+
+	assertVersions(t, s, id, 1)
+}
+
+func testDeduplicateInvalidEventID(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	e := newEntityWithID(ety.ID, "2")
+	e.EventID = "not a uuid"
+
+	res, err := s.Append(e, store.None)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.InternalError)
+
+	batch := newBatchWithEventIDs(2, 3)
+	batch[1].EventID = batch[0].EventID
+
+	_, err = s.AppendBatch(ety.ID, 1, batch)
+	AssertErrorType(t, err, store.InternalError)
+
+	assertVersions(t, s, ety.ID, 1)
+}
+
+func testGetLatestVersionNumber(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+
+	_, err = s.Append(ety, store.Optimistic)
+	require.Nil(t, err)
+
+	version, err = s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+func testGetLatestVersionNumberMissingEntity(t *testing.T, s store.EventStore) {
+	version, err := s.GetLatestVersionNumber(uuid.New().String())
+	assert.Equal(t, int64(0), version)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testGetByVersion(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 3)
+
+	for v := int64(1); v <= 3; v++ {
+		res, err := s.GetByVersion(ety.ID, v)
+		assert.Nil(t, err)
+		require.NotNil(t, res)
+		assert.True(t, res != ety)
+		assert.Equal(t, ety.ID, res.ID)
+		assert.Equal(t, v, res.Version)
+		assert.Equal(t, "Metadata", res.Metadata)
+		assert.Equal(t, fmt.Sprintf("%v", v), res.Data)
+	}
+}
+
+func testGetByVersionMissing(t *testing.T, s store.EventStore) {
+	res, err := s.GetByVersion(uuid.New().String(), 1)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	ety := addVersions(t, s, 1)
+
+	res, err = s.GetByVersion(ety.ID, 2)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testGetByVersionRange(t *testing.T, s store.EventStore) {
+	// more than 9 versions, so that ordering by a string representation of the version would fail
+	ety := addVersions(t, s, 12)
+
+	res, err := s.GetByVersionRange(ety.ID, 1, 12)
+	assert.Nil(t, err)
+	require.Equal(t, 12, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, ety.ID, e.ID)
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), e.Data)
+	}
+
+	// bounds are inclusive
+	res, err = s.GetByVersionRange(ety.ID, 3, 10)
+	assert.Nil(t, err)
+	require.Equal(t, 8, len(res))
+	assert.Equal(t, int64(3), res[0].Version)
+	assert.Equal(t, int64(10), res[7].Version)
+
+	res, err = s.GetByVersionRange(ety.ID, 5, 5)
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, int64(5), res[0].Version)
+
+	// end beyond the latest version
+	res, err = s.GetByVersionRange(ety.ID, 11, 100)
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(11), res[0].Version)
+	assert.Equal(t, int64(12), res[1].Version)
+}
+
+func testGetByVersionRangeEmpty(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	res, err := s.GetByVersionRange(ety.ID, 3, 10)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, 0, len(res))
+
+	res, err = s.GetByVersionRange(ety.ID, 2, 1)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, 0, len(res))
+}
+
+func testGetByVersionRangeMissingEntity(t *testing.T, s store.EventStore) {
+	res, err := s.GetByVersionRange(uuid.New().String(), 1, 10)
+	assert.Nil(t, res)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+// addVersionsOverTime adds a new entity with count versions like addVersions, the versions are created
+// at least a millisecond apart. It returns the times the versions were created at.
+func addVersionsOverTime(t *testing.T, s store.EventStore, count int) (*store.Entity, []time.Time) {
+	ety := newEntity("1")
+
+	_, err := s.Add(ety)
+	require.Nil(t, err)
+
+	times := []time.Time{ety.System.CreatedAt}
+
+	for v := 2; v <= count; v++ {
+		time.Sleep(time.Millisecond)
+
+		ety.Data = fmt.Sprintf("%v", v)
+		_, err = s.Append(ety, store.Optimistic)
+		require.Nil(t, err)
+
+		times = append(times, ety.System.CreatedAt)
+	}
+
+	return ety, times
+}
+
+func testGetAsOf(t *testing.T, s store.EventStore) {
+	ety, times := addVersionsOverTime(t, s, 3)
+
+	for i, at := range times {
+		res, err := s.GetAsOf(ety.ID, at)
+		assert.Nil(t, err)
+		require.NotNil(t, res)
+		assert.Equal(t, int64(i+1), res.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), res.Data)
+		assert.Equal(t, at, res.System.CreatedAt)
+	}
+
+	res, err := s.GetAsOf(ety.ID, times[2].Add(-time.Microsecond))
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(2), res.Version)
+
+	// the time zone of at doesn't matter
+	res, err = s.GetAsOf(ety.ID, times[1].In(time.FixedZone("UTC+1", 3600)))
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(2), res.Version)
+
+	res, err = s.GetAsOf(ety.ID, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(3), res.Version)
+}
+
+func testGetAsOfBeforeFirstVersion(t *testing.T, s store.EventStore) {
+	ety, times := addVersionsOverTime(t, s, 2)
+
+	res, err := s.GetAsOf(ety.ID, times[0].Add(-time.Microsecond))
+	AssertErrorType(t, err, store.EntityNotFound)
+	assert.Nil(t, res)
+}
+
+func testGetAsOfMissingEntity(t *testing.T, s store.EventStore) {
+	res, err := s.GetAsOf(uuid.New().String(), time.Now())
+	AssertErrorType(t, err, store.EntityNotFound)
+	assert.Nil(t, res)
+}
+
+func testGetByTimeRange(t *testing.T, s store.EventStore) {
+	ety, times := addVersionsOverTime(t, s, 4)
+
+	res, err := s.GetByTimeRange(ety.ID, times[1], times[2])
+	assert.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, int64(2), res[0].Version)
+	assert.Equal(t, "2", res[0].Data)
+	assert.Equal(t, int64(3), res[1].Version)
+	assert.Equal(t, "3", res[1].Data)
+
+	res, err = s.GetByTimeRange(ety.ID, times[1].Add(time.Microsecond), times[3].Add(-time.Microsecond))
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, int64(3), res[0].Version)
+
+	res, err = s.GetByTimeRange(ety.ID, times[0].Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	require.Equal(t, 4, len(res))
+
+	for i, e := range res {
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, times[i], e.System.CreatedAt)
+	}
+}
+
+func testGetByTimeRangeEmpty(t *testing.T, s store.EventStore) {
+	ety, times := addVersionsOverTime(t, s, 2)
+
+	res, err := s.GetByTimeRange(ety.ID, times[0].Add(-time.Hour), times[0].Add(-time.Microsecond))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	res, err = s.GetByTimeRange(ety.ID, times[1].Add(time.Microsecond), time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+
+	res, err = s.GetByTimeRange(ety.ID, times[1], times[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func testGetByTimeRangeMissingEntity(t *testing.T, s store.EventStore) {
+	_, err := s.GetByTimeRange(uuid.New().String(), time.Time{}, time.Now())
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testDeleteSoft(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 3)
+
+	err := s.Delete(ety.ID, store.ExactVersion(3), false)
+	assert.Nil(t, err)
+
+	_, err = s.GetLatestVersionNumber(ety.ID)
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.GetByVersion(ety.ID, 1)
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.GetByVersionRange(ety.ID, 1, 3)
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.GetAsOf(ety.ID, time.Now())
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.GetByTimeRange(ety.ID, time.Time{}, time.Now())
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.Add(newEntityWithID(ety.ID, "Hello World"))
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	ety.Data = "4"
+	_, err = s.Append(ety, store.None)
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.AppendBatch(ety.ID, 3, newBatch(4, 5))
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	_, err = s.AppendToStream(ety.ID, store.Any, newBatch(4, 5))
+	AssertErrorType(t, err, store.StreamDeleted)
+
+	err = s.Delete(ety.ID, store.Any, false)
+	AssertErrorType(t, err, store.StreamDeleted)
+}
+
+func testDeleteHard(t *testing.T, s store.EventStore) {
+	other := addVersions(t, s, 2)
+
+	ety := newEntity("1")
+	ety.EventID = uuid.New().String()
+
+	_, err := s.Add(ety)
+	require.Nil(t, err)
+
+	_, err = s.AppendBatch(ety.ID, 1, newBatch(2, 3))
+	require.Nil(t, err)
+
+	snapshots, isSnapshotStore := s.(store.SnapshotStore)
+	if isSnapshotStore {
+		require.Nil(t, snapshots.SaveSnapshot(ety.ID, 2, "state"))
+	}
+
+	err = s.Delete(ety.ID, store.Any, true)
+	assert.Nil(t, err)
+
+	_, err = s.GetLatestVersionNumber(ety.ID)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	_, err = s.GetByVersion(ety.ID, 1)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	_, err = s.GetByVersionRange(ety.ID, 1, 3)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	if isSnapshotStore {
+		_, err = snapshots.GetLatestSnapshot(ety.ID)
+		AssertErrorType(t, err, store.EntityNotFound)
+	}
+
+	// other entities are not affected
+	version, err := s.GetLatestVersionNumber(other.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+
+	// the log of all entities keeps no copy of the deleted entities
+	logged := readAllOf(t, s, ety.ID)
+	assert.Equal(t, 0, len(logged))
+	assert.Equal(t, 2, len(readAllOf(t, s, other.ID)))
+
+	// the id and the event ID can be used again
+	e := newEntityWithID(ety.ID, "Hello World")
+	e.EventID = ety.EventID
+
+	res, err := s.Add(e)
+	assert.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, int64(1), res.Version)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 10)
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(entities))
+	assert.Equal(t, "Hello World", entities[0].Data)
+
+	logged = readAllOf(t, s, ety.ID)
+	require.Equal(t, 1, len(logged))
+	assert.Equal(t, "Hello World", logged[0].Data)
+}
+
+// readAllOf returns the entities of the stream with the given id from the log of all entities
+func readAllOf(t *testing.T, s store.EventStore, id string) []store.Entity {
+	all, err := s.ReadAll(1, 10000)
+	require.Nil(t, err)
+
+	result := []store.Entity{}
+	for _, entity := range all {
+		if entity.ID == id {
+			result = append(result, entity)
+		}
+	}
+	return result
+}
+
+func testDeleteSoftThenHard(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 2)
+
+	err := s.Delete(ety.ID, store.StreamExists, false)
+	require.Nil(t, err)
+
+	err = s.Delete(ety.ID, store.ExactVersion(2), true)
+	assert.Nil(t, err)
+
+	_, err = s.GetLatestVersionNumber(ety.ID)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	err = s.Delete(ety.ID, store.Any, true)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testDeleteStale(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 3)
+
+	err := s.Delete(ety.ID, store.ExactVersion(2), false)
+	AssertErrorType(t, err, store.VersionConflict)
+
+	err = s.Delete(ety.ID, store.ExactVersion(2), true)
+	AssertErrorType(t, err, store.VersionConflict)
+
+	err = s.Delete(ety.ID, store.ExpectedVersion(-3), true)
+	AssertErrorType(t, err, store.InternalError)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entities))
+}
+
+func testDeleteMissingEntity(t *testing.T, s store.EventStore) {
+	err := s.Delete(uuid.New().String(), store.Any, false)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	err = s.Delete(uuid.New().String(), store.Any, true)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testConcurrentAppendNone(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	var wg sync.WaitGroup
+	versions := make(chan int64, concurrentWriters)
+	errs := make(chan error, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := s.Append(newEntityWithID(ety.ID, fmt.Sprintf("writer %v", i)), store.None)
+			if err != nil {
+				errs <- err
+				return
+			}
+			versions <- res.Version
+		}(i)
+	}
+
+	wg.Wait()
+	close(versions)
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	// every writer must get its own version
+	seen := map[int64]bool{}
+	for v := range versions {
+		assert.False(t, seen[v], "version %v assigned twice", v)
+		seen[v] = true
+	}
+	assert.Equal(t, concurrentWriters, len(seen))
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(concurrentWriters+1), version)
+
+	res, err := s.GetByVersionRange(ety.ID, 1, version)
+	assert.Nil(t, err)
+	assert.Equal(t, concurrentWriters+1, len(res))
+}
+
+func testConcurrentAppendOptimistic(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			e := newEntityWithID(ety.ID, fmt.Sprintf("writer %v", i))
+			e.Version = 1
+
+			_, err := s.Append(e, store.Optimistic)
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// all writers expect version 1, so exactly one of them wins
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		AssertErrorType(t, err, store.VersionConflict)
+	}
+	assert.Equal(t, 1, succeeded)
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), version)
+}
+
+func testConcurrentAppendBatch(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := s.AppendBatch(ety.ID, 1, newBatch(2, 4))
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		AssertErrorType(t, err, store.VersionConflict)
+	}
+	assert.Equal(t, 1, succeeded)
+
+	// the winning batch is stored completely, nothing of the others
+	entities, err := s.GetByVersionRange(ety.ID, 1, 100)
+	assert.Nil(t, err)
+	require.Equal(t, 4, len(entities))
+
+	for i, e := range entities {
+		assert.Equal(t, int64(i+1), e.Version)
+		assert.Equal(t, fmt.Sprintf("%v", i+1), e.Data)
+	}
+}
+
+func testConcurrentAppendToStreamAny(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+
+	var wg sync.WaitGroup
+	versions := make(chan int64, concurrentWriters)
+	errs := make(chan error, concurrentWriters)
+
+	// the writers race to create the entity, every one of them is appended
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := s.AppendToStream(id, store.Any, []*store.Entity{newEntity(fmt.Sprintf("writer %v", i))})
+			if err != nil {
+				errs <- err
+				return
+			}
+			versions <- res[0].Version
+		}(i)
+	}
+
+	wg.Wait()
+	close(versions)
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	seen := map[int64]bool{}
+	for v := range versions {
+		assert.False(t, seen[v], "version %v assigned twice", v)
+		seen[v] = true
+	}
+	assert.Equal(t, concurrentWriters, len(seen))
+
+	version, err := s.GetLatestVersionNumber(id)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(concurrentWriters), version)
+}
+
+func testConcurrentAppendToStreamNoStream(t *testing.T, s store.EventStore) {
+	id := uuid.New().String()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := s.AppendToStream(id, store.NoStream, newBatch(1, 2))
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// exactly one writer creates the entity
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		AssertErrorType(t, err, store.AlreadyExists)
+	}
+	assert.Equal(t, 1, succeeded)
+
+	assertVersions(t, s, id, 2)
+}
+
+func testConcurrentDeduplicate(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+	eventID := uuid.New().String()
+
+	var wg sync.WaitGroup
+	versions := make(chan int64, concurrentWriters)
+	errs := make(chan error, concurrentWriters)
+
+	// the same event is sent by every writer, it is stored once
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			e := newEntity("2")
+			e.EventID = eventID
+
+			res, err := s.AppendToStream(ety.ID, store.Any, []*store.Entity{e})
+			if err != nil {
+				errs <- err
+				return
+			}
+			versions <- res[0].Version
+		}()
+	}
+
+	wg.Wait()
+	close(versions)
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	for v := range versions {
+		assert.Equal(t, int64(2), v)
+	}
+
+	assertVersions(t, s, ety.ID, 2)
+}
+
+func testTypedData(t *testing.T, s store.EventStore) {
+	ety := newEntity("")
+	ety.Data = TestEvent{Text: "created", Count: 1}
+
+	res, err := s.Add(ety)
+	require.Nil(t, err)
+	assert.Equal(t, TestEventType, res.Type)
+
+	_, err = s.AppendBatch(ety.ID, 1, []*store.Entity{
+		{Data: TestEvent{Text: "changed", Count: 2}},
+		{Data: "untyped"},
+	})
+	require.Nil(t, err)
+
+	e, err := s.GetByVersion(ety.ID, 1)
+	assert.Nil(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, TestEventType, e.Type)
+	assert.Equal(t, TestEvent{Text: "created", Count: 1}, e.Data)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 3)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(entities))
+	assert.Equal(t, TestEvent{Text: "created", Count: 1}, entities[0].Data)
+	assert.Equal(t, TestEvent{Text: "changed", Count: 2}, entities[1].Data)
+
+	// data of an unregistered type is returned as it is decoded
+	assert.Equal(t, "", entities[2].Type)
+	assert.Equal(t, "untyped", entities[2].Data)
+}
+
+func testSystemMetadata(t *testing.T, s store.EventStore) {
+	before := time.Now().UTC().Add(-time.Second)
+
+	ety := newEntity("")
+	ety.Data = TestEvent{Text: "created", Count: 1}
+	ety.System = &store.SystemMetadata{CorrelationID: "correlation", CausationID: "command", UserPrincipal: "user@contoso.com"}
+
+	res, err := s.Add(ety)
+	require.Nil(t, err)
+	require.NotNil(t, res.System)
+	assert.Equal(t, TestEventType, res.System.EventType)
+	assert.Equal(t, "correlation", res.System.CorrelationID)
+	assert.Equal(t, "command", res.System.CausationID)
+	assert.Equal(t, "user@contoso.com", res.System.UserPrincipal)
+	assert.Equal(t, time.UTC, res.System.CreatedAt.Location())
+	assert.True(t, res.System.CreatedAt.After(before), "created at %v", res.System.CreatedAt)
+	assert.True(t, res.System.CreatedAt.Before(time.Now().Add(time.Second)), "created at %v", res.System.CreatedAt)
+
+	// the entities of a batch can share the system metadata they are written with
+	system := &store.SystemMetadata{CorrelationID: "correlation", CausationID: "created"}
+	batch := []*store.Entity{
+		{Metadata: "Metadata", Data: TestEvent{Text: "changed", Count: 2}, System: system},
+		{Metadata: "Metadata", Data: "untyped", System: system},
+	}
+
+	_, err = s.AppendBatch(ety.ID, 1, batch)
+	require.Nil(t, err)
+	assert.Equal(t, TestEventType, batch[0].System.EventType)
+	assert.Equal(t, "string", batch[1].System.EventType)
+	assert.Equal(t, "correlation", batch[1].System.CorrelationID)
+	assert.False(t, batch[0].System.CreatedAt.Before(res.System.CreatedAt))
+	assert.Equal(t, "", system.EventType)
+
+	e, err := s.GetByVersion(ety.ID, 1)
+	assert.Nil(t, err)
+	require.NotNil(t, e)
+	assert.Equal(t, res.System, e.System)
+	assert.Equal(t, "Metadata", e.Metadata)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 3)
+	assert.Nil(t, err)
+	require.Equal(t, 3, len(entities))
+	assert.Equal(t, res.System, entities[0].System)
+	assert.Equal(t, batch[0].System, entities[1].System)
+	assert.Equal(t, batch[1].System, entities[2].System)
+
+	all, err := s.ReadAll(res.Position, 1)
+	assert.Nil(t, err)
+	require.Equal(t, 1, len(all))
+	assert.Equal(t, res.System, all[0].System)
+}
+
+// writeEntities writes entities to two streams and returns them in the order they were written
+func writeEntities(t *testing.T, s store.EventStore) []store.Entity {
+	written := []store.Entity{}
+
+	a := newEntity("a1")
+	res, err := s.Add(a)
+	require.Nil(t, err)
+	written = append(written, *res)
+
+	b := newEntity("b1")
+	res, err = s.Add(b)
+	require.Nil(t, err)
+	written = append(written, *res)
+
+	a.Data = "a2"
+	res, err = s.Append(a, store.Optimistic)
+	require.Nil(t, err)
+	written = append(written, *res)
+
+	batch := []*store.Entity{newEntity("b2"), newEntity("b3")}
+	entities, err := s.AppendBatch(b.ID, 1, batch)
+	require.Nil(t, err)
+	for _, e := range entities {
+		written = append(written, *e)
+	}
+
+	return written
+}
+
+func testReadAll(t *testing.T, s store.EventStore) {
+	written := writeEntities(t, s)
+
+	for i := 1; i < len(written); i++ {
+		assert.True(t, written[i].Position > written[i-1].Position, "positions must increase")
+	}
+
+	res, err := s.ReadAll(written[0].Position, 100)
+	assert.Nil(t, err)
+	require.True(t, len(res) >= len(written))
+
+	for i, w := range written {
+		assert.Equal(t, w.ID, res[i].ID)
+		assert.Equal(t, w.Version, res[i].Version)
+		assert.Equal(t, w.Position, res[i].Position)
+		assert.Equal(t, "Metadata", res[i].Metadata)
+		assert.Equal(t, w.Data, res[i].Data)
+	}
+}
+
+func testReadAllPaged(t *testing.T, s store.EventStore) {
+	written := writeEntities(t, s)
+
+	read := []store.Entity{}
+	position := written[0].Position
+
+	for len(read) < len(written) {
+		res, err := s.ReadAll(position, 2)
+		require.Nil(t, err)
+		require.True(t, len(res) > 0)
+		assert.True(t, len(res) <= 2)
+
+		read = append(read, res...)
+		position = res[len(res)-1].Position + 1
+	}
+
+	for i, w := range written {
+		assert.Equal(t, w.ID, read[i].ID)
+		assert.Equal(t, w.Version, read[i].Version)
+		assert.Equal(t, w.Position, read[i].Position)
+	}
+}
+
+func testReadAllEnd(t *testing.T, s store.EventStore) {
+	written := writeEntities(t, s)
+
+	res, err := s.ReadAll(written[len(written)-1].Position+1, 10)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.Equal(t, 0, len(res))
+}
+
+func testReadAllInvalidMaxCount(t *testing.T, s store.EventStore) {
+	for _, maxCount := range []int{0, -1} {
+		res, err := s.ReadAll(1, maxCount)
+		assert.Nil(t, res)
+		assert.NotNil(t, err)
+	}
+}
+
+func testConcurrentReadAll(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 1)
+
+	var wg sync.WaitGroup
+	positions := make(chan int64, concurrentWriters)
+
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := s.Append(newEntityWithID(ety.ID, fmt.Sprintf("writer %v", i)), store.None)
+			if assert.Nil(t, err) {
+				positions <- res.Position
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(positions)
+
+	// every entity gets its own position and appears in the log of all entities
+	expected := map[int64]bool{}
+	for p := range positions {
+		assert.False(t, expected[p], "position %v assigned twice", p)
+		expected[p] = true
+	}
+
+	res, err := s.ReadAll(ety.Position+1, 1000)
+	assert.Nil(t, err)
+
+	version := int64(1)
+	for _, e := range res {
+		if e.ID != ety.ID {
+			continue
+		}
+
+		// the versions of a stream appear in the log in their order
+		version++
+		assert.Equal(t, version, e.Version)
+		delete(expected, e.Position)
+	}
+
+	assert.Equal(t, 0, len(expected), "positions missing in the log: %v", expected)
+}
+
+// subscriptionTimeout is the time a subscription test waits for an entity to be delivered
+const subscriptionTimeout = 10 * time.Second
+
+// subscribe starts a subscription in the background and returns the channel of delivered entities
+// and the channel of the error the subscription ended with
+func subscribe(ctx context.Context, s store.Subscriber, fromPosition int64, handler store.Handler) (<-chan store.Entity, <-chan error) {
+	delivered := make(chan store.Entity, 100)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.Subscribe(ctx, fromPosition, func(ctx context.Context, entity store.Entity) error {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			delivered <- entity
+			return nil
+		})
+	}()
+
+	return delivered, done
+}
+
+// receive waits for the entity with the given position, entities of other tests are skipped
+func receive(t *testing.T, delivered <-chan store.Entity, position int64) store.Entity {
+	timeout := time.After(subscriptionTimeout)
+
+	for {
+		select {
+		case e := <-delivered:
+			require.True(t, e.Position <= position, "entity at position %v was not delivered", position)
+			if e.Position == position {
+				return e
+			}
+		case <-timeout:
+			require.FailNow(t, "timeout", "entity at position %v was not delivered", position)
+		}
+	}
+}
+
+func testSubscribe(t *testing.T, s store.EventStore) {
+	subscriber, ok := s.(store.Subscriber)
+	if !ok {
+		t.Skip("store doesn't implement store.Subscriber")
+	}
+
+	// catch up with entities that are already stored
+	written := writeEntities(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	delivered, done := subscribe(ctx, subscriber, written[0].Position, func(ctx context.Context, entity store.Entity) error {
+		return nil
+	})
+
+	for _, w := range written {
+		e := receive(t, delivered, w.Position)
+		assert.Equal(t, w.ID, e.ID)
+		assert.Equal(t, w.Version, e.Version)
+		assert.Equal(t, w.Data, e.Data)
+	}
+
+	// live entities
+	ety := newEntity("live")
+	res, err := s.Add(ety)
+	require.Nil(t, err)
+
+	e := receive(t, delivered, res.Position)
+	assert.Equal(t, ety.ID, e.ID)
+	assert.Equal(t, "live", e.Data)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(subscriptionTimeout):
+		assert.Fail(t, "subscription didn't stop")
+	}
+}
+
+func testSubscribeResume(t *testing.T, s store.EventStore) {
+	subscriber, ok := s.(store.Subscriber)
+	if !ok {
+		t.Skip("store doesn't implement store.Subscriber")
+	}
+
+	written := writeEntities(t, s)
+	failAt := written[2].Position
+	errHandler := fmt.Errorf("handler failed at position %v", failAt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the subscription stops with the error of the handler
+	delivered, done := subscribe(ctx, subscriber, written[0].Position, func(ctx context.Context, entity store.Entity) error {
+		if entity.Position == failAt {
+			return errHandler
+		}
+		return nil
+	})
+
+	checkpoint := receive(t, delivered, written[1].Position).Position
+
+	select {
+	case err := <-done:
+		assert.Equal(t, errHandler, err)
+	case <-time.After(subscriptionTimeout):
+		require.FailNow(t, "subscription didn't stop")
+	}
+
+	// resuming after the checkpoint delivers the failed entity again
+	delivered, _ = subscribe(ctx, subscriber, checkpoint+1, func(ctx context.Context, entity store.Entity) error {
+		return nil
+	})
+
+	for _, w := range written[2:] {
+		e := receive(t, delivered, w.Position)
+		assert.Equal(t, w.ID, e.ID)
+		assert.Equal(t, w.Version, e.Version)
+	}
+}
+
+func testSnapshot(t *testing.T, s store.EventStore) {
+	snapshots, ok := s.(store.SnapshotStore)
+	if !ok {
+		t.Skip("store doesn't implement store.SnapshotStore")
+	}
+
+	ety := addVersions(t, s, 3)
+
+	err := snapshots.SaveSnapshot(ety.ID, 2, "state 2")
+	assert.Nil(t, err)
+
+	snapshot, err := snapshots.GetLatestSnapshot(ety.ID)
+	assert.Nil(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, ety.ID, snapshot.ID)
+	assert.Equal(t, int64(2), snapshot.Version)
+	assert.Equal(t, "state 2", snapshot.State)
+
+	err = snapshots.SaveSnapshot(ety.ID, 3, "state 3")
+	assert.Nil(t, err)
+
+	snapshot, err = snapshots.GetLatestSnapshot(ety.ID)
+	assert.Nil(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, int64(3), snapshot.Version)
+	assert.Equal(t, "state 3", snapshot.State)
+
+	// a snapshot is not an entity version
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), version)
+
+	entities, err := s.GetByVersionRange(ety.ID, 1, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entities))
+}
+
+func testSnapshotMissing(t *testing.T, s store.EventStore) {
+	snapshots, ok := s.(store.SnapshotStore)
+	if !ok {
+		t.Skip("store doesn't implement store.SnapshotStore")
+	}
+
+	snapshot, err := snapshots.GetLatestSnapshot(uuid.New().String())
+	assert.Nil(t, snapshot)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	err = snapshots.SaveSnapshot(uuid.New().String(), 1, "state")
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	// the version of a snapshot must exist
+	ety := addVersions(t, s, 2)
+
+	for _, v := range []int64{0, 3} {
+		err = snapshots.SaveSnapshot(ety.ID, v, "state")
+		AssertErrorType(t, err, store.EntityNotFound)
+	}
+
+	snapshot, err = snapshots.GetLatestSnapshot(ety.ID)
+	assert.Nil(t, snapshot)
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testSnapshotOlderVersion(t *testing.T, s store.EventStore) {
+	snapshots, ok := s.(store.SnapshotStore)
+	if !ok {
+		t.Skip("store doesn't implement store.SnapshotStore")
+	}
+
+	ety := addVersions(t, s, 3)
+
+	err := snapshots.SaveSnapshot(ety.ID, 3, "state 3")
+	assert.Nil(t, err)
+
+	// an older snapshot doesn't replace a newer one
+	err = snapshots.SaveSnapshot(ety.ID, 2, "state 2")
+	assert.Nil(t, err)
+
+	snapshot, err := snapshots.GetLatestSnapshot(ety.ID)
+	assert.Nil(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, int64(3), snapshot.Version)
+	assert.Equal(t, "state 3", snapshot.State)
+}
+
+func testLoadFromSnapshot(t *testing.T, s store.EventStore) {
+	ety := addVersions(t, s, 5)
+
+	// without a snapshot all versions are loaded
+	snapshot, entities, err := store.LoadFromSnapshot(context.Background(), s, ety.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, snapshot)
+	assert.Equal(t, 5, len(entities))
+
+	snapshots, ok := s.(store.SnapshotStore)
+	if !ok {
+		return
+	}
+
+	err = snapshots.SaveSnapshot(ety.ID, 3, "state 3")
+	require.Nil(t, err)
+
+	snapshot, entities, err = store.LoadFromSnapshot(context.Background(), s, ety.ID)
+	assert.Nil(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, int64(3), snapshot.Version)
+	require.Equal(t, 2, len(entities))
+	assert.Equal(t, int64(4), entities[0].Version)
+	assert.Equal(t, int64(5), entities[1].Version)
+
+	_, _, err = store.LoadFromSnapshot(context.Background(), s, uuid.New().String())
+	AssertErrorType(t, err, store.EntityNotFound)
+}
+
+func testCanceledContext(t *testing.T, s store.EventStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ety := newEntity("Hello World")
+
+	res, err := s.AddContext(ctx, ety)
+	assert.NotNil(t, err)
+	assert.Nil(t, res)
+
+	_, err = s.GetLatestVersionNumber(ety.ID)
+	AssertErrorType(t, err, store.EntityNotFound)
+
+	ety = addVersions(t, s, 1)
+
+	res, err = s.AppendContext(ctx, ety, store.None)
+	assert.NotNil(t, err)
+	assert.Nil(t, res)
+
+	batch, err := s.AppendBatchContext(ctx, ety.ID, 1, newBatch(2, 3))
+	assert.NotNil(t, err)
+	assert.Nil(t, batch)
+
+	batch, err = s.AppendToStreamContext(ctx, ety.ID, store.Any, newBatch(2, 3))
+	assert.NotNil(t, err)
+	assert.Nil(t, batch)
+
+	_, err = s.GetLatestVersionNumberContext(ctx, ety.ID)
+	assert.NotNil(t, err)
+
+	_, err = s.GetByVersionContext(ctx, ety.ID, 1)
+	assert.NotNil(t, err)
+
+	_, err = s.GetByVersionRangeContext(ctx, ety.ID, 1, 1)
+	assert.NotNil(t, err)
+
+	_, err = s.GetAsOfContext(ctx, ety.ID, time.Now())
+	assert.NotNil(t, err)
+
+	_, err = s.GetByTimeRangeContext(ctx, ety.ID, time.Time{}, time.Now())
+	assert.NotNil(t, err)
+
+	_, err = s.ReadAllContext(ctx, 1, 1)
+	assert.NotNil(t, err)
+
+	err = s.DeleteContext(ctx, ety.ID, store.Any, true)
+	assert.NotNil(t, err)
+
+	version, err := s.GetLatestVersionNumber(ety.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), version)
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// PollInterval is the metadata property for the time a polling subscription waits for new entities, e.g. "1s"
+	PollInterval = "pollInterval"
+	// PollBatchSize is the metadata property for the number of entities a polling subscription reads at once
+	PollBatchSize = "pollBatchSize"
+)
+
+// Handler handles an entity that is delivered by a subscription
+type Handler func(ctx context.Context, entity Entity) error
+
+// Subscriber is implemented by event stores that deliver entities to subscribers as they are stored
+//
+// Subscribe delivers all entities starting at fromPosition to handler, in the order of their positions.
+// First the entities that are already stored are delivered, then new entities as they are stored.
+// Subscribe blocks until ctx is done or handler returns an error, and returns the error.
+//
+// Delivery is at-least-once: to resume a subscription, pass the position of the last entity that was
+// handled successfully plus 1. An entity whose handler failed is delivered again.
+type Subscriber interface {
+	Subscribe(ctx context.Context, fromPosition int64, handler Handler) error
+}
+
+// PollingSubscriber implements Subscriber for an EventStore by reading the log of all entities with ReadAll.
+// It waits for the configured interval whenever it has caught up with the log.
+type PollingSubscriber struct {
+	store     EventStore
+	interval  time.Duration
+	batchSize int
+}
+
+// NewPollingSubscriber creates a PollingSubscriber for store, configured by metadata
+func NewPollingSubscriber(store EventStore, metadata Metadata) (*PollingSubscriber, error) {
+	s := &PollingSubscriber{
+		store:     store,
+		interval:  time.Second,
+		batchSize: 100,
+	}
+
+	if v, ok := metadata.Properties[PollInterval]; ok && v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration: %s", PollInterval, v)
+		}
+		s.interval = interval
+	}
+
+	if v, ok := metadata.Properties[PollBatchSize]; ok && v != "" {
+		batchSize, err := strconv.Atoi(v)
+		if err != nil || batchSize < 1 {
+			return nil, fmt.Errorf("%s must be a positive number: %s", PollBatchSize, v)
+		}
+		s.batchSize = batchSize
+	}
+
+	return s, nil
+}
+
+// Interval returns the time the subscriber waits for new entities when it has caught up with the log
+func (s *PollingSubscriber) Interval() time.Duration {
+	return s.interval
+}
+
+// BatchSize returns the number of entities the subscriber reads at once
+func (s *PollingSubscriber) BatchSize() int {
+	return s.batchSize
+}
+
+// Subscribe implements Subscriber
+func (s *PollingSubscriber) Subscribe(ctx context.Context, fromPosition int64, handler Handler) error {
+	position := fromPosition
+	if position < 1 {
+		position = 1
+	}
+
+	for {
+		entities, err := s.store.ReadAllContext(ctx, position, s.batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, entity := range entities {
+			if err := handler(ctx, entity); err != nil {
+				return err
+			}
+
+			position = entity.Position + 1
+		}
+
+		// a full batch means there are probably more entities to catch up with
+		if len(entities) == s.batchSize {
+			continue
+		}
+
+		timer := time.NewTimer(s.interval)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPollingSubscriber(t *testing.T) {
+	s, err := NewPollingSubscriber(nil, Metadata{Properties: map[string]string{}})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, s.interval)
+	assert.Equal(t, 100, s.batchSize)
+
+	s, err = NewPollingSubscriber(nil, Metadata{
+		Properties: map[string]string{
+			PollInterval:  "10ms",
+			PollBatchSize: "5",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Millisecond, s.interval)
+	assert.Equal(t, 5, s.batchSize)
+
+	for _, props := range []map[string]string{
+		{PollInterval: "soon"},
+		{PollInterval: "0s"},
+		{PollBatchSize: "0"},
+		{PollBatchSize: "many"},
+	} {
+		_, err := NewPollingSubscriber(nil, Metadata{Properties: props})
+		assert.NotNil(t, err, "%v", props)
+	}
+}
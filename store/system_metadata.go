@@ -0,0 +1,41 @@
+package store
+
+import (
+	"reflect"
+	"time"
+)
+
+// SystemMetadata is the metadata of an entity that is recorded by the EventStore, unlike the free-form
+// Metadata of an entity, which is left to the application.
+//
+// CreatedAt and EventType are set when the entity is stored. CorrelationID, CausationID and UserPrincipal
+// are set by the client before the entity is written, e.g. to trace a flow of events across services:
+// the correlation ID is shared by all events of a flow, the causation ID is the ID of the event or
+// command that caused the event.
+type SystemMetadata struct {
+	CreatedAt     time.Time `json:"createdAt"`
+	EventType     string    `json:"eventType,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	CausationID   string    `json:"causationId,omitempty"`
+	UserPrincipal string    `json:"userPrincipal,omitempty"`
+}
+
+// RecordSystemMetadata sets the system metadata of entity before it is stored. CreatedAt is the current
+// time in UTC with microsecond precision, EventType is the type of the entity or the name of the Go type
+// of its data, if it isn't registered in Types. The system metadata is copied, so entities can share the
+// system metadata they are written with.
+func RecordSystemMetadata(entity *Entity) {
+	system := SystemMetadata{}
+	if entity.System != nil {
+		system = *entity.System
+	}
+
+	system.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	system.EventType = entity.Type
+
+	if system.EventType == "" && entity.Data != nil {
+		system.EventType = reflect.TypeOf(entity.Data).String()
+	}
+
+	entity.System = &system
+}
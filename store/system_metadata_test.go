@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordSystemMetadata(t *testing.T) {
+	before := time.Now().UTC()
+
+	system := &SystemMetadata{CorrelationID: "correlation", CausationID: "causation", UserPrincipal: "user", EventType: "ignored"}
+	entity := &Entity{Type: "created", Data: "data", System: system}
+
+	RecordSystemMetadata(entity)
+
+	require.NotNil(t, entity.System)
+	assert.Equal(t, "created", entity.System.EventType)
+	assert.Equal(t, "correlation", entity.System.CorrelationID)
+	assert.Equal(t, "causation", entity.System.CausationID)
+	assert.Equal(t, "user", entity.System.UserPrincipal)
+	assert.Equal(t, time.UTC, entity.System.CreatedAt.Location())
+	assert.False(t, entity.System.CreatedAt.Before(before.Truncate(time.Microsecond)))
+	assert.Equal(t, time.Duration(0), entity.System.CreatedAt.Sub(entity.System.CreatedAt.Truncate(time.Microsecond)))
+
+	// the system metadata the entity was written with is not changed
+	assert.Equal(t, "ignored", system.EventType)
+	assert.True(t, system.CreatedAt.IsZero())
+}
+
+func TestRecordSystemMetadataEventType(t *testing.T) {
+	entity := &Entity{Data: 42}
+	RecordSystemMetadata(entity)
+	assert.Equal(t, "int", entity.System.EventType)
+
+	entity = &Entity{}
+	RecordSystemMetadata(entity)
+	assert.Equal(t, "", entity.System.EventType)
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SearchAsOf returns the latest of the versions 1 to latest of an entity, that was created at or before
+// at, or 0 if there is none. createdAt returns the time a version was created, see SystemMetadata, or the
+// zero time for versions that were stored without system metadata. Those versions are never found.
+//
+// The versions are searched binary, as the times they are created at ascend with the versions. That
+// holds as long as the clocks of the clients that write an entity don't drift apart.
+func SearchAsOf(latest int64, at time.Time, createdAt func(version int64) (time.Time, error)) (int64, error) {
+	cache := map[int64]time.Time{}
+	cached := func(version int64) (time.Time, error) {
+		if t, exists := cache[version]; exists {
+			return t, nil
+		}
+
+		t, err := createdAt(version)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		cache[version] = t
+		return t, nil
+	}
+
+	version, err := searchVersions(latest, cached, func(t time.Time) bool { return t.After(at) })
+	if err != nil || version == 0 {
+		return 0, err
+	}
+
+	// versions without system metadata precede all others, so if the found version has none, all
+	// versions before it have none either
+	t, err := cached(version)
+	if err != nil || t.IsZero() {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// SearchTimeRange returns the first and the last of the versions 1 to latest of an entity, that were
+// created between from and to, both inclusive, see SearchAsOf. If there are none, last is less than first.
+func SearchTimeRange(latest int64, from, to time.Time, createdAt func(version int64) (time.Time, error)) (int64, int64, error) {
+	last, err := SearchAsOf(latest, to, createdAt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if last == 0 {
+		return 1, 0, nil
+	}
+
+	first, err := searchVersions(last, createdAt, func(t time.Time) bool { return !t.Before(from) })
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return first + 1, last, nil
+}
+
+// searchVersions returns the number of the versions 1 to latest before the first version, whose creation
+// time satisfies f. Versions that were created without system metadata never satisfy it.
+func searchVersions(latest int64, createdAt func(version int64) (time.Time, error), f func(t time.Time) bool) (int64, error) {
+	var err error
+
+	n := sort.Search(int(latest), func(i int) bool {
+		if err != nil {
+			return true
+		}
+
+		var t time.Time
+		t, err = createdAt(int64(i) + 1)
+		return err != nil || (!t.IsZero() && f(t))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
+
+// GetAsOf implements EventStore.GetAsOfContext for backends that read single versions of an entity
+// efficiently, by a binary search over the versions of the entity with the given id, see SearchAsOf.
+func GetAsOf(ctx context.Context, s EventStore, id string, at time.Time) (*Entity, error) {
+	latest, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	read := map[int64]*Entity{}
+
+	version, err := SearchAsOf(latest, at, func(version int64) (time.Time, error) {
+		entity, err := s.GetByVersionContext(ctx, id, version)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		read[version] = entity
+		return CreatedAt(entity), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		return nil, NoVersionAsOf(id, at)
+	}
+
+	return read[version], nil
+}
+
+// GetByTimeRange implements EventStore.GetByTimeRangeContext for backends that read single versions of
+// an entity efficiently, by a binary search over the versions of the entity with the given id, see
+// SearchTimeRange.
+func GetByTimeRange(ctx context.Context, s EventStore, id string, from, to time.Time) ([]Entity, error) {
+	latest, err := s.GetLatestVersionNumberContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, err := SearchTimeRange(latest, from, to, func(version int64) (time.Time, error) {
+		entity, err := s.GetByVersionContext(ctx, id, version)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return CreatedAt(entity), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if last < first {
+		return []Entity{}, nil
+	}
+
+	return s.GetByVersionRangeContext(ctx, id, first, last)
+}
+
+// CreatedAt returns the time entity was created at, or the zero time if it has no system metadata
+func CreatedAt(entity *Entity) time.Time {
+	if entity.System == nil {
+		return time.Time{}
+	}
+
+	return entity.System.CreatedAt
+}
+
+// NoVersionAsOf returns an EventStoreError of type EntityNotFound for an entity with the given id,
+// that has no version that was created at or before at
+func NoVersionAsOf(id string, at time.Time) error {
+	return EventStoreError{
+		Text:       fmt.Sprintf("Entity with ID %s has no version as of %s", id, at.Format(time.RFC3339Nano)),
+		ErrorType:  EntityNotFound,
+		InnerError: nil,
+	}
+}
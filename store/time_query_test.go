@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createdAtOf returns the creation times of versions 1 to len(times), a zero time is a version
+// that was stored without system metadata
+func createdAtOf(times []time.Time) func(version int64) (time.Time, error) {
+	return func(version int64) (time.Time, error) {
+		return times[version-1], nil
+	}
+}
+
+func TestSearchAsOf(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{{}, {}, start, start.Add(time.Second), start.Add(time.Second), start.Add(time.Minute)}
+
+	tests := []struct {
+		at      time.Time
+		version int64
+	}{
+		{start.Add(-time.Second), 0},
+		{start, 3},
+		{start.Add(time.Millisecond), 3},
+		{start.Add(time.Second), 5},
+		{start.Add(time.Minute), 6},
+		{start.Add(time.Hour), 6},
+	}
+
+	for _, tc := range tests {
+		version, err := SearchAsOf(int64(len(times)), tc.at, createdAtOf(times))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.version, version, "as of %v", tc.at)
+	}
+
+	version, err := SearchAsOf(0, start, createdAtOf(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), version)
+}
+
+func TestSearchTimeRange(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := []time.Time{{}, start, start.Add(time.Second), start.Add(time.Second), start.Add(time.Minute)}
+
+	tests := []struct {
+		from, to    time.Time
+		first, last int64
+	}{
+		{time.Time{}, start.Add(time.Hour), 2, 5},
+		{start, start, 2, 2},
+		{start.Add(time.Second), start.Add(time.Second), 3, 4},
+		{start.Add(time.Millisecond), start.Add(time.Minute), 3, 5},
+	}
+
+	for _, tc := range tests {
+		first, last, err := SearchTimeRange(int64(len(times)), tc.from, tc.to, createdAtOf(times))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.first, first, "from %v to %v", tc.from, tc.to)
+		assert.Equal(t, tc.last, last, "from %v to %v", tc.from, tc.to)
+	}
+
+	// ranges without versions
+	for _, r := range [][2]time.Time{
+		{start.Add(-time.Hour), start.Add(-time.Second)},
+		{start.Add(time.Hour), start.Add(2 * time.Hour)},
+		{start.Add(time.Minute), start},
+	} {
+		first, last, err := SearchTimeRange(int64(len(times)), r[0], r[1], createdAtOf(times))
+		assert.Nil(t, err)
+		assert.True(t, last < first, "from %v to %v", r[0], r[1])
+	}
+}
+
+func TestSearchAsOfError(t *testing.T) {
+	failed := errors.New("failed")
+
+	_, err := SearchAsOf(10, time.Now(), func(version int64) (time.Time, error) {
+		return time.Time{}, failed
+	})
+	assert.Equal(t, failed, err)
+
+	_, _, err = SearchTimeRange(10, time.Time{}, time.Now(), func(version int64) (time.Time, error) {
+		return time.Time{}, failed
+	})
+	assert.Equal(t, failed, err)
+}